@@ -1,5 +1,7 @@
 package bootx
 
+import "github.com/gen-iot/std"
+
 type Application interface {
 	GetName() string
 	GetVersion() string
@@ -8,64 +10,179 @@ type Application interface {
 }
 
 func Bootstrap(app Application, configs ...interface{}) {
+	std.AssertError(Run(app, configs...), "bootstrap failed")
+}
+
+//Run same as Bootstrap,but return error instead of panic,
+//use errors.As to check *ConfigError,*ConnectError,ModuleNameDuplicate,DBNameDuplicateAdd ...
+//Run can be called again after failed, modules registered before Run are kept
+func Run(app Application, configs ...interface{}) (err error) {
 	appName := app.GetName()
 	appVersion := app.GetVersion()
-	logger.Printf("%s %s bootstrap ...", appName, appVersion)
+	Log().Info("bootstrap ...", "app", appName, "version", appVersion)
 	initKernel()
 	defer cleanupKernel()
-	webConf, dbConf, redisConf := initModules(configs...)
-	//if no gWebX config ,use default config
-	if !webConf {
-		webInit()
+	mark := gModules.mark()
+	defer func() {
+		if err != nil {
+			gModules.removeSince(mark)
+			resetBuiltinModules()
+		}
+	}()
+	if err := initModules(configs...); err != nil {
+		return err
+	}
+	if err := AddModule(newAppModule(app)); err != nil {
+		return err
 	}
-	if dbConf {
-		defer dbCleanup()
+	if err := gModules.initAll(); err != nil {
+		return err
 	}
-	if redisConf {
-		defer redisCleanup()
+	if err := gModules.startAll(); err != nil {
+		return err
 	}
-	app.Bootstrap()
-	defer app.Shutdown()
-	//start gWebX service
-	Web().start()
-	defer Web().stop()
+	defer gModules.stopAll()
 	getKernel().waitForExit()
+	return nil
 }
 
 func Kill() {
 	getKernel().kill()
 }
 
-func initModules(configs ...interface{}) (webConf, dbConf, redisConf bool) {
-	for _, conf := range configs {
-		switch c := conf.(type) {
-		case WebConfig:
-			webInitWithConfig(c)
-		case *WebConfig:
-			webInitWithConfig(*c)
-			webConf = true
-		case DBConfig:
-			dbInitWithConfig([]DBConfig{c})
-			dbConf = true
-		case *DBConfig:
-			dbInitWithConfig([]DBConfig{*c})
-			dbConf = true
-		case []DBConfig:
-			dbInitWithConfig(c)
-			dbConf = true
-		case []*DBConfig:
-			ds := make([]DBConfig, 0, len(c))
-			for _, db := range c {
-				ds = append(ds, *db)
+//builtin modules are inited again by next Run
+func resetBuiltinModules() {
+	dbReset()
+	redisReset()
+	mqttReset()
+	webReset()
+}
+
+//register builtin modules by configs
+func initModules(configs ...interface{}) error {
+	var webConf *WebConfig = nil
+	var dbConf []DBConfig = nil
+	var redisConf *RedisConfig = nil
+	var mqttConf *MqttConfig = nil
+	var logConf *LogConfig = nil
+	var collect func(configs []interface{})
+	collect = func(configs []interface{}) {
+		for _, conf := range configs {
+			switch c := conf.(type) {
+			case WebConfig:
+				if webConf == nil {
+					webConf = &c
+				}
+			case *WebConfig:
+				if webConf == nil {
+					webConf = c
+				}
+			case DBConfig:
+				dbConf = append(dbConf, c)
+			case *DBConfig:
+				dbConf = append(dbConf, *c)
+			case []DBConfig:
+				dbConf = append(dbConf, c...)
+			case []*DBConfig:
+				for _, db := range c {
+					dbConf = append(dbConf, *db)
+				}
+			case RedisConfig:
+				if redisConf == nil {
+					redisConf = &c
+				}
+			case *RedisConfig:
+				if redisConf == nil {
+					redisConf = c
+				}
+			case MqttConfig:
+				if mqttConf == nil {
+					mqttConf = &c
+				}
+			case *MqttConfig:
+				if mqttConf == nil {
+					mqttConf = c
+				}
+			case LogConfig:
+				logConf = &c
+			case *LogConfig:
+				logConf = c
+			case Config:
+				collect(c.modules())
+			case *Config:
+				collect(c.modules())
+			}
+		}
+	}
+	collect(configs)
+	if logConf != nil {
+		if err := logInitWithConfig(*logConf); err != nil {
+			return err
+		}
+	}
+	modules := make([]Module, 0, 4)
+	if len(dbConf) > 0 {
+		modules = append(modules, &ModuleFuncs{
+			ModuleName: ModuleDatabase,
+			OnInit: func() error {
+				return dbInitWithConfig(dbConf)
+			},
+			OnStop: func() error {
+				dbCleanup()
+				return nil
+			},
+		})
+		for _, c := range dbConf {
+			if c.AutoMigrate {
+				modules = append(modules, &ModuleFuncs{
+					ModuleName: ModuleMigrate,
+					DependsOn:  []string{ModuleDatabase, ModuleApp},
+					OnInit:     dbAutoMigrate,
+				})
+				break
 			}
-			dbInitWithConfig(ds)
-			dbConf = true
-		case RedisConfig:
-			redisInitWithConfig(c)
-		case *RedisConfig:
-			redisInitWithConfig(*c)
-			redisConf = true
 		}
 	}
-	return
+	if redisConf != nil {
+		modules = append(modules, &ModuleFuncs{
+			ModuleName: ModuleRedis,
+			OnInit: func() error {
+				return redisInitWithConfig(*redisConf)
+			},
+			OnStop: func() error {
+				redisCleanup()
+				return nil
+			},
+		})
+	}
+	if mqttConf != nil {
+		modules = append(modules, &ModuleFuncs{
+			ModuleName: ModuleMqtt,
+			OnInit: func() error {
+				return mqttInitWithConfig(*mqttConf)
+			},
+			OnStart: mqttStart,
+			OnStop: func() error {
+				mqttCleanup()
+				return nil
+			},
+		})
+	}
+	//if no web config ,use default config
+	var err error
+	if webConf != nil {
+		err = webInitWithConfig(*webConf)
+	} else {
+		err = webInit()
+	}
+	if err != nil {
+		return err
+	}
+	modules = append(modules, &webModule{})
+	for _, m := range modules {
+		if err = AddModule(m); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,335 @@
+package bootx
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gen-iot/std"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const EnvPrefix = "BOOTX"
+
+//Config 聚合了所有模块的配置,可以从yaml/json文件加载
+type Config struct {
+	Web       *WebConfig   `yaml:"web" json:"web"`
+	Databases []DBConfig   `yaml:"databases" json:"databases"`
+	Redis     *RedisConfig `yaml:"redis" json:"redis"`
+	Mqtt      *MqttConfig  `yaml:"mqtt" json:"mqtt"`
+	Log       *LogConfig   `yaml:"log" json:"log"`
+}
+
+//LoadConfig read config from a yaml or json file (chosen by extension),
+//then apply BOOTX_ prefixed environment overrides, e.g.
+//BOOTX_WEB_PORT=8090 , BOOTX_DATABASES_0_CONN_STR=... , BOOTX_REDIS_PASSWORD=...
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read config file '%s' failed", path)
+	}
+	conf := new(Config)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, conf)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, conf)
+	default:
+		return nil, errors.Errorf("unsupported config file type '%s'", path)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse config file '%s' failed", path)
+	}
+	//keys present in file, so explicit zero values are kept
+	var raw interface{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(data, &raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse config file '%s' failed", path)
+	}
+	keys := configKeys{}
+	keys.collect("", reflect.TypeOf(conf), raw)
+	if err = applyEnv(EnvPrefix, "", reflect.ValueOf(conf).Elem(), keys); err != nil {
+		return nil, err
+	}
+	conf.applyDefaults(keys)
+	if err = conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+//LoadConfigFromEnv build config only from BOOTX_ prefixed environment variables
+func LoadConfigFromEnv() (*Config, error) {
+	conf := &Config{}
+	keys := configKeys{}
+	if err := applyEnv(EnvPrefix, "", reflect.ValueOf(conf).Elem(), keys); err != nil {
+		return nil, err
+	}
+	conf.applyDefaults(keys)
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func MustLoadConfig(path string) *Config {
+	conf, err := LoadConfig(path)
+	std.AssertError(err, "load config failed")
+	return conf
+}
+
+//fill fields absent in file & env of present sections with module default config
+func (this *Config) applyDefaults(keys configKeys) {
+	if this.Web != nil {
+		mergeDefaults("Web", reflect.ValueOf(this.Web).Elem(), reflect.ValueOf(WebDefaultConfig), keys)
+	}
+	for i := range this.Databases {
+		path := fmt.Sprintf("Databases.%d", i)
+		mergeDefaults(path, reflect.ValueOf(&this.Databases[i]).Elem(), reflect.ValueOf(DBDefaultConfig), keys)
+	}
+	if this.Redis != nil {
+		mergeDefaults("Redis", reflect.ValueOf(this.Redis).Elem(), reflect.ValueOf(RedisDefaultConfig), keys)
+	}
+	if this.Mqtt != nil {
+		mergeDefaults("Mqtt", reflect.ValueOf(this.Mqtt).Elem(), reflect.ValueOf(MqttDefaultConfig), keys)
+	}
+}
+
+func (this *Config) Validate() error {
+	if this.Web != nil {
+		if err := std.ValidateStruct(this.Web); err != nil {
+			return errors.Wrap(err, "invalid web config")
+		}
+	}
+	for i, db := range this.Databases {
+		if err := std.ValidateStruct(db); err != nil {
+			return errors.Wrapf(err, "invalid database config at %d", i)
+		}
+	}
+	if this.Redis != nil {
+		if err := std.ValidateStruct(this.Redis); err != nil {
+			return errors.Wrap(err, "invalid redis config")
+		}
+	}
+	if this.Mqtt != nil {
+		if err := std.ValidateStruct(this.Mqtt); err != nil {
+			return errors.Wrap(err, "invalid mqtt config")
+		}
+	}
+	if this.Log != nil {
+		if err := std.ValidateStruct(this.Log); err != nil {
+			return errors.Wrap(err, "invalid log config")
+		}
+	}
+	return nil
+}
+
+//expand to the configs which initModules accepted
+func (this *Config) modules() []interface{} {
+	out := make([]interface{}, 0, 5)
+	if this.Web != nil {
+		out = append(out, this.Web)
+	}
+	if len(this.Databases) > 0 {
+		out = append(out, this.Databases)
+	}
+	if this.Redis != nil {
+		out = append(out, this.Redis)
+	}
+	if this.Mqtt != nil {
+		out = append(out, this.Mqtt)
+	}
+	if this.Log != nil {
+		out = append(out, this.Log)
+	}
+	return out
+}
+
+//configKeys field paths present in file or env, e.g. Web.Port, Databases.0.ConnStr
+type configKeys map[string]bool
+
+func joinConfigPath(path string, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+	return path + "." + name
+}
+
+//collect walk raw decoded file along t, key is matched by yaml tag, json tag is the same
+func (this configKeys) collect(path string, t reflect.Type, raw interface{}) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		items := make(map[string]interface{})
+		switch m := raw.(type) {
+		case map[string]interface{}:
+			items = m
+		case map[interface{}]interface{}:
+			for k, v := range m {
+				items[fmt.Sprint(k)] = v
+			}
+		default:
+			return
+		}
+		for key, value := range items {
+			sf, ok := configField(t, key)
+			if !ok {
+				continue
+			}
+			p := joinConfigPath(path, sf.Name)
+			this[p] = true
+			this.collect(p, sf.Type, value)
+		}
+	case reflect.Slice:
+		list, ok := raw.([]interface{})
+		if !ok {
+			return
+		}
+		for i, item := range list {
+			p := joinConfigPath(path, strconv.Itoa(i))
+			this[p] = true
+			this.collect(p, t.Elem(), item)
+		}
+	}
+}
+
+func configField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = sf.Name
+		}
+		if sf.PkgPath == "" && name != "-" && strings.EqualFold(name, key) {
+			return sf, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+//set default of fields absent in keys, explicit zero values & bools are kept
+func mergeDefaults(path string, dst reflect.Value, def reflect.Value, keys configKeys) {
+	for i := 0; i < dst.NumField(); i++ {
+		f := dst.Field(i)
+		if !f.CanSet() || f.Kind() == reflect.Func {
+			continue
+		}
+		p := joinConfigPath(path, dst.Type().Field(i).Name)
+		if !keys[p] {
+			f.Set(def.Field(i))
+		} else if f.Kind() == reflect.Struct {
+			mergeDefaults(p, f, def.Field(i), keys)
+		}
+	}
+}
+
+func applyEnv(prefix string, path string, v reflect.Value, keys configKeys) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			if !hasEnvPrefix(prefix + "_") {
+				return nil
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+			keys[path] = true
+		}
+		return applyEnv(prefix, path, v.Elem(), keys)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+			if name == "-" || sf.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+			err := applyEnv(prefix+"_"+envName(name), joinConfigPath(path, sf.Name), v.Field(i), keys)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			break
+		}
+		//allow appending one new element by env, e.g. BOOTX_DATABASES_<len>_CONN_STR
+		for i := 0; ; i++ {
+			p := fmt.Sprintf("%s_%d", prefix, i)
+			elemPath := joinConfigPath(path, strconv.Itoa(i))
+			if i >= v.Len() {
+				if !hasEnvPrefix(p + "_") {
+					return nil
+				}
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+				keys[path] = true
+				keys[elemPath] = true
+			}
+			if err := applyEnv(p, elemPath, v.Index(i), keys); err != nil {
+				return err
+			}
+		}
+	case reflect.Func, reflect.Interface, reflect.Map:
+		return nil
+	}
+	raw, ok := os.LookupEnv(prefix)
+	if !ok {
+		return nil
+	}
+	if err := setEnvValue(v, raw); err != nil {
+		return errors.Wrapf(err, "invalid env %s", prefix)
+	}
+	keys[path] = true
+	return nil
+}
+
+func setEnvValue(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		items := strings.Split(raw, ",")
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setWithProperType(v.Type().Elem().Kind(), strings.TrimSpace(item), slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	}
+	return setWithProperType(v.Kind(), raw, v)
+}
+
+func hasEnvPrefix(prefix string) bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+//staticPathPrefix -> STATIC_PATH_PREFIX
+func envName(name string) string {
+	b := strings.Builder{}
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package bootx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func setTestEnv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, old)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+const testYamlConfig = `
+web:
+  port: 9090
+  debug: true
+databases:
+  - name: main
+    databaseType: sqlite3
+    connStr: main.db
+redis:
+  host: redis.local
+mqtt:
+  pubApiAddr: http://127.0.0.1:8081/api/v4/mqtt/publish
+  timeout: 3
+`
+
+func TestLoadConfigYaml(t *testing.T) {
+	conf, err := LoadConfig(writeConfigFile(t, "app.yaml", testYamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Web == nil || conf.Web.Port != 9090 || !conf.Web.Debug {
+		t.Errorf("web not loaded: %+v", conf.Web)
+	}
+	//absent fields are filled by module defaults
+	if conf.Web.BodyLimit != DefaultWebBodyLimit {
+		t.Errorf("expect default body limit %d, got %d", DefaultWebBodyLimit, conf.Web.BodyLimit)
+	}
+	if len(conf.Databases) != 1 || conf.Databases[0].ConnStr != "main.db" ||
+		conf.Databases[0].MaxOpenConnCount != DBDefaultConfig.MaxOpenConnCount {
+		t.Errorf("databases not loaded: %+v", conf.Databases)
+	}
+	if conf.Redis == nil || conf.Redis.Host != "redis.local" || conf.Redis.Port != RedisDefaultConfig.Port {
+		t.Errorf("redis not loaded: %+v", conf.Redis)
+	}
+	if conf.Mqtt == nil || conf.Mqtt.TimeoutSec != 3 {
+		t.Errorf("mqtt not loaded: %+v", conf.Mqtt)
+	}
+	if n := len(conf.modules()); n != 4 {
+		t.Errorf("expect 4 module configs, got %d", n)
+	}
+}
+
+func TestLoadConfigJsonAndEnv(t *testing.T) {
+	path := writeConfigFile(t, "app.json", `{"web":{"port":9090},"databases":[{"databaseType":"sqlite3","connStr":"a.db"}]}`)
+	//env wins over file, and may add a section or slice element the file does not have
+	setTestEnv(t, "BOOTX_WEB_PORT", "9191")
+	setTestEnv(t, "BOOTX_WEB_STATIC_PATH_PREFIX", "/static")
+	setTestEnv(t, "BOOTX_DATABASES_1_DATABASE_TYPE", "sqlite3")
+	setTestEnv(t, "BOOTX_DATABASES_1_CONN_STR", "b.db")
+	setTestEnv(t, "BOOTX_REDIS_HOST", "10.0.0.1")
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Web.Port != 9191 || conf.Web.StaticPathPrefix != "/static" {
+		t.Errorf("web env not applied: %+v", conf.Web)
+	}
+	if len(conf.Databases) != 2 || conf.Databases[0].ConnStr != "a.db" || conf.Databases[1].ConnStr != "b.db" {
+		t.Errorf("database env not applied: %+v", conf.Databases)
+	}
+	if conf.Redis == nil || conf.Redis.Host != "10.0.0.1" {
+		t.Errorf("redis section not created by env: %+v", conf.Redis)
+	}
+	if conf.Mqtt != nil {
+		t.Errorf("expect no mqtt section, got %+v", conf.Mqtt)
+	}
+}
+
+func TestLoadConfigExplicitZero(t *testing.T) {
+	//a bool defaulting to true must be kept when file says false
+	old := WebDefaultConfig
+	WebDefaultConfig.Health = true
+	defer func() { WebDefaultConfig = old }()
+
+	//absent bool gets default
+	conf, err := LoadConfig(writeConfigFile(t, "app.json", `{"web":{"port":9090}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.Web.Health {
+		t.Error("expect absent bool defaulted")
+	}
+
+	//explicit zero & false in file or env are not replaced by default
+	path := writeConfigFile(t, "app.yaml", `
+web:
+  port: 9090
+  bodyLimit: 0
+  health: false
+databases:
+  - databaseType: sqlite3
+    connStr: a.db
+    maxIdleConn: 0
+`)
+	setTestEnv(t, "BOOTX_DATABASES_0_MAX_OPEN_CONN", "0")
+	conf, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Web.BodyLimit != 0 || conf.Web.Health {
+		t.Errorf("expect explicit zero kept, got %+v", conf.Web)
+	}
+	if conf.Web.ShutdownTimeout != DefaultWebShutdownTimeout {
+		t.Errorf("expect absent field defaulted, got %d", conf.Web.ShutdownTimeout)
+	}
+	if db := conf.Databases[0]; db.MaxIdleConnCount != 0 || db.MaxOpenConnCount != 0 {
+		t.Errorf("expect explicit zero in file & env kept, got %+v", db)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := map[string]struct {
+		file    string
+		content string
+		env     [2]string
+		expect  string
+	}{
+		"unsupported type": {file: "app.toml", content: "", expect: "unsupported config file type"},
+		"broken yaml":      {file: "app.yaml", content: "web: [", expect: "parse config file"},
+		"invalid port":     {file: "app.yaml", content: "web:\n  port: 70000", expect: "invalid web config"},
+		"missing conn str": {file: "app.yml", content: "databases:\n  - databaseType: sqlite3", expect: "invalid database config at 0"},
+		"bad env value": {file: "app.yaml", content: "web:\n  port: 80", env: [2]string{"BOOTX_WEB_PORT", "eighty"},
+			expect: "invalid env BOOTX_WEB_PORT"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			if len(c.env[0]) > 0 {
+				setTestEnv(t, c.env[0], c.env[1])
+			}
+			_, err := LoadConfig(writeConfigFile(t, c.file, c.content))
+			if err == nil || !strings.Contains(err.Error(), c.expect) {
+				t.Errorf("expect error contains '%s', got %v", c.expect, err)
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for name, expect := range map[string]string{
+		"port":             "PORT",
+		"staticPathPrefix": "STATIC_PATH_PREFIX",
+		"connStr":          "CONN_STR",
+		"Name":             "NAME",
+	} {
+		if got := envName(name); got != expect {
+			t.Errorf("envName(%s) expect %s, got %s", name, expect, got)
+		}
+	}
+}
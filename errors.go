@@ -0,0 +1,38 @@
+package bootx
+
+import "fmt"
+
+//ConfigError reported when a module config is invalid
+type ConfigError struct {
+	Module string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid %s config : %v", e.Module, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+//ConnectError reported when a module can't connect to its backend
+type ConnectError struct {
+	Module string
+	Target string
+	Err    error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("%s connect to '%s' failed : %v", e.Module, e.Target, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+type ModuleNameDuplicate string
+
+func (e ModuleNameDuplicate) Error() string {
+	return fmt.Sprintf("module '%s' duplicate register", string(e))
+}
@@ -0,0 +1,70 @@
+package bootx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestOpenRedisConnectError(t *testing.T) {
+	conf := RedisDefaultConfig
+	conf.Host = "127.0.0.1"
+	conf.Port = freePort(t)
+	_, err := OpenRedis(conf)
+	var connErr *ConnectError
+	if !errors.As(err, &connErr) {
+		t.Fatalf("expect ConnectError, got %v", err)
+	}
+	if expect := fmt.Sprintf("127.0.0.1:%d", conf.Port); connErr.Target != expect {
+		t.Errorf("expect target %s, got %s", expect, connErr.Target)
+	}
+	if connErr.Unwrap() == nil {
+		t.Error("expect cause kept")
+	}
+}
+
+func TestNewWebEConfigError(t *testing.T) {
+	conf := WebDefaultConfig
+	conf.Port = 0
+	_, err := NewWebE(conf)
+	var confErr *ConfigError
+	if !errors.As(err, &confErr) || confErr.Module != ModuleWeb {
+		t.Errorf("expect web ConfigError, got %v", err)
+	}
+}
+
+func TestWebStartAddrInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conf := WebDefaultConfig
+	conf.Port = ln.Addr().(*net.TCPAddr).Port
+	web, err := NewWebE(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var connErr *ConnectError
+	if err = web.start(); !errors.As(err, &connErr) || connErr.Module != ModuleWeb {
+		t.Errorf("expect web ConnectError, got %v", err)
+	}
+}
+
+func TestModuleNameDuplicate(t *testing.T) {
+	name := t.Name()
+	defer func() {
+		gModules.lock.Lock()
+		defer gModules.lock.Unlock()
+		delete(gModules.index, name)
+		gModules.entries = gModules.entries[:len(gModules.entries)-1]
+	}()
+	if err := AddModule(&ModuleFuncs{ModuleName: name}); err != nil {
+		t.Fatal(err)
+	}
+	err := AddModule(&ModuleFuncs{ModuleName: name})
+	if dup, ok := err.(ModuleNameDuplicate); !ok || string(dup) != name {
+		t.Errorf("expect ModuleNameDuplicate, got %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/gen-iot/bootx"
 	"github.com/gen-iot/bootx/middleware"
+	"time"
 )
 
 type FooApp struct {
@@ -29,11 +30,21 @@ func (f FooApp) Bootstrap() {
 	web.GET("", web.BuildHttpHandler(func(ctx bootx.Context) error {
 		return ctx.String(200, "hello word")
 	}))
-	web.GET("/foo/bar",
-		web.BuildHttpHandler(
-			func() (*FooResponse, error) {
-				return &FooResponse{Msg: "hello word"}, nil
-			}))
+	//routes registered by Handle/Get/Post..., or GET/POST... with BuildHttpHandler are listed in /openapi.json
+	web.Get("/foo/bar",
+		func() (*FooResponse, error) {
+			return &FooResponse{Msg: "hello word"}, nil
+		}, bootx.WithSummary("hello"))
+	v1 := web.NewGroup("/v1", bootx.WithTags("foo"), bootx.WithTimeout(5*time.Second))
+	v1.Use(middleware.ValidateWithConfig(middleware.DefaultValidateConfig))
+	v1.Get("/foo/:id", func(ctx bootx.Context, req *TestBindRequest) (*FooResponse, error) {
+		return &FooResponse{Msg: req.Id}, nil
+	}, bootx.WithName("getFoo"))
+	web.EnableOpenApi(bootx.OpenApiConfig{
+		Title:         f.GetName(),
+		Version:       f.GetVersion(),
+		SwaggerUIPath: "/swagger",
+	})
 	bootx.DisableReqPreBind = true
 	web.POST("/foo/bar",
 		web.BuildHttpHandler(
@@ -49,7 +60,7 @@ func (f FooApp) Bootstrap() {
 }
 
 type TestBindRequest struct {
-	Id  string `json:"id"`
+	Id  string `json:"id" param:"id"`
 	Msg string `json:"msg"`
 }
 
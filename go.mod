@@ -1,15 +1,22 @@
 module github.com/gen-iot/bootx
 
-go 1.13
+go 1.15
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/eclipse/paho.golang v0.11.0
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/gen-iot/std v1.1.6
+	github.com/go-playground/locales v0.12.1
+	github.com/go-playground/universal-translator v0.16.0
 	github.com/go-redis/redis v6.15.7+incompatible
+	github.com/golang/protobuf v1.3.2
 	github.com/jinzhu/gorm v1.9.12
 	github.com/labstack/echo/v4 v4.1.15
 	github.com/onsi/ginkgo v1.12.0 // indirect
 	github.com/onsi/gomega v1.9.0 // indirect
 	github.com/pkg/errors v0.9.1
-	gopkg.in/go-playground/validator.v9 v9.31.0 // indirect
+	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b
+	gopkg.in/go-playground/validator.v9 v9.31.0
+	gopkg.in/yaml.v2 v2.2.8
 )
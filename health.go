@@ -0,0 +1,238 @@
+package bootx
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultHealthCheckTimeout = 3 * time.Second
+	HealthStatusUp            = "up"
+	HealthStatusDown          = "down"
+)
+
+//HealthChecker check one component, return nil if healthy
+type HealthChecker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type healthCheckFunc struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func (this *healthCheckFunc) Name() string {
+	return this.name
+}
+
+func (this *healthCheckFunc) Check(ctx context.Context) error {
+	return this.fn(ctx)
+}
+
+func HealthCheckFunc(name string, fn func(ctx context.Context) error) HealthChecker {
+	return &healthCheckFunc{name: name, fn: fn}
+}
+
+type (
+	HealthConfig struct {
+		LivenessPath  string
+		ReadinessPath string
+		//default timeout of each checker
+		Timeout time.Duration
+		//builtin database/redis/mqtt checkers are disabled if true
+		DisableBuiltin bool
+	}
+	ComponentHealth struct {
+		Status  string `json:"status"`
+		Latency string `json:"latency"`
+		Error   string `json:"error,omitempty"`
+	}
+	HealthReport struct {
+		Status     string                      `json:"status"`
+		Components map[string]*ComponentHealth `json:"components,omitempty"`
+	}
+)
+
+var DefaultHealthConfig = HealthConfig{
+	LivenessPath:  "/healthz",
+	ReadinessPath: "/readyz",
+	Timeout:       DefaultHealthCheckTimeout,
+}
+
+type healthEntry struct {
+	checker HealthChecker
+	timeout time.Duration
+}
+
+var healthCheckers = make([]*healthEntry, 0)
+var healthLock = &sync.RWMutex{}
+
+//RegisterHealthChecker add user checker to readiness, timeout <= 0 means use HealthConfig.Timeout
+func RegisterHealthChecker(checker HealthChecker, timeout time.Duration) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	healthCheckers = append(healthCheckers, &healthEntry{checker: checker, timeout: timeout})
+}
+
+func (this *WebX) EnableHealth() {
+	this.EnableHealthWithConfig(DefaultHealthConfig)
+}
+
+func (this *WebX) EnableHealthWithConfig(conf HealthConfig) {
+	if conf.LivenessPath == "" {
+		conf.LivenessPath = DefaultHealthConfig.LivenessPath
+	}
+	if conf.ReadinessPath == "" {
+		conf.ReadinessPath = DefaultHealthConfig.ReadinessPath
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultHealthConfig.Timeout
+	}
+	this.GET(conf.LivenessPath, func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, &HealthReport{Status: HealthStatusUp})
+	})
+	this.GET(conf.ReadinessPath, func(ctx echo.Context) error {
+		report := this.CheckHealth(ctx.Request().Context(), conf)
+		code := http.StatusOK
+		if report.Status != HealthStatusUp {
+			code = http.StatusServiceUnavailable
+		}
+		return ctx.JSONPretty(code, report, jsonIndent)
+	})
+}
+
+//CheckHealth run all checkers concurrently
+func (this *WebX) CheckHealth(ctx context.Context, conf HealthConfig) *HealthReport {
+	entries := make([]*healthEntry, 0)
+	if !conf.DisableBuiltin {
+		entries = append(entries, builtinHealthCheckers()...)
+	}
+	healthLock.RLock()
+	entries = append(entries, healthCheckers...)
+	healthLock.RUnlock()
+	report := &HealthReport{
+		Status:     HealthStatusUp,
+		Components: make(map[string]*ComponentHealth, len(entries)),
+	}
+	if atomic.LoadInt32(&this.shuttingDown) == 1 {
+		report.Status = HealthStatusDown
+		report.Components[ModuleWeb] = &ComponentHealth{Status: HealthStatusDown, Error: "shutting down"}
+	}
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, e := range entries {
+		wg.Add(1)
+		go func(e *healthEntry) {
+			defer wg.Done()
+			timeout := e.timeout
+			if timeout <= 0 {
+				timeout = conf.Timeout
+			}
+			c := runHealthCheck(ctx, e.checker, timeout)
+			lock.Lock()
+			defer lock.Unlock()
+			report.Components[e.checker.Name()] = c
+			if c.Status != HealthStatusUp {
+				report.Status = HealthStatusDown
+			}
+		}(e)
+	}
+	wg.Wait()
+	return report
+}
+
+func runHealthCheck(ctx context.Context, checker HealthChecker, timeout time.Duration) (out *ComponentHealth) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic : %v", r)
+			}
+		}()
+		done <- checker.Check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	out = &ComponentHealth{Status: HealthStatusUp, Latency: time.Since(start).String()}
+	if err != nil {
+		out.Status = HealthStatusDown
+		out.Error = err.Error()
+	}
+	return
+}
+
+func builtinHealthCheckers() []*healthEntry {
+	out := make([]*healthEntry, 0)
+	dbRwLock.RLock()
+	for _, name := range dbNames {
+		db := dbMap[name]
+		out = append(out, &healthEntry{
+			checker: HealthCheckFunc(ModuleDatabase+":"+name, func(ctx context.Context) error {
+				return db.DB.DB().PingContext(ctx)
+			}),
+		})
+	}
+	dbRwLock.RUnlock()
+	if gRedisCli != nil {
+		cli := gRedisCli
+		out = append(out, &healthEntry{
+			checker: HealthCheckFunc(ModuleRedis, func(ctx context.Context) error {
+				return cli.WithContext(ctx).Ping().Err()
+			}),
+		})
+	}
+	if gMqttPubCli != nil {
+		cli := gMqttPubCli
+		out = append(out, &healthEntry{
+			checker: HealthCheckFunc(ModuleMqtt, cli.checkReachable),
+		})
+	}
+	if gMqttCli != nil {
+		cli := gMqttCli
+		out = append(out, &healthEntry{
+			checker: HealthCheckFunc(ModuleMqtt+":client", func(ctx context.Context) error {
+				if !cli.IsConnected() {
+					return ErrMqttNotConnected
+				}
+				return nil
+			}),
+		})
+	}
+	return out
+}
+
+//check tcp reachability of publish api
+func (this *MqttPubCli) checkReachable(ctx context.Context) error {
+	u, err := url.Parse(this.MqttPubApiAddr)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
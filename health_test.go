@@ -0,0 +1,89 @@
+package bootx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//withHealthCheckers replace registered checkers during test
+func withHealthCheckers(t *testing.T, checkers ...HealthChecker) {
+	healthLock.Lock()
+	old := healthCheckers
+	healthCheckers = make([]*healthEntry, 0)
+	healthLock.Unlock()
+	t.Cleanup(func() {
+		healthLock.Lock()
+		healthCheckers = old
+		healthLock.Unlock()
+	})
+	for _, c := range checkers {
+		RegisterHealthChecker(c, 0)
+	}
+}
+
+func getHealth(t *testing.T, web *WebX, path string) (int, *HealthReport) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	web.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	report := new(HealthReport)
+	if err := json.Unmarshal(rec.Body.Bytes(), report); err != nil {
+		t.Fatalf("decode %s failed : %v, body %s", path, err, rec.Body.String())
+	}
+	return rec.Code, report
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	up := HealthCheckFunc("up", func(ctx context.Context) error { return nil })
+	down := HealthCheckFunc("down", func(ctx context.Context) error { return errors.New("refused") })
+	slow := HealthCheckFunc("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	panics := HealthCheckFunc("panics", func(ctx context.Context) error { panic("boom") })
+
+	web := NewWebWithConf(WebDefaultConfig)
+	web.EnableHealthWithConfig(HealthConfig{Timeout: 50 * time.Millisecond, DisableBuiltin: true})
+
+	withHealthCheckers(t, up)
+	if code, report := getHealth(t, web, "/readyz"); code != http.StatusOK || report.Status != HealthStatusUp {
+		t.Errorf("expect ready, got %d %+v", code, report)
+	}
+
+	withHealthCheckers(t, up, down, slow, panics)
+	code, report := getHealth(t, web, "/readyz")
+	if code != http.StatusServiceUnavailable || report.Status != HealthStatusDown {
+		t.Fatalf("expect not ready, got %d %+v", code, report)
+	}
+	expect := map[string]string{"up": "", "down": "refused", "slow": context.DeadlineExceeded.Error(), "panics": "panic : boom"}
+	for name, msg := range expect {
+		c := report.Components[name]
+		if c == nil {
+			t.Errorf("component %s missing", name)
+			continue
+		}
+		if c.Error != msg {
+			t.Errorf("component %s expect error '%s', got '%s'", name, msg, c.Error)
+		}
+	}
+
+	//liveness never runs checkers
+	if code, report := getHealth(t, web, "/healthz"); code != http.StatusOK || report.Status != HealthStatusUp {
+		t.Errorf("expect live, got %d %+v", code, report)
+	}
+}
+
+func TestHealthShuttingDown(t *testing.T) {
+	withHealthCheckers(t)
+	web := NewWebWithConf(WebDefaultConfig)
+	atomic.StoreInt32(&web.shuttingDown, 1)
+	report := web.CheckHealth(context.Background(), HealthConfig{Timeout: time.Second, DisableBuiltin: true})
+	if report.Status != HealthStatusDown || report.Components[ModuleWeb] == nil {
+		t.Errorf("expect down while shutting down, got %+v", report)
+	}
+}
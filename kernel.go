@@ -16,6 +16,12 @@ type kernel struct {
 	WorkSpace       string
 	choseSignalChan chan bool
 	Lock            *sync.Mutex
+	reloadHooks     []*reloadHook
+}
+
+//reloadHook wrap fn, so it can be found when unregistered
+type reloadHook struct {
+	fn func()
 }
 
 func newKernel() *kernel {
@@ -36,45 +42,97 @@ func getKernel() *kernel {
 }
 
 func (this *kernel) kill() {
-	logger.Println("shutdown ...")
+	Log().Info("shutdown ...")
 	close(this.choseSignalChan)
 }
 
 //block event
 func (this *kernel) waitForExit() {
-	logger.Println("running ...")
+	Log().Info("running ...")
 	this.handleKillSignal()
 	<-this.choseSignalChan
 }
 
 func (this *kernel) handleKillSignal() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	//监听指定信号 ctrl+c kill
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL)
 	go func() {
 		for s := range c {
-			switch s {
-			case syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL:
-				logger.Println("receive signal", s)
-				this.kill()
-			default:
-				logger.Println("receive signal", s)
-			}
+			this.handleSignal(s)
 		}
 	}()
 }
 
+func (this *kernel) handleSignal(s os.Signal) {
+	switch s {
+	case syscall.SIGHUP:
+		//reload only if someone registered, otherwise exit as before
+		if this.hasReloadHooks() {
+			Log().Info("receive signal, reload ...", "signal", s)
+			this.reload()
+			return
+		}
+		Log().Info("receive signal", "signal", s)
+		this.kill()
+	case syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL:
+		Log().Info("receive signal", "signal", s)
+		this.kill()
+	default:
+		Log().Debug("receive signal", "signal", s)
+	}
+}
+
+func (this *kernel) onReload(fn func()) (unregister func()) {
+	hook := &reloadHook{fn: fn}
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	this.reloadHooks = append(this.reloadHooks, hook)
+	return func() {
+		this.Lock.Lock()
+		defer this.Lock.Unlock()
+		hooks := make([]*reloadHook, 0, len(this.reloadHooks))
+		for _, h := range this.reloadHooks {
+			if h != hook {
+				hooks = append(hooks, h)
+			}
+		}
+		this.reloadHooks = hooks
+	}
+}
+
+func (this *kernel) hasReloadHooks() bool {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	return len(this.reloadHooks) > 0
+}
+
+func (this *kernel) reload() {
+	this.Lock.Lock()
+	hooks := this.reloadHooks
+	this.Lock.Unlock()
+	for _, hook := range hooks {
+		hook.fn()
+	}
+}
+
+//OnSignalReload fn is called when SIGHUP received, e.g. reload certificates, the process keeps running.
+//SIGHUP exits the process if no fn registered. call the returned func to remove fn
+func OnSignalReload(fn func()) (unregister func()) {
+	return getKernel().onReload(fn)
+}
+
 func initKernel() {
-	logger.Println("main loop init ...")
+	Log().Info("main loop init ...")
 	initGolang()
 	getKernel()
 }
 
 func initGolang() {
-	logger.Println("golang init ...")
+	Log().Info("golang init ...")
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
 
 func cleanupKernel() {
-	logger.Println("exited !")
+	Log().Info("exited !")
 }
@@ -0,0 +1,33 @@
+package bootx
+
+import (
+	"syscall"
+	"testing"
+)
+
+func kernelKilled(k *kernel) bool {
+	select {
+	case <-k.choseSignalChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestKernelSignalHup(t *testing.T) {
+	k := newKernel()
+	reloaded := 0
+	unregister := k.onReload(func() {
+		reloaded++
+	})
+	k.handleSignal(syscall.SIGHUP)
+	if reloaded != 1 || kernelKilled(k) {
+		t.Fatalf("expect reloaded without exit, reloaded %d", reloaded)
+	}
+	//nobody cares reload, exit as before
+	unregister()
+	k.handleSignal(syscall.SIGHUP)
+	if reloaded != 1 || !kernelKilled(k) {
+		t.Errorf("expect exit without reload hooks, reloaded %d", reloaded)
+	}
+}
@@ -1,25 +1,290 @@
 package bootx
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 const logTag = "[Bootx]"
 
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "DEBUG"
+	case InfoLevel:
+		return "INFO"
+	case WarnLevel:
+		return "WARN"
+	case ErrorLevel:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int32(l))
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info", "":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level '%s'", s)
+}
+
+//Logger is a leveled structured logger, kv are key-value pairs, e.g.
+// log.Info("redis init", "addr", addr)
 type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	//child logger with fields attached
+	With(kv ...interface{}) Logger
+	//child logger for sub module, names are joined with '.'
+	Named(name string) Logger
+	//kept for compatible, logged at info level
 	Println(v ...interface{})
 	Printf(format string, v ...interface{})
 }
 
-type defaultLogger struct {
+type LogEntry struct {
+	Time    time.Time
+	Level   Level
+	Name    string
+	Message string
+	Fields  []interface{}
+}
+
+type LogEncoder interface {
+	Encode(buf *bytes.Buffer, e *LogEntry)
+}
+
+//ConsoleEncoder output like : [Bootx] 2006-01-02 15:04:05.000 INFO web: msg key=value
+type ConsoleEncoder struct {
+}
+
+func (ConsoleEncoder) Encode(buf *bytes.Buffer, e *LogEntry) {
+	buf.WriteString(logTag)
+	buf.WriteByte(' ')
+	buf.WriteString(e.Time.Format("2006-01-02 15:04:05.000"))
+	buf.WriteByte(' ')
+	buf.WriteString(fmt.Sprintf("%-5s", e.Level))
+	buf.WriteByte(' ')
+	if len(e.Name) > 0 {
+		buf.WriteString(e.Name)
+		buf.WriteString(": ")
+	}
+	buf.WriteString(e.Message)
+	for i := 0; i < len(e.Fields); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprintf("%v=%v", e.Fields[i], logValue(e.Fields[i+1])))
+	}
+	buf.WriteByte('\n')
+}
+
+//JSONEncoder output one json object per line
+type JSONEncoder struct {
+}
+
+func (JSONEncoder) Encode(buf *bytes.Buffer, e *LogEntry) {
+	m := make(map[string]interface{}, len(e.Fields)/2+4)
+	for i := 0; i < len(e.Fields); i += 2 {
+		v := logValue(e.Fields[i+1])
+		if _, err := json.Marshal(v); err != nil {
+			v = fmt.Sprintf("%v", v)
+		}
+		m[fmt.Sprintf("%v", e.Fields[i])] = v
+	}
+	m["time"] = e.Time.Format(time.RFC3339Nano)
+	m["level"] = strings.ToLower(e.Level.String())
+	m["msg"] = e.Message
+	if len(e.Name) > 0 {
+		m["logger"] = e.Name
+	}
+	bs, _ := json.Marshal(m)
+	buf.Write(bs)
+	buf.WriteByte('\n')
+}
+
+func logValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return v
+}
+
+//LogConfig is the file config of builtin logger
+type LogConfig struct {
+	Level  string `yaml:"level" json:"level" validate:"omitempty,oneof=debug info warn warning error"`
+	Format string `yaml:"format" json:"format" validate:"omitempty,oneof=console json"`
+}
+
+func logInitWithConfig(conf LogConfig) error {
+	level, err := ParseLevel(conf.Level)
+	if err != nil {
+		return &ConfigError{Module: "log", Err: err}
+	}
+	var enc LogEncoder = ConsoleEncoder{}
+	if conf.Format == "json" {
+		enc = JSONEncoder{}
+	}
+	SetLogger(NewLogger(LoggerConfig{Level: level, Encoder: enc}))
+	return nil
+}
+
+type LoggerConfig struct {
+	Out     io.Writer
+	Level   Level
+	Encoder LogEncoder
+}
+
+type logCore struct {
+	lock  *sync.Mutex
+	out   io.Writer
+	level int32
+	enc   LogEncoder
+}
+
+type stdLogger struct {
+	core   *logCore
+	name   string
+	fields []interface{}
 }
 
-func (this *defaultLogger) Println(v ...interface{}) {
-	vWithTag := []interface{}{logTag}
-	vWithTag = append(vWithTag, v...)
-	fmt.Println(vWithTag...)
+//NewLogger create the builtin logger, Out default stdout, Encoder default ConsoleEncoder
+func NewLogger(conf LoggerConfig) Logger {
+	if conf.Out == nil {
+		conf.Out = os.Stdout
+	}
+	if conf.Encoder == nil {
+		conf.Encoder = ConsoleEncoder{}
+	}
+	return &stdLogger{
+		core: &logCore{
+			lock:  &sync.Mutex{},
+			out:   conf.Out,
+			level: int32(conf.Level),
+			enc:   conf.Encoder,
+		},
+	}
 }
 
-func (this *defaultLogger) Printf(format string, v ...interface{}) {
-	fmt.Printf(fmt.Sprintf("%s %s\n", logTag, format), v...)
+func (this *stdLogger) log(level Level, msg string, kv []interface{}) {
+	if int32(level) < atomic.LoadInt32(&this.core.level) {
+		return
+	}
+	fields := make([]interface{}, 0, len(this.fields)+len(kv)+1)
+	fields = append(fields, this.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields[:len(fields)-1], "extra", fields[len(fields)-1])
+	}
+	e := &LogEntry{
+		Time:    time.Now(),
+		Level:   level,
+		Name:    this.name,
+		Message: msg,
+		Fields:  fields,
+	}
+	buf := &bytes.Buffer{}
+	this.core.enc.Encode(buf, e)
+	this.core.lock.Lock()
+	defer this.core.lock.Unlock()
+	_, _ = this.core.out.Write(buf.Bytes())
 }
 
-var logger = defaultLogger{}
+func (this *stdLogger) Debug(msg string, kv ...interface{}) {
+	this.log(DebugLevel, msg, kv)
+}
+
+func (this *stdLogger) Info(msg string, kv ...interface{}) {
+	this.log(InfoLevel, msg, kv)
+}
+
+func (this *stdLogger) Warn(msg string, kv ...interface{}) {
+	this.log(WarnLevel, msg, kv)
+}
+
+func (this *stdLogger) Error(msg string, kv ...interface{}) {
+	this.log(ErrorLevel, msg, kv)
+}
+
+func (this *stdLogger) Println(v ...interface{}) {
+	this.log(InfoLevel, strings.TrimSuffix(fmt.Sprintln(v...), "\n"), nil)
+}
+
+func (this *stdLogger) Printf(format string, v ...interface{}) {
+	this.log(InfoLevel, fmt.Sprintf(format, v...), nil)
+}
+
+func (this *stdLogger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(this.fields)+len(kv))
+	fields = append(fields, this.fields...)
+	fields = append(fields, kv...)
+	return &stdLogger{core: this.core, name: this.name, fields: fields}
+}
+
+func (this *stdLogger) Named(name string) Logger {
+	if len(this.name) > 0 {
+		name = this.name + "." + name
+	}
+	return &stdLogger{core: this.core, name: name, fields: this.fields}
+}
+
+func (this *stdLogger) SetLevel(level Level) {
+	atomic.StoreInt32(&this.core.level, int32(level))
+}
+
+var gLogger = &atomic.Value{}
+
+func init() {
+	SetLogger(NewLogger(LoggerConfig{Level: InfoLevel}))
+}
+
+//SetLogger replace the logger used by bootx
+func SetLogger(l Logger) {
+	if l == nil {
+		l = NewLogger(LoggerConfig{Level: InfoLevel})
+	}
+	gLogger.Store(&l)
+}
+
+//SetLogLevel change level of the builtin logger, no effect on custom logger
+func SetLogLevel(level Level) {
+	if l, ok := Log().(interface{ SetLevel(Level) }); ok {
+		l.SetLevel(level)
+	}
+}
+
+//Log return the root logger
+func Log() Logger {
+	return *(gLogger.Load().(*Logger))
+}
+
+//moduleLog return child logger of module
+func moduleLog(module string) Logger {
+	return Log().Named(module)
+}
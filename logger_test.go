@@ -0,0 +1,111 @@
+package bootx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func decodeLogLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	out := make([]map[string]interface{}, 0)
+	sc := bufio.NewScanner(buf)
+	for sc.Scan() {
+		m := make(map[string]interface{})
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("line '%s' not json : %v", sc.Text(), err)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	root := NewLogger(LoggerConfig{Out: buf, Level: InfoLevel, Encoder: JSONEncoder{}})
+	web := root.Named("web").With("port", 8080)
+	web.Debug("filtered")
+	web.Named("tls").Warn("cert reloaded", "err", errors.New("expired"), "odd")
+	root.Error("stopped")
+
+	lines := decodeLogLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("expect 2 lines, got %d", len(lines))
+	}
+	first := lines[0]
+	expect := map[string]interface{}{
+		"level":  "warn",
+		"logger": "web.tls",
+		"msg":    "cert reloaded",
+		"port":   float64(8080),
+		"err":    "expired",
+		"extra":  "odd",
+	}
+	for k, v := range expect {
+		if first[k] != v {
+			t.Errorf("expect %s=%v, got %v", k, v, first[k])
+		}
+	}
+	if _, ok := lines[1]["logger"]; ok || lines[1]["level"] != "error" {
+		t.Errorf("unexpected root line %v", lines[1])
+	}
+}
+
+func TestLoggerConsole(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogger(LoggerConfig{Out: buf, Level: DebugLevel})
+	l.Named("db").Debug("open", "name", "main")
+	line := buf.String()
+	if !strings.HasPrefix(line, logTag+" ") || !strings.HasSuffix(line, "DEBUG db: open name=main\n") {
+		t.Errorf("unexpected console line '%s'", line)
+	}
+}
+
+func TestLoggerPrint(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogger(LoggerConfig{Out: buf, Level: InfoLevel, Encoder: JSONEncoder{}}).Named("redis")
+	l.Println("redis init", "...")
+	l.Printf("redis close : %s", "timeout")
+	lines := decodeLogLines(t, buf)
+	if len(lines) != 2 || lines[0]["msg"] != "redis init ..." || lines[1]["msg"] != "redis close : timeout" ||
+		lines[1]["level"] != "info" || lines[1]["logger"] != "redis" {
+		t.Errorf("unexpected lines %v", lines)
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	old := Log()
+	defer SetLogger(old)
+	buf := &bytes.Buffer{}
+	SetLogger(NewLogger(LoggerConfig{Out: buf, Level: InfoLevel}))
+	moduleLog("redis").Debug("hidden")
+	SetLogLevel(DebugLevel)
+	//children share level of root
+	moduleLog("redis").Debug("shown")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "redis: shown") {
+		t.Errorf("unexpected output '%s'", out)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		in     string
+		expect Level
+		err    bool
+	}{
+		{in: "", expect: InfoLevel},
+		{in: "DEBUG", expect: DebugLevel},
+		{in: "warning", expect: WarnLevel},
+		{in: "error", expect: ErrorLevel},
+		{in: "fatal", expect: InfoLevel, err: true},
+	}
+	for _, c := range cases {
+		level, err := ParseLevel(c.in)
+		if level != c.expect || (err != nil) != c.err {
+			t.Errorf("ParseLevel(%s) expect %v err %v, got %v %v", c.in, c.expect, c.err, level, err)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package bootx
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMetricsPath = "/metrics"
+	metricsNamespace   = "bootx"
+	contentTypeMetrics = "text/plain; version=0.0.4; charset=utf-8"
+	//label of requests matched no route, e.g. 404 & static files
+	metricsUnmatchedFunc = "unmatched"
+	metricsOtherMethod   = "OTHER"
+	//echo context key of handler func name, set by bootx handlers
+	ctxKeyMetricsFunc = "bootx.metrics.func"
+)
+
+var DefaultHistogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+//Collector write metrics in prometheus text format
+type Collector interface {
+	Collect(buf *bytes.Buffer)
+}
+
+type MetricsRegistry struct {
+	lock       *sync.RWMutex
+	collectors []Collector
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		lock:       &sync.RWMutex{},
+		collectors: make([]Collector, 0),
+	}
+}
+
+func (this *MetricsRegistry) Register(c ...Collector) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.collectors = append(this.collectors, c...)
+}
+
+func (this *MetricsRegistry) WriteTo(buf *bytes.Buffer) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	for _, c := range this.collectors {
+		c.Collect(buf)
+	}
+}
+
+//DefaultMetrics holds all bootx builtin metrics, user metrics can be registered too
+var DefaultMetrics = NewMetricsRegistry()
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	count       uint64
+}
+
+type metricVec struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	lock    *sync.Mutex
+	series  map[string]*metricSeries
+}
+
+func newMetricVec(name, help, typ string, labels []string, buckets []float64) *metricVec {
+	return &metricVec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		lock:    &sync.Mutex{},
+		series:  make(map[string]*metricSeries),
+	}
+}
+
+func (this *metricVec) get(values []string) *metricSeries {
+	if len(values) != len(this.labels) {
+		panic(fmt.Sprintf("metric '%s' expect %d label values, got %d", this.name, len(this.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := this.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), values...)}
+		if this.buckets != nil {
+			s.buckets = make([]uint64, len(this.buckets))
+		}
+		this.series[key] = s
+	}
+	return s
+}
+
+func (this *metricVec) sortedSeries() []*metricSeries {
+	out := make([]*metricSeries, 0, len(this.series))
+	for _, s := range this.series {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].labelValues, ",") < strings.Join(out[j].labelValues, ",")
+	})
+	return out
+}
+
+type CounterVec struct {
+	*metricVec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newMetricVec(name, help, "counter", labels, nil)}
+}
+
+func (this *CounterVec) Inc(labelValues ...string) {
+	this.Add(1, labelValues...)
+}
+
+func (this *CounterVec) Add(v float64, labelValues ...string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.get(labelValues).value += v
+}
+
+func (this *CounterVec) Value(labelValues ...string) float64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.get(labelValues).value
+}
+
+func (this *CounterVec) Collect(buf *bytes.Buffer) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	writeMetricHeader(buf, this.name, this.help, this.typ)
+	for _, s := range this.sortedSeries() {
+		writeMetricLine(buf, this.name, this.labels, s.labelValues, "", "", s.value)
+	}
+}
+
+type HistogramVec struct {
+	*metricVec
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultHistogramBuckets
+	}
+	return &HistogramVec{newMetricVec(name, help, "histogram", labels, buckets)}
+}
+
+func (this *HistogramVec) Observe(v float64, labelValues ...string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	s := this.get(labelValues)
+	for i, upper := range this.buckets {
+		if v <= upper {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+func (this *HistogramVec) Collect(buf *bytes.Buffer) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	writeMetricHeader(buf, this.name, this.help, this.typ)
+	for _, s := range this.sortedSeries() {
+		for i, upper := range this.buckets {
+			writeMetricLine(buf, this.name+"_bucket", this.labels, s.labelValues,
+				"le", formatMetricValue(upper), float64(s.buckets[i]))
+		}
+		writeMetricLine(buf, this.name+"_bucket", this.labels, s.labelValues, "le", "+Inf", float64(s.count))
+		writeMetricLine(buf, this.name+"_sum", this.labels, s.labelValues, "", "", s.value)
+		writeMetricLine(buf, this.name+"_count", this.labels, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+//GaugeSample is one series of GaugeFunc
+type GaugeSample struct {
+	LabelValues []string
+	Value       float64
+}
+
+//GaugeFunc collect gauge values on every scrape
+type GaugeFunc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	fn     func() []GaugeSample
+}
+
+func NewGaugeFunc(name, help string, fn func() []GaugeSample, labels ...string) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, typ: "gauge", labels: labels, fn: fn}
+}
+
+//NewCounterFunc same as NewGaugeFunc, but exported as counter,
+//used for monotonic values read from other places e.g. sql.DBStats.WaitCount
+func NewCounterFunc(name, help string, fn func() []GaugeSample, labels ...string) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, typ: "counter", labels: labels, fn: fn}
+}
+
+func (this *GaugeFunc) Collect(buf *bytes.Buffer) {
+	samples := this.fn()
+	if len(samples) == 0 {
+		return
+	}
+	writeMetricHeader(buf, this.name, this.help, this.typ)
+	for _, s := range samples {
+		writeMetricLine(buf, this.name, this.labels, s.LabelValues, "", "", s.Value)
+	}
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, help, typ string) {
+	buf.WriteString(fmt.Sprintf("# HELP %s %s\n", name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(help)))
+	buf.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, typ))
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+
+func writeMetricLine(buf *bytes.Buffer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		buf.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(fmt.Sprintf(`%s="%s"`, l, labelValueEscaper.Replace(values[i])))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(fmt.Sprintf(`%s="%s"`, extraLabel, extraValue))
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatMetricValue(v))
+	buf.WriteByte('\n')
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+//builtin metrics
+var (
+	httpRequestsTotal = NewCounterVec(metricsNamespace+"_http_requests_total",
+		"Total number of http requests.", "func", "method", "status")
+	httpRequestDuration = NewHistogramVec(metricsNamespace+"_http_request_duration_seconds",
+		"Http request latency in seconds.", DefaultHistogramBuckets, "func", "method", "status")
+	mqttPublishTotal = NewCounterVec(metricsNamespace+"_mqtt_publish_total",
+		"Total number of mqtt publish by result.", "result")
+	mqttReceiveTotal = NewCounterVec(metricsNamespace+"_mqtt_receive_total",
+		"Total number of mqtt message received by result.", "result")
+	mqttOutboxTotal = NewCounterVec(metricsNamespace+"_mqtt_outbox_total",
+		"Total number of outbox delivery attempts by result.", "result")
+)
+
+func init() {
+	DefaultMetrics.Register(httpRequestsTotal, httpRequestDuration, mqttPublishTotal, mqttReceiveTotal, mqttOutboxTotal)
+	DefaultMetrics.Register(dbStatsCollectors()...)
+	DefaultMetrics.Register(redisStatsCollectors()...)
+}
+
+func dbStatsCollectors() []Collector {
+	stat := func(fn func(db *DataBase) float64) func() []GaugeSample {
+		return func() []GaugeSample {
+			dbRwLock.RLock()
+			defer dbRwLock.RUnlock()
+			out := make([]GaugeSample, 0, len(dbNames))
+			for _, name := range dbNames {
+				out = append(out, GaugeSample{LabelValues: []string{name}, Value: fn(dbMap[name])})
+			}
+			return out
+		}
+	}
+	prefix := metricsNamespace + "_db_"
+	return []Collector{
+		NewGaugeFunc(prefix+"max_open_connections", "Maximum number of open connections to the database.",
+			stat(func(db *DataBase) float64 { return float64(db.DB.DB().Stats().MaxOpenConnections) }), "db"),
+		NewGaugeFunc(prefix+"open_connections", "The number of established connections both in use and idle.",
+			stat(func(db *DataBase) float64 { return float64(db.DB.DB().Stats().OpenConnections) }), "db"),
+		NewGaugeFunc(prefix+"in_use_connections", "The number of connections currently in use.",
+			stat(func(db *DataBase) float64 { return float64(db.DB.DB().Stats().InUse) }), "db"),
+		NewGaugeFunc(prefix+"idle_connections", "The number of idle connections.",
+			stat(func(db *DataBase) float64 { return float64(db.DB.DB().Stats().Idle) }), "db"),
+		NewCounterFunc(prefix+"wait_count_total", "The total number of connections waited for.",
+			stat(func(db *DataBase) float64 { return float64(db.DB.DB().Stats().WaitCount) }), "db"),
+		NewCounterFunc(prefix+"wait_duration_seconds_total", "The total time blocked waiting for a new connection.",
+			stat(func(db *DataBase) float64 { return db.DB.DB().Stats().WaitDuration.Seconds() }), "db"),
+		NewCounterFunc(prefix+"max_idle_closed_total", "The total number of connections closed due to SetMaxIdleConns.",
+			stat(func(db *DataBase) float64 { return float64(db.DB.DB().Stats().MaxIdleClosed) }), "db"),
+		NewCounterFunc(prefix+"max_lifetime_closed_total", "The total number of connections closed due to SetConnMaxLifetime.",
+			stat(func(db *DataBase) float64 { return float64(db.DB.DB().Stats().MaxLifetimeClosed) }), "db"),
+	}
+}
+
+func redisStatsCollectors() []Collector {
+	stat := func(fn func(cli *RedisClient) float64) func() []GaugeSample {
+		return func() []GaugeSample {
+			cli := gRedisCli
+			if cli == nil {
+				return nil
+			}
+			return []GaugeSample{{Value: fn(cli)}}
+		}
+	}
+	prefix := metricsNamespace + "_redis_pool_"
+	return []Collector{
+		NewCounterFunc(prefix+"hits_total", "Number of times free connection was found in the pool.",
+			stat(func(cli *RedisClient) float64 { return float64(cli.PoolStats().Hits) })),
+		NewCounterFunc(prefix+"misses_total", "Number of times free connection was NOT found in the pool.",
+			stat(func(cli *RedisClient) float64 { return float64(cli.PoolStats().Misses) })),
+		NewCounterFunc(prefix+"timeouts_total", "Number of times a wait timeout occurred.",
+			stat(func(cli *RedisClient) float64 { return float64(cli.PoolStats().Timeouts) })),
+		NewGaugeFunc(prefix+"total_connections", "Number of total connections in the pool.",
+			stat(func(cli *RedisClient) float64 { return float64(cli.PoolStats().TotalConns) })),
+		NewGaugeFunc(prefix+"idle_connections", "Number of idle connections in the pool.",
+			stat(func(cli *RedisClient) float64 { return float64(cli.PoolStats().IdleConns) })),
+		NewCounterFunc(prefix+"stale_connections_total", "Number of stale connections removed from the pool.",
+			stat(func(cli *RedisClient) float64 { return float64(cli.PoolStats().StaleConns) })),
+	}
+}
+
+func (this *WebX) metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		start := time.Now()
+		err := next(ctx)
+		if err != nil {
+			//let error handler write the response, so the status code is known
+			ctx.Error(err)
+		}
+		fName := metricsFuncOf(ctx)
+		method := metricsMethodOf(ctx.Request().Method)
+		status := strconv.Itoa(ctx.Response().Status)
+		httpRequestsTotal.Inc(fName, method, status)
+		httpRequestDuration.Observe(time.Since(start).Seconds(), fName, method, status)
+		return nil
+	}
+}
+
+//labels must be bounded, never take them from request
+func metricsFuncOf(ctx echo.Context) string {
+	if fName, ok := ctx.Get(ctxKeyMetricsFunc).(string); ok && len(fName) > 0 {
+		return fName
+	}
+	//path of unmatched request is the raw url path
+	handler := reflect.ValueOf(ctx.Handler()).Pointer()
+	if handler == reflect.ValueOf(echo.NotFoundHandler).Pointer() || len(ctx.Path()) == 0 {
+		return metricsUnmatchedFunc
+	}
+	return ctx.Path()
+}
+
+func metricsMethodOf(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return metricsOtherMethod
+}
+
+//EnableMetrics record http metrics & serve all DefaultMetrics at path (default /metrics)
+func (this *WebX) EnableMetrics(path string) {
+	if len(path) == 0 {
+		path = DefaultMetricsPath
+	}
+	this.Use(this.metricsMiddleware)
+	this.GET(path, func(ctx echo.Context) error {
+		buf := &bytes.Buffer{}
+		DefaultMetrics.WriteTo(buf)
+		return ctx.Blob(http.StatusOK, contentTypeMetrics, buf.Bytes())
+	})
+}
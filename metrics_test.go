@@ -0,0 +1,77 @@
+package bootx
+
+import (
+	"bytes"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	reg := NewMetricsRegistry()
+	counter := NewCounterVec("test_events_total", "Events.\nBy kind.", "kind")
+	histogram := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	gauge := NewGaugeFunc("test_pool_size", "Pool size.", func() []GaugeSample {
+		return []GaugeSample{{LabelValues: []string{"main"}, Value: 3}}
+	}, "pool")
+	empty := NewGaugeFunc("test_absent", "Absent.", func() []GaugeSample { return nil })
+	reg.Register(counter, histogram, gauge, empty)
+
+	counter.Inc(`b"q`)
+	counter.Add(2, "a")
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	buf := &bytes.Buffer{}
+	reg.WriteTo(buf)
+	expect := `# HELP test_events_total Events.\nBy kind.
+# TYPE test_events_total counter
+test_events_total{kind="a"} 2
+test_events_total{kind="b\"q"} 1
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+# HELP test_pool_size Pool size.
+# TYPE test_pool_size gauge
+test_pool_size{pool="main"} 3
+`
+	if got := buf.String(); got != expect {
+		t.Errorf("unexpected exposition:\n%s\nexpect:\n%s", got, expect)
+	}
+}
+
+func TestEnableMetrics(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	web.EnableMetrics("")
+	web.GET("/ping", func(ctx echo.Context) error {
+		return ctx.String(http.StatusOK, "pong")
+	})
+	before := httpRequestsTotal.Value("/ping", http.MethodGet, "200")
+	for i := 0; i < 2; i++ {
+		web.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+	}
+	if n := httpRequestsTotal.Value("/ping", http.MethodGet, "200") - before; n != 2 {
+		t.Errorf("expect 2 requests counted, got %v", n)
+	}
+	rec := httptest.NewRecorder()
+	web.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, DefaultMetricsPath, nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected scrape response %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`bootx_http_requests_total{func="/ping",method="GET",status="200"}`,
+		`bootx_http_request_duration_seconds_count{func="/ping",method="GET",status="200"}`,
+		"# TYPE bootx_mqtt_publish_total counter",
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("scrape missing '%s'", line)
+		}
+	}
+}
@@ -11,3 +11,9 @@ type (
 func DefaultSkipper(bootx.Context) bool {
 	return false
 }
+
+//NoAuthRouteSkipper skip routes registered by WebX.Handle without bootx.WithAuth(true)
+func NoAuthRouteSkipper(ctx bootx.Context) bool {
+	r := ctx.Route()
+	return r != nil && !r.Auth
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gen-iot/bootx"
+	"runtime"
+	"time"
+)
+
+type (
+	MqttSkipper func(ctx bootx.MqttContext) bool
+
+	MqttDumpConfig struct {
+		Skipper MqttSkipper
+		Handler MqttDumpHandler
+	}
+	MqttDumpHandler func(ctx bootx.MqttContext, in interface{}, out interface{}, latency int64)
+
+	MqttRecoverConfig struct {
+		Skipper MqttSkipper
+		//size of the stack to be printed, default 4KB
+		StackSize int
+		//print stack of all goroutines
+		StackAll          bool
+		DisablePrintStack bool
+	}
+)
+
+func DefaultMqttSkipper(bootx.MqttContext) bool {
+	return false
+}
+
+var (
+	DefaultMqttDumpConfig = MqttDumpConfig{
+		Skipper: DefaultMqttSkipper,
+	}
+	DefaultMqttRecoverConfig = MqttRecoverConfig{
+		Skipper:   DefaultMqttSkipper,
+		StackSize: 4 << 10,
+	}
+)
+
+func DefaultMqttDumpHandler(ctx bootx.MqttContext, in interface{}, out interface{}, latency int64) {
+	buf := bytes.Buffer{}
+	msg := ctx.Message()
+	buf.WriteString(fmt.Sprintf("\n< %s >    %s qos=%d retained=%v   latency : %d ms\n",
+		ctx.FuncName(), msg.Topic, msg.Qos, msg.Retained, latency))
+	buf.WriteString("in :\n")
+	if in != nil {
+		bt, err := json.MarshalIndent(in, "", "  ")
+		if err == nil {
+			buf.Write(bt)
+			buf.WriteString("\n")
+		}
+	}
+	buf.WriteString("out :\n")
+	if out != nil {
+		bt, err := json.MarshalIndent(out, "", "  ")
+		if err == nil {
+			buf.Write(bt)
+			buf.WriteString("\n")
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		buf.WriteString(fmt.Sprintf("err : %v\n", err))
+	}
+	ctx.Log().Info(buf.String())
+}
+
+func MqttDump() bootx.MqttMiddlewareFunc {
+	return MqttDumpWithConfig(DefaultMqttDumpConfig)
+}
+
+func MqttDumpWithConfig(config MqttDumpConfig) bootx.MqttMiddlewareFunc {
+	if config.Handler == nil {
+		config.Handler = DefaultMqttDumpHandler
+	}
+	if config.Skipper == nil {
+		config.Skipper = DefaultMqttDumpConfig.Skipper
+	}
+	return func(next bootx.MqttCtxHandlerFunc) bootx.MqttCtxHandlerFunc {
+		return func(ctx bootx.MqttContext) {
+			if config.Skipper(ctx) {
+				next(ctx)
+				return
+			}
+			start := time.Now()
+			next(ctx)
+			config.Handler(ctx, ctx.Req(), ctx.Resp(), time.Since(start).Milliseconds())
+		}
+	}
+}
+
+//MqttRecover recover panic of handler & set it as ctx error
+func MqttRecover() bootx.MqttMiddlewareFunc {
+	return MqttRecoverWithConfig(DefaultMqttRecoverConfig)
+}
+
+func MqttRecoverWithConfig(config MqttRecoverConfig) bootx.MqttMiddlewareFunc {
+	if config.Skipper == nil {
+		config.Skipper = DefaultMqttRecoverConfig.Skipper
+	}
+	if config.StackSize <= 0 {
+		config.StackSize = DefaultMqttRecoverConfig.StackSize
+	}
+	return func(next bootx.MqttCtxHandlerFunc) bootx.MqttCtxHandlerFunc {
+		return func(ctx bootx.MqttContext) {
+			if config.Skipper(ctx) {
+				next(ctx)
+				return
+			}
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				err, ok := r.(error)
+				if !ok {
+					err = fmt.Errorf("%v", r)
+				}
+				if !config.DisablePrintStack {
+					stack := make([]byte, config.StackSize)
+					length := runtime.Stack(stack, config.StackAll)
+					ctx.Log().Error("[PANIC RECOVER]", "err", err, "stack", string(stack[:length]))
+				}
+				ctx.SetError(bootx.ErrInternal.Wrap(err))
+			}()
+			next(ctx)
+		}
+	}
+}
+
+var mqttHandleDuration = bootx.NewHistogramVec("bootx_mqtt_handle_duration_seconds",
+	"Mqtt message handle latency in seconds.", bootx.DefaultHistogramBuckets, "func", "result")
+
+func init() {
+	bootx.DefaultMetrics.Register(mqttHandleDuration)
+}
+
+//MqttMetrics record handle latency & result(success/failure) by func name
+func MqttMetrics() bootx.MqttMiddlewareFunc {
+	return func(next bootx.MqttCtxHandlerFunc) bootx.MqttCtxHandlerFunc {
+		return func(ctx bootx.MqttContext) {
+			start := time.Now()
+			next(ctx)
+			result := "success"
+			if ctx.Err() != nil {
+				result = "failure"
+			}
+			mqttHandleDuration.Observe(time.Since(start).Seconds(), ctx.FuncName(), result)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"github.com/gen-iot/bootx"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type (
+	TxConfig struct {
+		Skipper Skipper
+		//name of database, empty for the default one
+		DBName string
+		//http methods run in tx, others are skipped. default POST PUT PATCH DELETE
+		Methods []string
+		//retry is disabled by default, handler may have written response
+		Options []bootx.TxOption
+	}
+)
+
+var (
+	DefaultTxConfig = TxConfig{
+		Skipper: DefaultSkipper,
+		Methods: []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+	}
+)
+
+//Tx run handler in tx of the default database, tx is carried by ctx.Ctx(), use DataBase.Conn(ctx.Ctx())
+func Tx() bootx.MiddlewareFunc {
+	return TxWithConfig(DefaultTxConfig)
+}
+
+//TxWithConfig commit if ctx.Err() is nil after handler, otherwise rollback, also rollback when panic
+func TxWithConfig(config TxConfig) bootx.MiddlewareFunc {
+	if config.Skipper == nil {
+		config.Skipper = DefaultTxConfig.Skipper
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = DefaultTxConfig.Methods
+	}
+	methods := make(map[string]bool, len(config.Methods))
+	for _, m := range config.Methods {
+		methods[strings.ToUpper(m)] = true
+	}
+	opts := append([]bootx.TxOption{bootx.TxRetry(0)}, config.Options...)
+	resolve := txDBResolver(config.DBName)
+	return func(next bootx.HandlerFunc) bootx.HandlerFunc {
+		return func(ctx bootx.Context) {
+			if config.Skipper(ctx) || !methods[ctx.Request().Method] {
+				next(ctx)
+				return
+			}
+			db, err := resolve()
+			if err != nil {
+				ctx.SetError(bootx.ErrInternal.Wrap(err))
+				return
+			}
+			err = db.TxWeb(ctx, func(ctx bootx.Context) error {
+				next(ctx)
+				return ctx.Err()
+			}, opts...)
+			//begin or commit failed
+			if err != nil && ctx.Err() == nil {
+				ctx.Log().Error("tx of handler failed", "err", err)
+				ctx.SetError(bootx.ErrInternal.Wrap(err))
+			}
+		}
+	}
+}
+
+//database is resolved by first request, middleware may be built before databases inited.
+//failure is not kept, so it is resolved again by next request
+func txDBResolver(name string) func() (*bootx.DataBase, error) {
+	lock := &sync.Mutex{}
+	var db *bootx.DataBase
+	return func() (*bootx.DataBase, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if db != nil {
+			return db, nil
+		}
+		var err error
+		if len(name) > 0 {
+			db, err = bootx.DB2(name)
+		} else {
+			db, err = bootx.DefaultDB()
+		}
+		return db, err
+	}
+}
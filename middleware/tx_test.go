@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"github.com/gen-iot/bootx"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+type txTestDevice struct {
+	Name string `gorm:"primary_key"`
+}
+
+func TestTxWithConfig(t *testing.T) {
+	conf := bootx.DBDefaultConfig
+	conf.Name = "middleware-tx"
+	conf.DatabaseType = "sqlite3"
+	conf.ConnStr = filepath.Join(t.TempDir(), "tx.db")
+	db, err := bootx.OpenDB(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = bootx.AddDB(db); err != nil {
+		t.Fatal(err)
+	}
+	defer bootx.RemoveDB(conf.Name)
+	if err = db.AutoMigrate(&txTestDevice{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	web := bootx.NewWebWithConf(bootx.WebDefaultConfig)
+	api := web.NewGroup("", bootx.WithMiddleware(TxWithConfig(TxConfig{DBName: conf.Name})))
+	inTx := false
+	api.Post("/devices/:name", func(ctx bootx.Context) error {
+		name := ctx.Param("name")
+		if err := db.Conn(ctx.Ctx()).Create(&txTestDevice{Name: name}).Error; err != nil {
+			return err
+		}
+		if name == "bad" {
+			return bootx.ErrBadRequest.New()
+		}
+		return nil
+	})
+	api.Get("/devices", func(ctx bootx.Context) error {
+		inTx = bootx.TxFromContext(ctx.Ctx()) != nil
+		return nil
+	})
+
+	for _, c := range []struct {
+		method string
+		target string
+		code   int
+	}{
+		{http.MethodPost, "/devices/ok", http.StatusOK},
+		{http.MethodPost, "/devices/bad", http.StatusBadRequest},
+		{http.MethodGet, "/devices", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		web.ServeHTTP(rec, httptest.NewRequest(c.method, c.target, nil))
+		if rec.Code != c.code {
+			t.Errorf("%s %s expect %d, got %d %s", c.method, c.target, c.code, rec.Code, rec.Body.String())
+		}
+	}
+	if inTx {
+		t.Error("expect GET skipped")
+	}
+	names := make([]string, 0)
+	if err = db.Model(&txTestDevice{}).Pluck("name", &names).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "ok" {
+		t.Errorf("expect only committed device, got %v", names)
+	}
+}
+
+func TestTxUnknownDB(t *testing.T) {
+	web := bootx.NewWebWithConf(bootx.WebDefaultConfig)
+	called := false
+	web.Post("/", func(ctx bootx.Context) error {
+		called = true
+		return nil
+	}, bootx.WithMiddleware(TxWithConfig(TxConfig{DBName: "not-exist"})))
+	rec := httptest.NewRecorder()
+	web.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if called || rec.Code != http.StatusInternalServerError {
+		t.Errorf("expect 500 without calling handler, got %d %v", rec.Code, called)
+	}
+}
@@ -2,12 +2,13 @@ package middleware
 
 import (
 	"github.com/gen-iot/bootx"
-	"github.com/gen-iot/std"
+	"github.com/pkg/errors"
 )
 
 type (
 	ValidateConfig struct {
-		Skipper   Skipper
+		Skipper Skipper
+		//nil means ctx.Validate, message language from Accept-Language
 		Validator Validator
 	}
 	Validator interface {
@@ -18,7 +19,7 @@ type (
 var (
 	// DefaultBodyDumpConfig is the default BodyDump middleware config.
 	DefaultValidateConfig = ValidateConfig{
-		Validator: std.NewValidator(std.LANG_ZH),
+		Validator: nil,
 		Skipper:   DefaultSkipper,
 	}
 )
@@ -30,8 +31,8 @@ func Validate(validator Validator) bootx.MiddlewareFunc {
 }
 
 func ValidateWithConfig(config ValidateConfig) bootx.MiddlewareFunc {
-	if config.Validator == nil {
-		panic("bootx: validate middleware requires a validator")
+	if config.Skipper == nil {
+		config.Skipper = DefaultValidateConfig.Skipper
 	}
 	return func(next bootx.HandlerFunc) bootx.HandlerFunc {
 		return func(ctx bootx.Context) {
@@ -40,8 +41,17 @@ func ValidateWithConfig(config ValidateConfig) bootx.MiddlewareFunc {
 				return
 			}
 			if ctx.Req() != nil {
-				err := config.Validator.Validate(ctx.Req())
+				var err error
+				if config.Validator == nil {
+					err = ctx.Validate(ctx.Req())
+				} else {
+					err = config.Validator.Validate(ctx.Req())
+				}
 				if err != nil {
+					//validation failed is always 400
+					if !errors.Is(err, bootx.ErrValidation) {
+						err = bootx.ErrValidation.Wrap(err).WithDetails(&bootx.ErrorDetail{Message: err.Error()})
+					}
 					ctx.SetError(err)
 				}
 			}
@@ -0,0 +1,541 @@
+package bootx
+
+import (
+	"context"
+	"fmt"
+	"github.com/gen-iot/std"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MigrationTable     = "schema_migrations"
+	MigrationLockTable = "schema_migrations_lock"
+	//wait for lock held by other instance
+	DefaultMigrationLockTimeout = 5 * time.Minute
+	//lock of crashed instance is taken over after ttl
+	DefaultMigrationLockTTL = 30 * time.Minute
+)
+
+var ErrMigrationLockTimeout = errors.New("acquire migration lock timeout")
+
+//ErrMigrationLockLost lock taken over by other instance while migrating, the running migration is cancelled
+var ErrMigrationLockLost = errors.New("migration lock lost")
+
+//MigrateFunc run in transaction, note ddl of mysql is committed implicitly
+type MigrateFunc func(tx *gorm.DB) error
+
+type Migration struct {
+	//unique & > 0, applied in ascending order
+	Version int64
+	Name    string
+	Up      MigrateFunc
+	//nil if irreversible
+	Down MigrateFunc
+}
+
+//SchemaMigration record of applied migration
+type SchemaMigration struct {
+	Version   int64     `gorm:"primary_key;auto_increment:false"`
+	Name      string    `gorm:"size:255"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (SchemaMigration) TableName() string {
+	return MigrationTable
+}
+
+type schemaMigrationLock struct {
+	Id       int       `gorm:"primary_key;auto_increment:false"`
+	Owner    string    `gorm:"size:64;not null"`
+	LockedAt time.Time `gorm:"not null"`
+}
+
+func (schemaMigrationLock) TableName() string {
+	return MigrationLockTable
+}
+
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt *time.Time
+	//applied but not registered, can not be rolled back
+	Missing bool
+}
+
+var migrationRegistry = make(map[string][]*Migration)
+var migrationLock = sync.Mutex{}
+
+//RegisterMigrations add migrations of database, empty dbName for the default database
+func RegisterMigrations(dbName string, migrations ...*Migration) {
+	migrationLock.Lock()
+	defer migrationLock.Unlock()
+	migrationRegistry[dbName] = append(migrationRegistry[dbName], migrations...)
+}
+
+//e.g. 20200301120000_create_user.up.sql, 20200301120000_create_user.down.sql
+var sqlMigrationFileRe = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+//RegisterSQLMigrations add sql files in dir of fs, fs may be http.Dir or packed assets.
+//each file is executed as one statement, mysql requires multiStatements=true in connStr for multiple statements
+func RegisterSQLMigrations(dbName string, fs http.FileSystem, dir string) error {
+	migrations, err := LoadSQLMigrations(fs, dir)
+	if err != nil {
+		return err
+	}
+	RegisterMigrations(dbName, migrations...)
+	return nil
+}
+
+func LoadSQLMigrations(fs http.FileSystem, dir string) ([]*Migration, error) {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "open migration dir failed")
+	}
+	defer std.CloseIgnoreErr(d)
+	infos, err := d.Readdir(-1)
+	if err != nil {
+		return nil, errors.Wrap(err, "read migration dir failed")
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		match := sqlMigrationFileRe.FindStringSubmatch(info.Name())
+		if match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version of '%s'", info.Name())
+		}
+		content, err := readFile(fs, path.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has different names '%s' & '%s'", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = execSQL(content)
+		} else {
+			m.Down = execSQL(content)
+		}
+	}
+	out := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == nil {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Version < out[j].Version
+	})
+	return out, nil
+}
+
+func readFile(fs http.FileSystem, name string) (string, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer std.CloseIgnoreErr(f)
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func execSQL(sql string) MigrateFunc {
+	return func(tx *gorm.DB) error {
+		return tx.Exec(sql).Error
+	}
+}
+
+//Migrator apply migrations to a database, record them in table schema_migrations
+type Migrator struct {
+	db          *DataBase
+	migrations  []*Migration
+	owner       string
+	LockTimeout time.Duration
+	LockTTL     time.Duration
+}
+
+//NewMigrator with migrations registered for the database, and those for default database if it is
+func NewMigrator(db *DataBase, migrations ...*Migration) (*Migrator, error) {
+	migrationLock.Lock()
+	all := append([]*Migration{}, migrationRegistry[db.Name()]...)
+	dbRwLock.RLock()
+	isDefault := defaultDb == db
+	dbRwLock.RUnlock()
+	if isDefault && len(db.Name()) > 0 {
+		all = append(all, migrationRegistry[""]...)
+	}
+	migrationLock.Unlock()
+	all = append(all, migrations...)
+	versions := make(map[int64]bool, len(all))
+	for _, m := range all {
+		if m == nil || m.Version <= 0 || m.Up == nil {
+			return nil, fmt.Errorf("invalid migration %+v, version must > 0 & up required", m)
+		}
+		if versions[m.Version] {
+			return nil, fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+		versions[m.Version] = true
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Version < all[j].Version
+	})
+	for _, table := range []interface{}{&SchemaMigration{}, &schemaMigrationLock{}} {
+		if err := createMigrationTable(db, table); err != nil {
+			return nil, errors.Wrap(err, "create migration tables failed")
+		}
+	}
+	return &Migrator{
+		db:          db,
+		migrations:  all,
+		owner:       std.GenRandomUUID(),
+		LockTimeout: DefaultMigrationLockTimeout,
+		LockTTL:     DefaultMigrationLockTTL,
+	}, nil
+}
+
+//replicas may create the table concurrently, "already exists" of the loser is tolerated by migrating again
+func createMigrationTable(db *DataBase, table interface{}) error {
+	err := db.AutoMigrate(table).Error
+	if err != nil && db.HasTable(table) {
+		err = db.AutoMigrate(table).Error
+	}
+	return err
+}
+
+func (this *Migrator) log() Logger {
+	return moduleLog(ModuleDatabase).With("db", this.db.Name())
+}
+
+func (this *Migrator) applied() (map[int64]*SchemaMigration, error) {
+	records := make([]*SchemaMigration, 0)
+	if err := this.db.DB.Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	out := make(map[int64]*SchemaMigration, len(records))
+	for _, r := range records {
+		out[r.Version] = r
+	}
+	return out, nil
+}
+
+//Version the latest applied version, 0 if none
+func (this *Migrator) Version() (int64, error) {
+	applied, err := this.applied()
+	if err != nil {
+		return 0, err
+	}
+	version := int64(0)
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+//Status of registered & applied migrations in ascending order of version
+func (this *Migrator) Status() ([]*MigrationStatus, error) {
+	applied, err := this.applied()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*MigrationStatus, 0, len(this.migrations))
+	for _, m := range this.migrations {
+		s := &MigrationStatus{Version: m.Version, Name: m.Name}
+		if r, ok := applied[m.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = &r.AppliedAt
+			delete(applied, m.Version)
+		}
+		out = append(out, s)
+	}
+	for _, r := range applied {
+		appliedAt := r.AppliedAt
+		out = append(out, &MigrationStatus{Version: r.Version, Name: r.Name, Applied: true, AppliedAt: &appliedAt, Missing: true})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Version < out[j].Version
+	})
+	return out, nil
+}
+
+//Up apply all pending migrations, return count of applied
+func (this *Migrator) Up() (int, error) {
+	return this.to(-1)
+}
+
+//Down rollback the latest applied migration
+func (this *Migrator) Down() error {
+	return this.withLock(func(ctx context.Context) error {
+		applied, err := this.applied()
+		if err != nil {
+			return err
+		}
+		for i := len(this.migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[this.migrations[i].Version]; ok {
+				return this.rollback(ctx, this.migrations[i])
+			}
+		}
+		this.log().Info("no migration to rollback")
+		return nil
+	})
+}
+
+//To migrate up or down to version, 0 rollback all
+func (this *Migrator) To(version int64) error {
+	if version < 0 {
+		return fmt.Errorf("invalid migration version %d", version)
+	}
+	_, err := this.to(version)
+	return err
+}
+
+//version < 0 means latest
+func (this *Migrator) to(version int64) (int, error) {
+	count := 0
+	err := this.withLock(func(ctx context.Context) error {
+		applied, err := this.applied()
+		if err != nil {
+			return err
+		}
+		if version >= 0 {
+			for i := len(this.migrations) - 1; i >= 0; i-- {
+				m := this.migrations[i]
+				if _, ok := applied[m.Version]; !ok || m.Version <= version {
+					continue
+				}
+				if err = this.rollback(ctx, m); err != nil {
+					return err
+				}
+				count++
+			}
+		}
+		for _, m := range this.migrations {
+			if _, ok := applied[m.Version]; ok || (version >= 0 && m.Version > version) {
+				continue
+			}
+			if err = this.apply(ctx, m); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+//tx is rolled back when ctx cancelled by lock lost
+func (this *Migrator) apply(ctx context.Context, m *Migration) error {
+	start := time.Now()
+	err := this.db.TxCtx(ctx, func(ctx context.Context) error {
+		tx := this.db.Conn(ctx)
+		if err := m.Up(tx); err != nil {
+			return err
+		}
+		return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+	}, TxRetry(0))
+	if err != nil {
+		return errors.Wrapf(err, "apply migration %d_%s failed", m.Version, m.Name)
+	}
+	this.log().Info("migration applied", "version", m.Version, "name", m.Name,
+		"cost", time.Since(start).Milliseconds())
+	return nil
+}
+
+func (this *Migrator) rollback(ctx context.Context, m *Migration) error {
+	if m.Down == nil {
+		return fmt.Errorf("migration %d_%s is irreversible", m.Version, m.Name)
+	}
+	start := time.Now()
+	err := this.db.TxCtx(ctx, func(ctx context.Context) error {
+		tx := this.db.Conn(ctx)
+		if err := m.Down(tx); err != nil {
+			return err
+		}
+		return tx.Where("version = ?", m.Version).Delete(&SchemaMigration{}).Error
+	}, TxRetry(0))
+	if err != nil {
+		return errors.Wrapf(err, "rollback migration %d_%s failed", m.Version, m.Name)
+	}
+	this.log().Info("migration rolled back", "version", m.Version, "name", m.Name,
+		"cost", time.Since(start).Milliseconds())
+	return nil
+}
+
+//withLock hold the lock row while fn running, so replicas never migrate concurrently.
+//ctx of fn is cancelled if the lock lost, ErrMigrationLockLost is returned then
+func (this *Migrator) withLock(fn func(ctx context.Context) error) error {
+	if err := this.lock(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	lost := int32(0)
+	stop := make(chan struct{})
+	go this.heartbeat(stop, func() {
+		atomic.StoreInt32(&lost, 1)
+		cancel()
+	})
+	defer func() {
+		close(stop)
+		cancel()
+		err := this.db.DB.Where("id = 1 AND owner = ?", this.owner).Delete(&schemaMigrationLock{}).Error
+		if err != nil {
+			this.log().Error("release migration lock failed", "err", err)
+		}
+	}()
+	err := fn(ctx)
+	if atomic.LoadInt32(&lost) == 1 {
+		if err != nil {
+			return errors.Wrap(ErrMigrationLockLost, err.Error())
+		}
+		return ErrMigrationLockLost
+	}
+	return err
+}
+
+//locked_at is always written & compared by db server time, so clock skew of instances never takes over a live lock
+func (this *Migrator) lock() error {
+	deadline := time.Now().Add(this.LockTimeout)
+	waiting := false
+	insert := fmt.Sprintf("INSERT INTO %s (id, owner, locked_at) VALUES (1, ?, CURRENT_TIMESTAMP)", MigrationLockTable)
+	for {
+		//conflict is expected while other instance holding, not logged.
+		//LogMode changes the db in place, so a clone is used
+		if this.db.DB.New().LogMode(false).Exec(insert, this.owner).Error == nil {
+			return nil
+		}
+		holder := new(schemaMigrationLock)
+		err := this.db.DB.Where("id = 1").First(holder).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return errors.Wrap(err, "query migration lock failed")
+		}
+		if err == nil {
+			now, err := this.dbNow()
+			if err != nil {
+				return errors.Wrap(err, "query db time failed")
+			}
+			if now.Sub(holder.LockedAt) > this.LockTTL {
+				this.log().Warn("take over expired migration lock", "owner", holder.Owner, "lockedAt", holder.LockedAt)
+				//not refreshed by holder since read
+				this.db.DB.Where("id = 1 AND owner = ? AND locked_at <= ?", holder.Owner, holder.LockedAt).
+					Delete(&schemaMigrationLock{})
+				continue
+			}
+		}
+		if !waiting {
+			waiting = true
+			this.log().Info("migration locked by other instance, waiting ...", "owner", holder.Owner)
+		}
+		if time.Now().After(deadline) {
+			return ErrMigrationLockTimeout
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+//dbNow CURRENT_TIMESTAMP of db server
+func (this *Migrator) dbNow() (time.Time, error) {
+	now := dbTimestamp{}
+	if err := this.db.DB.Raw("SELECT CURRENT_TIMESTAMP").Row().Scan(&now); err != nil {
+		return time.Time{}, err
+	}
+	return now.Time, nil
+}
+
+//dbTimestamp scan CURRENT_TIMESTAMP, sqlite3 returns text 'YYYY-MM-DD HH:MM:SS' in UTC
+type dbTimestamp struct {
+	time.Time
+}
+
+func (this *dbTimestamp) Scan(src interface{}) error {
+	var text string
+	switch v := src.(type) {
+	case time.Time:
+		this.Time = v
+		return nil
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	default:
+		return errors.Errorf("unsupported timestamp %T", src)
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04:05.999999999-07:00", time.RFC3339Nano} {
+		if t, err := time.ParseInLocation(layout, text, time.UTC); err == nil {
+			this.Time = t
+			return nil
+		}
+	}
+	return errors.Errorf("unsupported timestamp '%s'", text)
+}
+
+//heartbeat refresh locked_at, so long migrations are not taken over after LockTTL
+func (this *Migrator) heartbeat(stop chan struct{}, onLost func()) {
+	interval := this.LockTTL / 3
+	if interval <= 0 {
+		interval = DefaultMigrationLockTTL / 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		res := this.db.DB.Model(&schemaMigrationLock{}).Where("id = 1 AND owner = ?", this.owner).
+			Update("locked_at", gorm.Expr("CURRENT_TIMESTAMP"))
+		if res.Error != nil {
+			this.log().Warn("refresh migration lock failed", "err", res.Error)
+		} else if res.RowsAffected == 0 {
+			this.log().Error("migration lock lost, taken over by other instance, cancel migrating")
+			onLost()
+			return
+		}
+	}
+}
+
+//run pending migrations of databases with AutoMigrate when bootstrap
+func dbAutoMigrate() error {
+	for _, name := range DBNames() {
+		db, err := DB2(name)
+		if err != nil {
+			return err
+		}
+		if !db.conf.AutoMigrate {
+			continue
+		}
+		migrator, err := NewMigrator(db)
+		if err != nil {
+			return &ConfigError{Module: ModuleDatabase, Err: err}
+		}
+		if _, err = migrator.Up(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package bootx
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testMigration(version int64) *Migration {
+	table := fmt.Sprintf("t%d", version)
+	return &Migration{
+		Version: version,
+		Name:    "create_" + table,
+		Up: func(tx *gorm.DB) error {
+			return tx.Exec("CREATE TABLE " + table + " (id INTEGER PRIMARY KEY)").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Exec("DROP TABLE " + table).Error
+		},
+	}
+}
+
+func newTestMigrator(t *testing.T, migrations ...*Migration) (*DataBase, *Migrator) {
+	t.Helper()
+	db := openTestDB(t, DBConfig{})
+	m, err := NewMigrator(db, migrations...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, m
+}
+
+func TestMigrator(t *testing.T) {
+	type step struct {
+		op      string
+		version int64
+	}
+	cases := []struct {
+		name    string
+		steps   []step
+		version int64
+		tables  []bool
+	}{
+		{name: "up", steps: []step{{op: "up"}}, version: 3, tables: []bool{true, true, true}},
+		{name: "up twice", steps: []step{{op: "up"}, {op: "up"}}, version: 3, tables: []bool{true, true, true}},
+		{name: "down", steps: []step{{op: "up"}, {op: "down"}}, version: 2, tables: []bool{true, true, false}},
+		{name: "to lower", steps: []step{{op: "up"}, {op: "to", version: 1}}, version: 1, tables: []bool{true, false, false}},
+		{name: "to higher", steps: []step{{op: "to", version: 2}}, version: 2, tables: []bool{true, true, false}},
+		{name: "to zero", steps: []step{{op: "up"}, {op: "to", version: 0}}, version: 0, tables: []bool{false, false, false}},
+		{name: "down all", steps: []step{{op: "to", version: 1}, {op: "down"}, {op: "down"}}, version: 0, tables: []bool{false, false, false}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, m := newTestMigrator(t, testMigration(3), testMigration(1), testMigration(2))
+			for _, s := range c.steps {
+				var err error
+				switch s.op {
+				case "up":
+					_, err = m.Up()
+				case "down":
+					err = m.Down()
+				case "to":
+					err = m.To(s.version)
+				}
+				if err != nil {
+					t.Fatalf("%s %d failed : %v", s.op, s.version, err)
+				}
+			}
+			version, err := m.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != c.version {
+				t.Errorf("expect version %d, got %d", c.version, version)
+			}
+			for i, exist := range c.tables {
+				if has := db.HasTable(fmt.Sprintf("t%d", i+1)); has != exist {
+					t.Errorf("expect table t%d exist %v, got %v", i+1, exist, has)
+				}
+			}
+		})
+	}
+}
+
+func TestMigratorInvalid(t *testing.T) {
+	irreversible := testMigration(2)
+	irreversible.Down = nil
+	cases := []struct {
+		name       string
+		migrations []*Migration
+	}{
+		{name: "duplicate version", migrations: []*Migration{testMigration(1), testMigration(1)}},
+		{name: "zero version", migrations: []*Migration{testMigration(0)}},
+		{name: "no up", migrations: []*Migration{{Version: 1}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := openTestDB(t, DBConfig{})
+			if _, err := NewMigrator(db, c.migrations...); err == nil {
+				t.Error("expect error")
+			}
+		})
+	}
+	t.Run("irreversible", func(t *testing.T) {
+		_, m := newTestMigrator(t, testMigration(1), irreversible)
+		if _, err := m.Up(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Down(); err == nil {
+			t.Error("expect irreversible error")
+		}
+	})
+}
+
+func TestMigratorLock(t *testing.T) {
+	cases := []struct {
+		name     string
+		lockedAt time.Duration
+		expect   error
+	}{
+		{name: "held by other", lockedAt: 0, expect: ErrMigrationLockTimeout},
+		{name: "expired is taken over", lockedAt: -time.Hour},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, m := newTestMigrator(t, testMigration(1))
+			m.LockTimeout = 100 * time.Millisecond
+			m.LockTTL = time.Minute
+			held := &schemaMigrationLock{Id: 1, Owner: "other", LockedAt: time.Now().Add(c.lockedAt)}
+			if err := db.Create(held).Error; err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.Up(); err != c.expect {
+				t.Fatalf("expect %v, got %v", c.expect, err)
+			}
+			if c.expect == nil && !db.HasTable("t1") {
+				t.Error("expect migration applied")
+			}
+		})
+	}
+}
+
+func TestMigratorLockDBTime(t *testing.T) {
+	db, m := newTestMigrator(t, testMigration(1))
+	if err := m.lock(); err != nil {
+		t.Fatal(err)
+	}
+	holder := new(schemaMigrationLock)
+	if err := db.Where("id = 1").First(holder).Error; err != nil {
+		t.Fatal(err)
+	}
+	now, err := m.dbNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//locked_at written by db server, so comparable with CURRENT_TIMESTAMP
+	if age := now.Sub(holder.LockedAt); holder.Owner != m.owner || age < 0 || age > 2*time.Second {
+		t.Errorf("unexpected lock %+v, age %v", holder, age)
+	}
+	if d := time.Since(now); d < -2*time.Second || d > 2*time.Second {
+		t.Errorf("unexpected db time %v", now)
+	}
+}
+
+func TestLoadSQLMigrations(t *testing.T) {
+	dir := t.TempDir()
+	for name, sql := range map[string]string{
+		"20200301120000_create_user.up.sql":   "CREATE TABLE user (id INTEGER PRIMARY KEY)",
+		"20200301120000_create_user.down.sql": "DROP TABLE user",
+		"20200302120000_create_role.up.sql":   "CREATE TABLE role (id INTEGER PRIMARY KEY)",
+		"README.md":                           "ignored",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(sql), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrations, err := LoadSQLMigrations(http.Dir(dir), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Name != "create_user" || migrations[1].Down != nil {
+		t.Fatalf("unexpected migrations %+v", migrations)
+	}
+	db, m := newTestMigrator(t, migrations...)
+	if n, err := m.Up(); err != nil || n != 2 || !db.HasTable("user") || !db.HasTable("role") {
+		t.Fatalf("expect 2 applied, got %d %v", n, err)
+	}
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if !s.Applied || s.AppliedAt == nil || s.Missing {
+			t.Errorf("unexpected status %+v", s)
+		}
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "3_orphan.down.sql"), []byte("SELECT 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadSQLMigrations(http.Dir(dir), "/"); err == nil {
+		t.Error("expect error of migration without up file")
+	}
+}
+
+func TestMigratorLockLost(t *testing.T) {
+	db := openTestDB(t, DBConfig{})
+	slow := testMigration(1)
+	up := slow.Up
+	slow.Up = func(tx *gorm.DB) error {
+		err := db.Model(&schemaMigrationLock{}).Where("id = 1").Update("owner", "other").Error
+		if err != nil {
+			return err
+		}
+		time.Sleep(300 * time.Millisecond)
+		return up(tx)
+	}
+	m, err := NewMigrator(db, slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.LockTTL = 150 * time.Millisecond
+	if _, err = m.Up(); errors.Cause(err) != ErrMigrationLockLost {
+		t.Fatalf("expect %v, got %v", ErrMigrationLockLost, err)
+	}
+	if version, err := m.Version(); err != nil || version != 0 {
+		t.Errorf("expect version 0, got %d, err %v", version, err)
+	}
+	if db.HasTable("t1") {
+		t.Error("expect migration rolled back")
+	}
+}
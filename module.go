@@ -0,0 +1,374 @@
+package bootx
+
+import (
+	"github.com/gen-iot/std"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+//builtin module names
+const (
+	ModuleWeb      = "web"
+	ModuleDatabase = "database"
+	ModuleRedis    = "redis"
+	ModuleMqtt     = "mqtt"
+	ModuleApp      = "app"
+	//run pending migrations of databases with AutoMigrate, after Application.Bootstrap() registered them
+	ModuleMigrate = "migrate"
+)
+
+//Module is a pluggable subsystem managed by the bootx lifecycle.
+//Modules are inited & started in dependency order and stopped in reverse order.
+type Module interface {
+	Name() string
+	//names of modules which must be started before this one
+	Dependencies() []string
+	Init() error
+	Start() error
+	Stop() error
+}
+
+type moduleEntry struct {
+	Module
+	inited  bool
+	started bool
+}
+
+type moduleRegistry struct {
+	lock    *sync.Mutex
+	entries []*moduleEntry
+	index   map[string]*moduleEntry
+	started []*moduleEntry
+	//inited order, rolled back in reverse if any init failed
+	inited []*moduleEntry
+}
+
+var gModules = newModuleRegistry()
+
+func newModuleRegistry() *moduleRegistry {
+	return &moduleRegistry{
+		lock:    &sync.Mutex{},
+		entries: make([]*moduleEntry, 0),
+		index:   make(map[string]*moduleEntry),
+	}
+}
+
+//RegisterModule add module to bootx lifecycle,
+//modules registered in Application.Bootstrap() will be inited right after it.
+func RegisterModule(m Module) {
+	std.AssertError(AddModule(m), "register module failed")
+}
+
+//AddModule same as RegisterModule, but return ModuleNameDuplicate instead of panic
+func AddModule(m Module) error {
+	if m == nil || len(m.Name()) == 0 {
+		return errors.New("not a valid module")
+	}
+	gModules.lock.Lock()
+	defer gModules.lock.Unlock()
+	name := m.Name()
+	if _, ok := gModules.index[name]; ok {
+		return ModuleNameDuplicate(name)
+	}
+	e := &moduleEntry{Module: m}
+	gModules.entries = append(gModules.entries, e)
+	gModules.index[name] = e
+	return nil
+}
+
+//mark count of registered modules, modules registered after it are removed by removeSince
+func (this *moduleRegistry) mark() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.entries)
+}
+
+func (this *moduleRegistry) removeSince(mark int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if mark >= len(this.entries) {
+		return
+	}
+	for _, e := range this.entries[mark:] {
+		delete(this.index, e.Name())
+	}
+	this.entries = this.entries[:mark]
+}
+
+func GetModule(name string) (Module, bool) {
+	gModules.lock.Lock()
+	defer gModules.lock.Unlock()
+	e, ok := gModules.index[name]
+	if !ok {
+		return nil, false
+	}
+	return e.Module, true
+}
+
+func ModuleNames() []string {
+	gModules.lock.Lock()
+	defer gModules.lock.Unlock()
+	return gModules.names()
+}
+
+func (this *moduleRegistry) names() []string {
+	out := make([]string, 0, len(this.entries))
+	for _, e := range this.entries {
+		out = append(out, e.Name())
+	}
+	return out
+}
+
+//resolve dependency order, stable with registration order
+func (this *moduleRegistry) sort() ([]*moduleEntry, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(this.entries))
+	out := make([]*moduleEntry, 0, len(this.entries))
+	var visit func(e *moduleEntry, path []string) error
+	visit = func(e *moduleEntry, path []string) error {
+		name := e.Name()
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return errors.Errorf("module dependency cycle : %v -> %s", path, name)
+		}
+		state[name] = visiting
+		for _, dep := range e.Dependencies() {
+			de, ok := this.index[dep]
+			if !ok {
+				return errors.Errorf("module '%s' depends on unknown module '%s'", name, dep)
+			}
+			if err := visit(de, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		out = append(out, e)
+		return nil
+	}
+	for _, e := range this.entries {
+		if err := visit(e, nil); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+//init modules not inited yet, loop until no new module registered during Init
+func (this *moduleRegistry) initAll() error {
+	for {
+		ordered, err := this.sort()
+		if err != nil {
+			return err
+		}
+		pending := 0
+		for _, e := range ordered {
+			if e.inited {
+				continue
+			}
+			pending++
+			Log().Info("module init ...", "module", e.Name())
+			if err := e.Init(); err != nil {
+				this.rollbackInit()
+				return errors.Wrapf(err, "module '%s' init failed", e.Name())
+			}
+			e.inited = true
+			this.inited = append(this.inited, e)
+		}
+		if pending == 0 {
+			return nil
+		}
+	}
+}
+
+//stop inited but not started modules in reverse order, so connections opened by Init are closed.
+//started ones are left to stopAll
+func (this *moduleRegistry) rollbackInit() {
+	for i := len(this.inited) - 1; i >= 0; i-- {
+		e := this.inited[i]
+		e.inited = false
+		if e.started {
+			continue
+		}
+		Log().Info("module rollback ...", "module", e.Name())
+		if err := e.Stop(); err != nil {
+			Log().Error("module rollback failed", "module", e.Name(), "err", err)
+		}
+	}
+	this.inited = nil
+}
+
+//start all modules in dependency order,if any failed ,all inited ones will be stopped & inited again by next Run
+func (this *moduleRegistry) startAll() error {
+	ordered, err := this.sort()
+	if err != nil {
+		return err
+	}
+	for _, e := range ordered {
+		Log().Info("module start ...", "module", e.Name())
+		if err := e.Start(); err != nil {
+			//failed one & the later are inited but not started
+			this.rollbackInit()
+			this.stopAll()
+			return errors.Wrapf(err, "module '%s' start failed", e.Name())
+		}
+		e.started = true
+		this.started = append(this.started, e)
+	}
+	return nil
+}
+
+func (this *moduleRegistry) stopAll() {
+	for i := len(this.started) - 1; i >= 0; i-- {
+		e := this.started[i]
+		Log().Info("module stop ...", "module", e.Name())
+		if err := e.Stop(); err != nil {
+			Log().Error("module stop failed", "module", e.Name(), "err", err)
+		}
+		e.started = false
+	}
+	this.started = nil
+}
+
+//initOnce like sync.Once, but done only when fn succeeded, so a failed init can be retried
+type initOnce struct {
+	lock sync.Mutex
+	done bool
+}
+
+func (this *initOnce) Do(fn func() error) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.done {
+		return nil
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	this.done = true
+	return nil
+}
+
+func (this *initOnce) reset() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.done = false
+}
+
+//ModuleFuncs build a Module from funcs, nil func means nothing to do
+type ModuleFuncs struct {
+	ModuleName string
+	DependsOn  []string
+	OnInit     func() error
+	OnStart    func() error
+	OnStop     func() error
+}
+
+func (this *ModuleFuncs) Name() string {
+	return this.ModuleName
+}
+
+func (this *ModuleFuncs) Dependencies() []string {
+	return this.DependsOn
+}
+
+func (this *ModuleFuncs) Init() error {
+	if this.OnInit == nil {
+		return nil
+	}
+	return this.OnInit()
+}
+
+func (this *ModuleFuncs) Start() error {
+	if this.OnStart == nil {
+		return nil
+	}
+	return this.OnStart()
+}
+
+func (this *ModuleFuncs) Stop() error {
+	if this.OnStop == nil {
+		return nil
+	}
+	return this.OnStop()
+}
+
+//web is started after & stopped before builtin modules & app,
+//so in-flight requests can still use them while shutting down
+type webModule struct {
+}
+
+func (this *webModule) Name() string {
+	return ModuleWeb
+}
+
+//only builtin modules, so user modules can depend on web
+func (this *webModule) Dependencies() []string {
+	deps := make([]string, 0)
+	for _, name := range gModules.names() {
+		switch name {
+		case ModuleDatabase, ModuleRedis, ModuleMqtt, ModuleApp, ModuleMigrate:
+			deps = append(deps, name)
+		}
+	}
+	return deps
+}
+
+func (this *webModule) Init() error {
+	//web is created while registering, so routes can be added in Application.Bootstrap()
+	return nil
+}
+
+func (this *webModule) Start() error {
+	return Web().start()
+}
+
+func (this *webModule) Stop() error {
+	Web().stop()
+	return nil
+}
+
+//app module call Application.Bootstrap() on init & Application.Shutdown() on stop
+type appModule struct {
+	app  Application
+	deps []string
+}
+
+func newAppModule(app Application) *appModule {
+	deps := make([]string, 0)
+	for _, name := range ModuleNames() {
+		if name != ModuleWeb && name != ModuleMigrate {
+			deps = append(deps, name)
+		}
+	}
+	return &appModule{app: app, deps: deps}
+}
+
+func (this *appModule) Name() string {
+	return ModuleApp
+}
+
+func (this *appModule) Dependencies() []string {
+	return this.deps
+}
+
+func (this *appModule) Init() error {
+	this.app.Bootstrap()
+	return nil
+}
+
+func (this *appModule) Start() error {
+	return nil
+}
+
+func (this *appModule) Stop() error {
+	this.app.Shutdown()
+	return nil
+}
@@ -0,0 +1,120 @@
+package bootx
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+//testModules record lifecycle calls of modules in one registry
+type testModules struct {
+	r      *moduleRegistry
+	events []string
+}
+
+func newTestModules() *testModules {
+	return &testModules{r: newModuleRegistry()}
+}
+
+func (this *testModules) add(name string, deps ...string) *ModuleFuncs {
+	m := &ModuleFuncs{
+		ModuleName: name,
+		DependsOn:  deps,
+		OnInit:     this.record("init", name),
+		OnStart:    this.record("start", name),
+		OnStop:     this.record("stop", name),
+	}
+	e := &moduleEntry{Module: m}
+	this.r.entries = append(this.r.entries, e)
+	this.r.index[name] = e
+	return m
+}
+
+func (this *testModules) record(op, name string) func() error {
+	return func() error {
+		this.events = append(this.events, op+" "+name)
+		return nil
+	}
+}
+
+func (this *testModules) order() (string, error) {
+	ordered, err := this.r.sort()
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(ordered))
+	for _, e := range ordered {
+		names = append(names, e.Name())
+	}
+	return strings.Join(names, ","), nil
+}
+
+func TestModuleOrder(t *testing.T) {
+	ms := newTestModules()
+	ms.add("app", "database", "redis")
+	ms.add("web", "app")
+	ms.add("database")
+	ms.add("redis")
+	ms.add("cron")
+	order, err := ms.order()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//dependencies first, otherwise registration order
+	if expect := "database,redis,app,web,cron"; order != expect {
+		t.Errorf("expect order %s, got %s", expect, order)
+	}
+}
+
+func TestModuleOrderInvalid(t *testing.T) {
+	ms := newTestModules()
+	ms.add("a", "b")
+	ms.add("b", "c")
+	ms.add("c", "a")
+	if _, err := ms.order(); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expect dependency cycle error, got %v", err)
+	}
+	ms = newTestModules()
+	ms.add("a", "missing")
+	if _, err := ms.order(); err == nil || !strings.Contains(err.Error(), "unknown module 'missing'") {
+		t.Errorf("expect unknown module error, got %v", err)
+	}
+}
+
+func TestModuleLifecycle(t *testing.T) {
+	ms := newTestModules()
+	ms.add("web", "database")
+	ms.add("database")
+	if err := ms.r.initAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.r.startAll(); err != nil {
+		t.Fatal(err)
+	}
+	ms.r.stopAll()
+	expect := "init database,init web,start database,start web,stop web,stop database"
+	if got := strings.Join(ms.events, ","); got != expect {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+}
+
+func TestModuleStartFailed(t *testing.T) {
+	ms := newTestModules()
+	ms.add("database")
+	ms.add("mqtt", "database").OnStart = func() error {
+		return fmt.Errorf("broker unreachable")
+	}
+	ms.add("web", "mqtt")
+	if err := ms.r.initAll(); err != nil {
+		t.Fatal(err)
+	}
+	err := ms.r.startAll()
+	if err == nil || !strings.Contains(err.Error(), "module 'mqtt' start failed") {
+		t.Fatalf("expect mqtt start failed, got %v", err)
+	}
+	//inited ones are all stopped in reverse order, including those never started
+	expect := "init database,init mqtt,init web,start database,stop web,stop mqtt,stop database"
+	if got := strings.Join(ms.events, ","); got != expect {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+}
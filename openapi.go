@@ -0,0 +1,566 @@
+package bootx
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultOpenApiPath      = "/openapi.json"
+	openApiVersion          = "3.0.3"
+	openApiErrorSchemaName  = "BootxError"
+	openApiComponentsPrefix = "#/components/schemas/"
+	openApiAuthSchemeName   = "bearerAuth"
+)
+
+type OpenApiConfig struct {
+	Title       string
+	Version     string
+	Description string
+	//default /openapi.json
+	Path string
+	//serve swagger ui page at this path if not empty, e.g. /swagger
+	SwaggerUIPath string
+}
+
+type (
+	OpenApiSchema struct {
+		Ref                  string                    `json:"$ref,omitempty"`
+		Type                 string                    `json:"type,omitempty"`
+		Format               string                    `json:"format,omitempty"`
+		Items                *OpenApiSchema            `json:"items,omitempty"`
+		Properties           map[string]*OpenApiSchema `json:"properties,omitempty"`
+		AdditionalProperties *OpenApiSchema            `json:"additionalProperties,omitempty"`
+		Required             []string                  `json:"required,omitempty"`
+		Enum                 []interface{}             `json:"enum,omitempty"`
+		Minimum              *float64                  `json:"minimum,omitempty"`
+		Maximum              *float64                  `json:"maximum,omitempty"`
+		ExclusiveMinimum     bool                      `json:"exclusiveMinimum,omitempty"`
+		ExclusiveMaximum     bool                      `json:"exclusiveMaximum,omitempty"`
+		MinLength            *uint64                   `json:"minLength,omitempty"`
+		MaxLength            *uint64                   `json:"maxLength,omitempty"`
+		MinItems             *uint64                   `json:"minItems,omitempty"`
+		MaxItems             *uint64                   `json:"maxItems,omitempty"`
+		Nullable             bool                      `json:"nullable,omitempty"`
+	}
+	OpenApiParameter struct {
+		Name     string         `json:"name"`
+		In       string         `json:"in"`
+		Required bool           `json:"required,omitempty"`
+		Schema   *OpenApiSchema `json:"schema"`
+	}
+	OpenApiMediaType struct {
+		Schema *OpenApiSchema `json:"schema"`
+	}
+	OpenApiRequestBody struct {
+		Required bool                         `json:"required,omitempty"`
+		Content  map[string]*OpenApiMediaType `json:"content"`
+	}
+	OpenApiResponse struct {
+		Description string                       `json:"description"`
+		Content     map[string]*OpenApiMediaType `json:"content,omitempty"`
+	}
+	OpenApiOperation struct {
+		OperationId string                      `json:"operationId,omitempty"`
+		Summary     string                      `json:"summary,omitempty"`
+		Tags        []string                    `json:"tags,omitempty"`
+		Parameters  []*OpenApiParameter         `json:"parameters,omitempty"`
+		RequestBody *OpenApiRequestBody         `json:"requestBody,omitempty"`
+		Responses   map[string]*OpenApiResponse `json:"responses"`
+		Security    []map[string][]string       `json:"security,omitempty"`
+	}
+	OpenApiInfo struct {
+		Title       string `json:"title"`
+		Version     string `json:"version"`
+		Description string `json:"description,omitempty"`
+	}
+	OpenApiSecurityScheme struct {
+		Type         string `json:"type"`
+		Scheme       string `json:"scheme,omitempty"`
+		BearerFormat string `json:"bearerFormat,omitempty"`
+	}
+	OpenApiComponents struct {
+		Schemas         map[string]*OpenApiSchema         `json:"schemas,omitempty"`
+		SecuritySchemes map[string]*OpenApiSecurityScheme `json:"securitySchemes,omitempty"`
+	}
+	OpenApiDoc struct {
+		OpenApi    string                                  `json:"openapi"`
+		Info       OpenApiInfo                             `json:"info"`
+		Paths      map[string]map[string]*OpenApiOperation `json:"paths"`
+		Components OpenApiComponents                       `json:"components"`
+	}
+)
+
+var (
+	typeOfTime  = reflect.TypeOf(time.Time{})
+	typeOfBytes = reflect.TypeOf([]byte(nil))
+)
+
+type openApiBuilder struct {
+	doc   *OpenApiDoc
+	names map[reflect.Type]string
+	//operation ids must be unique in document
+	operationIds map[string]bool
+}
+
+//methods allowed in openapi path item
+var openApiMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodPut:     true,
+	http.MethodPost:    true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodHead:    true,
+	http.MethodPatch:   true,
+	http.MethodTrace:   true,
+}
+
+//OpenApi generate openapi 3 document of all routes,
+//request & response schemas are of routes registered by Handle, or echo methods of WebX with BuildHttpHandler
+func (this *WebX) OpenApi(conf OpenApiConfig) *OpenApiDoc {
+	b := &openApiBuilder{
+		doc: &OpenApiDoc{
+			OpenApi: openApiVersion,
+			Info: OpenApiInfo{
+				Title:       conf.Title,
+				Version:     conf.Version,
+				Description: conf.Description,
+			},
+			Paths: make(map[string]map[string]*OpenApiOperation),
+			Components: OpenApiComponents{
+				Schemas: map[string]*OpenApiSchema{
+					openApiErrorSchemaName: {
+						Type: "object",
+						Properties: map[string]*OpenApiSchema{
+							"code":    {Type: "integer"},
+							"message": {Type: "string"},
+							"details": {Type: "array", Items: &OpenApiSchema{
+								Type: "object",
+								Properties: map[string]*OpenApiSchema{
+									"field":   {Type: "string"},
+									"rule":    {Type: "string"},
+									"message": {Type: "string"},
+								},
+							}},
+						},
+					},
+				},
+			},
+		},
+		names:        make(map[reflect.Type]string),
+		operationIds: make(map[string]bool),
+	}
+	for _, r := range this.openApiRoutes(conf) {
+		b.addRoute(r)
+	}
+	return b.doc
+}
+
+//all echo routes including those of echo.Group, schemas are known only of handlers recorded in RouteInfos
+func (this *WebX) openApiRoutes(conf OpenApiConfig) []*RouteInfo {
+	recorded := make(map[string]*RouteInfo)
+	for _, r := range this.RouteInfos() {
+		recorded[r.Method+" "+r.Path] = r
+	}
+	routes := this.Echo.Routes()
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	out := make([]*RouteInfo, 0, len(routes))
+	for _, route := range routes {
+		//the document itself
+		if route.Method == http.MethodGet && (route.Path == conf.Path || route.Path == conf.SwaggerUIPath) {
+			continue
+		}
+		r, ok := recorded[route.Method+" "+route.Path]
+		if !ok {
+			r = &RouteInfo{Method: route.Method, Path: route.Path, FuncName: route.Name}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func (this *WebX) EnableOpenApi(conf OpenApiConfig) {
+	if len(conf.Path) == 0 {
+		conf.Path = DefaultOpenApiPath
+	}
+	this.GET(conf.Path, func(ctx echo.Context) error {
+		return ctx.JSONPretty(http.StatusOK, this.OpenApi(conf), jsonIndent)
+	})
+	if len(conf.SwaggerUIPath) > 0 {
+		page := fmt.Sprintf(swaggerUITemplate, conf.Title, conf.Path)
+		this.GET(conf.SwaggerUIPath, func(ctx echo.Context) error {
+			return ctx.HTML(http.StatusOK, page)
+		})
+	}
+}
+
+//echo path /users/:id -> /users/{id}
+func openApiPath(path string) string {
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		if strings.HasPrefix(seg, ":") {
+			segs[i] = "{" + seg[1:] + "}"
+		} else if seg == "*" {
+			segs[i] = "{*}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+func (this *openApiBuilder) addRoute(r *RouteInfo) {
+	if !openApiMethods[r.Method] {
+		return
+	}
+	path := openApiPath(r.Path)
+	item, ok := this.doc.Paths[path]
+	if !ok {
+		item = make(map[string]*OpenApiOperation)
+		this.doc.Paths[path] = item
+	}
+	op := &OpenApiOperation{
+		OperationId: r.FuncName,
+		Summary:     r.Summary,
+		Tags:        r.Tags,
+		Responses:   make(map[string]*OpenApiResponse),
+	}
+	if len(r.Name) > 0 {
+		op.OperationId = r.Name
+	}
+	op.OperationId = this.uniqueOperationId(op.OperationId, r)
+	if r.Auth {
+		if this.doc.Components.SecuritySchemes == nil {
+			this.doc.Components.SecuritySchemes = map[string]*OpenApiSecurityScheme{
+				openApiAuthSchemeName: {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			}
+		}
+		op.Security = []map[string][]string{{openApiAuthSchemeName: {}}}
+	}
+	if r.InType != nil {
+		this.addRequest(op, r)
+	}
+	ok200 := &OpenApiResponse{Description: "OK"}
+	if r.OutType != nil {
+		ok200.Content = map[string]*OpenApiMediaType{
+			echo.MIMEApplicationJSON: {Schema: this.schemaOf(r.OutType)},
+		}
+	}
+	op.Responses["200"] = ok200
+	op.Responses["default"] = &OpenApiResponse{
+		Description: "Error",
+		Content: map[string]*OpenApiMediaType{
+			echo.MIMEApplicationJSON: {Schema: &OpenApiSchema{Ref: openApiComponentsPrefix + openApiErrorSchemaName}},
+		},
+	}
+	item[strings.ToLower(r.Method)] = op
+}
+
+//same handler may serve several routes, suffix with method & path
+func (this *openApiBuilder) uniqueOperationId(id string, r *RouteInfo) string {
+	if this.operationIds[id] {
+		suffix := strings.Map(func(c rune) rune {
+			if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+				return c
+			}
+			return '_'
+		}, strings.ToLower(r.Method)+r.Path)
+		id = id + "_" + suffix
+	}
+	base := id
+	for i := 2; this.operationIds[id]; i++ {
+		id = base + strconv.Itoa(i)
+	}
+	this.operationIds[id] = true
+	return id
+}
+
+func (this *openApiBuilder) addRequest(op *OpenApiOperation, r *RouteInfo) {
+	t := r.InType
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		op.RequestBody = &OpenApiRequestBody{
+			Required: true,
+			Content: map[string]*OpenApiMediaType{
+				echo.MIMEApplicationJSON: {Schema: this.schemaOf(t)},
+			},
+		}
+		return
+	}
+	jsonBody := &OpenApiSchema{Type: "object", Properties: make(map[string]*OpenApiSchema)}
+	formBody := &OpenApiSchema{Type: "object", Properties: make(map[string]*OpenApiSchema)}
+	forEachField(t, func(f reflect.StructField) {
+		fieldSchema := this.schemaOf(f.Type)
+		required := applyValidateTag(fieldSchema, f)
+		for _, in := range []string{"path", "param", "query"} {
+			name := tagName(f, in)
+			if len(name) == 0 {
+				continue
+			}
+			paramIn := in
+			if in == "param" {
+				paramIn = "path"
+			}
+			op.Parameters = append(op.Parameters, &OpenApiParameter{
+				Name:     name,
+				In:       paramIn,
+				Required: required || paramIn == "path",
+				Schema:   fieldSchema,
+			})
+		}
+		if name := tagName(f, "form"); len(name) > 0 {
+			formBody.Properties[name] = fieldSchema
+			if required {
+				formBody.Required = append(formBody.Required, name)
+			}
+		}
+		if name := tagName(f, "json"); len(name) > 0 {
+			jsonBody.Properties[name] = fieldSchema
+			if required {
+				jsonBody.Required = append(jsonBody.Required, name)
+			}
+		}
+	})
+	content := make(map[string]*OpenApiMediaType)
+	if len(jsonBody.Properties) > 0 {
+		content[echo.MIMEApplicationJSON] = &OpenApiMediaType{Schema: jsonBody}
+	}
+	if len(formBody.Properties) > 0 {
+		content[echo.MIMEApplicationForm] = &OpenApiMediaType{Schema: formBody}
+		content[echo.MIMEMultipartForm] = &OpenApiMediaType{Schema: formBody}
+	}
+	if len(content) > 0 && r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodDelete {
+		op.RequestBody = &OpenApiRequestBody{Content: content}
+	}
+}
+
+//walk exported fields, anonymous struct fields are flattened like encoding/json
+func forEachField(t reflect.Type, fn func(f reflect.StructField)) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct && len(tagName(f, "json")) == 0 {
+				forEachField(ft, fn)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		fn(f)
+	}
+}
+
+func tagName(f reflect.StructField, tag string) string {
+	name := strings.Split(f.Tag.Get(tag), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+func (this *openApiBuilder) schemaOf(t reflect.Type) *OpenApiSchema {
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+	switch {
+	case t == typeOfTime:
+		return &OpenApiSchema{Type: "string", Format: "date-time"}
+	case t == typeOfBytes:
+		return &OpenApiSchema{Type: "string", Format: "byte"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &OpenApiSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &OpenApiSchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &OpenApiSchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &OpenApiSchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &OpenApiSchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &OpenApiSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &OpenApiSchema{Type: "array", Items: this.schemaOf(t.Elem()), Nullable: nullable}
+	case reflect.Map:
+		return &OpenApiSchema{Type: "object", AdditionalProperties: this.schemaOf(t.Elem())}
+	case reflect.Struct:
+		return &OpenApiSchema{Ref: openApiComponentsPrefix + this.structSchema(t)}
+	}
+	return &OpenApiSchema{}
+}
+
+//register struct to components, return the schema name
+func (this *openApiBuilder) structSchema(t reflect.Type) string {
+	if name, ok := this.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if len(name) == 0 {
+		name = "Anonymous"
+	}
+	base := name
+	for i := 2; ; i++ {
+		if _, exist := this.doc.Components.Schemas[name]; !exist {
+			break
+		}
+		name = base + strconv.Itoa(i)
+	}
+	s := &OpenApiSchema{Type: "object", Properties: make(map[string]*OpenApiSchema)}
+	//register before walking fields, for recursive types
+	this.names[t] = name
+	this.doc.Components.Schemas[name] = s
+	forEachField(t, func(f reflect.StructField) {
+		fieldName := tagName(f, "json")
+		if len(fieldName) == 0 {
+			if f.Tag.Get("json") == "-" {
+				return
+			}
+			fieldName = f.Name
+		}
+		fs := this.schemaOf(f.Type)
+		if applyValidateTag(fs, f) {
+			s.Required = append(s.Required, fieldName)
+		}
+		s.Properties[fieldName] = fs
+	})
+	return name
+}
+
+//map validator tags to schema constraints, return true if field is required
+func applyValidateTag(s *OpenApiSchema, f reflect.StructField) (required bool) {
+	tag := f.Tag.Get("validate")
+	if len(tag) == 0 || len(s.Ref) > 0 {
+		for _, rule := range strings.Split(tag, ",") {
+			if rule == "required" {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rule := range strings.Split(tag, ",") {
+		kv := strings.SplitN(rule, "=", 2)
+		key := kv[0]
+		val := ""
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+		switch key {
+		case "required":
+			required = true
+		case "min", "gte":
+			setBound(s, val, true, false)
+		case "max", "lte":
+			setBound(s, val, false, false)
+		case "gt":
+			setBound(s, val, true, true)
+		case "lt":
+			setBound(s, val, false, true)
+		case "len":
+			setBound(s, val, true, false)
+			setBound(s, val, false, false)
+		case "oneof":
+			for _, e := range strings.Fields(val) {
+				if s.Type == "integer" || s.Type == "number" {
+					if n, err := strconv.ParseFloat(e, 64); err == nil {
+						s.Enum = append(s.Enum, n)
+						continue
+					}
+				}
+				s.Enum = append(s.Enum, e)
+			}
+		case "email":
+			s.Format = "email"
+		case "url", "uri":
+			s.Format = "uri"
+		case "uuid", "uuid4":
+			s.Format = "uuid"
+		case "ip", "ipv4":
+			s.Format = "ipv4"
+		case "ipv6":
+			s.Format = "ipv6"
+		case "datetime":
+			s.Format = "date-time"
+		}
+	}
+	return
+}
+
+func setBound(s *OpenApiSchema, val string, lower bool, exclusive bool) {
+	n, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return
+	}
+	switch s.Type {
+	case "integer", "number":
+		if lower {
+			s.Minimum, s.ExclusiveMinimum = &n, exclusive
+		} else {
+			s.Maximum, s.ExclusiveMaximum = &n, exclusive
+		}
+		return
+	}
+	if n < 0 {
+		return
+	}
+	u := uint64(n)
+	if exclusive {
+		if lower {
+			u++
+		} else if u > 0 {
+			u--
+		}
+	}
+	switch s.Type {
+	case "string":
+		if lower {
+			s.MinLength = &u
+		} else {
+			s.MaxLength = &u
+		}
+	case "array":
+		if lower {
+			s.MinItems = &u
+		} else {
+			s.MaxItems = &u
+		}
+	}
+}
+
+const swaggerUITemplate = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8"/>
+  <title>%s</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@3/swagger-ui.css"/>
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@3/swagger-ui-bundle.js"></script>
+<script>
+  window.onload = function () {
+    SwaggerUIBundle({url: "%s", dom_id: "#swagger-ui"});
+  };
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,145 @@
+package bootx
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type openApiTestAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type openApiTestUser struct {
+	Id       int64               `json:"id"`
+	Name     string              `json:"name" validate:"required,min=2,max=32"`
+	Email    string              `json:"email,omitempty" validate:"omitempty,email"`
+	Role     string              `json:"role" validate:"oneof=admin guest"`
+	Tags     []string            `json:"tags" validate:"max=5"`
+	Address  *openApiTestAddress `json:"address"`
+	Friends  []*openApiTestUser  `json:"friends"`
+	Created  time.Time           `json:"created"`
+	internal string
+}
+
+type openApiTestQuery struct {
+	Id    int64 `param:"id"`
+	Limit int   `query:"limit" validate:"gt=0,lte=100"`
+}
+
+func openApiTestGetUser(ctx Context, req *openApiTestQuery) (*openApiTestUser, error) {
+	return nil, nil
+}
+
+func openApiTestCreateUser(req *openApiTestUser) error {
+	return nil
+}
+
+func TestOpenApi(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	web.Handle(http.MethodGet, "/users/:id", openApiTestGetUser)
+	web.Handle(http.MethodPost, "/users", openApiTestCreateUser)
+	doc := web.OpenApi(OpenApiConfig{Title: "test", Version: "1.0"})
+
+	get := doc.Paths["/users/{id}"]["get"]
+	if get == nil || get.OperationId != "bootx.openApiTestGetUser" {
+		t.Fatalf("get operation not documented: %+v", doc.Paths)
+	}
+	params := make(map[string]*OpenApiParameter)
+	for _, p := range get.Parameters {
+		params[p.In+":"+p.Name] = p
+	}
+	if p := params["path:id"]; p == nil || !p.Required || p.Schema.Format != "int64" {
+		t.Errorf("unexpected path param %+v", p)
+	}
+	if p := params["query:limit"]; p == nil || p.Required || *p.Schema.Minimum != 0 || !p.Schema.ExclusiveMinimum ||
+		*p.Schema.Maximum != 100 {
+		t.Errorf("unexpected query param %+v", p)
+	}
+	if get.RequestBody != nil {
+		t.Error("expect no body of get")
+	}
+	if ref := get.Responses["200"].Content["application/json"].Schema.Ref; ref != openApiComponentsPrefix+"openApiTestUser" {
+		t.Errorf("unexpected response schema %s", ref)
+	}
+
+	post := doc.Paths["/users"]["post"]
+	if post == nil || post.RequestBody == nil || post.Responses["200"].Content != nil {
+		t.Fatalf("unexpected post operation %+v", post)
+	}
+
+	user := doc.Components.Schemas["openApiTestUser"]
+	if user == nil {
+		t.Fatal("user schema not registered")
+	}
+	if _, ok := user.Properties["internal"]; ok {
+		t.Error("unexported field documented")
+	}
+	if len(user.Required) != 1 || user.Required[0] != "name" {
+		t.Errorf("expect only name required, got %v", user.Required)
+	}
+	name := user.Properties["name"]
+	if *name.MinLength != 2 || *name.MaxLength != 32 {
+		t.Errorf("unexpected name schema %+v", name)
+	}
+	if user.Properties["email"].Format != "email" || len(user.Properties["role"].Enum) != 2 ||
+		*user.Properties["tags"].MaxItems != 5 || user.Properties["created"].Format != "date-time" {
+		t.Errorf("validate tags not mapped: %+v", user.Properties)
+	}
+	//recursive type refers itself
+	if ref := user.Properties["friends"].Items.Ref; ref != openApiComponentsPrefix+"openApiTestUser" {
+		t.Errorf("unexpected friends items %s", ref)
+	}
+	if address := doc.Components.Schemas["openApiTestAddress"]; address == nil || address.Required[0] != "city" {
+		t.Errorf("unexpected address schema %+v", address)
+	}
+}
+
+func TestEnableOpenApi(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	web.Handle(http.MethodPost, "/users", openApiTestCreateUser)
+	web.EnableOpenApi(OpenApiConfig{Title: "test", SwaggerUIPath: "/swagger"})
+	rec := httptest.NewRecorder()
+	web.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, DefaultOpenApiPath, nil))
+	doc := new(OpenApiDoc)
+	if err := json.Unmarshal(rec.Body.Bytes(), doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenApi != openApiVersion || doc.Paths["/users"]["post"] == nil {
+		t.Errorf("unexpected served doc %s", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	web.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/swagger", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expect swagger ui served, got %d", rec.Code)
+	}
+}
+
+func TestOpenApiEchoRoutes(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	web.GET("/users/:id", web.BuildHttpHandler(openApiTestGetUser))
+	web.POST("/users", web.BuildHttpHandler(openApiTestCreateUser))
+	//echo group bypasses WebX, route is documented without schemas
+	web.Group("/raw").GET("/ping", func(ctx echo.Context) error {
+		return ctx.String(http.StatusOK, "pong")
+	})
+	web.EnableOpenApi(OpenApiConfig{Title: "test"})
+	doc := web.OpenApi(OpenApiConfig{Title: "test", Path: DefaultOpenApiPath})
+
+	get := doc.Paths["/users/{id}"]["get"]
+	if get == nil || get.OperationId != "bootx.openApiTestGetUser" || len(get.Parameters) != 2 {
+		t.Errorf("built handler not documented: %+v", get)
+	}
+	if post := doc.Paths["/users"]["post"]; post == nil || post.RequestBody == nil {
+		t.Errorf("built handler not documented: %+v", post)
+	}
+	if ping := doc.Paths["/raw/ping"]["get"]; ping == nil || ping.Responses["200"].Content != nil {
+		t.Errorf("echo group route not documented: %+v", doc.Paths)
+	}
+	if _, ok := doc.Paths[DefaultOpenApiPath]; ok {
+		t.Error("expect document itself excluded")
+	}
+}
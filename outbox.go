@@ -0,0 +1,380 @@
+package bootx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gen-iot/std"
+	"github.com/pkg/errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ModuleOutbox              = "outbox"
+	DefaultOutboxBatchSize    = 100
+	DefaultOutboxPollInterval = time.Second
+	DefaultOutboxMinBackoff   = time.Second
+	DefaultOutboxMaxBackoff   = 5 * time.Minute
+	DefaultOutboxMaxAttempts  = 10
+	DefaultOutboxLease        = 30 * time.Second
+	DefaultOutboxDedupWindow  = 24 * time.Hour
+	outboxPurgeInterval       = time.Minute
+	outboxLastErrorMaxLen     = 1024
+	outboxStatusPending       = 0
+	outboxStatusSent          = 1
+)
+
+//MqttPublisher is implemented by MqttPubCli & MqttClient
+type MqttPublisher interface {
+	Publish(topic string, msg interface{}, qos Qos, retainMsg bool) error
+}
+
+//OutboxMessage is a publish waiting for delivery, also the row of table bootx_outbox & bootx_outbox_dead
+type OutboxMessage struct {
+	Id string `gorm:"primary_key;size:64" json:"id"`
+	//messages with same key are delivered once in dedup window, nil means no dedup
+	DedupKey *string `gorm:"size:191;unique_index" json:"dedupKey,omitempty"`
+	Topic    string  `gorm:"size:512;not null" json:"topic"`
+	//json of msg
+	Payload       []byte     `json:"payload"`
+	Qos           Qos        `json:"qos"`
+	Retain        bool       `json:"retain"`
+	Status        int        `gorm:"not null;default:0" json:"status"`
+	Attempts      int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index" json:"nextAttemptAt"`
+	LastError     string     `gorm:"size:1024" json:"lastError,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	SentAt        *time.Time `json:"sentAt,omitempty"`
+	DeadAt        *time.Time `json:"deadAt,omitempty"`
+}
+
+func (OutboxMessage) TableName() string {
+	return "bootx_outbox"
+}
+
+//NewOutboxMessage msg is marshaled to json like MqttPubCli.Publish
+func NewOutboxMessage(topic string, msg interface{}, qos Qos, retainMsg bool) (*OutboxMessage, error) {
+	if qos > Lv2OnlyOnce {
+		return nil, fmt.Errorf("invalid qos %d", qos)
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal msg to json failed")
+	}
+	now := time.Now()
+	return &OutboxMessage{
+		Id:            std.GenRandomUUID(),
+		Topic:         topic,
+		Payload:       payload,
+		Qos:           qos,
+		Retain:        retainMsg,
+		Status:        outboxStatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}, nil
+}
+
+//Dedup set dedup key, e.g. command id
+func (this *OutboxMessage) Dedup(key string) *OutboxMessage {
+	this.DedupKey = &key
+	return this
+}
+
+type OutboxStats struct {
+	Pending int64 `json:"pending"`
+	Dead    int64 `json:"dead"`
+}
+
+//OutboxStore persist outbox messages, must be safe for concurrent use across instances
+type OutboxStore interface {
+	//message with a dedup key seen in dedup window is skipped
+	Add(ctx context.Context, msgs ...*OutboxMessage) error
+	//claim due messages, claimed ones are invisible to others until lease expired
+	Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*OutboxMessage, error)
+	MarkSent(ctx context.Context, msg *OutboxMessage) error
+	//save Attempts, NextAttemptAt & LastError
+	MarkRetry(ctx context.Context, msg *OutboxMessage) error
+	//move to dead letter
+	MarkDead(ctx context.Context, msg *OutboxMessage) error
+	//move dead letter back to pending
+	Requeue(ctx context.Context, id string) error
+	//remove sent messages before t
+	Purge(ctx context.Context, before time.Time) error
+	Stats(ctx context.Context) (*OutboxStats, error)
+}
+
+type OutboxConfig struct {
+	//required, NewDBOutboxStore / NewRedisOutboxStore
+	Store OutboxStore
+	//nil means MqttCli() if brokers configured, otherwise MqttPub()
+	Publisher MqttPublisher
+	//default 100
+	BatchSize int
+	//default 1s
+	PollInterval time.Duration
+	//backoff of n-th retry is MinBackoff * 2^(n-1), default 1s ~ 5m
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	//moved to dead letter after it, default 10
+	MaxAttempts int
+	//claimed message is retried by others if not done in lease, default 30s
+	Lease time.Duration
+	//sent messages are kept for dedup, default 24h
+	DedupWindow time.Duration
+	//called when a message is moved to dead letter
+	OnDead func(msg *OutboxMessage)
+}
+
+var DefaultOutboxConfig = OutboxConfig{
+	BatchSize:    DefaultOutboxBatchSize,
+	PollInterval: DefaultOutboxPollInterval,
+	MinBackoff:   DefaultOutboxMinBackoff,
+	MaxBackoff:   DefaultOutboxMaxBackoff,
+	MaxAttempts:  DefaultOutboxMaxAttempts,
+	Lease:        DefaultOutboxLease,
+	DedupWindow:  DefaultOutboxDedupWindow,
+}
+
+//Outbox deliver stored publishes in background, it is a Module
+type Outbox struct {
+	conf      OutboxConfig
+	started   int32
+	wakeup    chan struct{}
+	stopOnce  *sync.Once
+	stopChan  chan struct{}
+	done      chan struct{}
+	lastPurge time.Time
+}
+
+//EnableOutbox create outbox & register it as module, started after database/redis/mqtt
+func EnableOutbox(conf OutboxConfig) (*Outbox, error) {
+	if conf.Store == nil {
+		return nil, &ConfigError{Module: ModuleOutbox, Err: fmt.Errorf("store required")}
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = DefaultOutboxConfig.BatchSize
+	}
+	if conf.PollInterval <= 0 {
+		conf.PollInterval = DefaultOutboxConfig.PollInterval
+	}
+	if conf.MinBackoff <= 0 {
+		conf.MinBackoff = DefaultOutboxConfig.MinBackoff
+	}
+	if conf.MaxBackoff < conf.MinBackoff {
+		conf.MaxBackoff = DefaultOutboxConfig.MaxBackoff
+	}
+	if conf.MaxAttempts <= 0 {
+		conf.MaxAttempts = DefaultOutboxConfig.MaxAttempts
+	}
+	if conf.Lease <= 0 {
+		conf.Lease = DefaultOutboxConfig.Lease
+	}
+	if conf.DedupWindow <= 0 {
+		conf.DedupWindow = DefaultOutboxConfig.DedupWindow
+	}
+	if rs, ok := conf.Store.(*RedisOutboxStore); ok {
+		rs.DedupWindow = conf.DedupWindow
+	}
+	this := &Outbox{
+		conf:     conf,
+		wakeup:   make(chan struct{}, 1),
+		stopOnce: &sync.Once{},
+		stopChan: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := AddModule(this); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *Outbox) Name() string {
+	return ModuleOutbox
+}
+
+//computed when sorting, so modules registered after EnableOutbox are included
+func (this *Outbox) Dependencies() []string {
+	deps := make([]string, 0)
+	for _, name := range gModules.names() {
+		switch name {
+		case ModuleDatabase, ModuleRedis, ModuleMqtt:
+			deps = append(deps, name)
+		}
+	}
+	return deps
+}
+
+func (this *Outbox) Init() error {
+	return nil
+}
+
+func (this *Outbox) Start() error {
+	if this.conf.Publisher == nil {
+		if gMqttCli != nil {
+			this.conf.Publisher = gMqttCli
+		} else if gMqttPubCli != nil {
+			this.conf.Publisher = gMqttPubCli
+		} else {
+			return &ConfigError{Module: ModuleOutbox, Err: fmt.Errorf("publisher required, mqtt not configured")}
+		}
+	}
+	if atomic.CompareAndSwapInt32(&this.started, 0, 1) {
+		go this.loop()
+	}
+	return nil
+}
+
+func (this *Outbox) Stop() error {
+	this.stopOnce.Do(func() {
+		close(this.stopChan)
+		if atomic.LoadInt32(&this.started) == 1 {
+			<-this.done
+		}
+	})
+	return nil
+}
+
+func (this *Outbox) Store() OutboxStore {
+	return this.conf.Store
+}
+
+//Publish store messages, they are delivered by dispatcher later.
+//DBOutboxStore joins the tx held by ctx of DataBase.TxCtx, or use DBOutboxStore.AddTx in DataBase.Tx
+func (this *Outbox) Publish(ctx context.Context, msgs ...*OutboxMessage) error {
+	if err := this.conf.Store.Add(ctx, msgs...); err != nil {
+		return err
+	}
+	this.Notify()
+	return nil
+}
+
+//Notify wake up dispatcher without waiting PollInterval
+func (this *Outbox) Notify() {
+	select {
+	case this.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (this *Outbox) Stats(ctx context.Context) (*OutboxStats, error) {
+	return this.conf.Store.Stats(ctx)
+}
+
+func (this *Outbox) Requeue(ctx context.Context, id string) error {
+	if err := this.conf.Store.Requeue(ctx, id); err != nil {
+		return err
+	}
+	this.Notify()
+	return nil
+}
+
+func (this *Outbox) loop() {
+	defer close(this.done)
+	ticker := time.NewTicker(this.conf.PollInterval)
+	defer ticker.Stop()
+	for {
+		//keep dispatching while batch is full
+		for this.dispatch() >= this.conf.BatchSize {
+			select {
+			case <-this.stopChan:
+				return
+			default:
+			}
+		}
+		this.purge()
+		select {
+		case <-this.stopChan:
+			return
+		case <-ticker.C:
+		case <-this.wakeup:
+		}
+	}
+}
+
+//return count of claimed messages
+func (this *Outbox) dispatch() int {
+	ctx := context.Background()
+	msgs, err := this.conf.Store.Claim(ctx, time.Now(), this.conf.Lease, this.conf.BatchSize)
+	if err != nil {
+		moduleLog(ModuleOutbox).Error("claim outbox messages failed", "err", err)
+		return 0
+	}
+	for _, msg := range msgs {
+		this.deliver(ctx, msg)
+	}
+	return len(msgs)
+}
+
+func (this *Outbox) deliver(ctx context.Context, msg *OutboxMessage) {
+	pubErr := this.conf.Publisher.Publish(msg.Topic, json.RawMessage(msg.Payload), msg.Qos, msg.Retain)
+	if pubErr == nil {
+		if err := this.conf.Store.MarkSent(ctx, msg); err != nil {
+			//delivered again after lease, at least once
+			moduleLog(ModuleOutbox).Error("mark outbox message sent failed", "id", msg.Id, "err", err)
+		}
+		mqttOutboxTotal.Inc("sent")
+		return
+	}
+	msg.Attempts++
+	msg.LastError = pubErr.Error()
+	if len(msg.LastError) > outboxLastErrorMaxLen {
+		msg.LastError = msg.LastError[:outboxLastErrorMaxLen]
+	}
+	if msg.Attempts >= this.conf.MaxAttempts {
+		now := time.Now()
+		msg.DeadAt = &now
+		if err := this.conf.Store.MarkDead(ctx, msg); err != nil {
+			//attempts saved & moved again by next delivery, not looping every lease with stale attempts
+			moduleLog(ModuleOutbox).Error("move outbox message to dead letter failed", "id", msg.Id, "err", err)
+			msg.DeadAt = nil
+			msg.NextAttemptAt = time.Now().Add(this.backoff(msg.Attempts))
+			if err = this.conf.Store.MarkRetry(ctx, msg); err != nil {
+				moduleLog(ModuleOutbox).Error("mark outbox message retry failed", "id", msg.Id, "err", err)
+			}
+			return
+		}
+		mqttOutboxTotal.Inc("dead")
+		moduleLog(ModuleOutbox).Error("outbox message dead", "id", msg.Id, "topic", msg.Topic,
+			"attempts", msg.Attempts, "err", pubErr)
+		if this.conf.OnDead != nil {
+			this.conf.OnDead(msg)
+		}
+		return
+	}
+	msg.NextAttemptAt = time.Now().Add(this.backoff(msg.Attempts))
+	if err := this.conf.Store.MarkRetry(ctx, msg); err != nil {
+		moduleLog(ModuleOutbox).Error("mark outbox message retry failed", "id", msg.Id, "err", err)
+	}
+	mqttOutboxTotal.Inc("retry")
+	moduleLog(ModuleOutbox).Warn("outbox publish failed, retry later", "id", msg.Id, "topic", msg.Topic,
+		"attempts", msg.Attempts, "next", msg.NextAttemptAt, "err", pubErr)
+}
+
+//exponential backoff with ±20% jitter, at most MaxBackoff
+func (this *Outbox) backoff(attempts int) time.Duration {
+	d := this.conf.MinBackoff
+	for i := 1; i < attempts && d < this.conf.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > this.conf.MaxBackoff {
+		d = this.conf.MaxBackoff
+	}
+	d += time.Duration(rand.Int63n(int64(d)/5*2+1)) - d/5
+	if d > this.conf.MaxBackoff {
+		d = this.conf.MaxBackoff
+	}
+	return d
+}
+
+func (this *Outbox) purge() {
+	if time.Since(this.lastPurge) < outboxPurgeInterval {
+		return
+	}
+	this.lastPurge = time.Now()
+	if err := this.conf.Store.Purge(context.Background(), time.Now().Add(-this.conf.DedupWindow)); err != nil {
+		moduleLog(ModuleOutbox).Error("purge outbox failed", "err", err)
+	}
+}
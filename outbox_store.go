@@ -0,0 +1,401 @@
+package bootx
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/go-redis/redis"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+var ErrOutboxMessageNotFound = errors.New("outbox message not found")
+
+const outboxDeadTable = "bootx_outbox_dead"
+
+//DBOutboxStore keep messages in table bootx_outbox & dead letters in bootx_outbox_dead
+type DBOutboxStore struct {
+	db *DataBase
+}
+
+//NewDBOutboxStore create store & auto migrate its tables
+func NewDBOutboxStore(db *DataBase) (*DBOutboxStore, error) {
+	if err := db.AutoMigrate(&OutboxMessage{}).Error; err != nil {
+		return nil, errors.Wrap(err, "migrate outbox table failed")
+	}
+	if err := migrateOutboxDeadTable(db); err != nil {
+		return nil, errors.Wrap(err, "migrate outbox dead letter table failed")
+	}
+	//claim is compare-and-set, replicas may lag
+	return &DBOutboxStore{db: db.ForcePrimary()}, nil
+}
+
+//outboxDeadMessage is schema of dead letter table, columns are same as OutboxMessage.
+//same dedup key may die more than once, e.g. added again after the first one died, so it is not unique
+type outboxDeadMessage struct {
+	Id            string  `gorm:"primary_key;size:64"`
+	DedupKey      *string `gorm:"size:191;index"`
+	Topic         string  `gorm:"size:512;not null"`
+	Payload       []byte
+	Qos           Qos
+	Retain        bool
+	Status        int       `gorm:"not null;default:0"`
+	Attempts      int       `gorm:"not null;default:0"`
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string    `gorm:"size:1024"`
+	CreatedAt     time.Time
+	SentAt        *time.Time
+	DeadAt        *time.Time
+}
+
+func (outboxDeadMessage) TableName() string {
+	return outboxDeadTable
+}
+
+//unique index of dedup key created by older versions is dropped
+func migrateOutboxDeadTable(db *DataBase) error {
+	if err := db.AutoMigrate(&outboxDeadMessage{}).Error; err != nil {
+		return err
+	}
+	unique := db.Dialect().BuildKeyName("uix", outboxDeadTable, "dedup_key")
+	if !db.Dialect().HasIndex(outboxDeadTable, unique) {
+		return nil
+	}
+	return db.Model(&outboxDeadMessage{}).RemoveIndex(unique).Error
+}
+
+//Add join the tx of this database in ctx, e.g. in DataBase.TxCtx, so messages are stored with business change
+func (this *DBOutboxStore) Add(ctx context.Context, msgs ...*OutboxMessage) error {
+	return this.db.TxCtx(ctx, func(ctx context.Context) error {
+		return this.AddTx(this.db.Conn(ctx), msgs...)
+	})
+}
+
+//AddTx store messages in the transaction of business change, e.g. in DataBase.Tx
+func (this *DBOutboxStore) AddTx(tx *gorm.DB, msgs ...*OutboxMessage) error {
+	for _, msg := range msgs {
+		if msg.DedupKey != nil {
+			count := 0
+			if err := tx.Model(&OutboxMessage{}).Where("dedup_key = ?", *msg.DedupKey).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			if err := this.createDedup(tx, msg); err != nil {
+				return errors.Wrap(err, "add outbox message failed")
+			}
+			continue
+		}
+		if err := tx.Create(msg).Error; err != nil {
+			return errors.Wrap(err, "add outbox message failed")
+		}
+	}
+	return nil
+}
+
+//concurrent tx may add same dedup key after count, the duplicate is already queued & skipped.
+//insert is wrapped by a savepoint, a failed statement aborts the whole tx of postgres
+func (this *DBOutboxStore) createDedup(tx *gorm.DB, msg *OutboxMessage) error {
+	if _, ok := tx.CommonDB().(*sql.Tx); !ok {
+		err := tx.Create(msg).Error
+		if isDuplicateKeyError(err) {
+			return nil
+		}
+		return err
+	}
+	const name = "bootx_outbox_dedup"
+	create, rollback, release := savepointSQL(this.db.DBType())
+	if err := tx.Exec(create + name).Error; err != nil {
+		return err
+	}
+	err := tx.Create(msg).Error
+	if isDuplicateKeyError(err) {
+		return tx.Exec(rollback + name).Error
+	}
+	if err != nil {
+		return err
+	}
+	if len(release) > 0 {
+		return tx.Exec(release + name).Error
+	}
+	return nil
+}
+
+//optimistic claim by next_attempt_at, so instances never claim a message twice in lease
+func (this *DBOutboxStore) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*OutboxMessage, error) {
+	due := make([]*OutboxMessage, 0)
+	err := this.db.Query().Where("status = ? AND next_attempt_at <= ?", outboxStatusPending, now).
+		Order("next_attempt_at").Limit(limit).Find(&due).Error
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*OutboxMessage, 0, len(due))
+	until := now.Add(lease)
+	for _, msg := range due {
+		q := this.db.Query().Model(&OutboxMessage{}).
+			Where("id = ? AND status = ? AND next_attempt_at = ?", msg.Id, outboxStatusPending, msg.NextAttemptAt).
+			Update("next_attempt_at", until)
+		if q.Error != nil {
+			return out, q.Error
+		}
+		if q.RowsAffected == 1 {
+			msg.NextAttemptAt = until
+			out = append(out, msg)
+		}
+	}
+	return out, nil
+}
+
+//sent message is kept for dedup until purged
+func (this *DBOutboxStore) MarkSent(ctx context.Context, msg *OutboxMessage) error {
+	now := time.Now()
+	return this.db.Query().Model(&OutboxMessage{}).Where("id = ?", msg.Id).
+		Updates(map[string]interface{}{"status": outboxStatusSent, "sent_at": now}).Error
+}
+
+func (this *DBOutboxStore) MarkRetry(ctx context.Context, msg *OutboxMessage) error {
+	return this.db.Query().Model(&OutboxMessage{}).Where("id = ?", msg.Id).
+		Updates(map[string]interface{}{
+			"attempts":        msg.Attempts,
+			"next_attempt_at": msg.NextAttemptAt,
+			"last_error":      msg.LastError,
+		}).Error
+}
+
+//joins the tx held by ctx, retried by TxCtx on deadlock
+func (this *DBOutboxStore) MarkDead(ctx context.Context, msg *OutboxMessage) error {
+	return this.db.TxCtx(ctx, func(ctx context.Context) error {
+		tx := this.db.Conn(ctx)
+		if err := tx.Table(outboxDeadTable).Create(msg).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", msg.Id).Delete(&OutboxMessage{}).Error
+	})
+}
+
+func (this *DBOutboxStore) Requeue(ctx context.Context, id string) error {
+	return this.db.TxCtx(ctx, func(ctx context.Context) error {
+		tx := this.db.Conn(ctx)
+		msg := new(OutboxMessage)
+		err := tx.Table(outboxDeadTable).Where("id = ?", id).First(msg).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return ErrOutboxMessageNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err = tx.Table(outboxDeadTable).Where("id = ?", id).Delete(&OutboxMessage{}).Error; err != nil {
+			return err
+		}
+		resetOutboxMessage(msg)
+		return tx.Create(msg).Error
+	})
+}
+
+func resetOutboxMessage(msg *OutboxMessage) {
+	msg.Status = outboxStatusPending
+	msg.Attempts = 0
+	msg.NextAttemptAt = time.Now()
+	msg.DeadAt = nil
+}
+
+func (this *DBOutboxStore) Purge(ctx context.Context, before time.Time) error {
+	return this.db.Query().Where("status = ? AND sent_at < ?", outboxStatusSent, before).
+		Delete(&OutboxMessage{}).Error
+}
+
+func (this *DBOutboxStore) Stats(ctx context.Context) (*OutboxStats, error) {
+	stats := new(OutboxStats)
+	err := this.db.Query().Model(&OutboxMessage{}).Where("status = ?", outboxStatusPending).Count(&stats.Pending).Error
+	if err != nil {
+		return nil, err
+	}
+	if err = this.db.Query().Table(outboxDeadTable).Count(&stats.Dead).Error; err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+const (
+	redisOutboxDueKey      = "bootx:outbox:due"
+	redisOutboxMsgKey      = "bootx:outbox:msg"
+	redisOutboxDeadKey     = "bootx:outbox:dead"
+	redisOutboxDedupPrefix = "bootx:outbox:dedup:"
+)
+
+//claim due ids & push their score to lease end
+var redisOutboxClaimScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+local out = {}
+for _, id in ipairs(ids) do
+	local m = redis.call('HGET', KEYS[2], id)
+	if m then
+		redis.call('ZADD', KEYS[1], ARGV[2], id)
+		table.insert(out, m)
+	else
+		redis.call('ZREM', KEYS[1], id)
+	end
+end
+return out
+`)
+
+//set dedup key & store message atomically, dedup key is optional.
+//returns 0 if dedup key already exists
+var redisOutboxAddScript = redis.NewScript(`
+if KEYS[3] then
+	local ok
+	if tonumber(ARGV[4]) > 0 then
+		ok = redis.call('SET', KEYS[3], ARGV[1], 'NX', 'PX', ARGV[4])
+	else
+		ok = redis.call('SET', KEYS[3], ARGV[1], 'NX')
+	end
+	if not ok then
+		return 0
+	end
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+//RedisOutboxStore keep messages json in hash, due time indexed by sorted set
+type RedisOutboxStore struct {
+	cli *redis.Client
+	//dedup key expiration, default 24h
+	DedupWindow time.Duration
+}
+
+func NewRedisOutboxStore(cli *RedisClient) *RedisOutboxStore {
+	return &RedisOutboxStore{cli: cli.Client, DedupWindow: DefaultOutboxDedupWindow}
+}
+
+func outboxScore(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
+
+func (this *RedisOutboxStore) Add(ctx context.Context, msgs ...*OutboxMessage) error {
+	cli := this.cli.WithContext(ctx)
+	for _, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		keys := []string{redisOutboxDueKey, redisOutboxMsgKey}
+		if msg.DedupKey != nil {
+			keys = append(keys, redisOutboxDedupPrefix+*msg.DedupKey)
+		}
+		err = redisOutboxAddScript.Run(cli, keys, msg.Id, data,
+			strconv.FormatFloat(outboxScore(msg.NextAttemptAt), 'f', 0, 64),
+			int64(this.DedupWindow/time.Millisecond)).Err()
+		if err != nil {
+			return errors.Wrap(err, "add outbox message failed")
+		}
+	}
+	return nil
+}
+
+func (this *RedisOutboxStore) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*OutboxMessage, error) {
+	until := now.Add(lease)
+	res, err := redisOutboxClaimScript.Run(this.cli.WithContext(ctx), []string{redisOutboxDueKey, redisOutboxMsgKey},
+		strconv.FormatFloat(outboxScore(now), 'f', 0, 64),
+		strconv.FormatFloat(outboxScore(until), 'f', 0, 64),
+		limit).Result()
+	if err != nil {
+		return nil, err
+	}
+	items, _ := res.([]interface{})
+	out := make([]*OutboxMessage, 0, len(items))
+	for _, item := range items {
+		data, _ := item.(string)
+		msg := new(OutboxMessage)
+		if err := json.Unmarshal([]byte(data), msg); err != nil {
+			return nil, err
+		}
+		msg.NextAttemptAt = until
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+//dedup is kept by key expiration, so sent message is removed
+func (this *RedisOutboxStore) MarkSent(ctx context.Context, msg *OutboxMessage) error {
+	_, err := this.cli.WithContext(ctx).TxPipelined(func(p redis.Pipeliner) error {
+		p.ZRem(redisOutboxDueKey, msg.Id)
+		p.HDel(redisOutboxMsgKey, msg.Id)
+		return nil
+	})
+	return err
+}
+
+func (this *RedisOutboxStore) MarkRetry(ctx context.Context, msg *OutboxMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = this.cli.WithContext(ctx).TxPipelined(func(p redis.Pipeliner) error {
+		p.HSet(redisOutboxMsgKey, msg.Id, data)
+		p.ZAdd(redisOutboxDueKey, redis.Z{Score: outboxScore(msg.NextAttemptAt), Member: msg.Id})
+		return nil
+	})
+	return err
+}
+
+func (this *RedisOutboxStore) MarkDead(ctx context.Context, msg *OutboxMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = this.cli.WithContext(ctx).TxPipelined(func(p redis.Pipeliner) error {
+		p.ZRem(redisOutboxDueKey, msg.Id)
+		p.HDel(redisOutboxMsgKey, msg.Id)
+		p.HSet(redisOutboxDeadKey, msg.Id, data)
+		return nil
+	})
+	return err
+}
+
+func (this *RedisOutboxStore) Requeue(ctx context.Context, id string) error {
+	cli := this.cli.WithContext(ctx)
+	data, err := cli.HGet(redisOutboxDeadKey, id).Bytes()
+	if err == redis.Nil {
+		return ErrOutboxMessageNotFound
+	}
+	if err != nil {
+		return err
+	}
+	msg := new(OutboxMessage)
+	if err = json.Unmarshal(data, msg); err != nil {
+		return err
+	}
+	resetOutboxMessage(msg)
+	if data, err = json.Marshal(msg); err != nil {
+		return err
+	}
+	_, err = cli.TxPipelined(func(p redis.Pipeliner) error {
+		p.HDel(redisOutboxDeadKey, id)
+		p.HSet(redisOutboxMsgKey, id, data)
+		p.ZAdd(redisOutboxDueKey, redis.Z{Score: outboxScore(msg.NextAttemptAt), Member: id})
+		return nil
+	})
+	return err
+}
+
+func (this *RedisOutboxStore) Purge(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+func (this *RedisOutboxStore) Stats(ctx context.Context) (*OutboxStats, error) {
+	cli := this.cli.WithContext(ctx)
+	pending, err := cli.ZCard(redisOutboxDueKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	dead, err := cli.HLen(redisOutboxDeadKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxStats{Pending: pending, Dead: dead}, nil
+}
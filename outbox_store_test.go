@@ -0,0 +1,250 @@
+package bootx
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDBOutboxStore(t *testing.T) (*DataBase, *DBOutboxStore) {
+	t.Helper()
+	db := openTestDB(t, DBConfig{MaxOpenConnCount: 4})
+	store, err := NewDBOutboxStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, store
+}
+
+func newTestOutboxMessage(t *testing.T, i int) *OutboxMessage {
+	t.Helper()
+	msg, err := NewOutboxMessage(fmt.Sprintf("device/%d/cmd", i), map[string]int{"i": i}, Lv1AtLeastOnce, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func countOutbox(t *testing.T, db *DataBase) int {
+	t.Helper()
+	count := 0
+	if err := db.Model(&OutboxMessage{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestDBOutboxStoreClaimConcurrent(t *testing.T) {
+	const total, workers = 50, 8
+	_, store := newTestDBOutboxStore(t)
+	ctx := context.Background()
+	msgs := make([]*OutboxMessage, 0, total)
+	for i := 0; i < total; i++ {
+		msgs = append(msgs, newTestOutboxMessage(t, i))
+	}
+	if err := store.Add(ctx, msgs...); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(time.Second)
+	lock := &sync.Mutex{}
+	claimed := make(map[string]int)
+	claim := func() (int, error) {
+		list, err := store.Claim(ctx, now, time.Minute, 10)
+		lock.Lock()
+		defer lock.Unlock()
+		for _, msg := range list {
+			claimed[msg.Id]++
+		}
+		return len(list), err
+	}
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				if _, err := claim(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	//messages lost every cas are left
+	for {
+		n, err := claim()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if len(claimed) != total {
+		t.Errorf("expect %d messages claimed, got %d", total, len(claimed))
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Errorf("message %s claimed %d times", id, n)
+		}
+	}
+	//leased messages are invisible until lease expired
+	if list, err := store.Claim(ctx, now.Add(time.Second), time.Minute, total); err != nil || len(list) != 0 {
+		t.Errorf("expect none claimable in lease, got %d, err %v", len(list), err)
+	}
+	if list, err := store.Claim(ctx, now.Add(2*time.Minute), time.Minute, total); err != nil || len(list) != total {
+		t.Errorf("expect %d claimable after lease, got %d, err %v", total, len(list), err)
+	}
+}
+
+func TestDBOutboxStoreDedup(t *testing.T) {
+	cases := []struct {
+		name   string
+		keys   []string
+		expect int
+	}{
+		{name: "distinct keys", keys: []string{"a", "b", "c"}, expect: 3},
+		{name: "same key in one call", keys: []string{"a", "a", "b"}, expect: 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, store := newTestDBOutboxStore(t)
+			msgs := make([]*OutboxMessage, 0, len(c.keys))
+			for i, key := range c.keys {
+				msgs = append(msgs, newTestOutboxMessage(t, i).Dedup(key))
+			}
+			if err := store.Add(context.Background(), msgs...); err != nil {
+				t.Fatal(err)
+			}
+			//added again, e.g. command retried by client
+			again := newTestOutboxMessage(t, 0).Dedup(c.keys[0])
+			if err := store.Add(context.Background(), again); err != nil {
+				t.Fatal(err)
+			}
+			if count := countOutbox(t, db); count != c.expect {
+				t.Errorf("expect %d messages, got %d", c.expect, count)
+			}
+		})
+	}
+}
+
+func TestDBOutboxStoreDedupDuplicateKey(t *testing.T) {
+	db, store := newTestDBOutboxStore(t)
+	if err := db.AutoMigrate(&txTestRow{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(context.Background(), newTestOutboxMessage(t, 0).Dedup("a")); err != nil {
+		t.Fatal(err)
+	}
+	err := db.TxCtx(context.Background(), func(ctx context.Context) error {
+		tx := db.Conn(ctx)
+		if err := tx.Create(&txTestRow{Name: "business"}).Error; err != nil {
+			return err
+		}
+		return store.createDedup(tx, newTestOutboxMessage(t, 1).Dedup("a"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := txTestNames(t, db); len(names) != 1 {
+		t.Errorf("expect business change committed, got %v", names)
+	}
+	if count := countOutbox(t, db); count != 1 {
+		t.Errorf("expect 1 message, got %d", count)
+	}
+}
+
+func TestDBOutboxStoreAddJoinTx(t *testing.T) {
+	errRollback := fmt.Errorf("rollback")
+	cases := []struct {
+		name   string
+		err    error
+		expect int
+	}{
+		{name: "committed", expect: 1},
+		{name: "rolled back", err: errRollback, expect: 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, store := newTestDBOutboxStore(t)
+			err := db.TxCtx(context.Background(), func(ctx context.Context) error {
+				if err := store.Add(ctx, newTestOutboxMessage(t, 0)); err != nil {
+					return err
+				}
+				return c.err
+			})
+			if err != c.err {
+				t.Fatalf("expect %v, got %v", c.err, err)
+			}
+			if count := countOutbox(t, db); count != c.expect {
+				t.Errorf("expect %d messages, got %d", c.expect, count)
+			}
+		})
+	}
+}
+
+func TestDBOutboxStoreDeadSameKey(t *testing.T) {
+	db := openTestDB(t, DBConfig{})
+	//dead letter table created by older versions has unique dedup key
+	if err := db.Table(outboxDeadTable).AutoMigrate(&OutboxMessage{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewDBOutboxStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	//same command added again after the first one died, dies again
+	for i := 0; i < 2; i++ {
+		msg := newTestOutboxMessage(t, i).Dedup("a")
+		if err = store.Add(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.MarkDead(ctx, msg); err != nil {
+			t.Fatalf("dead %d: %v", i, err)
+		}
+	}
+	stats, err := store.Stats(ctx)
+	if err != nil || stats.Dead != 2 || stats.Pending != 0 {
+		t.Errorf("expect 2 dead, got %+v %v", stats, err)
+	}
+	//still ok after migrated again
+	if _, err = NewDBOutboxStore(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBOutboxStoreDeadJoinTx(t *testing.T) {
+	db, store := newTestDBOutboxStore(t)
+	msg := newTestOutboxMessage(t, 0)
+	if err := store.Add(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	//dead letter & requeue are rolled back with the outer tx
+	errRollback := fmt.Errorf("rollback")
+	err := db.TxCtx(context.Background(), func(ctx context.Context) error {
+		if err := store.MarkDead(ctx, msg); err != nil {
+			return err
+		}
+		if err := store.Requeue(ctx, msg.Id); err != nil {
+			return err
+		}
+		if err := store.MarkDead(ctx, msg); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("expect %v, got %v", errRollback, err)
+	}
+	stats, err := store.Stats(context.Background())
+	if err != nil || stats.Dead != 0 || stats.Pending != 1 {
+		t.Errorf("expect message still pending, got %+v %v", stats, err)
+	}
+	if err = store.Requeue(context.Background(), msg.Id); err != ErrOutboxMessageNotFound {
+		t.Errorf("expect not found, got %v", err)
+	}
+}
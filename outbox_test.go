@@ -0,0 +1,161 @@
+package bootx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+//fakePublisher fail the first n publishes
+type fakePublisher struct {
+	fails    int
+	payloads []string
+}
+
+func (this *fakePublisher) Publish(topic string, msg interface{}, qos Qos, retainMsg bool) error {
+	if this.fails > 0 {
+		this.fails--
+		return fmt.Errorf("broker unavailable")
+	}
+	bs, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	this.payloads = append(this.payloads, topic+" "+string(bs))
+	return nil
+}
+
+func TestOutboxDeliver(t *testing.T) {
+	db, store := newTestDBOutboxStore(t)
+	pub := &fakePublisher{fails: 3}
+	dead := make([]string, 0)
+	box := &Outbox{conf: OutboxConfig{
+		Store:       store,
+		Publisher:   pub,
+		BatchSize:   10,
+		Lease:       time.Minute,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		MaxAttempts: 2,
+		OnDead: func(msg *OutboxMessage) {
+			dead = append(dead, msg.Id)
+		},
+	}}
+	msg := newTestOutboxMessage(t, 1)
+	if err := store.Add(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	//1st attempt failed, retried after backoff
+	if n := box.dispatch(); n != 1 {
+		t.Fatalf("expect 1 claimed, got %d", n)
+	}
+	stats, _ := store.Stats(context.Background())
+	if stats.Pending != 1 || stats.Dead != 0 {
+		t.Errorf("unexpected stats after retry %+v", stats)
+	}
+	time.Sleep(5 * time.Millisecond)
+	//2nd attempt failed, moved to dead letter
+	if n := box.dispatch(); n != 1 {
+		t.Fatalf("expect 1 claimed, got %d", n)
+	}
+	stats, _ = store.Stats(context.Background())
+	if stats.Pending != 0 || stats.Dead != 1 || len(dead) != 1 || dead[0] != msg.Id {
+		t.Fatalf("expect message dead, stats %+v, dead %v", stats, dead)
+	}
+	if n := box.dispatch(); n != 0 {
+		t.Errorf("dead message claimed")
+	}
+
+	if err := box.Requeue(context.Background(), msg.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := box.Requeue(context.Background(), msg.Id); err != ErrOutboxMessageNotFound {
+		t.Errorf("expect ErrOutboxMessageNotFound, got %v", err)
+	}
+	//3rd publish still fail, requeued message start attempts from 0
+	box.dispatch()
+	time.Sleep(5 * time.Millisecond)
+	box.dispatch()
+	if len(pub.payloads) != 1 || pub.payloads[0] != `device/1/cmd {"i":1}` {
+		t.Errorf("unexpected published %v", pub.payloads)
+	}
+	sent := new(OutboxMessage)
+	if err := db.Where("id = ?", msg.Id).First(sent).Error; err != nil || sent.Status != outboxStatusSent || sent.SentAt == nil {
+		t.Errorf("expect message kept as sent for dedup, got %+v %v", sent, err)
+	}
+	box.lastPurge = time.Time{}
+	box.conf.DedupWindow = -time.Second
+	box.purge()
+	if count := countOutbox(t, db); count != 0 {
+		t.Errorf("expect sent message purged, got %d", count)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	box := &Outbox{conf: OutboxConfig{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+	for attempts, base := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+		for i := 0; i < 20; i++ {
+			d := box.backoff(attempts)
+			if d < base-base/5 || d > base+base/5 || d > box.conf.MaxBackoff {
+				t.Fatalf("backoff of %d attempts out of range: %v", attempts, d)
+			}
+		}
+	}
+}
+
+//failDeadStore fail moving to dead letter
+type failDeadStore struct {
+	*DBOutboxStore
+}
+
+func (this failDeadStore) MarkDead(ctx context.Context, msg *OutboxMessage) error {
+	return fmt.Errorf("dead letter table unavailable")
+}
+
+func TestOutboxMarkDeadFailed(t *testing.T) {
+	db, store := newTestDBOutboxStore(t)
+	box := &Outbox{conf: OutboxConfig{
+		Store:       failDeadStore{store},
+		Publisher:   &fakePublisher{fails: 10},
+		BatchSize:   10,
+		Lease:       time.Minute,
+		MinBackoff:  time.Second,
+		MaxBackoff:  time.Second,
+		MaxAttempts: 1,
+	}}
+	msg := newTestOutboxMessage(t, 1)
+	if err := store.Add(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	box.dispatch()
+	saved := new(OutboxMessage)
+	if err := db.Where("id = ?", msg.Id).First(saved).Error; err != nil {
+		t.Fatal(err)
+	}
+	//retried after backoff instead of lease, attempts kept
+	if saved.Attempts != 1 || saved.LastError == "" || saved.NextAttemptAt.After(before.Add(30*time.Second)) {
+		t.Errorf("expect retry saved, got attempts %d next %v", saved.Attempts, saved.NextAttemptAt)
+	}
+}
+
+func TestOutboxDependencies(t *testing.T) {
+	old := gModules
+	gModules = newModuleRegistry()
+	defer func() { gModules = old }()
+	_, store := newTestDBOutboxStore(t)
+	box, err := EnableOutbox(OutboxConfig{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//mqtt registered after EnableOutbox is still started before outbox
+	if err = AddModule(&ModuleFuncs{ModuleName: ModuleMqtt}); err != nil {
+		t.Fatal(err)
+	}
+	if deps := box.Dependencies(); len(deps) != 1 || deps[0] != ModuleMqtt {
+		t.Errorf("expect depends on mqtt, got %v", deps)
+	}
+}
@@ -0,0 +1,229 @@
+package bootx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gen-iot/std"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const DefaultUploadDir = "upload"
+
+var ErrObjectNotFound = errors.New("storage object not found")
+
+//Storage store uploaded objects, key is slash separated, e.g. 2020/01/02/xxx.png
+type Storage interface {
+	Name() string
+	//size < 0 means unknown, r is read until EOF
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	//return ErrObjectNotFound if key not exist
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var gStorage Storage
+var storageLock = &sync.Mutex{}
+
+//SetDefaultStorage replace storage used when UploadConfig.Storage is nil
+func SetDefaultStorage(s Storage) {
+	storageLock.Lock()
+	defer storageLock.Unlock()
+	gStorage = s
+}
+
+//DefaultStorage default is local storage at {WorkSpace}/upload
+func DefaultStorage() Storage {
+	storageLock.Lock()
+	defer storageLock.Unlock()
+	if gStorage == nil {
+		s, err := NewLocalStorage(DefaultUploadDir)
+		std.AssertError(err, "create default storage failed")
+		gStorage = s
+	}
+	return gStorage
+}
+
+//clean key & reject path escape
+func cleanObjectKey(key string) (string, error) {
+	key = strings.TrimPrefix(path.Clean("/"+strings.Replace(key, "\\", "/", -1)), "/")
+	if len(key) == 0 || key == "." {
+		return "", fmt.Errorf("invalid object key")
+	}
+	return key, nil
+}
+
+//LocalStorage store objects in directory
+type LocalStorage struct {
+	root string
+}
+
+//NewLocalStorage relative dir is under kernel WorkSpace
+func NewLocalStorage(dir string) (*LocalStorage, error) {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(getKernel().WorkSpace, dir)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "create storage dir failed")
+	}
+	return &LocalStorage{root: dir}, nil
+}
+
+func (this *LocalStorage) Name() string {
+	return "local"
+}
+
+func (this *LocalStorage) Root() string {
+	return this.root
+}
+
+func (this *LocalStorage) path(key string) (string, error) {
+	key, err := cleanObjectKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(this.root, filepath.FromSlash(key)), nil
+}
+
+//write to temp file then rename, partial file is never visible
+func (this *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := this.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, ctxReader(ctx, r))
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (this *LocalStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := this.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return f, err
+}
+
+func (this *LocalStorage) Delete(ctx context.Context, key string) error {
+	p, err := this.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//MemoryStorage keep objects in memory, for test
+type MemoryStorage struct {
+	lock    *sync.RWMutex
+	objects map[string][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		lock:    &sync.RWMutex{},
+		objects: make(map[string][]byte),
+	}
+}
+
+func (this *MemoryStorage) Name() string {
+	return "memory"
+}
+
+func (this *MemoryStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	key, err := cleanObjectKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(ctxReader(ctx, r))
+	if err != nil {
+		return err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.objects[key] = data
+	return nil
+}
+
+func (this *MemoryStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	key, err := cleanObjectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	data, ok := this.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (this *MemoryStorage) Delete(ctx context.Context, key string) error {
+	key, err := cleanObjectKey(key)
+	if err != nil {
+		return err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.objects, key)
+	return nil
+}
+
+//Keys return all object keys, unordered
+func (this *MemoryStorage) Keys() []string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	out := make([]string, 0, len(this.objects))
+	for k := range this.objects {
+		out = append(out, k)
+	}
+	return out
+}
+
+//stop reading when ctx canceled, e.g. client gone
+type ctxReaderImpl struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func ctxReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx == nil {
+		return r
+	}
+	return &ctxReaderImpl{ctx: ctx, r: r}
+}
+
+func (this *ctxReaderImpl) Read(p []byte) (int, error) {
+	if err := this.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return this.r.Read(p)
+}
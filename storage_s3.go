@@ -0,0 +1,417 @@
+package bootx
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/gen-iot/std"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	//part of multipart upload is buffered in memory, s3 requires >= 5MB except the last
+	s3PartSize = 8 * KSizeMb
+)
+
+//S3Config config of S3 compatible storage, e.g. aws s3, minio, oss
+type S3Config struct {
+	//e.g. https://s3.amazonaws.com, http://127.0.0.1:9000
+	Endpoint  string `yaml:"endpoint" json:"endpoint" validate:"required,url"`
+	Region    string `yaml:"region" json:"region"`
+	Bucket    string `yaml:"bucket" json:"bucket" validate:"required"`
+	AccessKey string `yaml:"accessKey" json:"accessKey" validate:"required"`
+	SecretKey string `yaml:"secretKey" json:"secretKey" validate:"required"`
+	//key prefix of all objects
+	Prefix string `yaml:"prefix" json:"prefix"`
+	//use endpoint/bucket/key instead of bucket.endpoint/key, minio need this
+	PathStyle  bool `yaml:"pathStyle" json:"pathStyle"`
+	TimeoutSec int  `yaml:"timeout" json:"timeout" validate:"min=0,max=3600"`
+}
+
+var S3DefaultConfig = S3Config{
+	Region:     "us-east-1",
+	TimeoutSec: 300,
+}
+
+//S3Storage store objects by S3 REST api with signature v4
+type S3Storage struct {
+	conf     S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3Storage(conf S3Config) (*S3Storage, error) {
+	if len(conf.Region) == 0 {
+		conf.Region = S3DefaultConfig.Region
+	}
+	if conf.TimeoutSec == 0 {
+		conf.TimeoutSec = S3DefaultConfig.TimeoutSec
+	}
+	if err := std.ValidateStruct(conf); err != nil {
+		return nil, &ConfigError{Module: "s3", Err: err}
+	}
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, &ConfigError{Module: "s3", Err: err}
+	}
+	return &S3Storage{
+		conf:     conf,
+		endpoint: u,
+		client:   &http.Client{Timeout: time.Second * time.Duration(conf.TimeoutSec)},
+	}, nil
+}
+
+func (this *S3Storage) Name() string {
+	return "s3"
+}
+
+func (this *S3Storage) objectUrl(key string) (*url.URL, error) {
+	key, err := cleanObjectKey(joinObjectKey(this.conf.Prefix, key))
+	if err != nil {
+		return nil, err
+	}
+	u := *this.endpoint
+	if this.conf.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + this.conf.Bucket + "/" + key
+	} else {
+		u.Host = this.conf.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	return &u, nil
+}
+
+func joinObjectKey(prefix string, key string) string {
+	if len(prefix) == 0 {
+		return key
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + key
+}
+
+//S3 need Content-Length, body of unknown size is streamed by multipart upload part by part,
+//a body fits in one part is put directly
+func (this *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if size >= 0 {
+		return this.put(ctx, key, r, size, contentType)
+	}
+	part := make([]byte, s3PartSize)
+	n, err := io.ReadFull(ctxReader(ctx, r), part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return this.put(ctx, key, bytes.NewReader(part[:n]), int64(n), contentType)
+	}
+	if err != nil {
+		return err
+	}
+	return this.putMultipart(ctx, key, r, part, contentType)
+}
+
+func (this *S3Storage) put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	u, err := this.objectUrl(key)
+	if err != nil {
+		return err
+	}
+	//NopCloser with ContentLength 0 is sent chunked, which s3 rejects
+	var body io.ReadCloser = http.NoBody
+	if size > 0 {
+		body = ioutil.NopCloser(r)
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rsp, err := this.do(ctx, req, s3UnsignedPayload)
+	if err != nil {
+		return err
+	}
+	std.CloseIgnoreErr(rsp.Body)
+	return nil
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+//buf is filled with the first part, the rest is read from r into it part by part.
+//aborted if any failed, so the parts are not kept by s3
+func (this *S3Storage) putMultipart(ctx context.Context, key string, r io.Reader, buf []byte, contentType string) error {
+	initiate := new(s3InitiateMultipartUploadResult)
+	header := http.Header{}
+	if len(contentType) > 0 {
+		header.Set("Content-Type", contentType)
+	}
+	err := this.doXml(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, initiate)
+	if err != nil {
+		return err
+	}
+	if len(initiate.UploadId) == 0 {
+		return fmt.Errorf("s3 initiate multipart upload of '%s' failed, no upload id", key)
+	}
+	uploadId := url.Values{"uploadId": {initiate.UploadId}}
+	complete := &s3CompleteMultipartUpload{}
+	err = this.uploadParts(ctx, key, r, buf, initiate.UploadId, complete)
+	if err == nil {
+		var data []byte
+		if data, err = xml.Marshal(complete); err == nil {
+			err = this.doXml(ctx, http.MethodPost, key, uploadId, nil, data, nil)
+		}
+	}
+	if err != nil {
+		if abortErr := this.doXml(context.Background(), http.MethodDelete, key, uploadId, nil, nil, nil); abortErr != nil {
+			moduleLog("s3").Warn("abort multipart upload failed", "key", key, "err", abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (this *S3Storage) uploadParts(ctx context.Context, key string, r io.Reader, buf []byte,
+	uploadId string, complete *s3CompleteMultipartUpload) error {
+	r = ctxReader(ctx, r)
+	n, last := len(buf), false
+	for number := 1; ; number++ {
+		u, err := this.objectUrl(key)
+		if err != nil {
+			return err
+		}
+		u.RawQuery = s3CanonicalQuery(url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}})
+		req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(buf[:n]))
+		if err != nil {
+			return err
+		}
+		rsp, err := this.do(ctx, req, s3UnsignedPayload)
+		if err != nil {
+			return err
+		}
+		std.CloseIgnoreErr(rsp.Body)
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: number, ETag: rsp.Header.Get("ETag")})
+		if last {
+			return nil
+		}
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF {
+			return nil
+		}
+		last = err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+	}
+}
+
+//doXml send request with query, decode xml response into out if not nil.
+//s3 may respond 200 with an error document, e.g. complete multipart upload
+func (this *S3Storage) doXml(ctx context.Context, method string, key string, query url.Values,
+	header http.Header, body []byte, out interface{}) error {
+	u, err := this.objectUrl(key)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+	var reqBody io.Reader = http.NoBody
+	payloadHash := s3EmptyPayload
+	if len(body) > 0 {
+		reqBody = bytes.NewReader(body)
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	rsp, err := this.do(ctx, req, payloadHash)
+	if err != nil {
+		return err
+	}
+	defer std.CloseIgnoreErr(rsp.Body)
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	root := struct {
+		XMLName xml.Name
+	}{}
+	if xml.Unmarshal(data, &root) == nil && root.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 %s %s failed : %s", method, u.Path, string(data))
+	}
+	if out != nil {
+		return xml.Unmarshal(data, out)
+	}
+	return nil
+}
+
+func (this *S3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	u, err := this.objectUrl(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := this.do(ctx, req, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Body, nil
+}
+
+func (this *S3Storage) Delete(ctx context.Context, key string) error {
+	u, err := this.objectUrl(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := this.do(ctx, req, s3EmptyPayload)
+	if err == ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	std.CloseIgnoreErr(rsp.Body)
+	return nil
+}
+
+func (this *S3Storage) do(ctx context.Context, req *http.Request, payloadHash string) (*http.Response, error) {
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	this.sign(req, payloadHash, time.Now().UTC())
+	rsp, err := this.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode == http.StatusNotFound {
+		std.CloseIgnoreErr(rsp.Body)
+		return nil, ErrObjectNotFound
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		defer std.CloseIgnoreErr(rsp.Body)
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s failed, status %d : %s", req.Method, req.URL.Path, rsp.StatusCode, string(msg))
+	}
+	return rsp, nil
+}
+
+//sign request with aws signature v4
+func (this *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-date":           amzDate,
+		"x-amz-content-sha256": payloadHash,
+	}
+	if ct := req.Header.Get("Content-Type"); len(ct) > 0 {
+		headers["content-type"] = ct
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + this.conf.Region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+	key := hmacSha256([]byte("AWS4"+this.conf.SecretKey), date)
+	key = hmacSha256(key, this.conf.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, this.conf.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := q[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, false)
+}
+
+//uri encode except unreserved chars, '/' is kept if not encodeSlash
+func s3Escape(s string, encodeSlash bool) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return b.String()
+}
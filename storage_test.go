@@ -0,0 +1,160 @@
+package bootx
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCleanObjectKey(t *testing.T) {
+	for in, expect := range map[string]string{
+		"a/b.png":           "a/b.png",
+		"/a//b.png":         "a/b.png",
+		`a\b.png`:           "a/b.png",
+		"../../etc/passwd":  "etc/passwd",
+		"a/../../b/./c.txt": "b/c.txt",
+		"":                  "",
+		"..":                "",
+	} {
+		got, err := cleanObjectKey(in)
+		if (len(expect) == 0) != (err != nil) || got != expect {
+			t.Errorf("cleanObjectKey(%q) expect %q, got %q %v", in, expect, got, err)
+		}
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = s.Put(ctx, "../2020/a.txt", strings.NewReader("hello"), -1, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, "2020", "a.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("object not written under root: %v %s", err, data)
+	}
+	entries, _ := ioutil.ReadDir(filepath.Join(root, "2020"))
+	if len(entries) != 1 {
+		t.Errorf("temp file left: %d entries", len(entries))
+	}
+
+	//canceled ctx leaves nothing behind
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err = s.Put(canceled, "2020/b.txt", strings.NewReader("partial"), -1, ""); err == nil {
+		t.Error("expect put canceled")
+	}
+	if entries, _ = ioutil.ReadDir(filepath.Join(root, "2020")); len(entries) != 1 {
+		t.Errorf("canceled put left %d entries", len(entries))
+	}
+
+	if err = s.Delete(ctx, "2020/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Open(ctx, "2020/a.txt"); err != ErrObjectNotFound {
+		t.Errorf("expect ErrObjectNotFound, got %v", err)
+	}
+	if err = s.Delete(ctx, "2020/a.txt"); err != nil {
+		t.Errorf("delete missing object should be ok, got %v", err)
+	}
+}
+
+//fakeS3 keep objects of PUT requests by url path
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string]string
+	auth    []string
+}
+
+func (this *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.auth = append(this.auth, r.Header.Get("Authorization"))
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		if r.ContentLength != int64(len(data)) {
+			http.Error(w, "MissingContentLength", http.StatusLengthRequired)
+			return
+		}
+		this.objects[r.URL.Path] = string(data)
+	case http.MethodGet:
+		data, ok := this.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(data))
+	case http.MethodDelete:
+		if _, ok := this.objects[r.URL.Path]; !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		delete(this.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string]string)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s, err := NewS3Storage(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "iot",
+		AccessKey: "AK",
+		SecretKey: "SK",
+		Prefix:    "dev/",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = s.Put(ctx, "a b.txt", strings.NewReader("known"), 5, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	//unknown size is spooled so Content-Length is still sent
+	if err = s.Put(ctx, "c.txt", strings.NewReader("unknown"), -1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fake.objects["/iot/dev/a b.txt"] != "known" || fake.objects["/iot/dev/c.txt"] != "unknown" {
+		t.Errorf("unexpected objects %v", fake.objects)
+	}
+	r, err := s.Open(ctx, "a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	_ = r.Close()
+	if string(data) != "known" {
+		t.Errorf("unexpected object %s", data)
+	}
+	if err = s.Delete(ctx, "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Open(ctx, "c.txt"); err != ErrObjectNotFound {
+		t.Errorf("expect ErrObjectNotFound, got %v", err)
+	}
+	if err = s.Delete(ctx, "c.txt"); err != nil {
+		t.Errorf("delete missing object should be ok, got %v", err)
+	}
+	for _, auth := range fake.auth {
+		if !strings.HasPrefix(auth, s3Algorithm+" Credential=AK/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") {
+			t.Fatalf("unexpected authorization %s", auth)
+		}
+	}
+
+	if _, err = NewS3Storage(S3Config{Endpoint: server.URL}); err == nil {
+		t.Error("expect config error without bucket")
+	}
+}
@@ -10,16 +10,26 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/pkg/errors"
 	"sync"
+	"time"
 )
 
 type DBConfig struct {
-	Default          bool   `yaml:"default" json:"default"`
-	Name             string `yaml:"name" json:"name"`
-	DatabaseType     string `yaml:"databaseType" json:"databaseType" validate:"oneof=mysql postgres sqlite3 mssql"`
-	ConnStr          string `yaml:"connStr" json:"connStr" validate:"required"`
-	ShowSql          bool   `yaml:"showSql" json:"showSql"`
-	MaxIdleConnCount int    `yaml:"maxIdleConn" json:"maxIdleConn" validate:"min=0,max=1000"`
-	MaxOpenConnCount int    `yaml:"maxOpenConn" json:"maxOpenConn" validate:"min=0,max=1000"`
+	Default              bool     `yaml:"default" json:"default"`
+	Name                 string   `yaml:"name" json:"name"`
+	DatabaseType         string   `yaml:"databaseType" json:"databaseType" validate:"oneof=mysql postgres sqlite3 mssql"`
+	ConnStr              string   `yaml:"connStr" json:"connStr" validate:"required"`
+	ShowSql              bool     `yaml:"showSql" json:"showSql"`
+	MaxIdleConnCount     int      `yaml:"maxIdleConn" json:"maxIdleConn" validate:"min=0,max=1000"`
+	MaxOpenConnCount     int      `yaml:"maxOpenConn" json:"maxOpenConn" validate:"min=0,max=1000"`
+	AutoMigrate          bool     `yaml:"autoMigrate" json:"autoMigrate"`                    //run pending migrations when bootstrap
+	Replicas             []string `yaml:"replicas" json:"replicas" validate:"dive,required"` //conn strings of read replicas, Query() is routed to them
+	ReplicaPolicy        string   `yaml:"replicaPolicy" json:"replicaPolicy" validate:"omitempty,oneof=round_robin random least_conn"`
+	ReplicaCheckInterval int      `yaml:"replicaCheckInterval" json:"replicaCheckInterval" validate:"min=0,max=3600"` //seconds, default 10
+	ConnMaxLifetime      int      `yaml:"connMaxLifetime" json:"connMaxLifetime" validate:"min=0"`                    //seconds, 0 no limit
+	ConnMaxIdleTime      int      `yaml:"connMaxIdleTime" json:"connMaxIdleTime" validate:"min=0"`                    //seconds, 0 no limit
+	ConnectMaxWait       int      `yaml:"connectMaxWait" json:"connectMaxWait" validate:"min=0"`                      //seconds to retry connecting at startup, 0 no retry
+	ConnectRetryInterval int      `yaml:"connectRetryInterval" json:"connectRetryInterval" validate:"min=0,max=60"`   //seconds of first retry, doubled each time up to 30, default 1
+	HealthCheckInterval  int      `yaml:"healthCheckInterval" json:"healthCheckInterval" validate:"min=-1,max=3600"`  //seconds between pings, default 10, -1 disabled
 }
 
 var DBDefaultConfig = DBConfig{
@@ -30,12 +40,16 @@ var DBDefaultConfig = DBConfig{
 	MaxOpenConnCount: 100,
 }
 
+//DataBase embedded *gorm.DB & Tx are always the primary, Query() is routed to replicas if any
 type DataBase struct {
 	*gorm.DB
-	conf DBConfig
+	conf         DBConfig
+	replicas     *dbReplicaSet
+	health       *dbHealth
+	forcePrimary bool
 }
 
-var dbOnce = sync.Once{}
+var dbOnce = initOnce{}
 var dbMap = make(map[string]*DataBase)
 var dbNames = make([]string, 0)
 var defaultDb *DataBase = nil
@@ -52,14 +66,66 @@ func NewDB(dbType string, connStr string, name ...string) *DataBase {
 }
 
 func NewDBWithConf(conf DBConfig) *DataBase {
+	db, err := OpenDB(conf)
+	std.AssertError(err, "database init failed")
+	return db
+}
+
+//OpenDB open database with config, return *ConfigError or *ConnectError when failed
+func OpenDB(conf DBConfig) (*DataBase, error) {
 	if len(conf.Name) == 0 {
 		conf.Name = std.GenRandomUUID()
 	}
-	err := std.ValidateStruct(conf)
-	std.AssertError(err, "invalid database configuration")
-	logger.Printf("database db(%s %s) init ...", conf.Name, conf.ConnStr)
-	db, err := gorm.Open(conf.DatabaseType, conf.ConnStr)
-	std.AssertError(err, "database open failed")
+	if err := std.ValidateStruct(conf); err != nil {
+		return nil, &ConfigError{Module: ModuleDatabase, Err: err}
+	}
+	moduleLog(ModuleDatabase).Info("database init ...", "name", conf.Name, "type", conf.DatabaseType,
+		"replicas", len(conf.Replicas))
+	db, err := openGormWithRetry(conf)
+	if err != nil {
+		return nil, &ConnectError{Module: ModuleDatabase, Target: conf.Name, Err: err}
+	}
+	out := &DataBase{DB: db, conf: conf}
+	if len(conf.Replicas) > 0 {
+		out.replicas = newDBReplicaSet(conf)
+	}
+	out.health = newDBHealth(out)
+	return out, nil
+}
+
+//retry with backoff until ConnectMaxWait elapsed, database may not be ready when service starts
+func openGormWithRetry(conf DBConfig) (*gorm.DB, error) {
+	deadline := time.Now().Add(time.Second * time.Duration(conf.ConnectMaxWait))
+	interval := time.Second * time.Duration(conf.ConnectRetryInterval)
+	if interval <= 0 {
+		interval = time.Second * DefaultDBConnectRetryInterval
+	}
+	for attempt := 1; ; attempt++ {
+		db, err := openGorm(conf, conf.ConnStr)
+		if err == nil {
+			return db, nil
+		}
+		remain := time.Until(deadline)
+		if remain <= 0 {
+			return nil, err
+		}
+		if interval > remain {
+			interval = remain
+		}
+		moduleLog(ModuleDatabase).Warn("database connect failed, retry ...", "name", conf.Name,
+			"attempt", attempt, "after", interval.String(), "err", err)
+		time.Sleep(interval)
+		if interval *= 2; interval > dbMaxConnectRetryInterval {
+			interval = dbMaxConnectRetryInterval
+		}
+	}
+}
+
+func openGorm(conf DBConfig, connStr string) (*gorm.DB, error) {
+	db, err := gorm.Open(conf.DatabaseType, connStr)
+	if err != nil {
+		return nil, err
+	}
 	if conf.ShowSql {
 		//use gorm default logger
 		//gDb.SetLogger(log.DEBUG)
@@ -68,7 +134,9 @@ func NewDBWithConf(conf DBConfig) *DataBase {
 	//dbConfig connection pool
 	db.DB().SetMaxIdleConns(conf.MaxIdleConnCount)
 	db.DB().SetMaxOpenConns(conf.MaxOpenConnCount)
-	return &DataBase{db, conf}
+	db.DB().SetConnMaxLifetime(time.Second * time.Duration(conf.ConnMaxLifetime))
+	db.DB().SetConnMaxIdleTime(time.Second * time.Duration(conf.ConnMaxIdleTime))
+	return db, nil
 }
 
 func DB() *DataBase {
@@ -78,6 +146,16 @@ func DB() *DataBase {
 	return defaultDb
 }
 
+//DefaultDB same as DB, but return NoSuchDatabase instead of panic when default database not init yet
+func DefaultDB() (*DataBase, error) {
+	dbRwLock.RLock()
+	defer dbRwLock.RUnlock()
+	if defaultDb == nil {
+		return nil, NoSuchDatabase("default")
+	}
+	return defaultDb, nil
+}
+
 type NoSuchDatabase string
 
 func (e NoSuchDatabase) Error() string {
@@ -188,10 +266,46 @@ func (this *DataBase) Tx(txFunc func(*gorm.DB) error) (err error) {
 	return tx.Commit().Error
 }
 
+//Query for reads, routed to a healthy replica by ReplicaPolicy, the primary if none.
+//replicas may lag behind, use ForcePrimary() to read own writes
 func (this *DataBase) Query() (query *gorm.DB) {
+	if this.forcePrimary || this.replicas == nil {
+		return this.DB
+	}
+	if replica := this.replicas.pick(); replica != nil {
+		return replica
+	}
 	return this.DB
 }
 
+//ForcePrimary a view of the database whose Query() always use the primary
+func (this *DataBase) ForcePrimary() *DataBase {
+	out := *this
+	out.forcePrimary = true
+	return &out
+}
+
+//HealthyReplicas count of replicas in rotation
+func (this *DataBase) HealthyReplicas() int {
+	if this.replicas == nil {
+		return 0
+	}
+	return this.replicas.HealthyCount()
+}
+
+//Close the primary & replicas
+func (this *DataBase) Close() error {
+	if this.health != nil && !this.forcePrimary {
+		this.health.Stop()
+	}
+	if this.replicas != nil && !this.forcePrimary {
+		if err := this.replicas.Close(); err != nil {
+			moduleLog(ModuleDatabase).Warn("close replicas failed", "name", this.Name(), "err", err)
+		}
+	}
+	return this.DB.Close()
+}
+
 func (this *DataBase) Name() string {
 	return this.conf.Name
 }
@@ -208,42 +322,74 @@ func (this *DataBase) Conf() DBConfig {
 	return this.conf
 }
 
-func dbInit(dbType string, connStr string) {
+func dbInit(dbType string, connStr string) error {
 	c := DBDefaultConfig
 	c.DatabaseType = dbType
 	c.ConnStr = connStr
-	dbInitWithConfig([]DBConfig{c})
+	return dbInitWithConfig([]DBConfig{c})
 }
 
-func dbInitWithConfig(conf []DBConfig) {
-	std.Assert(len(conf) > 0, "at least one database config should be specified")
-	dbOnce.Do(func() {
+func dbInitWithConfig(conf []DBConfig) (err error) {
+	if len(conf) == 0 {
+		return &ConfigError{Module: ModuleDatabase, Err: errors.New("at least one database config should be specified")}
+	}
+	return dbOnce.Do(func() error {
 		dbRwLock.Lock()
 		defer dbRwLock.Unlock()
 		dbMap = make(map[string]*DataBase, len(conf))
 		dbNames = make([]string, 0, len(conf))
 		var first *DataBase = nil
+		var dft *DataBase = nil
 		for i, c := range conf {
-			db := NewDBWithConf(c)
-			name := db.Name()
+			if c.Default && dft != nil {
+				err = &ConfigError{Module: ModuleDatabase, Err: errors.New("more than one database set to default")}
+				break
+			}
+			var db *DataBase
+			db, err = OpenDB(c)
+			if err != nil {
+				break
+			}
 			if i == 0 {
 				first = db
 			}
 			if c.Default {
-				std.Assert(defaultDb == nil, "more than one database set to default")
-				defaultDb = db
+				dft = db
+			}
+			if err = addDB(db); err != nil {
+				std.CloseIgnoreErr(db)
+				break
 			}
-			std.AssertError(addDB(db), fmt.Sprintf("database '%s' init failed ", name))
 		}
-		if defaultDb == nil {
-			defaultDb = first
+		if err != nil {
+			for _, db := range dbMap {
+				std.CloseIgnoreErr(db)
+			}
+			dbMap = make(map[string]*DataBase)
+			dbNames = make([]string, 0)
+			return err
 		}
+		if dft == nil {
+			dft = first
+		}
+		defaultDb = dft
+		return nil
 	})
 }
 
 func dbCleanup() {
 	for name, db := range dbMap {
-		logger.Printf("database(%s) cleanup ...", name)
+		moduleLog(ModuleDatabase).Info("database cleanup ...", "name", name)
 		std.CloseIgnoreErr(db)
 	}
 }
+
+//forget closed databases, so dbInitWithConfig opens them again
+func dbReset() {
+	dbRwLock.Lock()
+	defer dbRwLock.Unlock()
+	dbMap = make(map[string]*DataBase)
+	dbNames = make([]string, 0)
+	defaultDb = nil
+	dbOnce.reset()
+}
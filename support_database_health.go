@@ -0,0 +1,129 @@
+package bootx
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//seconds of first connect retry at startup
+	DefaultDBConnectRetryInterval = 1
+	//seconds between health checks of the primary
+	DefaultDBHealthCheckInterval = 10
+	dbMaxConnectRetryInterval    = 30 * time.Second
+	dbHealthPingTimeout          = 5 * time.Second
+)
+
+//DBHealthHook called when health state of database changed
+type DBHealthHook func(db *DataBase, healthy bool)
+
+//dbHealth pings the primary in background, the pool reconnects by itself once database is back
+type dbHealth struct {
+	db       *DataBase
+	healthy  int32
+	lock     sync.Mutex
+	hooks    []DBHealthHook
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func newDBHealth(db *DataBase) *dbHealth {
+	this := &dbHealth{
+		db:       db,
+		healthy:  1,
+		stopChan: make(chan struct{}),
+	}
+	interval := db.conf.HealthCheckInterval
+	if interval < 0 {
+		return this
+	}
+	if interval == 0 {
+		interval = DefaultDBHealthCheckInterval
+	}
+	go this.loop(time.Second * time.Duration(interval))
+	return this
+}
+
+func (this *dbHealth) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stopChan:
+			return
+		case <-ticker.C:
+			this.check()
+		}
+	}
+}
+
+func (this *dbHealth) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), dbHealthPingTimeout)
+	defer cancel()
+	err := this.db.DB.DB().PingContext(ctx)
+	healthy := err == nil
+	var state int32 = 0
+	if healthy {
+		state = 1
+	}
+	if atomic.SwapInt32(&this.healthy, state) == state {
+		return
+	}
+	if healthy {
+		moduleLog(ModuleDatabase).Info("database is healthy again", "name", this.db.Name())
+	} else {
+		moduleLog(ModuleDatabase).Warn("database is unhealthy", "name", this.db.Name(), "err", err)
+	}
+	this.lock.Lock()
+	hooks := append([]DBHealthHook(nil), this.hooks...)
+	this.lock.Unlock()
+	for _, hook := range hooks {
+		this.runHook(hook, healthy)
+	}
+}
+
+func (this *dbHealth) runHook(hook DBHealthHook, healthy bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := make([]byte, 4<<10)
+			stack = stack[:runtime.Stack(stack, false)]
+			moduleLog(ModuleDatabase).Error("database health hook panic", "err", r, "stack", string(stack))
+		}
+	}()
+	hook(this.db, healthy)
+}
+
+func (this *dbHealth) Healthy() bool {
+	return atomic.LoadInt32(&this.healthy) == 1
+}
+
+func (this *dbHealth) onChange(hook DBHealthHook) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.hooks = append(this.hooks, hook)
+}
+
+func (this *dbHealth) Stop() {
+	this.stopOnce.Do(func() {
+		close(this.stopChan)
+	})
+}
+
+//Healthy result of the latest background ping of the primary, always true if check disabled
+func (this *DataBase) Healthy() bool {
+	if this.health == nil {
+		return true
+	}
+	return this.health.Healthy()
+}
+
+//OnHealthChange hook is called from background when the primary became unhealthy or healthy again
+func (this *DataBase) OnHealthChange(hook DBHealthHook) {
+	if this.health == nil {
+		return
+	}
+	this.health.onChange(hook)
+}
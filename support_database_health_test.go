@@ -0,0 +1,65 @@
+package bootx
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenDBConnectRetry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "later")
+	//database file can be created only after dir exists
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = os.Mkdir(dir, 0700)
+	}()
+	begin := time.Now()
+	db := openTestDB(t, DBConfig{
+		ConnStr:              filepath.Join(dir, "test.db"),
+		ConnectMaxWait:       5,
+		ConnectRetryInterval: 1,
+		HealthCheckInterval:  -1,
+		ConnMaxLifetime:      60,
+	})
+	if cost := time.Since(begin); cost < time.Second || cost > 3*time.Second {
+		t.Errorf("expect connected by the 1st retry, cost %v", cost)
+	}
+	if err := db.DB.DB().Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBHealth(t *testing.T) {
+	db := openTestDB(t, DBConfig{HealthCheckInterval: -1})
+	lock := sync.Mutex{}
+	changes := make([]bool, 0)
+	db.OnHealthChange(func(changed *DataBase, healthy bool) {
+		if changed != db {
+			t.Error("unexpected database in hook")
+		}
+		lock.Lock()
+		changes = append(changes, healthy)
+		lock.Unlock()
+	})
+	db.OnHealthChange(func(*DataBase, bool) {
+		panic("hook panic is recovered")
+	})
+
+	db.health.check()
+	if !db.Healthy() || len(changes) != 0 {
+		t.Fatalf("expect healthy without change, got %v", changes)
+	}
+	_ = db.DB.DB().Close()
+	db.health.check()
+	db.health.check()
+	if db.Healthy() {
+		t.Error("expect unhealthy after pool closed")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(changes) != 1 || changes[0] {
+		t.Errorf("expect hook called once with unhealthy, got %v", changes)
+	}
+}
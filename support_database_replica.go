@@ -0,0 +1,191 @@
+package bootx
+
+import (
+	"context"
+	"github.com/jinzhu/gorm"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ReplicaRoundRobin = "round_robin"
+	ReplicaRandom     = "random"
+	ReplicaLeastConn  = "least_conn"
+	//seconds between health checks of replicas
+	DefaultReplicaCheckInterval = 10
+)
+
+type dbReplica struct {
+	index int
+	//nil until connected
+	db      *gorm.DB
+	healthy bool
+}
+
+//dbReplicaSet reads are routed to healthy replicas, unhealthy ones are checked & reconnected in background
+type dbReplicaSet struct {
+	conf     DBConfig
+	name     string
+	replicas []*dbReplica
+	//[]*gorm.DB of healthy replicas
+	healthy  atomic.Value
+	counter  uint64
+	lock     sync.Mutex
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func newDBReplicaSet(conf DBConfig) *dbReplicaSet {
+	this := &dbReplicaSet{
+		conf:     conf,
+		name:     conf.Name,
+		replicas: make([]*dbReplica, len(conf.Replicas)),
+		stopChan: make(chan struct{}),
+	}
+	for i := range conf.Replicas {
+		this.replicas[i] = &dbReplica{index: i}
+	}
+	//replicas join rotation after the first check, reads go to the primary until then
+	this.healthy.Store([]*gorm.DB{})
+	interval := conf.ReplicaCheckInterval
+	if interval <= 0 {
+		interval = DefaultReplicaCheckInterval
+	}
+	go this.loop(time.Second * time.Duration(interval))
+	return this
+}
+
+//first check runs in background, so a dead replica never blocks startup
+func (this *dbReplicaSet) loop(interval time.Duration) {
+	this.check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stopChan:
+			return
+		case <-ticker.C:
+			this.check()
+		}
+	}
+}
+
+//connect or ping each replica without lock, then refresh healthy list.
+//a hanging replica never blocks Close & others, ping is bounded by dbHealthPingTimeout
+func (this *dbReplicaSet) check() {
+	this.lock.Lock()
+	if this.closed() {
+		this.lock.Unlock()
+		return
+	}
+	conns := make([]*gorm.DB, len(this.replicas))
+	for i, r := range this.replicas {
+		conns[i] = r.db
+	}
+	this.lock.Unlock()
+
+	errs := make([]error, len(conns))
+	opened := make([]bool, len(conns))
+	for i, db := range conns {
+		if db == nil {
+			conns[i], errs[i] = openGorm(this.conf, this.conf.Replicas[i])
+			opened[i] = errs[i] == nil
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dbHealthPingTimeout)
+		errs[i] = db.DB().PingContext(ctx)
+		cancel()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	healthy := make([]*gorm.DB, 0, len(this.replicas))
+	for i, r := range this.replicas {
+		if opened[i] {
+			//closed meanwhile or connected by a concurrent check
+			if this.closed() || r.db != nil {
+				_ = conns[i].Close()
+				continue
+			}
+			r.db = conns[i]
+		}
+		ok := errs[i] == nil && r.db != nil
+		if ok != r.healthy {
+			if ok {
+				moduleLog(ModuleDatabase).Info("replica joined rotation", "name", this.name, "replica", r.index)
+			} else {
+				moduleLog(ModuleDatabase).Warn("replica dropped from rotation", "name", this.name, "replica", r.index, "err", errs[i])
+			}
+			r.healthy = ok
+		}
+		if ok {
+			healthy = append(healthy, r.db)
+		}
+	}
+	if this.closed() {
+		return
+	}
+	this.healthy.Store(healthy)
+}
+
+func (this *dbReplicaSet) closed() bool {
+	select {
+	case <-this.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+//pick a healthy replica by policy, nil if none
+func (this *dbReplicaSet) pick() *gorm.DB {
+	healthy := this.healthy.Load().([]*gorm.DB)
+	switch len(healthy) {
+	case 0:
+		return nil
+	case 1:
+		return healthy[0]
+	}
+	switch this.conf.ReplicaPolicy {
+	case ReplicaRandom:
+		return healthy[rand.Intn(len(healthy))]
+	case ReplicaLeastConn:
+		best := healthy[0]
+		bestInUse := best.DB().Stats().InUse
+		for _, db := range healthy[1:] {
+			if inUse := db.DB().Stats().InUse; inUse < bestInUse {
+				best, bestInUse = db, inUse
+			}
+		}
+		return best
+	default:
+		n := atomic.AddUint64(&this.counter, 1)
+		return healthy[n%uint64(len(healthy))]
+	}
+}
+
+//HealthyCount replicas in rotation
+func (this *dbReplicaSet) HealthyCount() int {
+	return len(this.healthy.Load().([]*gorm.DB))
+}
+
+func (this *dbReplicaSet) Close() error {
+	this.stopOnce.Do(func() {
+		close(this.stopChan)
+	})
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var lastErr error
+	for _, r := range this.replicas {
+		if r.db != nil {
+			if err := r.db.Close(); err != nil {
+				lastErr = err
+			}
+			r.db = nil
+		}
+	}
+	this.healthy.Store([]*gorm.DB{})
+	return lastErr
+}
@@ -0,0 +1,210 @@
+package bootx
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type replicaTestRow struct {
+	Name string
+}
+
+//openTestReplicaDB primary & replicas are sqlite files named by role, so the one serving a query can be told
+func openTestReplicaDB(t *testing.T, policy string, replicas ...string) *DataBase {
+	t.Helper()
+	dir := t.TempDir()
+	connStr := func(name string) string {
+		return filepath.Join(dir, name+".db")
+	}
+	conf := DBConfig{ConnStr: connStr("primary"), ReplicaPolicy: policy, ReplicaCheckInterval: 3600}
+	for _, name := range append([]string{"primary"}, replicas...) {
+		if name == "broken" {
+			//directory not exist, never connected
+			conf.Replicas = append(conf.Replicas, filepath.Join(dir, "missing", "broken.db"))
+			continue
+		}
+		if name != "primary" {
+			conf.Replicas = append(conf.Replicas, connStr(name))
+		}
+		seed := openTestDB(t, DBConfig{ConnStr: connStr(name), Name: t.Name() + name})
+		if err := seed.AutoMigrate(&replicaTestRow{}).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := seed.Create(&replicaTestRow{Name: name}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := openTestDB(t, conf)
+	//health of replicas is known before the first query
+	db.replicas.check()
+	return db
+}
+
+func queryRole(t *testing.T, db *DataBase) string {
+	t.Helper()
+	row := new(replicaTestRow)
+	if err := db.Query().First(row).Error; err != nil {
+		t.Fatal(err)
+	}
+	return row.Name
+}
+
+func TestDBReplicaRouting(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   string
+		replicas []string
+		healthy  int
+		expect   map[string]bool
+	}{
+		{name: "all broken use primary", replicas: []string{"broken"}, healthy: 0, expect: map[string]bool{"primary": true}},
+		{name: "broken skipped", replicas: []string{"broken", "r1"}, healthy: 1, expect: map[string]bool{"r1": true}},
+		{name: "round robin", policy: ReplicaRoundRobin, replicas: []string{"r1", "r2"}, healthy: 2,
+			expect: map[string]bool{"r1": true, "r2": true}},
+		{name: "random", policy: ReplicaRandom, replicas: []string{"r1", "r2"}, healthy: 2,
+			expect: map[string]bool{"r1": true, "r2": true}},
+		{name: "least conn", policy: ReplicaLeastConn, replicas: []string{"r1", "broken", "r2"}, healthy: 2,
+			expect: map[string]bool{"r1": true, "r2": true}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := openTestReplicaDB(t, c.policy, c.replicas...)
+			if n := db.HealthyReplicas(); n != c.healthy {
+				t.Fatalf("expect %d healthy replicas, got %d", c.healthy, n)
+			}
+			for i := 0; i < 20; i++ {
+				if role := queryRole(t, db); !c.expect[role] {
+					t.Fatalf("query routed to %s, expect one of %v", role, c.expect)
+				}
+			}
+			if role := queryRole(t, db.ForcePrimary()); role != "primary" {
+				t.Errorf("ForcePrimary routed to %s", role)
+			}
+		})
+	}
+	t.Run("round robin visits all", func(t *testing.T) {
+		db := openTestReplicaDB(t, ReplicaRoundRobin, "r1", "r2")
+		seen := make(map[string]bool)
+		for i := 0; i < 4; i++ {
+			seen[queryRole(t, db)] = true
+		}
+		if !seen["r1"] || !seen["r2"] {
+			t.Errorf("expect r1 & r2 both queried, got %v", seen)
+		}
+	})
+}
+
+//unhealthy replica is dropped from rotation by next check, reads fail over to the rest then the primary
+func TestDBReplicaFailover(t *testing.T) {
+	db := openTestReplicaDB(t, ReplicaRoundRobin, "r1", "r2")
+	expects := []struct {
+		down    int
+		healthy int
+		roles   map[string]bool
+	}{
+		{down: 0, healthy: 1, roles: map[string]bool{"r2": true}},
+		{down: 1, healthy: 0, roles: map[string]bool{"primary": true}},
+	}
+	for _, e := range expects {
+		//closed pool never pings again, like a replica gone
+		db.replicas.lock.Lock()
+		err := db.replicas.replicas[e.down].db.DB().Close()
+		db.replicas.lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.replicas.check()
+		if n := db.HealthyReplicas(); n != e.healthy {
+			t.Fatalf("expect %d healthy replicas, got %d", e.healthy, n)
+		}
+		for i := 0; i < 4; i++ {
+			if role := queryRole(t, db); !e.roles[role] {
+				t.Fatalf("query routed to %s, expect one of %v", role, e.roles)
+			}
+		}
+	}
+}
+
+//hangDriver ping blocks while hang is set, until released or ctx done
+type hangDriver struct {
+	hang    int32
+	release chan struct{}
+	pinging chan struct{}
+}
+
+type hangConn struct {
+	d *hangDriver
+}
+
+func (this *hangDriver) Open(name string) (driver.Conn, error) {
+	return &hangConn{d: this}, nil
+}
+
+func (this *hangConn) Ping(ctx context.Context) error {
+	if atomic.LoadInt32(&this.d.hang) == 0 {
+		return nil
+	}
+	this.d.pinging <- struct{}{}
+	select {
+	case <-this.d.release:
+		return errors.New("replica gone")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (this *hangConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (this *hangConn) Close() error {
+	return nil
+}
+
+func (this *hangConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestDBReplicaCheckNotBlocking(t *testing.T) {
+	d := &hangDriver{release: make(chan struct{}), pinging: make(chan struct{}, 1)}
+	name := fmt.Sprintf("bootx_hang_%d", time.Now().UnixNano())
+	sql.Register(name, d)
+	conf := DBConfig{Name: "hang", DatabaseType: name, Replicas: []string{"r1"}, ReplicaCheckInterval: 3600}
+	set := newDBReplicaSet(conf)
+	set.check()
+	if set.HealthyCount() != 1 {
+		t.Fatalf("expect replica healthy, got %d", set.HealthyCount())
+	}
+
+	atomic.StoreInt32(&d.hang, 1)
+	checked := make(chan struct{})
+	go func() {
+		set.check()
+		close(checked)
+	}()
+	<-d.pinging
+	closed := make(chan error)
+	go func() {
+		if set.HealthyCount() != 1 || set.pick() == nil {
+			t.Error("expect replica still in rotation while checking")
+		}
+		closed <- set.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked by hanging ping")
+	}
+	close(d.release)
+	<-checked
+	if set.HealthyCount() != 0 {
+		t.Errorf("expect no replica after closed, got %d", set.HealthyCount())
+	}
+}
@@ -0,0 +1,51 @@
+package bootx
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+//openTestDB open a sqlite database in temp dir of t, closed when t finished
+func openTestDB(t *testing.T, conf DBConfig) *DataBase {
+	t.Helper()
+	conf.DatabaseType = "sqlite3"
+	if len(conf.ConnStr) == 0 {
+		conf.ConnStr = filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=5000"
+	}
+	if len(conf.Name) == 0 {
+		conf.Name = t.Name()
+	}
+	db, err := OpenDB(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+func TestOpenDB(t *testing.T) {
+	db := openTestDB(t, DBConfig{MaxOpenConnCount: 2})
+	if err := db.DB.DB().Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Name() != t.Name() || db.DBType() != "sqlite3" {
+		t.Errorf("unexpected db %s %s", db.Name(), db.DBType())
+	}
+}
+
+func TestOpenDBErrors(t *testing.T) {
+	var confErr *ConfigError
+	_, err := OpenDB(DBConfig{DatabaseType: "oracle", ConnStr: "x"})
+	if !errors.As(err, &confErr) || confErr.Module != ModuleDatabase {
+		t.Errorf("expect database ConfigError, got %v", err)
+	}
+	var connErr *ConnectError
+	missing := filepath.Join(t.TempDir(), "missing", "test.db")
+	_, err = OpenDB(DBConfig{Name: "missing", DatabaseType: "sqlite3", ConnStr: missing})
+	if !errors.As(err, &connErr) || connErr.Module != ModuleDatabase || connErr.Target != "missing" {
+		t.Errorf("expect database ConnectError, got %v", err)
+	}
+}
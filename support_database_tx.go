@@ -0,0 +1,281 @@
+package bootx
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+//no retry unless TxRetry, fn may have side effects out of the tx
+const DefaultTxMaxRetries = 0
+
+type TxOptions struct {
+	ReadOnly  bool
+	Isolation sql.IsolationLevel
+	//retry the whole tx on deadlock or serialization failure, fn must be safe to re-run
+	MaxRetries int
+}
+
+type TxOption func(opts *TxOptions)
+
+func TxReadOnly() TxOption {
+	return func(opts *TxOptions) {
+		opts.ReadOnly = true
+	}
+}
+
+//TxIsolation e.g. sql.LevelSerializable
+func TxIsolation(level sql.IsolationLevel) TxOption {
+	return func(opts *TxOptions) {
+		opts.Isolation = level
+	}
+}
+
+//TxRetry 0 disable retry
+func TxRetry(maxRetries int) TxOption {
+	return func(opts *TxOptions) {
+		opts.MaxRetries = maxRetries
+	}
+}
+
+//txState shared by outermost tx & nested calls joined it
+type txState struct {
+	tx         *gorm.DB
+	dbType     string
+	savepoints int
+	hooksLock  sync.Mutex
+	hooks      []func()
+}
+
+//txKey per database, so tx of different databases can be nested
+type txKey struct {
+	primary *gorm.DB
+}
+
+//latest tx of any database, used by AfterCommit
+type txCurrentKey struct{}
+
+//TxCtx run fn in a tx stored in the returned ctx of fn.
+//nested call with a ctx which already holds a tx of this database joins it by savepoint,
+//options of nested call are ignored, only the outermost one retries
+func (this *DataBase) TxCtx(ctx context.Context, fn func(ctx context.Context) error, opts ...TxOption) error {
+	if state, ok := ctx.Value(txKey{this.DB}).(*txState); ok {
+		return state.savepoint(ctx, fn)
+	}
+	options := TxOptions{MaxRetries: DefaultTxMaxRetries}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	for attempt := 0; ; attempt++ {
+		err := this.runTx(ctx, options, fn)
+		if err == nil || attempt >= options.MaxRetries || !IsRetryableTxError(err) {
+			return err
+		}
+		moduleLog(ModuleDatabase).Warn("tx conflict, retry ...", "name", this.Name(), "attempt", attempt+1, "err", err)
+		//jittered exponential backoff from 10ms
+		backoff := time.Duration(10<<uint(attempt)) * time.Millisecond
+		backoff += time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (this *DataBase) runTx(ctx context.Context, options TxOptions, fn func(ctx context.Context) error) (err error) {
+	tx := this.DB.BeginTx(ctx, &sql.TxOptions{Isolation: options.Isolation, ReadOnly: options.ReadOnly})
+	if err = tx.Error; err != nil {
+		return err
+	}
+	state := &txState{tx: tx, dbType: this.DBType()}
+	txCtx := context.WithValue(context.WithValue(ctx, txKey{this.DB}, state), txCurrentKey{}, state)
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	if err = fn(txCtx); err != nil {
+		return err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return err
+	}
+	committed = true
+	state.hooksLock.Lock()
+	hooks := state.hooks
+	state.hooksLock.Unlock()
+	for _, hook := range hooks {
+		runAfterCommitHook(hook)
+	}
+	return nil
+}
+
+func runAfterCommitHook(hook func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := make([]byte, 4<<10)
+			stack = stack[:runtime.Stack(stack, false)]
+			moduleLog(ModuleDatabase).Error("after commit hook panic", "err", r, "stack", string(stack))
+		}
+	}()
+	hook()
+}
+
+//a panic of fn is propagated after rolled back to the savepoint
+func (this *txState) savepoint(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	this.savepoints++
+	name := fmt.Sprintf("bootx_sp_%d", this.savepoints)
+	create, rollback, release := savepointSQL(this.dbType)
+	if err = this.tx.Exec(create + name).Error; err != nil {
+		return errors.Wrap(err, "create savepoint failed")
+	}
+	this.hooksLock.Lock()
+	hooks := len(this.hooks)
+	this.hooksLock.Unlock()
+	done := false
+	defer func() {
+		if done {
+			return
+		}
+		this.hooksLock.Lock()
+		this.hooks = this.hooks[:hooks]
+		this.hooksLock.Unlock()
+		if rbErr := this.tx.Exec(rollback + name).Error; rbErr != nil {
+			moduleLog(ModuleDatabase).Error("rollback to savepoint failed", "savepoint", name, "err", rbErr)
+		}
+	}()
+	//ctx may hold tx of other database as the latest, reset it for AfterCommit
+	if err = fn(context.WithValue(ctx, txCurrentKey{}, this)); err != nil {
+		return err
+	}
+	done = true
+	if len(release) > 0 {
+		if err = this.tx.Exec(release + name).Error; err != nil {
+			return errors.Wrap(err, "release savepoint failed")
+		}
+	}
+	return nil
+}
+
+//statement prefixes of savepoint, release is empty if not supported
+func savepointSQL(dbType string) (create, rollback, release string) {
+	if dbType == "mssql" {
+		return "SAVE TRANSACTION ", "ROLLBACK TRANSACTION ", ""
+	}
+	return "SAVEPOINT ", "ROLLBACK TO SAVEPOINT ", "RELEASE SAVEPOINT "
+}
+
+//Conn the tx of this database in ctx, the primary if none
+func (this *DataBase) Conn(ctx context.Context) *gorm.DB {
+	if state, ok := ctx.Value(txKey{this.DB}).(*txState); ok {
+		return state.tx
+	}
+	return this.DB
+}
+
+//TxFromContext the latest tx in ctx, nil if none
+func TxFromContext(ctx context.Context) *gorm.DB {
+	if state, ok := ctx.Value(txCurrentKey{}).(*txState); ok {
+		return state.tx
+	}
+	return nil
+}
+
+//AfterCommit fn is called after the outermost tx in ctx committed, dropped if rolled back.
+//called at once if no tx in ctx, e.g. publish mqtt event only when data saved.
+//safe to call from goroutines sharing the ctx
+func AfterCommit(ctx context.Context, fn func()) {
+	if state, ok := ctx.Value(txCurrentKey{}).(*txState); ok {
+		state.hooksLock.Lock()
+		state.hooks = append(state.hooks, fn)
+		state.hooksLock.Unlock()
+		return
+	}
+	runAfterCommitHook(fn)
+}
+
+//TxWeb run fn with tx stored in ctx.Ctx(), restored after fn returned
+func (this *DataBase) TxWeb(ctx Context, fn func(ctx Context) error, opts ...TxOption) error {
+	old := ctx.Ctx()
+	defer ctx.SetCtx(old)
+	return this.TxCtx(old, func(txCtx context.Context) error {
+		ctx.SetCtx(txCtx)
+		return fn(ctx)
+	}, opts...)
+}
+
+//errors of drivers are classified by behaviour, so drivers are not linked, e.g. sqlite3 requires cgo
+type (
+	//mssql
+	sqlErrorNumber interface {
+		SQLErrorNumber() int32
+	}
+	//pgx, lib/pq >= 1.10
+	sqlStateError interface {
+		SQLState() string
+	}
+	//lib/pq, Get('C') is the sqlstate
+	pqFieldError interface {
+		Get(k byte) string
+	}
+)
+
+//IsRetryableTxError deadlock or serialization failure of supported databases
+func IsRetryableTxError(err error) bool {
+	err = errors.Cause(err)
+	if err == nil {
+		return false
+	}
+	switch e := err.(type) {
+	case sqlErrorNumber:
+		return e.SQLErrorNumber() == 1205
+	case sqlStateError:
+		//serialization_failure, deadlock_detected
+		return isRetryableSQLState(e.SQLState())
+	case pqFieldError:
+		return isRetryableSQLState(e.Get('C'))
+	}
+	msg := err.Error()
+	//mysql "Error 1213: ...", deadlock, lock wait timeout
+	var number int
+	if _, scanErr := fmt.Sscanf(msg, "Error %d", &number); scanErr == nil {
+		return number == 1213 || number == 1205
+	}
+	//sqlite3 SQLITE_BUSY & SQLITE_LOCKED
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
+
+//isDuplicateKeyError unique constraint violation of supported databases
+func isDuplicateKeyError(err error) bool {
+	err = errors.Cause(err)
+	if err == nil {
+		return false
+	}
+	switch e := err.(type) {
+	case sqlErrorNumber:
+		return e.SQLErrorNumber() == 2627 || e.SQLErrorNumber() == 2601
+	case sqlStateError:
+		return e.SQLState() == "23505"
+	case pqFieldError:
+		return e.Get('C') == "23505"
+	}
+	msg := err.Error()
+	var number int
+	if _, scanErr := fmt.Sscanf(msg, "Error %d", &number); scanErr == nil {
+		return number == 1062
+	}
+	return strings.Contains(msg, "UNIQUE constraint failed")
+}
+
+func isRetryableSQLState(state string) bool {
+	return state == "40001" || state == "40P01"
+}
@@ -0,0 +1,194 @@
+package bootx
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type txTestRow struct {
+	Id   int `gorm:"primary_key"`
+	Name string
+}
+
+func txTestNames(t *testing.T, db *DataBase) []string {
+	t.Helper()
+	rows := make([]*txTestRow, 0)
+	if err := db.Order("id").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	out := make([]string, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, r.Name)
+	}
+	return out
+}
+
+func TestTxCtxNested(t *testing.T) {
+	errInner := errors.New("inner failed")
+	errOuter := errors.New("outer failed")
+	cases := []struct {
+		name     string
+		innerErr error
+		outerErr error
+		expect   []string
+		hooks    []string
+	}{
+		{name: "all committed", expect: []string{"outer", "inner"}, hooks: []string{"outer", "inner"}},
+		{name: "inner rolled back to savepoint", innerErr: errInner, expect: []string{"outer"}, hooks: []string{"outer"}},
+		{name: "outer rolled back", outerErr: errOuter, expect: []string{}, hooks: []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := openTestDB(t, DBConfig{})
+			if err := db.AutoMigrate(&txTestRow{}).Error; err != nil {
+				t.Fatal(err)
+			}
+			hooks := make([]string, 0)
+			err := db.TxCtx(context.Background(), func(ctx context.Context) error {
+				if err := db.Conn(ctx).Create(&txTestRow{Name: "outer"}).Error; err != nil {
+					return err
+				}
+				AfterCommit(ctx, func() { hooks = append(hooks, "outer") })
+				innerErr := db.TxCtx(ctx, func(ctx context.Context) error {
+					if err := db.Conn(ctx).Create(&txTestRow{Name: "inner"}).Error; err != nil {
+						return err
+					}
+					AfterCommit(ctx, func() { hooks = append(hooks, "inner") })
+					return c.innerErr
+				})
+				if innerErr != c.innerErr {
+					return fmt.Errorf("inner tx returned %v", innerErr)
+				}
+				return c.outerErr
+			})
+			if errors.Cause(err) != c.outerErr {
+				t.Fatalf("expect %v, got %v", c.outerErr, err)
+			}
+			if names := txTestNames(t, db); fmt.Sprint(names) != fmt.Sprint(c.expect) {
+				t.Errorf("expect rows %v, got %v", c.expect, names)
+			}
+			if fmt.Sprint(hooks) != fmt.Sprint(c.hooks) {
+				t.Errorf("expect hooks %v, got %v", c.hooks, hooks)
+			}
+		})
+	}
+}
+
+func TestAfterCommitConcurrent(t *testing.T) {
+	const workers = 20
+	db := openTestDB(t, DBConfig{})
+	called := int32(0)
+	err := db.TxCtx(context.Background(), func(ctx context.Context) error {
+		wg := sync.WaitGroup{}
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				AfterCommit(ctx, func() { atomic.AddInt32(&called, 1) })
+			}()
+		}
+		wg.Wait()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called != workers {
+		t.Errorf("expect %d hooks called, got %d", workers, called)
+	}
+}
+
+func TestTxCtxRetry(t *testing.T) {
+	deadlock := errors.New("Error 1213: Deadlock found when trying to get lock")
+	badInput := errors.New("bad input")
+	cases := []struct {
+		name   string
+		errs   []error
+		opts   []TxOption
+		calls  int
+		expect error
+	}{
+		{name: "retried until succeeded", errs: []error{deadlock, deadlock, nil}, opts: []TxOption{TxRetry(3)}, calls: 3},
+		{name: "max retries exceeded", errs: []error{deadlock, deadlock, deadlock, deadlock, deadlock}, opts: []TxOption{TxRetry(3)}, calls: 4, expect: deadlock},
+		{name: "not retryable", errs: []error{badInput, nil}, calls: 1, expect: badInput},
+		{name: "retry disabled", errs: []error{deadlock, nil}, opts: []TxOption{TxRetry(0)}, calls: 1, expect: deadlock},
+		{name: "no retry by default", errs: []error{deadlock, nil}, calls: 1, expect: deadlock},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := openTestDB(t, DBConfig{})
+			calls := 0
+			err := db.TxCtx(context.Background(), func(ctx context.Context) error {
+				err := c.errs[calls]
+				calls++
+				return err
+			}, c.opts...)
+			if calls != c.calls {
+				t.Errorf("expect %d calls, got %d", c.calls, calls)
+			}
+			if err != c.expect {
+				t.Errorf("expect %v, got %v", c.expect, err)
+			}
+		})
+	}
+}
+
+//drivers are not linked, errors are matched by behaviour
+type testSQLErrorNumber int32
+
+func (e testSQLErrorNumber) Error() string         { return fmt.Sprintf("mssql error %d", int32(e)) }
+func (e testSQLErrorNumber) SQLErrorNumber() int32 { return int32(e) }
+
+type testSQLStateError string
+
+func (e testSQLStateError) Error() string    { return "pgx error " + string(e) }
+func (e testSQLStateError) SQLState() string { return string(e) }
+
+type testPqError string
+
+func (e testPqError) Error() string { return "pq error " + string(e) }
+func (e testPqError) Get(k byte) string {
+	if k == 'C' {
+		return string(e)
+	}
+	return ""
+}
+
+func TestIsRetryableTxError(t *testing.T) {
+	cases := []struct {
+		name      string
+		err       error
+		retryable bool
+		duplicate bool
+	}{
+		{name: "nil", err: nil},
+		{name: "plain", err: errors.New("connection refused")},
+		{name: "mssql deadlock", err: testSQLErrorNumber(1205), retryable: true},
+		{name: "mssql duplicate", err: testSQLErrorNumber(2627), duplicate: true},
+		{name: "pgx serialization failure", err: testSQLStateError("40001"), retryable: true},
+		{name: "pgx deadlock", err: testSQLStateError("40P01"), retryable: true},
+		{name: "pgx unique violation", err: testSQLStateError("23505"), duplicate: true},
+		{name: "pq deadlock", err: testPqError("40P01"), retryable: true},
+		{name: "pq unique violation", err: testPqError("23505"), duplicate: true},
+		{name: "mysql deadlock", err: errors.New("Error 1213: Deadlock found when trying to get lock"), retryable: true},
+		{name: "mysql lock wait timeout", err: errors.New("Error 1205: Lock wait timeout exceeded"), retryable: true},
+		{name: "mysql duplicate", err: errors.New("Error 1062: Duplicate entry 'a' for key 'dedup_key'"), duplicate: true},
+		{name: "sqlite busy", err: errors.New("database is locked"), retryable: true},
+		{name: "sqlite unique", err: errors.New("UNIQUE constraint failed: bootx_outbox.dedup_key"), duplicate: true},
+		{name: "wrapped", err: errors.Wrap(testSQLStateError("40001"), "commit failed"), retryable: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := IsRetryableTxError(c.err); got != c.retryable {
+				t.Errorf("IsRetryableTxError expect %v, got %v", c.retryable, got)
+			}
+			if got := isDuplicateKeyError(c.err); got != c.duplicate {
+				t.Errorf("isDuplicateKeyError expect %v, got %v", c.duplicate, got)
+			}
+		})
+	}
+}
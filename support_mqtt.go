@@ -1,6 +1,8 @@
 package bootx
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -9,6 +11,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -39,120 +42,422 @@ const (
 )
 
 const (
-	MqttDefaultTimeoutSec = 20
-	MqttDefaultRetainMsg  = true
-	MqttDefaultQos        = Lv2OnlyOnce
-	applicationJson       = "application/json"
+	MqttDefaultTimeoutSec     = 20
+	MqttDefaultRetainMsg      = true
+	MqttDefaultQos            = Lv2OnlyOnce
+	MqttDefaultMaxConcurrency = 16
+	MqttDefaultMaxBatchSize   = 100
+	applicationJson           = "application/json"
+	mqttIdleConnTimeout       = 90 * time.Second
 )
 
 type mqttPubReq struct {
-	Topic    string `json:"topic"`
-	Payload  string `json:"payload"`
-	Qos      Qos    `json:"qos"`
-	Retain   bool   `json:"retain"`
-	ClientId string `json:"client_id"`
+	Topic string `json:"topic"`
+	//json string of marshaled msg, quoted once when req created, copied as is when req marshaled
+	Payload  json.RawMessage `json:"payload"`
+	Qos      Qos             `json:"qos"`
+	Retain   bool            `json:"retain"`
+	ClientId string          `json:"client_id"`
 }
 
 type mqttPubRsp struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	//result of each message of batch publish
+	Data []*mqttPubRsp `json:"data"`
 }
 
-func newHttpClient(timeoutSec int64) *http.Client {
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
-		DisableKeepAlives: true,
+//mqttPubTransport keep-alive connections are pooled, at most maxConns per host.
+//pool is replaced when tls files reloaded
+type mqttPubTransport struct {
+	lock     sync.RWMutex
+	cur      *http.Transport
+	maxConns int
+}
+
+func newMqttPubTransport(maxConns int, tlsConf *tls.Config) *mqttPubTransport {
+	this := &mqttPubTransport{maxConns: maxConns}
+	this.cur = this.newTransport(tlsConf)
+	return this
+}
+
+func (this *mqttPubTransport) newTransport(tlsConf *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConf,
+		MaxIdleConns:        this.maxConns,
+		MaxIdleConnsPerHost: this.maxConns,
+		MaxConnsPerHost:     this.maxConns,
+		IdleConnTimeout:     mqttIdleConnTimeout,
 	}
+}
+
+func (this *mqttPubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	this.lock.RLock()
+	cur := this.cur
+	this.lock.RUnlock()
+	return cur.RoundTrip(req)
+}
+
+//in flight requests of old pool are not interrupted
+func (this *mqttPubTransport) swap(tlsConf *tls.Config) {
+	next := this.newTransport(tlsConf)
+	this.lock.Lock()
+	old := this.cur
+	this.cur = next
+	this.lock.Unlock()
+	old.CloseIdleConnections()
+}
+
+func (this *mqttPubTransport) CloseIdleConnections() {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	this.cur.CloseIdleConnections()
+}
+
+func newHttpClient(timeoutSec int64, transport http.RoundTripper) *http.Client {
 	return &http.Client{
 		Transport: transport,
 		Timeout:   time.Second * time.Duration(timeoutSec),
 	}
 }
 
+type MqttConfig struct {
+	//http publish api of emqx, MqttPub()
+	PubApiAddr string `yaml:"pubApiAddr" json:"pubApiAddr" validate:"required_without=Brokers,omitempty,url"`
+	//http batch publish api of emqx, default PubApiAddr + "_batch" if PubApiAddr ends with "/publish"
+	BatchPubApiAddr string `yaml:"batchPubApiAddr" json:"batchPubApiAddr" validate:"omitempty,url"`
+	UserName        string `yaml:"userName" json:"userName"`
+	Password        string `yaml:"password" json:"password"`
+	TimeoutSec      int64  `yaml:"timeout" json:"timeout" validate:"min=0,max=600"`
+	Debug           bool   `yaml:"debug" json:"debug"`
+	ClientIdPrefix  string `yaml:"clientIdPrefix" json:"clientIdPrefix"`
+	//max in flight http requests of MqttPub(), also size of connection pool
+	MaxConcurrency int `yaml:"maxConcurrency" json:"maxConcurrency" validate:"min=0,max=1024"`
+	//max messages per batch publish request, larger batch is split
+	MaxBatchSize int `yaml:"maxBatchSize" json:"maxBatchSize" validate:"min=0,max=10000"`
+	//tls of https publish api, server certificate is verified by system roots if empty
+	PubApiTLS TLSConfig `yaml:"pubApiTLS" json:"pubApiTLS"`
+	//native client, MqttCli(), e.g. tcp://127.0.0.1:1883, ssl://127.0.0.1:8883, ws://127.0.0.1:8083/mqtt
+	Brokers []string `yaml:"brokers" json:"brokers" validate:"dive,url"`
+	//default ClientIdPrefix + uuid, must be fixed if PersistentSession
+	ClientId string `yaml:"clientId" json:"clientId"`
+	//3 = mqtt 3.1, 4 = mqtt 3.1.1, 5 = mqtt 5
+	ProtocolVersion uint `yaml:"protocolVersion" json:"protocolVersion" validate:"omitempty,oneof=3 4 5"`
+	//clean session = false, broker keep subscriptions & qos1/2 messages while offline
+	PersistentSession       bool  `yaml:"persistentSession" json:"persistentSession"`
+	KeepAliveSec            int64 `yaml:"keepAlive" json:"keepAlive" validate:"min=0,max=3600"`
+	MaxReconnectIntervalSec int64 `yaml:"maxReconnectInterval" json:"maxReconnectInterval" validate:"min=0,max=3600"`
+	//seconds to retry connecting at startup, bootstrap failed if still unreachable. 0 no retry, -1 connect in background
+	ConnectMaxWait int64 `yaml:"connectMaxWait" json:"connectMaxWait" validate:"min=-1,max=3600"`
+	//received messages buffered per worker, default 256
+	ReceiveQueueSize int `yaml:"receiveQueueSize" json:"receiveQueueSize" validate:"min=0,max=65536"`
+	//which message is dropped when queue of worker is full, default drop_new
+	ReceiveOverflow string `yaml:"receiveOverflow" json:"receiveOverflow" validate:"omitempty,oneof=drop_new drop_oldest"`
+}
+
+var MqttDefaultConfig = MqttConfig{
+	TimeoutSec:              MqttDefaultTimeoutSec,
+	MaxConcurrency:          MqttDefaultMaxConcurrency,
+	MaxBatchSize:            MqttDefaultMaxBatchSize,
+	ProtocolVersion:         MqttProtocolV311,
+	KeepAliveSec:            MqttDefaultKeepAliveSec,
+	MaxReconnectIntervalSec: MqttDefaultMaxReconnectInterval,
+	ReceiveQueueSize:        MqttDefaultReceiveQueueSize,
+	ReceiveOverflow:         MqttReceiveDropNew,
+}
+
 type MqttPubCli struct {
 	httpCli        *http.Client
+	sem            chan struct{}
+	tls            *tlsReloader
 	MqttPubApiAddr string
-	Timeout        int64
-	Debug          bool
-	UserName       string
-	Password       string
-	ClientIdPrefix string
+	//batch publish api, PublishBatch()
+	MqttBatchPubApiAddr string
+	MaxBatchSize        int
+	Timeout             int64
+	Debug               bool
+	UserName            string
+	Password            string
+	ClientIdPrefix      string
+}
+
+//MqttPubMessage item of PublishBatch
+type MqttPubMessage struct {
+	Topic  string
+	Msg    interface{}
+	Qos    Qos
+	Retain bool
+}
+
+//MqttBatchError some messages of batch failed, others are published
+type MqttBatchError struct {
+	Total int
+	//index of message -> error
+	Failed map[int]error
+}
+
+//message of first failed one is included
+func (this *MqttBatchError) Error() string {
+	first := -1
+	for idx := range this.Failed {
+		if first < 0 || idx < first {
+			first = idx
+		}
+	}
+	if first < 0 {
+		return fmt.Sprintf("mqtt batch publish 0/%d failed", this.Total)
+	}
+	return fmt.Sprintf("mqtt batch publish %d/%d failed, [%d] : %s", len(this.Failed), this.Total, first, this.Failed[first])
+}
+
+//MqttPubFuture result of PublishAsync
+type MqttPubFuture struct {
+	done chan struct{}
+	err  error
+}
+
+func newMqttPubFuture() *MqttPubFuture {
+	return &MqttPubFuture{done: make(chan struct{})}
+}
+
+func (this *MqttPubFuture) complete(err error) {
+	this.err = err
+	close(this.done)
+}
+
+//Done closed when publish finished
+func (this *MqttPubFuture) Done() <-chan struct{} {
+	return this.done
+}
+
+//Err result of publish, nil if not finished yet
+func (this *MqttPubFuture) Err() error {
+	select {
+	case <-this.done:
+		return this.err
+	default:
+		return nil
+	}
+}
+
+//Wait block until publish finished or ctx done, the publish is not canceled by ctx of Wait
+func (this *MqttPubFuture) Wait(ctx context.Context) error {
+	select {
+	case <-this.done:
+		return this.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 //noinspection ALL
 func NewMqttPubCli(mqttPubApiUrl, username, pass string, timeoutSec int64, debug bool) *MqttPubCli {
+	cli, err := newMqttPubCli(mqttPubApiUrl, username, pass, timeoutSec, debug, MqttDefaultMaxConcurrency, TLSConfig{})
+	std.AssertError(err, "mqtt init failed")
+	return cli
+}
+
+func newMqttPubCli(mqttPubApiUrl, username, pass string, timeoutSec int64, debug bool, maxConcurrency int,
+	tlsConf TLSConfig) (*MqttPubCli, error) {
 	if timeoutSec <= 0 {
 		timeoutSec = MqttDefaultTimeoutSec
 	}
+	if maxConcurrency <= 0 {
+		maxConcurrency = MqttDefaultMaxConcurrency
+	}
+	reloader, err := newClientTLSReloader(ModuleMqtt, tlsConf)
+	if err != nil {
+		return nil, err
+	}
+	transport := newMqttPubTransport(maxConcurrency, reloader.Config())
+	reloader.OnReload(transport.swap)
 	cli := &MqttPubCli{
-		httpCli:        newHttpClient(timeoutSec),
-		MqttPubApiAddr: mqttPubApiUrl,
-		UserName:       username,
-		Password:       pass,
-		Timeout:        timeoutSec,
-		Debug:          debug,
+		httpCli:             newHttpClient(timeoutSec, transport),
+		sem:                 make(chan struct{}, maxConcurrency),
+		tls:                 reloader,
+		MqttPubApiAddr:      mqttPubApiUrl,
+		MqttBatchPubApiAddr: defaultMqttBatchPubApiAddr(mqttPubApiUrl),
+		MaxBatchSize:        MqttDefaultMaxBatchSize,
+		UserName:            username,
+		Password:            pass,
+		Timeout:             timeoutSec,
+		Debug:               debug,
 	}
 	cli.httpCli.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		req.SetBasicAuth(username, pass)
 		return nil
 	}
+	return cli, nil
+}
+
+//emqx: /api/v4/mqtt/publish -> /api/v4/mqtt/publish_batch
+func defaultMqttBatchPubApiAddr(pubApiAddr string) string {
+	if strings.HasSuffix(pubApiAddr, "/publish") {
+		return pubApiAddr + "_batch"
+	}
+	return ""
+}
+
+func NewMqttPubCliWithConf(conf MqttConfig) *MqttPubCli {
+	cli, err := OpenMqttPub(conf)
+	std.AssertError(err, "mqtt init failed")
 	return cli
 }
 
+func OpenMqttPub(conf MqttConfig) (*MqttPubCli, error) {
+	if len(conf.PubApiAddr) == 0 {
+		return nil, &ConfigError{Module: ModuleMqtt, Err: errors.New("pubApiAddr required")}
+	}
+	if err := std.ValidateStruct(conf); err != nil {
+		return nil, &ConfigError{Module: ModuleMqtt, Err: err}
+	}
+	cli, err := newMqttPubCli(conf.PubApiAddr, conf.UserName, conf.Password, conf.TimeoutSec, conf.Debug,
+		conf.MaxConcurrency, conf.PubApiTLS)
+	if err != nil {
+		return nil, err
+	}
+	cli.ClientIdPrefix = conf.ClientIdPrefix
+	if len(conf.BatchPubApiAddr) > 0 {
+		cli.MqttBatchPubApiAddr = conf.BatchPubApiAddr
+	}
+	if conf.MaxBatchSize > 0 {
+		cli.MaxBatchSize = conf.MaxBatchSize
+	}
+	return cli, nil
+}
+
 func NewMqttPubCli1(mqttPubApiUrl, username, pass string) *MqttPubCli {
 	return NewMqttPubCli(mqttPubApiUrl, username, pass, MqttDefaultTimeoutSec, false)
 }
 
-func (this *MqttPubCli) postJson(body string) (string, error) {
+//acquire a slot of in flight requests
+func (this *MqttPubCli) acquire(ctx context.Context) error {
+	select {
+	case this.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (this *MqttPubCli) release() {
+	<-this.sem
+}
+
+//Close release idle pooled connections & stop watching tls files
+func (this *MqttPubCli) Close() {
+	this.tls.Stop()
+	this.httpCli.CloseIdleConnections()
+}
+
+func (this *MqttPubCli) postJson(ctx context.Context, addr string, body []byte) ([]byte, error) {
 	if this.Debug {
-		logger.Printf("mqtt pub by http post %s :\n %s", this.MqttPubApiAddr, body)
+		moduleLog(ModuleMqtt).Info("mqtt pub by http post", "addr", addr, "body", string(body))
 	}
-	req, err := http.NewRequest("POST", this.MqttPubApiAddr, strings.NewReader(body))
+	req, err := http.NewRequest("POST", addr, bytes.NewReader(body))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	req = req.WithContext(ctx)
 	req.SetBasicAuth(this.UserName, this.Password)
 	req.Header.Set("Content-Type", applicationJson)
 	resp, err := this.httpCli.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	//body must be read to the end, so the connection is reused
 	defer func() { _ = resp.Body.Close() }()
-	b, readErr := ioutil.ReadAll(resp.Body)
-	if readErr != nil {
-		return "", readErr
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("mqtt publish api response status %d : %s", resp.StatusCode, b)
 	}
-	return string(b), nil
+	return b, nil
 }
 
-func (this *MqttPubCli) Publish(topic string, msg interface{}, qos Qos, retainMsg bool) error {
+func (this *MqttPubCli) newPubReq(topic string, msg interface{}, qos Qos, retainMsg bool) (*mqttPubReq, error) {
 	msgBs, err := json.Marshal(msg)
 	if err != nil {
-		return errors.New(fmt.Sprintf("marshal msg to json failed : %s", err))
+		return nil, fmt.Errorf("marshal msg to json failed : %s", err)
 	}
-	mqttPubReq := mqttPubReq{
+	//payload of publish api is a string
+	payload, err := json.Marshal(string(msgBs))
+	if err != nil {
+		return nil, fmt.Errorf("marshal msg to json failed : %s", err)
+	}
+	return &mqttPubReq{
 		Topic:    topic,
-		Payload:  string(msgBs),
+		Payload:  payload,
 		Qos:      qos,
 		Retain:   retainMsg,
-		ClientId: fmt.Sprintf("%s%s", this.ClientIdPrefix, std.GenRandomUUID()),
+		ClientId: this.ClientIdPrefix + std.GenRandomUUID(),
+	}, nil
+}
+
+func mqttPubResult(err error) {
+	if err != nil {
+		mqttPublishTotal.Inc("failure")
+	} else {
+		mqttPublishTotal.Inc("success")
 	}
-	bs, err := json.Marshal(mqttPubReq)
+}
+
+func (this *MqttPubCli) Publish(topic string, msg interface{}, qos Qos, retainMsg bool) error {
+	return this.PublishCtx(context.Background(), topic, msg, qos, retainMsg)
+}
+
+//PublishCtx ctx cancel the waiting of a free slot & the http request
+func (this *MqttPubCli) PublishCtx(ctx context.Context, topic string, msg interface{}, qos Qos, retainMsg bool) error {
+	if err := this.acquire(ctx); err != nil {
+		mqttPubResult(err)
+		return err
+	}
+	defer this.release()
+	err := this.publish(ctx, topic, msg, qos, retainMsg)
+	mqttPubResult(err)
+	return err
+}
+
+//PublishAsync block only while all slots are busy, then publish in background.
+//ctx is used by the publish, not only the waiting
+func (this *MqttPubCli) PublishAsync(ctx context.Context, topic string, msg interface{}, qos Qos, retainMsg bool) *MqttPubFuture {
+	future := newMqttPubFuture()
+	if err := this.acquire(ctx); err != nil {
+		mqttPubResult(err)
+		future.complete(err)
+		return future
+	}
+	go func() {
+		defer this.release()
+		err := this.publish(ctx, topic, msg, qos, retainMsg)
+		mqttPubResult(err)
+		future.complete(err)
+	}()
+	return future
+}
+
+func (this *MqttPubCli) publish(ctx context.Context, topic string, msg interface{}, qos Qos, retainMsg bool) error {
+	pubReq, err := this.newPubReq(topic, msg, qos, retainMsg)
 	if err != nil {
-		return errors.New(fmt.Sprintf("marshal mqtt publish req failed : %s", err))
+		return err
+	}
+	bs, err := json.Marshal(pubReq)
+	if err != nil {
+		return fmt.Errorf("marshal mqtt publish req failed : %s", err)
 	}
-	ack, err := this.postJson(string(bs))
+	ack, err := this.postJson(ctx, this.MqttPubApiAddr, bs)
 	if err != nil {
 		return err
 	}
 	rsp := new(mqttPubRsp)
-	if err = json.Unmarshal([]byte(ack), rsp); err != nil {
-		return errors.New(fmt.Sprintf("unmarshal mqtt response failed : %s", err))
+	if err = json.Unmarshal(ack, rsp); err != nil {
+		return fmt.Errorf("unmarshal mqtt response failed : %s", err)
 	}
 	if rsp.Code != 0 {
-		return errors.New(fmt.Sprintf("mqtt publish to '%s' failed : %s", topic, rsp.Message))
+		return fmt.Errorf("mqtt publish to '%s' failed : %s", topic, rsp.Message)
 	}
 	return nil
 }
@@ -160,3 +465,161 @@ func (this *MqttPubCli) Publish(topic string, msg interface{}, qos Qos, retainMs
 func (this *MqttPubCli) Publish1(topic string, msg interface{}) error {
 	return this.Publish(topic, msg, MqttDefaultQos, MqttDefaultRetainMsg)
 }
+
+//PublishBatch publish by batch api, split into requests of MaxBatchSize which are sent concurrently.
+//return *MqttBatchError if some messages failed
+func (this *MqttPubCli) PublishBatch(ctx context.Context, msgs ...*MqttPubMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	if len(this.MqttBatchPubApiAddr) == 0 {
+		return errors.New("mqtt batch publish api addr required")
+	}
+	size := this.MaxBatchSize
+	if size <= 0 {
+		size = MqttDefaultMaxBatchSize
+	}
+	batchErr := &MqttBatchError{Total: len(msgs), Failed: make(map[int]error)}
+	lock := sync.Mutex{}
+	onFailed := func(offset int, errs []error) {
+		lock.Lock()
+		defer lock.Unlock()
+		for idx, err := range errs {
+			if err != nil {
+				batchErr.Failed[offset+idx] = err
+			}
+		}
+	}
+	wg := sync.WaitGroup{}
+	for offset := 0; offset < len(msgs); offset += size {
+		end := offset + size
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+		chunk := msgs[offset:end]
+		if err := this.acquire(ctx); err != nil {
+			errs := make([]error, len(msgs)-offset)
+			for idx := range errs {
+				errs[idx] = err
+			}
+			onFailed(offset, errs)
+			break
+		}
+		wg.Add(1)
+		go func(offset int, chunk []*MqttPubMessage) {
+			defer wg.Done()
+			defer this.release()
+			onFailed(offset, this.publishBatch(ctx, chunk))
+		}(offset, chunk)
+	}
+	wg.Wait()
+	for idx := range msgs {
+		mqttPubResult(batchErr.Failed[idx])
+	}
+	if len(batchErr.Failed) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+//return error of each message
+func (this *MqttPubCli) publishBatch(ctx context.Context, msgs []*MqttPubMessage) []error {
+	errs := make([]error, len(msgs))
+	failAll := func(err error) []error {
+		for idx := range errs {
+			errs[idx] = err
+		}
+		return errs
+	}
+	reqs := make([]*mqttPubReq, 0, len(msgs))
+	//index of reqs -> index of msgs
+	reqIdx := make([]int, 0, len(msgs))
+	for idx, msg := range msgs {
+		pubReq, err := this.newPubReq(msg.Topic, msg.Msg, msg.Qos, msg.Retain)
+		if err != nil {
+			errs[idx] = err
+			continue
+		}
+		reqs = append(reqs, pubReq)
+		reqIdx = append(reqIdx, idx)
+	}
+	if len(reqs) == 0 {
+		return errs
+	}
+	bs, err := json.Marshal(reqs)
+	if err != nil {
+		return failAll(fmt.Errorf("marshal mqtt batch publish req failed : %s", err))
+	}
+	ack, err := this.postJson(ctx, this.MqttBatchPubApiAddr, bs)
+	if err != nil {
+		return failAll(err)
+	}
+	rsp := new(mqttPubRsp)
+	if err = json.Unmarshal(ack, rsp); err != nil {
+		return failAll(fmt.Errorf("unmarshal mqtt response failed : %s", err))
+	}
+	if rsp.Code != 0 {
+		return failAll(fmt.Errorf("mqtt batch publish failed : %s", rsp.Message))
+	}
+	//result of each message is optional
+	for idx, item := range rsp.Data {
+		if idx >= len(reqIdx) || item == nil || item.Code == 0 {
+			continue
+		}
+		errs[reqIdx[idx]] = fmt.Errorf("mqtt publish to '%s' failed : code %d", reqs[idx].Topic, item.Code)
+	}
+	return errs
+}
+
+var gMqttPubCli *MqttPubCli = nil
+var mqttOnce = initOnce{}
+
+func MqttPub() *MqttPubCli {
+	std.Assert(gMqttPubCli != nil, "mqtt not init yet")
+	return gMqttPubCli
+}
+
+func mqttInitWithConfig(conf MqttConfig) error {
+	return mqttOnce.Do(func() error {
+		moduleLog(ModuleMqtt).Info("mqtt init ...", "pubApiAddr", conf.PubApiAddr, "brokers", conf.Brokers)
+		var pub *MqttPubCli
+		var cli *MqttClient
+		var err error
+		if len(conf.PubApiAddr) > 0 {
+			if pub, err = OpenMqttPub(conf); err != nil {
+				return err
+			}
+		}
+		if len(conf.Brokers) > 0 {
+			if cli, err = NewMqttClient(conf); err != nil {
+				if pub != nil {
+					pub.Close()
+				}
+				return err
+			}
+		}
+		gMqttPubCli, gMqttCli = pub, cli
+		return nil
+	})
+}
+
+func mqttStart() error {
+	if gMqttCli != nil {
+		return gMqttCli.Start()
+	}
+	return nil
+}
+
+func mqttReset() {
+	gMqttPubCli, gMqttCli = nil, nil
+	mqttOnce.reset()
+}
+
+func mqttCleanup() {
+	if gMqttCli != nil {
+		gMqttCli.Close()
+	}
+	if gMqttPubCli != nil {
+		gMqttPubCli.Close()
+	}
+}
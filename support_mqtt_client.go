@@ -0,0 +1,554 @@
+package bootx
+
+import (
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gen-iot/std"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//mqtt 3.1 & 3.1.1 are served by paho.mqtt.golang, mqtt 5 by paho.golang
+const (
+	MqttProtocolV31                 = 3
+	MqttProtocolV311                = 4
+	MqttProtocolV5                  = 5
+	MqttDefaultKeepAliveSec         = 30
+	MqttDefaultMaxReconnectInterval = 60
+	mqttDisconnectQuiesceMs         = 250
+	mqttInitialReconnectIntervalSec = 1
+	MqttDefaultReceiveQueueSize     = 256
+	//messages of a topic are handled in order by the same worker
+	mqttDispatchWorkers = 4
+)
+
+//overflow policy when receive queue of a worker is full, dropped messages are counted by metrics
+const (
+	MqttReceiveDropNew    = "drop_new"
+	MqttReceiveDropOldest = "drop_oldest"
+)
+
+var ErrMqttNotConnected = errors.New("mqtt not connected")
+
+//MqttMessage is the received publish packet
+type MqttMessage struct {
+	Topic     string
+	Payload   []byte
+	Qos       Qos
+	Retained  bool
+	Duplicate bool
+	MessageId uint16
+}
+
+//Bind unmarshal json payload
+func (this *MqttMessage) Bind(v interface{}) error {
+	return json.Unmarshal(this.Payload, v)
+}
+
+//MqttHandlerFunc handle message of subscription, returned error is logged
+type MqttHandlerFunc func(msg *MqttMessage) error
+
+//mqttConn is the transport of MqttClient, one per protocol version
+type mqttConn interface {
+	//connect once, wait at most timeout
+	connect() error
+	isConnected() bool
+	subscribe(pattern string, qos Qos) error
+	unsubscribe(patterns ...string) error
+	publish(topic string, qos Qos, retain bool, payload []byte) error
+	close()
+}
+
+type mqttSubscription struct {
+	pattern string
+	qos     Qos
+	handler MqttHandlerFunc
+}
+
+//MqttClient is a persistent mqtt connection,
+//subscriptions are kept & resubscribed after reconnect
+type MqttClient struct {
+	conf      MqttConfig
+	conn      mqttConn
+	lock      *sync.RWMutex
+	subs      []*mqttSubscription
+	stopChan  chan struct{}
+	stopOnce  *sync.Once
+	startOnce *initOnce
+	queues    []chan *MqttMessage
+}
+
+//NewMqttClient create client by MqttConfig.Brokers, connect by Start()
+func NewMqttClient(conf MqttConfig) (*MqttClient, error) {
+	if len(conf.Brokers) == 0 {
+		return nil, &ConfigError{Module: ModuleMqtt, Err: errors.New("brokers required")}
+	}
+	if err := std.ValidateStruct(conf); err != nil {
+		return nil, &ConfigError{Module: ModuleMqtt, Err: err}
+	}
+	if conf.TimeoutSec <= 0 {
+		conf.TimeoutSec = MqttDefaultTimeoutSec
+	}
+	if conf.KeepAliveSec <= 0 {
+		conf.KeepAliveSec = MqttDefaultKeepAliveSec
+	}
+	if conf.MaxReconnectIntervalSec <= 0 {
+		conf.MaxReconnectIntervalSec = MqttDefaultMaxReconnectInterval
+	}
+	if conf.ProtocolVersion == 0 {
+		conf.ProtocolVersion = MqttProtocolV311
+	}
+	if conf.ReceiveQueueSize <= 0 {
+		conf.ReceiveQueueSize = MqttDefaultReceiveQueueSize
+	}
+	if len(conf.ReceiveOverflow) == 0 {
+		conf.ReceiveOverflow = MqttReceiveDropNew
+	}
+	if len(conf.ClientId) == 0 {
+		conf.ClientId = conf.ClientIdPrefix + std.GenRandomUUID()
+	}
+	this := &MqttClient{
+		conf:      conf,
+		lock:      &sync.RWMutex{},
+		subs:      make([]*mqttSubscription, 0),
+		stopChan:  make(chan struct{}),
+		stopOnce:  &sync.Once{},
+		startOnce: &initOnce{},
+		queues:    make([]chan *MqttMessage, mqttDispatchWorkers),
+	}
+	if conf.ProtocolVersion == MqttProtocolV5 {
+		conn, err := newMqttConnV5(this)
+		if err != nil {
+			return nil, &ConfigError{Module: ModuleMqtt, Err: err}
+		}
+		this.conn = conn
+	} else {
+		this.conn = newMqttConnV3(this)
+	}
+	for i := range this.queues {
+		this.queues[i] = make(chan *MqttMessage, conf.ReceiveQueueSize)
+		go this.dispatchLoop(this.queues[i])
+	}
+	return this, nil
+}
+
+func (this *MqttClient) timeout() time.Duration {
+	return time.Second * time.Duration(this.conf.TimeoutSec)
+}
+
+func (this *MqttClient) ClientId() string {
+	return this.conf.ClientId
+}
+
+func (this *MqttClient) IsConnected() bool {
+	return this.conn.isConnected()
+}
+
+//Start connect to broker, retry until ConnectMaxWait elapsed, return *ConnectError if still unreachable.
+//with ConnectMaxWait -1, retry in background & never fail. Start can be called again after failed
+func (this *MqttClient) Start() error {
+	return this.startOnce.Do(this.start)
+}
+
+func (this *MqttClient) start() error {
+	if this.conf.ConnectMaxWait < 0 {
+		if err := this.connect(); err != nil {
+			moduleLog(ModuleMqtt).Warn("mqtt connect failed, retry in background", "brokers", this.conf.Brokers, "err", err)
+			go this.connectLoop()
+		}
+		return nil
+	}
+	deadline := time.Now().Add(time.Second * time.Duration(this.conf.ConnectMaxWait))
+	interval := time.Second * mqttInitialReconnectIntervalSec
+	maxInterval := time.Second * time.Duration(this.conf.MaxReconnectIntervalSec)
+	for attempt := 1; ; attempt++ {
+		err := this.connect()
+		if err == nil {
+			return nil
+		}
+		remain := time.Until(deadline)
+		if remain <= 0 {
+			return &ConnectError{Module: ModuleMqtt, Target: strings.Join(this.conf.Brokers, ","), Err: err}
+		}
+		if interval > remain {
+			interval = remain
+		}
+		moduleLog(ModuleMqtt).Warn("mqtt connect failed, retry ...", "brokers", this.conf.Brokers,
+			"attempt", attempt, "after", interval.String(), "err", err)
+		select {
+		case <-this.stopChan:
+			return ErrMqttNotConnected
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+func (this *MqttClient) connect() error {
+	return this.conn.connect()
+}
+
+//paho only reconnect after first connect succeeded
+func (this *MqttClient) connectLoop() {
+	interval := time.Second * mqttInitialReconnectIntervalSec
+	maxInterval := time.Second * time.Duration(this.conf.MaxReconnectIntervalSec)
+	for {
+		select {
+		case <-this.stopChan:
+			return
+		case <-time.After(interval):
+		}
+		err := this.connect()
+		if err == nil {
+			return
+		}
+		moduleLog(ModuleMqtt).Warn("mqtt connect failed", "brokers", this.conf.Brokers, "err", err)
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+//Close disconnect & stop reconnecting
+func (this *MqttClient) Close() {
+	this.stopOnce.Do(func() {
+		close(this.stopChan)
+		this.conn.close()
+	})
+}
+
+func (this *MqttClient) onConnect() {
+	moduleLog(ModuleMqtt).Info("mqtt connected", "clientId", this.conf.ClientId)
+	this.lock.RLock()
+	subs := append([]*mqttSubscription(nil), this.subs...)
+	this.lock.RUnlock()
+	for _, sub := range subs {
+		if err := this.subscribe(sub); err != nil {
+			moduleLog(ModuleMqtt).Error("mqtt resubscribe failed", "topic", sub.pattern, "err", err)
+		}
+	}
+}
+
+func (this *MqttClient) onConnectionLost(err error) {
+	moduleLog(ModuleMqtt).Warn("mqtt connection lost, reconnecting", "err", err)
+}
+
+func (this *MqttClient) subscribe(sub *mqttSubscription) error {
+	return this.conn.subscribe(sub.pattern, sub.qos)
+}
+
+//Subscribe add handler of topic pattern, '+' & '#' wildcards and $share/{group}/ are supported.
+//subscription is sent once connected if not connected yet, and resent after reconnect
+func (this *MqttClient) Subscribe(pattern string, qos Qos, handler MqttHandlerFunc) error {
+	if err := validateTopicPattern(pattern); err != nil {
+		return err
+	}
+	if qos > Lv2OnlyOnce {
+		return fmt.Errorf("invalid qos %d", qos)
+	}
+	std.Assert(handler != nil, "mqtt handler is nil")
+	sub := &mqttSubscription{pattern: pattern, qos: qos, handler: handler}
+	this.lock.Lock()
+	replaced := false
+	for i, it := range this.subs {
+		if it.pattern == pattern {
+			this.subs[i] = sub
+			replaced = true
+		}
+	}
+	if !replaced {
+		this.subs = append(this.subs, sub)
+	}
+	this.lock.Unlock()
+	if !this.IsConnected() {
+		return nil
+	}
+	return this.subscribe(sub)
+}
+
+func (this *MqttClient) Unsubscribe(patterns ...string) error {
+	this.lock.Lock()
+	removed := make(map[string]bool, len(patterns))
+	for _, p := range patterns {
+		removed[p] = true
+	}
+	subs := make([]*mqttSubscription, 0, len(this.subs))
+	for _, it := range this.subs {
+		if !removed[it.pattern] {
+			subs = append(subs, it)
+		}
+	}
+	this.subs = subs
+	this.lock.Unlock()
+	if !this.IsConnected() {
+		return nil
+	}
+	return this.conn.unsubscribe(patterns...)
+}
+
+//Publish []byte & string are sent as is, others are marshaled to json
+func (this *MqttClient) Publish(topic string, msg interface{}, qos Qos, retainMsg bool) error {
+	err := this.publish(topic, msg, qos, retainMsg)
+	if err != nil {
+		mqttPublishTotal.Inc("failure")
+	} else {
+		mqttPublishTotal.Inc("success")
+	}
+	return err
+}
+
+func (this *MqttClient) publish(topic string, msg interface{}, qos Qos, retainMsg bool) error {
+	if qos > Lv2OnlyOnce {
+		return fmt.Errorf("invalid qos %d", qos)
+	}
+	if !this.IsConnected() {
+		return ErrMqttNotConnected
+	}
+	var payload []byte
+	switch m := msg.(type) {
+	case []byte:
+		payload = m
+	case string:
+		payload = []byte(m)
+	default:
+		bs, err := json.Marshal(msg)
+		if err != nil {
+			return errors.Wrap(err, "marshal msg to json failed")
+		}
+		payload = bs
+	}
+	if err := this.conn.publish(topic, qos, retainMsg, payload); err != nil {
+		return errors.Wrapf(err, "mqtt publish to '%s' failed", topic)
+	}
+	return nil
+}
+
+func (this *MqttClient) Publish1(topic string, msg interface{}) error {
+	return this.Publish(topic, msg, MqttDefaultQos, MqttDefaultRetainMsg)
+}
+
+//call all handlers whose pattern match the topic
+//enqueue called by receiving goroutine of conn, workers are sharded by topic so order of a topic is kept.
+//never blocks, otherwise keepalive & acks of the connection are stalled by slow handlers
+func (this *MqttClient) enqueue(msg *MqttMessage) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(msg.Topic))
+	queue := this.queues[h.Sum32()%uint32(len(this.queues))]
+	select {
+	case queue <- msg:
+		return
+	default:
+	}
+	if this.conf.ReceiveOverflow == MqttReceiveDropOldest {
+		select {
+		case old := <-queue:
+			this.dropped(old)
+		default:
+		}
+	}
+	select {
+	case queue <- msg:
+	default:
+		this.dropped(msg)
+	}
+}
+
+func (this *MqttClient) dropped(msg *MqttMessage) {
+	mqttReceiveTotal.Inc("dropped")
+	moduleLog(ModuleMqtt).Warn("mqtt receive queue full, message dropped", "topic", msg.Topic,
+		"policy", this.conf.ReceiveOverflow)
+}
+
+func (this *MqttClient) dispatchLoop(queue chan *MqttMessage) {
+	for {
+		select {
+		case <-this.stopChan:
+			return
+		case msg := <-queue:
+			this.dispatch(msg)
+		}
+	}
+}
+
+func (this *MqttClient) dispatch(msg *MqttMessage) {
+	this.lock.RLock()
+	handlers := make([]MqttHandlerFunc, 0, 1)
+	for _, sub := range this.subs {
+		if MatchTopic(sub.pattern, msg.Topic) {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	this.lock.RUnlock()
+	if len(handlers) == 0 {
+		mqttReceiveTotal.Inc("unhandled")
+		moduleLog(ModuleMqtt).Warn("mqtt message unhandled", "topic", msg.Topic)
+		return
+	}
+	for _, h := range handlers {
+		if err := callMqttHandler(h, msg); err != nil {
+			mqttReceiveTotal.Inc("failure")
+			moduleLog(ModuleMqtt).Error("mqtt handle message failed", "topic", msg.Topic, "err", err)
+		} else {
+			mqttReceiveTotal.Inc("success")
+		}
+	}
+}
+
+//mqttConnV3 mqtt 3.1 & 3.1.1
+type mqttConnV3 struct {
+	client *MqttClient
+	cli    mqtt.Client
+}
+
+func newMqttConnV3(client *MqttClient) *mqttConnV3 {
+	this := &mqttConnV3{client: client}
+	opts := mqtt.NewClientOptions()
+	for _, broker := range client.conf.Brokers {
+		opts.AddBroker(broker)
+	}
+	opts.SetClientID(client.conf.ClientId).
+		SetUsername(client.conf.UserName).
+		SetPassword(client.conf.Password).
+		SetProtocolVersion(client.conf.ProtocolVersion).
+		SetCleanSession(!client.conf.PersistentSession).
+		SetKeepAlive(time.Second * time.Duration(client.conf.KeepAliveSec)).
+		SetConnectTimeout(client.timeout()).
+		SetWriteTimeout(client.timeout()).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(time.Second * time.Duration(client.conf.MaxReconnectIntervalSec)).
+		//received in order, enqueue to workers of MqttClient never blocks the callback
+		SetOrderMatters(true).
+		SetDefaultPublishHandler(this.dispatch).
+		SetOnConnectHandler(this.onConnect).
+		SetConnectionLostHandler(this.onConnectionLost)
+	this.cli = mqtt.NewClient(opts)
+	return this
+}
+
+func (this *mqttConnV3) connect() error {
+	token := this.cli.Connect()
+	if !token.WaitTimeout(this.client.timeout()) {
+		return errors.New("mqtt connect timeout")
+	}
+	return token.Error()
+}
+
+func (this *mqttConnV3) isConnected() bool {
+	return this.cli.IsConnectionOpen()
+}
+
+func (this *mqttConnV3) subscribe(pattern string, qos Qos) error {
+	//nil callback, messages are dispatched by default handler
+	token := this.cli.Subscribe(pattern, qos, nil)
+	if !token.WaitTimeout(this.client.timeout()) {
+		return errors.New("mqtt subscribe timeout")
+	}
+	return token.Error()
+}
+
+func (this *mqttConnV3) unsubscribe(patterns ...string) error {
+	token := this.cli.Unsubscribe(patterns...)
+	if !token.WaitTimeout(this.client.timeout()) {
+		return errors.New("mqtt unsubscribe timeout")
+	}
+	return token.Error()
+}
+
+func (this *mqttConnV3) publish(topic string, qos Qos, retain bool, payload []byte) error {
+	token := this.cli.Publish(topic, qos, retain, payload)
+	if !token.WaitTimeout(this.client.timeout()) {
+		return errors.New("timeout")
+	}
+	return token.Error()
+}
+
+func (this *mqttConnV3) close() {
+	this.cli.Disconnect(mqttDisconnectQuiesceMs)
+}
+
+func (this *mqttConnV3) onConnect(_ mqtt.Client) {
+	this.client.onConnect()
+}
+
+func (this *mqttConnV3) onConnectionLost(_ mqtt.Client, err error) {
+	this.client.onConnectionLost(err)
+}
+
+func (this *mqttConnV3) dispatch(_ mqtt.Client, m mqtt.Message) {
+	this.client.enqueue(&MqttMessage{
+		Topic:     m.Topic(),
+		Payload:   m.Payload(),
+		Qos:       m.Qos(),
+		Retained:  m.Retained(),
+		Duplicate: m.Duplicate(),
+		MessageId: m.MessageID(),
+	})
+}
+
+func callMqttHandler(h MqttHandlerFunc, msg *MqttMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic : %v", r)
+		}
+	}()
+	return h(msg)
+}
+
+//MatchTopic report whether topic match subscription pattern, $share/{group}/ prefix is ignored
+func MatchTopic(pattern string, topic string) bool {
+	if strings.HasPrefix(pattern, "$share/") {
+		parts := strings.SplitN(pattern, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		pattern = parts[2]
+	}
+	//wildcard at first level never match topics start with $
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(pattern, "+") || strings.HasPrefix(pattern, "#")) {
+		return false
+	}
+	ps := strings.Split(pattern, "/")
+	ts := strings.Split(topic, "/")
+	for i, p := range ps {
+		if p == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if p != "+" && p != ts[i] {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
+
+func validateTopicPattern(pattern string) error {
+	if len(pattern) == 0 {
+		return errors.New("empty topic pattern")
+	}
+	levels := strings.Split(pattern, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("invalid topic pattern '%s', '#' must be the last level", pattern)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("invalid topic pattern '%s', '+' must occupy an entire level", pattern)
+		}
+	}
+	return nil
+}
+
+var gMqttCli *MqttClient = nil
+
+//MqttCli return native client, MqttConfig.Brokers is required
+func MqttCli() *MqttClient {
+	std.Assert(gMqttCli != nil, "mqtt client not init yet, brokers not configured?")
+	return gMqttCli
+}
@@ -0,0 +1,162 @@
+package bootx
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/+/c", "a/x/c", true},
+		{"a/+/c", "a/x/y/c", false},
+		{"a/+", "a/", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+/b", "$SYS/b", false},
+		{"#", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+		{"$share/g1/dev/+/up", "dev/d1/up", true},
+		{"$share/g1", "g1", false},
+	}
+	for _, c := range cases {
+		if got := MatchTopic(c.pattern, c.topic); got != c.match {
+			t.Errorf("MatchTopic(%s, %s) expect %v", c.pattern, c.topic, c.match)
+		}
+	}
+}
+
+func TestValidateTopicPattern(t *testing.T) {
+	for _, p := range []string{"a/b", "+", "#", "a/+/#", "$share/g/a/#"} {
+		if err := validateTopicPattern(p); err != nil {
+			t.Errorf("pattern %s should be valid: %v", p, err)
+		}
+	}
+	for _, p := range []string{"", "a/#/b", "a/b#", "a+/b"} {
+		if err := validateTopicPattern(p); err == nil {
+			t.Errorf("pattern %s should be invalid", p)
+		}
+	}
+}
+
+func TestMqttClientDispatch(t *testing.T) {
+	if _, err := NewMqttClient(MqttConfig{}); err == nil {
+		t.Fatal("expect config error without brokers")
+	}
+	cli, err := NewMqttClient(MqttConfig{Brokers: []string{"tcp://127.0.0.1:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	record := func(name string) MqttHandlerFunc {
+		return func(msg *MqttMessage) error {
+			got = append(got, name+":"+msg.Topic+":"+string(msg.Payload))
+			return nil
+		}
+	}
+	//subscribe before connected only keep bookkeeping
+	for pattern, name := range map[string]string{"dev/+/up": "old", "dev/#": "all"} {
+		if err = cli.Subscribe(pattern, Lv1AtLeastOnce, record(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = cli.Subscribe("dev/+/up", Lv1AtLeastOnce, record("up")); err != nil {
+		t.Fatal(err)
+	}
+	if err = cli.Subscribe("dev/#/x", Lv0OnceMax, record("bad")); err == nil {
+		t.Error("expect invalid pattern rejected")
+	}
+	if err = cli.Subscribe("panic/#", Lv0OnceMax, func(msg *MqttMessage) error { panic("boom") }); err != nil {
+		t.Fatal(err)
+	}
+	if len(cli.subs) != 3 {
+		t.Fatalf("expect 3 subscriptions, got %d", len(cli.subs))
+	}
+
+	unhandled := mqttReceiveTotal.Value("unhandled")
+	failed := mqttReceiveTotal.Value("failure")
+	cli.dispatch(&MqttMessage{Topic: "dev/d1/up", Payload: []byte("on")})
+	cli.dispatch(&MqttMessage{Topic: "other", Payload: []byte("x")})
+	cli.dispatch(&MqttMessage{Topic: "panic/now"})
+	if len(got) != 2 || !containsString(got, "up:dev/d1/up:on") || !containsString(got, "all:dev/d1/up:on") {
+		t.Errorf("unexpected dispatch %v", got)
+	}
+	if n := mqttReceiveTotal.Value("unhandled") - unhandled; n != 1 {
+		t.Errorf("expect 1 unhandled, got %v", n)
+	}
+	if n := mqttReceiveTotal.Value("failure") - failed; n != 1 {
+		t.Errorf("expect panic counted as failure, got %v", n)
+	}
+
+	if err = cli.Unsubscribe("dev/#", "panic/#"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cli.subs) != 1 || cli.subs[0].pattern != "dev/+/up" {
+		t.Errorf("unexpected subscriptions after unsubscribe %d", len(cli.subs))
+	}
+	if err = cli.Publish1("dev/d1/down", map[string]int{"on": 1}); !errors.Is(err, ErrMqttNotConnected) {
+		t.Errorf("expect ErrMqttNotConnected, got %v", err)
+	}
+}
+
+func TestMqttClientEnqueueOverflow(t *testing.T) {
+	for policy, expect := range map[string]string{
+		MqttReceiveDropNew:    "0,1",
+		MqttReceiveDropOldest: "0,2",
+	} {
+		t.Run(policy, func(t *testing.T) {
+			cli, err := NewMqttClient(MqttConfig{
+				Brokers:          []string{"tcp://127.0.0.1:1"},
+				ReceiveQueueSize: 1,
+				ReceiveOverflow:  policy,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cli.Close()
+			entered := make(chan struct{}, 3)
+			release := make(chan struct{})
+			handled := make(chan string, 3)
+			err = cli.Subscribe("dev/#", Lv0OnceMax, func(msg *MqttMessage) error {
+				entered <- struct{}{}
+				<-release
+				handled <- string(msg.Payload)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dropped := mqttReceiveTotal.Value("dropped")
+			cli.enqueue(&MqttMessage{Topic: "dev/1", Payload: []byte("0")})
+			<-entered
+			//worker is busy, queue holds one message, receiving never blocks
+			done := make(chan struct{})
+			go func() {
+				cli.enqueue(&MqttMessage{Topic: "dev/1", Payload: []byte("1")})
+				cli.enqueue(&MqttMessage{Topic: "dev/1", Payload: []byte("2")})
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("enqueue blocked while queue full")
+			}
+			if n := mqttReceiveTotal.Value("dropped") - dropped; n != 1 {
+				t.Errorf("expect 1 dropped, got %v", n)
+			}
+			close(release)
+			got := []string{<-handled, <-handled}
+			if strings.Join(got, ",") != expect {
+				t.Errorf("expect handled %s, got %v", expect, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package bootx
+
+import (
+	"context"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/pkg/errors"
+	"math"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//seconds between connect attempts of mqtt 5 client, capped by MaxReconnectInterval
+const mqttV5ConnectRetryDelaySec = 10
+
+//mqttConnV5 mqtt 5, reconnect & resubscribe by autopaho
+type mqttConnV5 struct {
+	client    *MqttClient
+	cfg       autopaho.ClientConfig
+	lock      sync.Mutex
+	cm        *autopaho.ConnectionManager
+	connected int32
+	lastErr   atomic.Value
+}
+
+func newMqttConnV5(client *MqttClient) (*mqttConnV5, error) {
+	conf := client.conf
+	this := &mqttConnV5{client: client}
+	brokers := make([]*url.URL, 0, len(conf.Brokers))
+	for _, broker := range conf.Brokers {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid broker '%s'", broker)
+		}
+		brokers = append(brokers, u)
+	}
+	retryDelay := time.Second * mqttV5ConnectRetryDelaySec
+	if maxInterval := time.Second * time.Duration(conf.MaxReconnectIntervalSec); retryDelay > maxInterval {
+		retryDelay = maxInterval
+	}
+	this.cfg = autopaho.ClientConfig{
+		BrokerUrls:        brokers,
+		KeepAlive:         uint16(conf.KeepAliveSec),
+		ConnectRetryDelay: retryDelay,
+		ConnectTimeout:    client.timeout(),
+		OnConnectionUp:    this.onConnectionUp,
+		OnConnectError:    this.onConnectError,
+		ClientConfig: paho.ClientConfig{
+			ClientID:           conf.ClientId,
+			Router:             paho.NewSingleHandlerRouter(this.dispatch),
+			OnClientError:      this.onClientError,
+			OnServerDisconnect: this.onServerDisconnect,
+		},
+	}
+	if len(conf.UserName) != 0 {
+		this.cfg.SetUsernamePassword(conf.UserName, []byte(conf.Password))
+	}
+	persistent := conf.PersistentSession
+	this.cfg.SetConnectPacketConfigurator(func(cp *paho.Connect) *paho.Connect {
+		cp.CleanStart = !persistent
+		if persistent {
+			//keep session like mqtt 3.1.1 clean session = false
+			expiry := uint32(math.MaxUint32)
+			if cp.Properties == nil {
+				cp.Properties = &paho.ConnectProperties{}
+			}
+			cp.Properties.SessionExpiryInterval = &expiry
+		}
+		return cp
+	})
+	return this, nil
+}
+
+//connect start connection manager, stop it if not connected within timeout
+func (this *mqttConnV5) connect() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.cm == nil {
+		cm, err := autopaho.NewConnection(context.Background(), this.cfg)
+		if err != nil {
+			return err
+		}
+		this.cm = cm
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), this.client.timeout())
+	defer cancel()
+	if err := this.cm.AwaitConnection(ctx); err == nil {
+		return nil
+	}
+	this.stop()
+	if err, ok := this.lastErr.Load().(error); ok {
+		return err
+	}
+	return errors.New("mqtt connect timeout")
+}
+
+func (this *mqttConnV5) manager() *autopaho.ConnectionManager {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.cm
+}
+
+func (this *mqttConnV5) isConnected() bool {
+	return atomic.LoadInt32(&this.connected) == 1
+}
+
+func (this *mqttConnV5) subscribe(pattern string, qos Qos) error {
+	cm := this.manager()
+	if cm == nil {
+		return ErrMqttNotConnected
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), this.client.timeout())
+	defer cancel()
+	_, err := cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{pattern: {QoS: qos}},
+	})
+	return err
+}
+
+func (this *mqttConnV5) unsubscribe(patterns ...string) error {
+	cm := this.manager()
+	if cm == nil {
+		return ErrMqttNotConnected
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), this.client.timeout())
+	defer cancel()
+	_, err := cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: patterns})
+	return err
+}
+
+func (this *mqttConnV5) publish(topic string, qos Qos, retain bool, payload []byte) error {
+	cm := this.manager()
+	if cm == nil {
+		return ErrMqttNotConnected
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), this.client.timeout())
+	defer cancel()
+	_, err := cm.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retain,
+		Payload: payload,
+	})
+	return err
+}
+
+func (this *mqttConnV5) close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.stop()
+}
+
+//stop must be called with lock held
+func (this *mqttConnV5) stop() {
+	if this.cm == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*mqttDisconnectQuiesceMs)
+	defer cancel()
+	_ = this.cm.Disconnect(ctx)
+	this.cm = nil
+	atomic.StoreInt32(&this.connected, 0)
+}
+
+func (this *mqttConnV5) onConnectionUp(_ *autopaho.ConnectionManager, _ *paho.Connack) {
+	atomic.StoreInt32(&this.connected, 1)
+	this.client.onConnect()
+}
+
+func (this *mqttConnV5) onConnectError(err error) {
+	this.lastErr.Store(err)
+}
+
+func (this *mqttConnV5) onClientError(err error) {
+	if atomic.SwapInt32(&this.connected, 0) == 1 {
+		this.client.onConnectionLost(err)
+	}
+}
+
+func (this *mqttConnV5) onServerDisconnect(d *paho.Disconnect) {
+	if atomic.SwapInt32(&this.connected, 0) == 1 {
+		this.client.onConnectionLost(errors.Errorf("disconnected by server, reason code %d", d.ReasonCode))
+	}
+}
+
+func (this *mqttConnV5) dispatch(p *paho.Publish) {
+	msg := &MqttMessage{
+		Topic:     p.Topic,
+		Payload:   p.Payload,
+		Qos:       p.QoS,
+		Retained:  p.Retain,
+		MessageId: p.PacketID,
+	}
+	//router is sequential, handler may publish & wait, so it is run by workers of MqttClient.
+	//enqueue drops by ReceiveOverflow when full instead of blocking the router
+	this.client.enqueue(msg)
+}
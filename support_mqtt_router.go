@@ -0,0 +1,433 @@
+package bootx
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gen-iot/std"
+	"reflect"
+	"strings"
+)
+
+type MqttCtxHandlerFunc = func(ctx MqttContext)
+type MqttMiddlewareFunc = func(next MqttCtxHandlerFunc) MqttCtxHandlerFunc
+
+//MqttContext is the Context of typed mqtt handler, e.g. func(ctx MqttContext, req *Telemetry) error
+type MqttContext interface {
+	Client() *MqttClient
+	Message() *MqttMessage
+	Topic() string
+	Route() *MqttRoute
+	//topic param, e.g. deviceId of devices/{deviceId}/telemetry
+	Param(name string) string
+	ParamNames() []string
+	ParamValues() []string
+	FuncName() string
+	//logger with topic & func name attached
+	Log() Logger
+	Validate(i interface{}) error
+
+	Get(key string) interface{}
+	Set(key string, val interface{})
+
+	HandlerValue() reflect.Value
+	InType() reflect.Type
+	HasInReqArg() bool
+	HasInCtxArg() bool
+
+	SetReq(in interface{})
+	Req() interface{}
+
+	HasOutRespArg() bool
+	SetResp(out interface{})
+	Resp() interface{}
+
+	SetError(err error)
+	Err() error
+}
+
+type mqttContextImpl struct {
+	cli    *MqttClient
+	msg    *MqttMessage
+	route  *MqttRoute
+	meta   *handlerMeta
+	values []string
+	store  map[string]interface{}
+	in     interface{}
+	out    interface{}
+	err    error
+	log    Logger
+}
+
+var typeOfMqttContext = reflect.TypeOf((*MqttContext)(nil)).Elem()
+
+func (c *mqttContextImpl) Client() *MqttClient {
+	return c.cli
+}
+
+func (c *mqttContextImpl) Message() *MqttMessage {
+	return c.msg
+}
+
+func (c *mqttContextImpl) Topic() string {
+	return c.msg.Topic
+}
+
+func (c *mqttContextImpl) Route() *MqttRoute {
+	return c.route
+}
+
+func (c *mqttContextImpl) Param(name string) string {
+	for i, n := range c.route.params {
+		if n == name {
+			return c.values[i]
+		}
+	}
+	return ""
+}
+
+func (c *mqttContextImpl) ParamNames() []string {
+	return c.route.params
+}
+
+func (c *mqttContextImpl) ParamValues() []string {
+	return c.values
+}
+
+func (c *mqttContextImpl) FuncName() string {
+	return c.meta.fName
+}
+
+func (c *mqttContextImpl) Log() Logger {
+	if c.log == nil {
+		c.log = moduleLog(ModuleMqtt).With("topic", c.msg.Topic, "func", c.meta.fName)
+	}
+	return c.log
+}
+
+//Validate return *Error(ErrValidation) with field details in DefaultLanguage
+func (c *mqttContextImpl) Validate(i interface{}) error {
+	return ValidateWithLang(DefaultLanguage, i)
+}
+
+func (c *mqttContextImpl) Get(key string) interface{} {
+	return c.store[key]
+}
+
+func (c *mqttContextImpl) Set(key string, val interface{}) {
+	if c.store == nil {
+		c.store = make(map[string]interface{})
+	}
+	c.store[key] = val
+}
+
+func (c *mqttContextImpl) HandlerValue() reflect.Value {
+	return c.meta.fv
+}
+
+func (c *mqttContextImpl) InType() reflect.Type {
+	return c.meta.inType
+}
+
+func (c *mqttContextImpl) HasInReqArg() bool {
+	return c.meta.flags&handlerHasReqData != 0
+}
+
+func (c *mqttContextImpl) HasInCtxArg() bool {
+	return c.meta.flags&handlerHasCtx != 0
+}
+
+func (c *mqttContextImpl) SetReq(in interface{}) {
+	c.in = in
+}
+
+func (c *mqttContextImpl) Req() interface{} {
+	return c.in
+}
+
+func (c *mqttContextImpl) HasOutRespArg() bool {
+	return c.meta.flags&handlerHasRsp != 0
+}
+
+func (c *mqttContextImpl) SetResp(out interface{}) {
+	c.out = out
+}
+
+func (c *mqttContextImpl) Resp() interface{} {
+	return c.out
+}
+
+func (c *mqttContextImpl) SetError(err error) {
+	c.err = err
+}
+
+func (c *mqttContextImpl) Err() error {
+	return c.err
+}
+
+//MqttRoute is the metadata of typed mqtt handler
+type MqttRoute struct {
+	//topic template, e.g. devices/{deviceId}/telemetry
+	Path string
+	//subscribed topic filter, e.g. devices/+/telemetry
+	Topic    string
+	Qos      Qos
+	FuncName string
+	InType   reflect.Type
+	OutType  reflect.Type
+	//topic template which handler out is published to, e.g. devices/{deviceId}/reply
+	ReplyTopic string
+	ReplyQos   Qos
+	//param name of each topic level, empty if not a param
+	levels      []string
+	params      []string
+	middlewares []MqttMiddlewareFunc
+}
+
+type MqttRouteOption func(r *MqttRoute)
+
+//WithMqttReply publish handler out to topic, params of route path can be used, e.g. devices/{deviceId}/reply
+func WithMqttReply(topic string, qos Qos) MqttRouteOption {
+	return func(r *MqttRoute) {
+		r.ReplyTopic = topic
+		r.ReplyQos = qos
+	}
+}
+
+func WithMqttMiddleware(m ...MqttMiddlewareFunc) MqttRouteOption {
+	return func(r *MqttRoute) {
+		r.middlewares = append(r.middlewares, m...)
+	}
+}
+
+//MqttRouter dispatch messages of MqttClient to typed handlers
+type MqttRouter struct {
+	cli         *MqttClient
+	middlewares []MqttMiddlewareFunc
+	routes      []*MqttRoute
+}
+
+func NewMqttRouter(cli *MqttClient) *MqttRouter {
+	std.Assert(cli != nil, "mqtt client is nil")
+	return &MqttRouter{
+		cli:         cli,
+		middlewares: make([]MqttMiddlewareFunc, 0),
+		routes:      make([]*MqttRoute, 0),
+	}
+}
+
+//Use add middleware to routes registered after it
+func (this *MqttRouter) Use(m ...MqttMiddlewareFunc) {
+	this.middlewares = append(this.middlewares, m...)
+}
+
+func (this *MqttRouter) Routes() []*MqttRoute {
+	return append([]*MqttRoute(nil), this.routes...)
+}
+
+//Handle subscribe path & dispatch its messages to handler,
+//handler is func([ctx MqttContext,] [req any]) ([out any,] error),
+//json payload & topic params (field tag `topic:"deviceId"`) are bound to req then validated,
+//req of []byte or string is the raw payload
+func (this *MqttRouter) Handle(path string, qos Qos, handler interface{}, opts ...MqttRouteOption) error {
+	meta := newHandlerMetaOf(handler, typeOfMqttContext)
+	route, err := newMqttRoute(path, qos)
+	if err != nil {
+		return err
+	}
+	route.FuncName = meta.fName
+	route.InType = meta.inType
+	route.OutType = meta.outType
+	for _, opt := range opts {
+		opt(route)
+	}
+	m := append(append([]MqttMiddlewareFunc(nil), this.middlewares...), route.middlewares...)
+	h := mqttBuildChain(m...)
+	this.routes = append(this.routes, route)
+	return this.cli.Subscribe(route.Topic, qos, func(msg *MqttMessage) error {
+		return this.serve(route, meta, h, msg)
+	})
+}
+
+func (this *MqttRouter) serve(route *MqttRoute, meta *handlerMeta, h MqttCtxHandlerFunc, msg *MqttMessage) error {
+	ctx := &mqttContextImpl{
+		cli:    this.cli,
+		msg:    msg,
+		route:  route,
+		meta:   meta,
+		values: route.paramValues(msg.Topic),
+	}
+	h(ctx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(route.ReplyTopic) > 0 && ctx.Resp() != nil {
+		return this.cli.Publish(route.replyTopic(ctx), ctx.Resp(), route.ReplyQos, false)
+	}
+	return nil
+}
+
+//{name} level is replaced by '+'
+func newMqttRoute(path string, qos Qos) (*MqttRoute, error) {
+	r := &MqttRoute{Path: path, Qos: qos}
+	levels := strings.Split(path, "/")
+	//$share/{group}/ is not part of message topic
+	skip := 0
+	if strings.HasPrefix(path, "$share/") {
+		skip = 2
+	}
+	for i, level := range levels {
+		name := ""
+		if strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}") {
+			name = level[1 : len(level)-1]
+			if len(name) == 0 || containsString(r.params, name) {
+				return nil, fmt.Errorf("invalid mqtt route '%s', empty or duplicate param", path)
+			}
+			r.params = append(r.params, name)
+			levels[i] = "+"
+		} else if strings.ContainsAny(level, "{}") {
+			return nil, fmt.Errorf("invalid mqtt route '%s', param must occupy an entire level", path)
+		}
+		if i >= skip {
+			r.levels = append(r.levels, name)
+		}
+	}
+	r.Topic = strings.Join(levels, "/")
+	if err := validateTopicPattern(r.Topic); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (this *MqttRoute) paramValues(topic string) []string {
+	values := make([]string, 0, len(this.params))
+	if len(this.params) == 0 {
+		return values
+	}
+	levels := strings.Split(topic, "/")
+	for i, name := range this.levels {
+		if len(name) > 0 && i < len(levels) {
+			values = append(values, levels[i])
+		}
+	}
+	return values
+}
+
+func (this *MqttRoute) replyTopic(ctx MqttContext) string {
+	topic := this.ReplyTopic
+	for i, name := range ctx.ParamNames() {
+		topic = strings.Replace(topic, "{"+name+"}", ctx.ParamValues()[i], -1)
+	}
+	return topic
+}
+
+var typeOfString = reflect.TypeOf("")
+
+func mqttBuildChain(m ...MqttMiddlewareFunc) MqttCtxHandlerFunc {
+	call := mqttApplyMiddleware(mqttBuildCall(), m...)
+	return func(ctx MqttContext) {
+		if ctx.HasInReqArg() {
+			req, err := mqttBindReq(ctx)
+			if err != nil {
+				ctx.SetError(ErrBadRequest.Wrap(err).WithDetails(&ErrorDetail{Message: err.Error()}))
+			} else if err = mqttValidateReq(ctx, req); err != nil {
+				ctx.SetError(err)
+			}
+			ctx.SetReq(req)
+		}
+		call(ctx)
+	}
+}
+
+func mqttBindReq(ctx MqttContext) (interface{}, error) {
+	inType := ctx.InType()
+	switch inType {
+	case typeOfBytes:
+		return ctx.Message().Payload, nil
+	case typeOfString:
+		return string(ctx.Message().Payload), nil
+	}
+	elementType := inType
+	isPtr := false
+	if elementType.Kind() == reflect.Ptr {
+		elementType = elementType.Elem()
+		isPtr = true
+	}
+	req := reflect.New(elementType).Interface()
+	if len(ctx.Message().Payload) > 0 {
+		if err := json.Unmarshal(ctx.Message().Payload, req); err != nil {
+			return nil, err
+		}
+	}
+	if len(ctx.ParamNames()) > 0 && elementType.Kind() == reflect.Struct {
+		data := make(map[string][]string, len(ctx.ParamNames()))
+		for i, name := range ctx.ParamNames() {
+			data[name] = []string{ctx.ParamValues()[i]}
+		}
+		if err := NewCustomBinder().bindData(req, data, "topic"); err != nil {
+			return nil, err
+		}
+	}
+	if !isPtr {
+		req = reflect.ValueOf(req).Elem().Interface()
+	}
+	return req, nil
+}
+
+func mqttValidateReq(ctx MqttContext, req interface{}) error {
+	if req == nil {
+		return nil
+	}
+	t := reflect.TypeOf(req)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return ctx.Validate(req)
+}
+
+func mqttBuildCall() MqttCtxHandlerFunc {
+	return func(ctx MqttContext) {
+		//bind or validate failed, don't call handler with invalid req
+		if ctx.Err() != nil {
+			return
+		}
+		inParams := make([]reflect.Value, 0, 2)
+		if ctx.HasInCtxArg() {
+			inParams = append(inParams, reflect.ValueOf(ctx))
+		}
+		if ctx.HasInReqArg() {
+			inParams = append(inParams, reflect.ValueOf(ctx.Req()))
+		}
+		outs := ctx.HandlerValue().Call(inParams)
+		rspErrIdx := 0
+		if ctx.HasOutRespArg() {
+			rspErrIdx = 1
+			if rsp := outs[0]; isNilableKind(rsp.Kind()) && rsp.IsNil() {
+				ctx.SetResp(nil)
+			} else {
+				ctx.SetResp(rsp.Interface())
+			}
+		}
+		if !outs[rspErrIdx].IsNil() {
+			ctx.SetError(outs[rspErrIdx].Interface().(error))
+		}
+	}
+}
+
+func isNilableKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Chan, reflect.Func:
+		return true
+	}
+	return false
+}
+
+func mqttApplyMiddleware(h MqttCtxHandlerFunc, m ...MqttMiddlewareFunc) MqttCtxHandlerFunc {
+	std.Assert(h != nil, "mqttApplyMiddleware, h == nil")
+	for i := len(m) - 1; i >= 0; i-- {
+		h = m[i](h)
+	}
+	return h
+}
@@ -0,0 +1,108 @@
+package bootx
+
+import (
+	"strings"
+	"testing"
+)
+
+type mqttTestTelemetry struct {
+	DeviceId string  `topic:"deviceId"`
+	Temp     float64 `json:"temp" validate:"lte=100"`
+}
+
+type mqttTestAck struct {
+	DeviceId string `json:"deviceId"`
+}
+
+func TestNewMqttRoute(t *testing.T) {
+	r, err := newMqttRoute("$share/g1/devices/{deviceId}/{kind}", Lv1AtLeastOnce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Topic != "$share/g1/devices/+/+" || strings.Join(r.params, ",") != "deviceId,kind" {
+		t.Errorf("unexpected route %+v", r)
+	}
+	if values := r.paramValues("devices/d1/up"); strings.Join(values, ",") != "d1,up" {
+		t.Errorf("unexpected param values %v", values)
+	}
+	for _, path := range []string{"devices/{}/up", "devices/{id}/{id}", "devices/x{id}/up", "devices/#/{id}"} {
+		if _, err = newMqttRoute(path, Lv0OnceMax); err == nil {
+			t.Errorf("expect invalid route %s", path)
+		}
+	}
+}
+
+func TestMqttRouter(t *testing.T) {
+	cli, err := NewMqttClient(MqttConfig{Brokers: []string{"tcp://127.0.0.1:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewMqttRouter(cli)
+	trace := make([]string, 0)
+	router.Use(func(next MqttCtxHandlerFunc) MqttCtxHandlerFunc {
+		return func(ctx MqttContext) {
+			ctx.Set("tenant", "t1")
+			next(ctx)
+			if ctx.Err() != nil {
+				trace = append(trace, "err:"+ctx.Topic())
+			}
+		}
+	})
+	var got *mqttTestTelemetry
+	err = router.Handle("devices/{deviceId}/telemetry", Lv1AtLeastOnce, func(ctx MqttContext, req *mqttTestTelemetry) error {
+		if ctx.Get("tenant") != "t1" || ctx.Param("deviceId") != req.DeviceId {
+			t.Errorf("unexpected ctx of %s", ctx.Topic())
+		}
+		got = req
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw string
+	if err = router.Handle("raw/#", Lv0OnceMax, func(payload string) error {
+		raw = payload
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = router.Handle("devices/{deviceId}/ping", Lv0OnceMax, func(ctx MqttContext) (*mqttTestAck, error) {
+		return &mqttTestAck{DeviceId: ctx.Param("deviceId")}, nil
+	}, WithMqttReply("devices/{deviceId}/pong", Lv0OnceMax)); err != nil {
+		t.Fatal(err)
+	}
+	if len(router.Routes()) != 3 || router.Routes()[0].Topic != "devices/+/telemetry" {
+		t.Fatalf("unexpected routes %v", router.Routes())
+	}
+
+	cli.dispatch(&MqttMessage{Topic: "devices/d1/telemetry", Payload: []byte(`{"temp":21.5}`)})
+	if got == nil || got.DeviceId != "d1" || got.Temp != 21.5 {
+		t.Errorf("unexpected bound req %+v", got)
+	}
+	got = nil
+	cli.dispatch(&MqttMessage{Topic: "devices/d2/telemetry", Payload: []byte(`{"temp":120}`)})
+	cli.dispatch(&MqttMessage{Topic: "devices/d3/telemetry", Payload: []byte(`{"temp":`)})
+	if got != nil {
+		t.Errorf("handler called with invalid req %+v", got)
+	}
+	cli.dispatch(&MqttMessage{Topic: "raw/a/b", Payload: []byte("plain text")})
+	if raw != "plain text" {
+		t.Errorf("unexpected raw payload %s", raw)
+	}
+
+	//reply is published after middlewares, which fails when not connected
+	failed := mqttPublishTotal.Value("failure")
+	cli.dispatch(&MqttMessage{Topic: "devices/d4/ping"})
+	if n := mqttPublishTotal.Value("failure") - failed; n != 1 {
+		t.Errorf("expect reply published once, got %v", n)
+	}
+	if got := strings.Join(trace, ","); got != "err:devices/d2/telemetry,err:devices/d3/telemetry" {
+		t.Errorf("unexpected trace %s", got)
+	}
+
+	route := router.Routes()[2]
+	ctx := &mqttContextImpl{msg: &MqttMessage{Topic: "devices/d4/ping"}, route: route, values: route.paramValues("devices/d4/ping")}
+	if topic := route.replyTopic(ctx); topic != "devices/d4/pong" {
+		t.Errorf("unexpected reply topic %s", topic)
+	}
+}
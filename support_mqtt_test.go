@@ -0,0 +1,217 @@
+package bootx
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//fakeEmqx serve publish & publish_batch api, topic "bad" fails
+type fakeEmqx struct {
+	lock     sync.Mutex
+	requests int
+	topics   []string
+	inFlight int32
+	peak     int32
+	delay    time.Duration
+}
+
+type fakeEmqxReq struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+}
+
+func (this *fakeEmqx) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&this.inFlight, 1)
+	defer atomic.AddInt32(&this.inFlight, -1)
+	for {
+		peak := atomic.LoadInt32(&this.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&this.peak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(this.delay)
+	if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "public" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	reqs := make([]*fakeEmqxReq, 0)
+	if r.URL.Path == "/api/v4/mqtt/publish_batch" {
+		_ = json.Unmarshal(body, &reqs)
+	} else {
+		req := new(fakeEmqxReq)
+		_ = json.Unmarshal(body, req)
+		reqs = append(reqs, req)
+	}
+	this.lock.Lock()
+	this.requests++
+	rsp := &mqttPubRsp{}
+	for _, req := range reqs {
+		this.topics = append(this.topics, req.Topic+" "+req.Payload)
+		item := &mqttPubRsp{}
+		if req.Topic == "bad" {
+			item.Code = 112
+			rsp.Code = 112
+		}
+		rsp.Data = append(rsp.Data, item)
+	}
+	this.lock.Unlock()
+	if r.URL.Path == "/api/v4/mqtt/publish_batch" {
+		//batch api report each message
+		rsp.Code = 0
+	}
+	bs, _ := json.Marshal(rsp)
+	_, _ = w.Write(bs)
+}
+
+func newTestMqttPubCli(t *testing.T, fake *fakeEmqx, conf MqttConfig) *MqttPubCli {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	conf.PubApiAddr = server.URL + "/api/v4/mqtt/publish"
+	conf.UserName = "admin"
+	conf.Password = "public"
+	cli, err := OpenMqttPub(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cli.Close)
+	return cli
+}
+
+func TestMqttPubCliPublish(t *testing.T) {
+	fake := &fakeEmqx{}
+	cli := newTestMqttPubCli(t, fake, MqttConfig{})
+	if cli.MqttBatchPubApiAddr != cli.MqttPubApiAddr+"_batch" {
+		t.Errorf("unexpected batch api %s", cli.MqttBatchPubApiAddr)
+	}
+	if err := cli.Publish1("dev/1", map[string]int{"on": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Publish("bad", "x", Lv0OnceMax, false); err == nil {
+		t.Error("expect error of failed code")
+	}
+	if err := cli.Publish("dev/2", make(chan int), Lv0OnceMax, false); err == nil {
+		t.Error("expect marshal error")
+	}
+	future := cli.PublishAsync(context.Background(), "dev/3", "async", Lv1AtLeastOnce, false)
+	if err := future.Wait(context.Background()); err != nil || future.Err() != nil {
+		t.Fatalf("async publish failed: %v", err)
+	}
+	expect := []string{`dev/1 {"on":1}`, `bad "x"`, `dev/3 "async"`}
+	if len(fake.topics) != len(expect) {
+		t.Fatalf("unexpected published %v", fake.topics)
+	}
+	for i, s := range expect {
+		if fake.topics[i] != s {
+			t.Errorf("expect %s, got %s", s, fake.topics[i])
+		}
+	}
+}
+
+func TestMqttPubCliConcurrency(t *testing.T) {
+	fake := &fakeEmqx{delay: 20 * time.Millisecond}
+	cli := newTestMqttPubCli(t, fake, MqttConfig{MaxConcurrency: 2})
+	futures := make([]*MqttPubFuture, 0)
+	for i := 0; i < 6; i++ {
+		futures = append(futures, cli.PublishAsync(context.Background(), "dev", i, Lv0OnceMax, false))
+	}
+	for _, f := range futures {
+		if err := f.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if peak := atomic.LoadInt32(&fake.peak); peak > 2 {
+		t.Errorf("expect at most 2 in flight, got %d", peak)
+	}
+
+	//all slots busy, waiting is canceled by ctx
+	block := cli.PublishAsync(context.Background(), "dev", "a", Lv0OnceMax, false)
+	_ = cli.PublishAsync(context.Background(), "dev", "b", Lv0OnceMax, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := cli.PublishCtx(ctx, "dev", "c", Lv0OnceMax, false); err != context.DeadlineExceeded {
+		t.Errorf("expect deadline exceeded, got %v", err)
+	}
+	_ = block.Wait(context.Background())
+}
+
+func TestMqttPubCliBatch(t *testing.T) {
+	fake := &fakeEmqx{}
+	cli := newTestMqttPubCli(t, fake, MqttConfig{MaxBatchSize: 2})
+	msgs := []*MqttPubMessage{
+		{Topic: "dev/0", Msg: 0},
+		{Topic: "bad", Msg: 1},
+		{Topic: "dev/2", Msg: make(chan int)},
+		{Topic: "dev/3", Msg: 3},
+		{Topic: "dev/4", Msg: 4},
+	}
+	err := cli.PublishBatch(context.Background(), msgs...)
+	batchErr, ok := err.(*MqttBatchError)
+	if !ok {
+		t.Fatalf("expect *MqttBatchError, got %v", err)
+	}
+	if batchErr.Total != 5 || len(batchErr.Failed) != 2 || batchErr.Failed[1] == nil || batchErr.Failed[2] == nil {
+		t.Errorf("unexpected batch error %v", batchErr.Failed)
+	}
+	if fake.requests != 3 || len(fake.topics) != 4 {
+		t.Errorf("expect 3 requests of 4 messages, got %d %v", fake.requests, fake.topics)
+	}
+	if err = cli.PublishBatch(context.Background(), msgs[0], msgs[3]); err != nil {
+		t.Errorf("expect batch ok, got %v", err)
+	}
+}
+
+//countMarshaler count calls of MarshalJSON
+type countMarshaler struct {
+	calls *int32
+}
+
+func (this countMarshaler) MarshalJSON() ([]byte, error) {
+	atomic.AddInt32(this.calls, 1)
+	return []byte(`{"on":"\"1\""}`), nil
+}
+
+func TestMqttPubCliMarshalOnce(t *testing.T) {
+	fake := &fakeEmqx{}
+	cli := newTestMqttPubCli(t, fake, MqttConfig{})
+	calls := int32(0)
+	msg := countMarshaler{calls: &calls}
+	if err := cli.Publish1("dev/1", msg); err != nil {
+		t.Fatal(err)
+	}
+	err := cli.PublishBatch(context.Background(), &MqttPubMessage{Topic: "dev/2", Msg: msg}, &MqttPubMessage{Topic: "dev/3", Msg: msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("expect msg marshaled once per message, got %d", calls)
+	}
+	for _, s := range fake.topics {
+		if !strings.HasSuffix(s, ` {"on":"\"1\""}`) {
+			t.Errorf("unexpected payload %s", s)
+		}
+	}
+}
+
+func BenchmarkMqttPubReq(b *testing.B) {
+	cli := &MqttPubCli{}
+	msg := map[string]interface{}{"deviceId": "d1", "temp": 21.5, "tags": []string{"a", "b\"c"}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req, err := cli.newPubReq("dev/1", msg, Lv1AtLeastOnce, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = json.Marshal(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
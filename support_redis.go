@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/gen-iot/std"
 	"github.com/go-redis/redis"
-	"sync"
 	"time"
 )
 
@@ -40,7 +39,7 @@ type RedisClient struct {
 }
 
 var gRedisCli *RedisClient = nil
-var redisOnce = sync.Once{}
+var redisOnce = initOnce{}
 
 func NewRedisCli(host string, pass string) *RedisClient {
 	c := RedisDefaultConfig
@@ -50,9 +49,17 @@ func NewRedisCli(host string, pass string) *RedisClient {
 }
 
 func NewRedisCliWithConf(conf RedisConfig) *RedisClient {
-	err := std.ValidateStruct(conf)
-	std.AssertError(err, "Redis配置不正确")
-	logger.Println("redis init ...")
+	cli, err := OpenRedis(conf)
+	std.AssertError(err, "redis init failed")
+	return cli
+}
+
+//OpenRedis create redis client & ping it, return *ConfigError or *ConnectError when failed
+func OpenRedis(conf RedisConfig) (*RedisClient, error) {
+	if err := std.ValidateStruct(conf); err != nil {
+		return nil, &ConfigError{Module: ModuleRedis, Err: err}
+	}
+	moduleLog(ModuleRedis).Info("redis init ...", "host", conf.Host, "port", conf.Port)
 	redisAddr := fmt.Sprintf("%s:%d", conf.Host, conf.Port)
 	option := &redis.Options{
 		Addr:         redisAddr,
@@ -62,7 +69,12 @@ func NewRedisCliWithConf(conf RedisConfig) *RedisClient {
 		ReadTimeout:  time.Duration(conf.ReadTimeoutSec) * time.Second,
 		WriteTimeout: time.Duration(conf.WriteTimeoutSec) * time.Second,
 	}
-	return &RedisClient{Client: redis.NewClient(option)}
+	cli := redis.NewClient(option)
+	if err := cli.Ping().Err(); err != nil {
+		std.CloseIgnoreErr(cli)
+		return nil, &ConnectError{Module: ModuleRedis, Target: redisAddr, Err: err}
+	}
+	return &RedisClient{Client: cli}, nil
 }
 
 func RedisCli() *RedisClient {
@@ -70,23 +82,33 @@ func RedisCli() *RedisClient {
 	return gRedisCli
 }
 
-func redisInit(host string, pass string) {
+func redisInit(host string, pass string) error {
 	c := RedisDefaultConfig
 	c.Host = host
 	c.Password = pass
-	redisInitWithConfig(c)
+	return redisInitWithConfig(c)
 }
 
-func redisInitWithConfig(conf RedisConfig) {
-	redisOnce.Do(func() {
-		gRedisCli = NewRedisCliWithConf(conf)
+func redisInitWithConfig(conf RedisConfig) error {
+	return redisOnce.Do(func() error {
+		cli, err := OpenRedis(conf)
+		if err != nil {
+			return err
+		}
+		gRedisCli = cli
+		return nil
 	})
 }
 
+func redisReset() {
+	gRedisCli = nil
+	redisOnce.reset()
+}
+
 func redisCleanup() {
-	logger.Println("redis cleanup ...")
+	moduleLog(ModuleRedis).Info("redis cleanup ...")
 	err := RedisCli().Close()
 	if err != nil {
-		logger.Printf("error occurred while redis close : %s ...", err)
+		moduleLog(ModuleRedis).Error("redis close failed", "err", err)
 	}
 }
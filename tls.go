@@ -0,0 +1,239 @@
+package bootx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultTLSReloadIntervalSec = 30
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//TLSConfig tls of client, files are reloaded when changed on disk
+type TLSConfig struct {
+	//pem bundle of trusted ca, default system roots
+	CAFile string `yaml:"caFile" json:"caFile" validate:"omitempty,file"`
+	//client certificate & key for mtls
+	CertFile string `yaml:"certFile" json:"certFile" validate:"required_with=KeyFile,omitempty,file"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile" validate:"required_with=CertFile,omitempty,file"`
+	//override server name to verify, default host of addr
+	ServerName string `yaml:"serverName" json:"serverName"`
+	//1.0 1.1 1.2 1.3, default 1.2
+	MinVersion string `yaml:"minVersion" json:"minVersion" validate:"omitempty,oneof=1.0 1.1 1.2 1.3"`
+	//skip verify of server certificate, only for test, a warning is logged
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify" json:"insecureSkipVerify"`
+	//interval of checking files change, default 30s, < 0 disable reload
+	ReloadIntervalSec int64 `yaml:"reloadInterval" json:"reloadInterval" validate:"max=86400"`
+}
+
+func (this TLSConfig) files() []string {
+	out := make([]string, 0, 3)
+	for _, f := range []string{this.CAFile, this.CertFile, this.KeyFile} {
+		if len(f) > 0 {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if len(version) == 0 {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version '%s'", version)
+	}
+	return v, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in '%s'", caFile)
+	}
+	return pool, nil
+}
+
+func (this TLSConfig) clientConfig() (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(this.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		ServerName:         this.ServerName,
+		InsecureSkipVerify: this.InsecureSkipVerify,
+		MinVersion:         minVersion,
+	}
+	if len(this.CAFile) > 0 {
+		if conf.RootCAs, err = loadCertPool(this.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(this.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(this.CertFile, this.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+//newClientTLSReloader warn if verify disabled
+func newClientTLSReloader(module string, conf TLSConfig) (*tlsReloader, error) {
+	if conf.InsecureSkipVerify {
+		moduleLog(module).Warn("tls verify of server certificate is disabled, insecureSkipVerify is only for test")
+	}
+	return newTLSReloader(module, conf.files(), conf.clientConfig, conf.ReloadIntervalSec)
+}
+
+//tlsReloader rebuild tls config when files changed or SIGHUP received, the old one is kept if reload failed
+type tlsReloader struct {
+	files   []string
+	build   func() (*tls.Config, error)
+	log     Logger
+	lock    sync.RWMutex
+	current *tls.Config
+	//serialize reload of watcher & signal
+	reloadLock sync.Mutex
+	modTimes   map[string]time.Time
+	onReload   []func(conf *tls.Config)
+	//remove signal hook when stopped
+	unregister func()
+	stopChan   chan struct{}
+	stopOnce   sync.Once
+}
+
+//interval of checking files change, 0 = default, < 0 disable
+func newTLSReloader(module string, files []string, build func() (*tls.Config, error), intervalSec int64) (*tlsReloader, error) {
+	this := &tlsReloader{
+		files:    files,
+		build:    build,
+		log:      moduleLog(module),
+		modTimes: make(map[string]time.Time),
+		stopChan: make(chan struct{}),
+	}
+	if _, err := this.reload(true); err != nil {
+		return nil, &ConfigError{Module: module, Err: err}
+	}
+	if len(files) == 0 {
+		return this, nil
+	}
+	this.unregister = OnSignalReload(this.signalReload)
+	if intervalSec == 0 {
+		intervalSec = DefaultTLSReloadIntervalSec
+	}
+	if intervalSec > 0 {
+		go this.watch(time.Second * time.Duration(intervalSec))
+	}
+	return this, nil
+}
+
+func (this *tlsReloader) Config() *tls.Config {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.current
+}
+
+//OnReload fn is called after config rebuilt
+func (this *tlsReloader) OnReload(fn func(conf *tls.Config)) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.onReload = append(this.onReload, fn)
+}
+
+func (this *tlsReloader) Stop() {
+	this.stopOnce.Do(func() {
+		close(this.stopChan)
+		if this.unregister != nil {
+			this.unregister()
+		}
+	})
+}
+
+func (this *tlsReloader) stopped() bool {
+	select {
+	case <-this.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (this *tlsReloader) signalReload() {
+	if this.stopped() {
+		return
+	}
+	this.tryReload(true)
+}
+
+func (this *tlsReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stopChan:
+			return
+		case <-ticker.C:
+			this.tryReload(false)
+		}
+	}
+}
+
+func (this *tlsReloader) tryReload(force bool) {
+	reloaded, err := this.reload(force)
+	if err != nil {
+		this.log.Error("reload tls files failed, keep the old", "err", err)
+	} else if reloaded {
+		this.log.Info("tls files reloaded", "files", this.files)
+	}
+}
+
+//reload if forced or any file changed since last load
+func (this *tlsReloader) reload(force bool) (bool, error) {
+	this.reloadLock.Lock()
+	defer this.reloadLock.Unlock()
+	modTimes := make(map[string]time.Time)
+	changed := force
+	for _, f := range this.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+		modTimes[f] = info.ModTime()
+		if !info.ModTime().Equal(this.modTimes[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	conf, err := this.build()
+	if err != nil {
+		return false, err
+	}
+	this.modTimes = modTimes
+	this.lock.Lock()
+	this.current = conf
+	hooks := this.onReload
+	this.lock.Unlock()
+	for _, fn := range hooks {
+		fn(conf)
+	}
+	return true, nil
+}
@@ -0,0 +1,174 @@
+package bootx
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//testCA issue certificates for 127.0.0.1
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+//issue return pem of certificate & key
+func (this *testCA) issue(t *testing.T, cn string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, this.cert, &key.PublicKey, this.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func (this *testCA) tlsCert(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	certPem, keyPem := this.issue(t, cn)
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+//writeTLSFile write data & move mod time forward, so change is seen by reloader
+func writeTLSFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	next := time.Now().Add(time.Duration(len(data)) * time.Second)
+	if err := os.Chtimes(path, next, next); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestTLSServer(t *testing.T, cert tls.Certificate, handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTLSConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	notPem := filepath.Join(dir, "ca.pem")
+	writeTLSFile(t, notPem, []byte("not a pem"))
+	for name, conf := range map[string]TLSConfig{
+		"ca not pem":      {CAFile: notPem},
+		"ca missing":      {CAFile: filepath.Join(dir, "missing.pem")},
+		"key not pem":     {CertFile: notPem, KeyFile: notPem},
+		"unknown version": {MinVersion: "0.9"},
+	} {
+		if _, err := newClientTLSReloader(ModuleMqtt, conf); err == nil {
+			t.Errorf("%s: expect error", name)
+		} else if _, ok := err.(*ConfigError); !ok {
+			t.Errorf("%s: expect ConfigError, got %T", name, err)
+		}
+	}
+}
+
+func TestMqttPubCliTLSReload(t *testing.T) {
+	ca1 := newTestCA(t, "ca1")
+	ca2 := newTestCA(t, "ca2")
+	fake := &fakeEmqx{}
+	server1 := newTestTLSServer(t, ca1.tlsCert(t, "emqx"), fake)
+	server2 := newTestTLSServer(t, ca2.tlsCert(t, "emqx"), fake)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeTLSFile(t, caFile, ca1.certPem)
+	cli, err := OpenMqttPub(MqttConfig{
+		PubApiAddr: server1.URL + "/api/v4/mqtt/publish",
+		UserName:   "admin",
+		Password:   "public",
+		PubApiTLS:  TLSConfig{CAFile: caFile, ReloadIntervalSec: -1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err = cli.Publish1("dev/1", 1); err != nil {
+		t.Fatalf("publish with trusted ca failed: %v", err)
+	}
+	cli.MqttPubApiAddr = server2.URL + "/api/v4/mqtt/publish"
+	if err = cli.Publish1("dev/1", 2); err == nil {
+		t.Fatal("expect certificate of unknown ca rejected")
+	}
+
+	if reloaded, err := cli.tls.reload(false); err != nil || reloaded {
+		t.Fatalf("expect nothing reloaded of unchanged files, got %v %v", reloaded, err)
+	}
+	writeTLSFile(t, caFile, ca2.certPem)
+	if reloaded, err := cli.tls.reload(false); err != nil || !reloaded {
+		t.Fatalf("expect reloaded, got %v %v", reloaded, err)
+	}
+	if err = cli.Publish1("dev/1", 3); err != nil {
+		t.Errorf("publish after ca reloaded failed: %v", err)
+	}
+
+	//broken file keeps the old config
+	writeTLSFile(t, caFile, []byte("broken"))
+	if _, err = cli.tls.reload(false); err == nil {
+		t.Fatal("expect reload error")
+	}
+	if err = cli.Publish1("dev/1", 4); err != nil {
+		t.Errorf("expect old config kept, got %v", err)
+	}
+}
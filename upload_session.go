@@ -0,0 +1,363 @@
+package bootx
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-redis/redis"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrUploadSessionNotFound = errors.New("upload session not found")
+
+//UploadSession is the state of resumable upload
+type UploadSession struct {
+	Id       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	//storage keys of received chunks in order
+	Chunks    []string `json:"chunks,omitempty"`
+	Completed bool     `json:"completed"`
+	//token of the request assembling final file, empty if none
+	Completing   string        `json:"completing,omitempty"`
+	CompletingAt time.Time     `json:"completingAt"`
+	File         *UploadedFile `json:"file,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	ExpiresAt    time.Time     `json:"expiresAt"`
+}
+
+//stored session matches the expected state of Update
+func (this *UploadSession) match(expectOffset int64, expectCompleting string) bool {
+	return !this.Completed && this.Offset == expectOffset && this.Completing == expectCompleting
+}
+
+//UploadSessionStore persist upload sessions, must be safe for concurrent use across instances
+type UploadSessionStore interface {
+	Create(ctx context.Context, s *UploadSession) error
+	//return ErrUploadSessionNotFound if not exist
+	Get(ctx context.Context, id string) (*UploadSession, error)
+	//save s only if stored one is not completed, its offset == expectOffset & Completing == expectCompleting,
+	//return false if not
+	Update(ctx context.Context, s *UploadSession, expectOffset int64, expectCompleting string) (bool, error)
+	Delete(ctx context.Context, id string) error
+	//sessions expired before t, at most limit
+	Expired(ctx context.Context, t time.Time, limit int) ([]*UploadSession, error)
+}
+
+//MemoryUploadStore keep sessions in memory, for test or single instance
+type MemoryUploadStore struct {
+	lock     *sync.Mutex
+	sessions map[string]*UploadSession
+}
+
+func NewMemoryUploadStore() *MemoryUploadStore {
+	return &MemoryUploadStore{
+		lock:     &sync.Mutex{},
+		sessions: make(map[string]*UploadSession),
+	}
+}
+
+func copySession(s *UploadSession) *UploadSession {
+	out := *s
+	out.Chunks = append([]string(nil), s.Chunks...)
+	return &out
+}
+
+func (this *MemoryUploadStore) Create(ctx context.Context, s *UploadSession) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.sessions[s.Id] = copySession(s)
+	return nil
+}
+
+func (this *MemoryUploadStore) Get(ctx context.Context, id string) (*UploadSession, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	s, ok := this.sessions[id]
+	if !ok {
+		return nil, ErrUploadSessionNotFound
+	}
+	return copySession(s), nil
+}
+
+func (this *MemoryUploadStore) Update(ctx context.Context, s *UploadSession, expectOffset int64, expectCompleting string) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	old, ok := this.sessions[s.Id]
+	if !ok {
+		return false, ErrUploadSessionNotFound
+	}
+	if !old.match(expectOffset, expectCompleting) {
+		return false, nil
+	}
+	this.sessions[s.Id] = copySession(s)
+	return true, nil
+}
+
+func (this *MemoryUploadStore) Delete(ctx context.Context, id string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.sessions, id)
+	return nil
+}
+
+func (this *MemoryUploadStore) Expired(ctx context.Context, t time.Time, limit int) ([]*UploadSession, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	out := make([]*UploadSession, 0)
+	for _, s := range this.sessions {
+		if s.ExpiresAt.Before(t) {
+			out = append(out, copySession(s))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ExpiresAt.Before(out[j].ExpiresAt)
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+const (
+	redisUploadKeyPrefix  = "bootx:upload:"
+	redisUploadExpiresKey = "bootx:upload-expires"
+	//redis key live longer than session, so cleanup could find its chunks
+	redisUploadKeyGrace = time.Hour
+)
+
+//RedisUploadStore keep session json in redis, expires are indexed by a sorted set
+type RedisUploadStore struct {
+	cli *redis.Client
+}
+
+func NewRedisUploadStore(cli *RedisClient) *RedisUploadStore {
+	return &RedisUploadStore{cli: cli.Client}
+}
+
+func (this *RedisUploadStore) set(p redis.Cmdable, s *UploadSession) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(s.ExpiresAt) + redisUploadKeyGrace
+	p.Set(redisUploadKeyPrefix+s.Id, data, ttl)
+	p.ZAdd(redisUploadExpiresKey, redis.Z{Score: float64(s.ExpiresAt.Unix()), Member: s.Id})
+	return nil
+}
+
+func (this *RedisUploadStore) Create(ctx context.Context, s *UploadSession) error {
+	var err error
+	_, pErr := this.cli.WithContext(ctx).TxPipelined(func(p redis.Pipeliner) error {
+		err = this.set(p, s)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return pErr
+}
+
+func (this *RedisUploadStore) get(c redis.Cmdable, id string) (*UploadSession, error) {
+	data, err := c.Get(redisUploadKeyPrefix + id).Bytes()
+	if err == redis.Nil {
+		return nil, ErrUploadSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := new(UploadSession)
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (this *RedisUploadStore) Get(ctx context.Context, id string) (*UploadSession, error) {
+	return this.get(this.cli.WithContext(ctx), id)
+}
+
+//optimistic lock by WATCH
+func (this *RedisUploadStore) Update(ctx context.Context, s *UploadSession, expectOffset int64, expectCompleting string) (bool, error) {
+	updated := false
+	err := this.cli.WithContext(ctx).Watch(func(tx *redis.Tx) error {
+		old, err := this.get(tx, s.Id)
+		if err != nil {
+			return err
+		}
+		if !old.match(expectOffset, expectCompleting) {
+			return nil
+		}
+		var setErr error
+		_, err = tx.TxPipelined(func(p redis.Pipeliner) error {
+			setErr = this.set(p, s)
+			return setErr
+		})
+		if setErr != nil {
+			return setErr
+		}
+		updated = err == nil
+		return err
+	}, redisUploadKeyPrefix+s.Id)
+	if err == redis.TxFailedErr {
+		return false, nil
+	}
+	return updated, err
+}
+
+func (this *RedisUploadStore) Delete(ctx context.Context, id string) error {
+	_, err := this.cli.WithContext(ctx).TxPipelined(func(p redis.Pipeliner) error {
+		p.Del(redisUploadKeyPrefix + id)
+		p.ZRem(redisUploadExpiresKey, id)
+		return nil
+	})
+	return err
+}
+
+func (this *RedisUploadStore) Expired(ctx context.Context, t time.Time, limit int) ([]*UploadSession, error) {
+	cli := this.cli.WithContext(ctx)
+	ids, err := cli.ZRangeByScore(redisUploadExpiresKey, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(t.Unix(), 10),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*UploadSession, 0, len(ids))
+	for _, id := range ids {
+		s, err := this.get(cli, id)
+		if err == ErrUploadSessionNotFound {
+			//key expired, only index left
+			cli.ZRem(redisUploadExpiresKey, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+//state column of completed session, never equals a completing token
+const uploadStateCompleted = "completed"
+
+//UploadSessionRecord is the table of DBUploadStore
+type UploadSessionRecord struct {
+	Id           string `gorm:"primary_key;size:64"`
+	UploadOffset int64  `gorm:"not null"`
+	//completing token, uploadStateCompleted or empty, null of rows created before the column
+	State     string    `gorm:"size:64"`
+	ExpiresAt time.Time `gorm:"index"`
+	Data      string    `gorm:"type:text"`
+}
+
+func (UploadSessionRecord) TableName() string {
+	return "bootx_upload_sessions"
+}
+
+//DBUploadStore keep sessions in table bootx_upload_sessions
+type DBUploadStore struct {
+	db *DataBase
+}
+
+//NewDBUploadStore create store & auto migrate its table
+func NewDBUploadStore(db *DataBase) (*DBUploadStore, error) {
+	if err := db.AutoMigrate(&UploadSessionRecord{}).Error; err != nil {
+		return nil, errors.Wrap(err, "migrate upload session table failed")
+	}
+	//session is read right after written, replicas may lag
+	return &DBUploadStore{db: db.ForcePrimary()}, nil
+}
+
+func sessionRecord(s *UploadSession) (*UploadSessionRecord, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	state := s.Completing
+	if s.Completed {
+		state = uploadStateCompleted
+	}
+	return &UploadSessionRecord{
+		Id:           s.Id,
+		UploadOffset: s.Offset,
+		State:        state,
+		ExpiresAt:    s.ExpiresAt,
+		Data:         string(data),
+	}, nil
+}
+
+func (this *UploadSessionRecord) session() (*UploadSession, error) {
+	s := new(UploadSession)
+	if err := json.Unmarshal([]byte(this.Data), s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (this *DBUploadStore) Create(ctx context.Context, s *UploadSession) error {
+	r, err := sessionRecord(s)
+	if err != nil {
+		return err
+	}
+	return this.db.Query().Create(r).Error
+}
+
+func (this *DBUploadStore) Get(ctx context.Context, id string) (*UploadSession, error) {
+	r := new(UploadSessionRecord)
+	err := this.db.Query().Where("id = ?", id).First(r).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrUploadSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.session()
+}
+
+func (this *DBUploadStore) Update(ctx context.Context, s *UploadSession, expectOffset int64, expectCompleting string) (bool, error) {
+	r, err := sessionRecord(s)
+	if err != nil {
+		return false, err
+	}
+	q := this.db.Query().Model(&UploadSessionRecord{}).
+		Where("id = ? AND upload_offset = ? AND COALESCE(state, '') = ?", s.Id, expectOffset, expectCompleting).
+		Updates(map[string]interface{}{
+			"upload_offset": r.UploadOffset,
+			"state":         r.State,
+			"expires_at":    r.ExpiresAt,
+			"data":          r.Data,
+		})
+	if q.Error != nil {
+		return false, q.Error
+	}
+	return q.RowsAffected == 1, nil
+}
+
+func (this *DBUploadStore) Delete(ctx context.Context, id string) error {
+	return this.db.Query().Where("id = ?", id).Delete(&UploadSessionRecord{}).Error
+}
+
+func (this *DBUploadStore) Expired(ctx context.Context, t time.Time, limit int) ([]*UploadSession, error) {
+	records := make([]*UploadSessionRecord, 0)
+	err := this.db.Query().Where("expires_at < ?", t).Order("expires_at").Limit(limit).Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*UploadSession, 0, len(records))
+	for _, r := range records {
+		s, err := r.session()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
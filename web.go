@@ -1,14 +1,23 @@
 package bootx
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/gen-iot/std"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/netutil"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const HeaderAuthorization = echo.HeaderAuthorization
@@ -16,6 +25,15 @@ const (
 	DefaultHttpPort     = 8080
 	DefaultStaticRoot   = ""
 	DefaultWebBodyLimit = 5
+	//wait for in-flight requests before force close
+	DefaultWebShutdownTimeout = 30
+	//seconds, whole request including body, large upload may need more
+	DefaultWebReadTimeout       = 300
+	DefaultWebReadHeaderTimeout = 10
+	DefaultWebWriteTimeout      = 300
+	DefaultWebIdleTimeout       = 120
+	DefaultWebMaxHeaderBytes    = http.DefaultMaxHeaderBytes
+	DefaultWebMaxConns          = 10000
 )
 
 //noinspection ALL
@@ -26,23 +44,103 @@ const (
 
 type (
 	WebConfig struct {
-		Port              int          `yaml:"port" json:"port" validate:"min=1,max=65535"`
-		StaticPathPrefix  string       `yaml:"staticPathPrefix" json:"staticPathPrefix"`
-		StaticRootDir     string       `yaml:"staticRootDir" json:"staticRootDir"`
-		DirectoryBrowsing bool         `yaml:"directoryBrowsing" json:"directoryBrowsing"`
-		Debug             bool         `yaml:"debug" json:"debug"`
-		BodyLimit         int          `yaml:"bodyLimit" json:"bodyLimit"`
-		ErrHandler        ErrorHandler `json:"-" yaml:"-"`
+		Port              int    `yaml:"port" json:"port" validate:"min=1,max=65535"`
+		StaticPathPrefix  string `yaml:"staticPathPrefix" json:"staticPathPrefix"`
+		StaticRootDir     string `yaml:"staticRootDir" json:"staticRootDir"`
+		DirectoryBrowsing bool   `yaml:"directoryBrowsing" json:"directoryBrowsing"`
+		Debug             bool   `yaml:"debug" json:"debug"`
+		BodyLimit         int    `yaml:"bodyLimit" json:"bodyLimit"`
+		ShutdownTimeout   int    `yaml:"shutdownTimeout" json:"shutdownTimeout" validate:"min=0,max=3600"`
+		ReadTimeout       int    `yaml:"readTimeout" json:"readTimeout" validate:"min=-1"`             //seconds, 0 = default, -1 = no limit
+		ReadHeaderTimeout int    `yaml:"readHeaderTimeout" json:"readHeaderTimeout" validate:"min=-1"` //seconds, 0 = default, -1 = no limit
+		WriteTimeout      int    `yaml:"writeTimeout" json:"writeTimeout" validate:"min=-1"`           //seconds, 0 = default, -1 = no limit
+		IdleTimeout       int    `yaml:"idleTimeout" json:"idleTimeout" validate:"min=-1"`             //seconds of keep-alive, 0 = default, -1 = no limit
+		MaxHeaderBytes    int    `yaml:"maxHeaderBytes" json:"maxHeaderBytes" validate:"min=0"`
+		MaxConns          int    `yaml:"maxConns" json:"maxConns" validate:"min=-1"` //max concurrent connections, 0 = default, -1 = no limit
+		Health            bool   `yaml:"health" json:"health"`                       //enable /healthz & /readyz
+		Metrics           bool   `yaml:"metrics" json:"metrics"`
+		MetricsPath       string `yaml:"metricsPath" json:"metricsPath"` //default /metrics
+		//serve https if certFile & keyFile set
+		TLS WebTLSConfig `yaml:"tls" json:"tls"`
+		//http/2 is negotiated by alpn over tls unless disabled
+		DisableHTTP2 bool `yaml:"disableHTTP2" json:"disableHTTP2"`
+		//serve http/2 without tls (h2c), ignored when tls enabled
+		H2C bool `yaml:"h2c" json:"h2c"`
+		//listen plain http on the port & redirect to https, only when tls enabled
+		RedirectHttpPort int          `yaml:"redirectHttpPort" json:"redirectHttpPort" validate:"omitempty,min=1,max=65535"`
+		ErrHandler       ErrorHandler `json:"-" yaml:"-"`
 	}
 	ErrorHandler func(error, Context)
+
+	//WebTLSConfig cert & ca files are reloaded when changed on disk or SIGHUP received
+	WebTLSConfig struct {
+		CertFile string `yaml:"certFile" json:"certFile" validate:"required_with=KeyFile,omitempty,file"`
+		KeyFile  string `yaml:"keyFile" json:"keyFile" validate:"required_with=CertFile,omitempty,file"`
+		//pem bundle of ca to verify client certificate, enable mtls
+		ClientCAFile string `yaml:"clientCAFile" json:"clientCAFile" validate:"omitempty,file"`
+		//require: client must send a certificate, request: verify if sent. default require
+		ClientAuth string `yaml:"clientAuth" json:"clientAuth" validate:"omitempty,oneof=require request"`
+		//1.0 1.1 1.2 1.3, default 1.2
+		MinVersion string `yaml:"minVersion" json:"minVersion" validate:"omitempty,oneof=1.0 1.1 1.2 1.3"`
+		//interval of checking files change, default 30s, < 0 disable, SIGHUP always reload
+		ReloadIntervalSec int64 `yaml:"reloadInterval" json:"reloadInterval" validate:"max=86400"`
+	}
 )
 
+func (this WebTLSConfig) Enabled() bool {
+	return len(this.CertFile) > 0
+}
+
+func (this WebTLSConfig) files() []string {
+	out := []string{this.CertFile, this.KeyFile}
+	if len(this.ClientCAFile) > 0 {
+		out = append(out, this.ClientCAFile)
+	}
+	return out
+}
+
+func (this WebTLSConfig) serverConfig(http2 bool) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(this.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(this.CertFile, this.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		NextProtos:   []string{"http/1.1"},
+	}
+	if http2 {
+		conf.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if len(this.ClientCAFile) > 0 {
+		if conf.ClientCAs, err = loadCertPool(this.ClientCAFile); err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+		if this.ClientAuth == "request" {
+			conf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return conf, nil
+}
+
 var WebDefaultConfig = WebConfig{
 	Port:              DefaultHttpPort,
 	StaticRootDir:     DefaultStaticRoot,
 	DirectoryBrowsing: false,
 	Debug:             false,
 	BodyLimit:         DefaultWebBodyLimit,
+	ShutdownTimeout:   DefaultWebShutdownTimeout,
+	ReadTimeout:       DefaultWebReadTimeout,
+	ReadHeaderTimeout: DefaultWebReadHeaderTimeout,
+	WriteTimeout:      DefaultWebWriteTimeout,
+	IdleTimeout:       DefaultWebIdleTimeout,
+	MaxHeaderBytes:    DefaultWebMaxHeaderBytes,
+	MaxConns:          DefaultWebMaxConns,
 }
 
 type WebX struct {
@@ -50,6 +148,14 @@ type WebX struct {
 	*echo.Echo
 	ctxPool          *sync.Pool
 	preUseMiddleware middlewares
+	routes           *routeTable
+	handlers         *handlerTable
+	renderer         ResponseRenderer
+	inFlight         int64
+	drained          int64
+	shuttingDown     int32
+	tls              *tlsReloader
+	redirectServer   *http.Server
 }
 
 func (this *WebX) grabCtx() *contextImpl {
@@ -78,6 +184,37 @@ func (this *WebX) NewContext(r *http.Request, w http.ResponseWriter) Context {
 }
 
 func NewWebWithConf(conf WebConfig) *WebX {
+	web, err := NewWebE(conf)
+	std.AssertError(err, "web init failed")
+	return web
+}
+
+//NewWebE create web with config, return *ConfigError when config invalid
+func NewWebE(conf WebConfig) (*WebX, error) {
+	if err := std.ValidateStruct(conf); err != nil {
+		return nil, &ConfigError{Module: ModuleWeb, Err: err}
+	}
+	if conf.ShutdownTimeout <= 0 {
+		conf.ShutdownTimeout = DefaultWebShutdownTimeout
+	}
+	if conf.ReadTimeout == 0 {
+		conf.ReadTimeout = DefaultWebReadTimeout
+	}
+	if conf.ReadHeaderTimeout == 0 {
+		conf.ReadHeaderTimeout = DefaultWebReadHeaderTimeout
+	}
+	if conf.WriteTimeout == 0 {
+		conf.WriteTimeout = DefaultWebWriteTimeout
+	}
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = DefaultWebIdleTimeout
+	}
+	if conf.MaxHeaderBytes == 0 {
+		conf.MaxHeaderBytes = DefaultWebMaxHeaderBytes
+	}
+	if conf.MaxConns == 0 {
+		conf.MaxConns = DefaultWebMaxConns
+	}
 	web := &WebX{
 		conf: conf,
 		Echo: echo.New(),
@@ -86,7 +223,11 @@ func NewWebWithConf(conf WebConfig) *WebX {
 				return new(contextImpl)
 			},
 		},
+		routes:   newRouteTable(),
+		handlers: newHandlerTable(),
+		renderer: NewRenderer(DefaultRendererConfig),
 	}
+	web.Pre(web.inFlightMiddleware)
 	web.Use(middleware.Recover())
 	web.Use(middleware.RequestID())
 	web.Use(web.customContextMiddleware)
@@ -106,8 +247,9 @@ func NewWebWithConf(conf WebConfig) *WebX {
 	conf.StaticRootDir = strings.Trim(conf.StaticRootDir, " ")
 	conf.StaticPathPrefix = strings.Trim(conf.StaticPathPrefix, " ")
 	if conf.StaticRootDir != "" {
-		err := os.MkdirAll(conf.StaticRootDir, os.ModePerm)
-		std.AssertError(err, "create web static dir failed")
+		if err := os.MkdirAll(conf.StaticRootDir, os.ModePerm); err != nil {
+			return nil, &ConfigError{Module: ModuleWeb, Err: errors.Wrap(err, "create web static dir failed")}
+		}
 		staticConfig := middleware.StaticConfig{
 			Root:   conf.StaticRootDir,
 			HTML5:  true,
@@ -120,6 +262,12 @@ func NewWebWithConf(conf WebConfig) *WebX {
 			web.Use(middleware.StaticWithConfig(staticConfig))
 		}
 	}
+	if conf.Health {
+		web.EnableHealth()
+	}
+	if conf.Metrics {
+		web.EnableMetrics(conf.MetricsPath)
+	}
 	web.Validator = NewWebValidator()
 	web.Binder = NewCustomBinder()
 	web.HideBanner = true
@@ -129,6 +277,11 @@ func NewWebWithConf(conf WebConfig) *WebX {
 		conf.ErrHandler = web.defaultErrorHandler
 	}
 	web.HTTPErrorHandler = func(e error, echoCtx echo.Context) {
+		//reuse the context of request, a fresh one only when ctx released, e.g. panic recovered
+		if ctx, ok := echoCtx.Get(ctxKeyContext).(*contextImpl); ok {
+			conf.ErrHandler(e, ctx)
+			return
+		}
 		ctx := web.grabCtx()
 		defer func() {
 			ctx.reset()
@@ -137,10 +290,10 @@ func NewWebWithConf(conf WebConfig) *WebX {
 		ctx.init(echoCtx)
 		conf.ErrHandler(e, ctx)
 	}
-	return web
+	return web, nil
 }
 
-var webOnce = sync.Once{}
+var webOnce = initOnce{}
 var gWebX *WebX = nil
 
 func Web() *WebX {
@@ -148,33 +301,178 @@ func Web() *WebX {
 	return gWebX
 }
 
-func webInit() {
-	webInitWithConfig(WebDefaultConfig)
+func webInit() error {
+	return webInitWithConfig(WebDefaultConfig)
 }
 
-func webInitWithConfig(conf WebConfig) {
+func webInitWithConfig(conf WebConfig) error {
 	if conf.BodyLimit <= 0 {
 		conf.BodyLimit = DefaultWebBodyLimit
 	}
-	webOnce.Do(func() {
-		err := std.ValidateStruct(conf)
-		std.AssertError(err, "web配置不正确")
-		logger.Printf("web(port=%d,debug=%v) init  ...", conf.Port, conf.Debug)
-		gWebX = NewWebWithConf(conf)
+	return webOnce.Do(func() error {
+		moduleLog(ModuleWeb).Info("web init ...", "port", conf.Port, "debug", conf.Debug)
+		web, err := NewWebE(conf)
+		if err != nil {
+			return err
+		}
+		gWebX = web
+		return nil
 	})
 }
 
-func (this *WebX) start() {
+func webReset() {
+	gWebX = nil
+	webOnce.reset()
+}
+
+//listen synchronously so that address errors can be reported, then serve in background
+func (this *WebX) start() error {
+	addr := fmt.Sprintf(":%d", this.conf.Port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return &ConnectError{Module: ModuleWeb, Target: addr, Err: err}
+	}
+	if this.conf.MaxConns > 0 {
+		ln = netutil.LimitListener(ln, this.conf.MaxConns)
+	}
+	this.applyServerLimits(this.Server)
+	this.applyServerLimits(this.TLSServer)
+	if this.conf.TLS.Enabled() {
+		if err = this.startTLS(ln); err != nil {
+			_ = ln.Close()
+			return err
+		}
+		return nil
+	}
+	this.Listener = ln
+	go func() {
+		var err error
+		if this.conf.H2C {
+			err = this.StartH2CServer(addr, &http2.Server{})
+		} else {
+			err = this.Start(addr)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			moduleLog(ModuleWeb).Error("web serve failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+//timeouts <= 0 means no limit
+func (this *WebX) applyServerLimits(s *http.Server) {
+	second := func(n int) time.Duration {
+		if n <= 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+	s.ReadTimeout = second(this.conf.ReadTimeout)
+	s.ReadHeaderTimeout = second(this.conf.ReadHeaderTimeout)
+	s.WriteTimeout = second(this.conf.WriteTimeout)
+	s.IdleTimeout = second(this.conf.IdleTimeout)
+	s.MaxHeaderBytes = this.conf.MaxHeaderBytes
+}
+
+//every handshake use the latest reloaded certificates
+func (this *WebX) startTLS(ln net.Listener) error {
+	conf := this.conf.TLS
+	reloader, err := newTLSReloader(ModuleWeb, conf.files(), func() (*tls.Config, error) {
+		return conf.serverConfig(!this.conf.DisableHTTP2)
+	}, conf.ReloadIntervalSec)
+	if err != nil {
+		return err
+	}
+	if this.conf.RedirectHttpPort > 0 {
+		if err = this.startRedirect(); err != nil {
+			reloader.Stop()
+			return err
+		}
+	}
+	this.tls = reloader
+	this.DisableHTTP2 = this.conf.DisableHTTP2
+	s := this.TLSServer
+	//NextProtos of base config decide whether http/2 is configured by server
+	s.TLSConfig = &tls.Config{
+		NextProtos: reloader.Config().NextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return reloader.Config(), nil
+		},
+	}
+	if this.conf.DisableHTTP2 {
+		s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	this.TLSListener = tls.NewListener(ln, s.TLSConfig)
 	go func() {
-		addr := fmt.Sprintf(":%d", this.conf.Port)
-		if err := this.Start(addr); err != nil {
-			logger.Println("Web got error when shutting down : ", err)
+		if err := this.StartServer(s); err != nil && err != http.ErrServerClosed {
+			moduleLog(ModuleWeb).Error("web serve failed", "err", err)
 		}
 	}()
+	return nil
 }
 
+func (this *WebX) startRedirect() error {
+	addr := fmt.Sprintf(":%d", this.conf.RedirectHttpPort)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return &ConnectError{Module: ModuleWeb, Target: addr, Err: err}
+	}
+	this.redirectServer = &http.Server{Handler: http.HandlerFunc(this.redirectHttps)}
+	this.applyServerLimits(this.redirectServer)
+	go func() {
+		if err := this.redirectServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			moduleLog(ModuleWeb).Error("web redirect serve failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (this *WebX) redirectHttps(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if this.conf.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(this.conf.Port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+func (this *WebX) inFlightMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		atomic.AddInt64(&this.inFlight, 1)
+		defer func() {
+			atomic.AddInt64(&this.inFlight, -1)
+			if atomic.LoadInt32(&this.shuttingDown) == 1 {
+				atomic.AddInt64(&this.drained, 1)
+			}
+		}()
+		return next(ctx)
+	}
+}
+
+//stop accepting new connections, wait for in-flight requests until timeout ,then force close
 func (this *WebX) stop() {
-	if err := this.Close(); err != nil {
-		logger.Println(" got error when shutting down: ", err)
+	atomic.StoreInt32(&this.shuttingDown, 1)
+	timeout := time.Duration(this.conf.ShutdownTimeout) * time.Second
+	moduleLog(ModuleWeb).Info("web shutting down ...",
+		"inFlight", atomic.LoadInt64(&this.inFlight), "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if this.redirectServer != nil {
+		_ = this.redirectServer.Shutdown(ctx)
+	}
+	if this.tls != nil {
+		this.tls.Stop()
+	}
+	err := this.Shutdown(ctx)
+	aborted := atomic.LoadInt64(&this.inFlight)
+	if err != nil {
+		moduleLog(ModuleWeb).Warn("web graceful shutdown failed, force close", "err", err)
+		if err = this.Close(); err != nil {
+			moduleLog(ModuleWeb).Error("web close failed", "err", err)
+		}
 	}
+	moduleLog(ModuleWeb).Info("web stopped",
+		"drained", atomic.LoadInt64(&this.drained), "aborted", aborted)
 }
@@ -1,6 +1,7 @@
 package bootx
 
 import (
+	"context"
 	"fmt"
 	"github.com/gen-iot/std"
 	"github.com/labstack/echo/v4"
@@ -12,6 +13,9 @@ import (
 
 const HeaderFuncName = "BootX-Func-Name"
 
+//echo context key of the bootx context of request
+const ctxKeyContext = "bootx.context"
+
 //if DisableReqPreBind == true ,you should bind req yourself
 var DisableReqPreBind = false
 
@@ -19,6 +23,16 @@ type Context interface {
 	echo.Context
 	Id() string
 	FuncName() string
+	//logger with request id & func name attached
+	Log() Logger
+	//primary tag of Accept-Language, e.g. zh, en
+	Language() string
+	//context of request, carry tx of DataBase.TxWeb
+	Ctx() context.Context
+	SetCtx(ctx context.Context)
+	//route metadata, nil if handler not registered by WebX.Handle
+	Route() *RouteInfo
+	setRoute(r *RouteInfo)
 
 	SetUserAuthData(data interface{})
 	UserAuthData() interface{}
@@ -60,6 +74,8 @@ type contextImpl struct {
 	inType    reflect.Type
 	handlerV  reflect.Value
 	funcFlags uint32
+	log       Logger
+	route     *RouteInfo
 }
 
 func (c *contextImpl) reset() {
@@ -73,6 +89,8 @@ func (c *contextImpl) reset() {
 	c.funcFlags = 0
 	c.inType = nil
 	c.handlerV = reflect.ValueOf(nil)
+	c.log = nil
+	c.route = nil
 }
 
 func (c *contextImpl) init(echoCtx echo.Context) {
@@ -82,13 +100,53 @@ func (c *contextImpl) init(echoCtx echo.Context) {
 }
 
 func (c *contextImpl) Id() string {
-	return c.Request().Header.Get(echo.HeaderXRequestID)
+	id := c.Request().Header.Get(echo.HeaderXRequestID)
+	if len(id) == 0 {
+		//generated by RequestID middleware
+		id = c.Response().Header().Get(echo.HeaderXRequestID)
+	}
+	return id
 }
 
 func (c *contextImpl) FuncName() string {
 	return c.Request().Header.Get(HeaderFuncName)
 }
 
+func (c *contextImpl) Log() Logger {
+	if c.log == nil {
+		c.log = moduleLog(ModuleWeb).With("requestId", c.Id())
+	}
+	if name := c.FuncName(); len(name) > 0 {
+		return c.log.With("func", name)
+	}
+	return c.log
+}
+
+func (c *contextImpl) Ctx() context.Context {
+	return c.Request().Context()
+}
+
+func (c *contextImpl) SetCtx(ctx context.Context) {
+	c.SetRequest(c.Request().WithContext(ctx))
+}
+
+func (c *contextImpl) Language() string {
+	return ParseLanguage(c.Request().Header.Get("Accept-Language"))
+}
+
+//Validate override echo validator, return *Error(ErrValidation) with field details
+func (c *contextImpl) Validate(i interface{}) error {
+	return ValidateWithLang(c.Language(), i)
+}
+
+func (c *contextImpl) Route() *RouteInfo {
+	return c.route
+}
+
+func (c *contextImpl) setRoute(r *RouteInfo) {
+	c.route = r
+}
+
 func (c *contextImpl) SetUserAuthData(data interface{}) {
 	c.AuthData = data
 }
@@ -166,12 +224,7 @@ func (c *contextImpl) BindAndValidate(in interface{}) error {
 	if err != nil {
 		return err
 	}
-	lang := c.Request().Header.Get("Accept-Language")
-	err = std.ValidateStructWithLanguage(std.Str2Lang(lang), in)
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.Validate(in)
 }
 
 func (c *contextImpl) End() error {
@@ -186,11 +239,17 @@ func (this *WebX) customContextMiddleware(next echo.HandlerFunc) echo.HandlerFun
 	return func(echoCtx echo.Context) error {
 		ctx := this.grabCtx()
 		defer func() {
+			echoCtx.Set(ctxKeyContext, nil)
 			ctx.reset()
 			this.releaseCtx(ctx)
 		}()
 		ctx.init(echoCtx)
-		return next(ctx)
+		echoCtx.Set(ctxKeyContext, ctx)
+		//handle error before ctx released, so route & in type of ctx are known by error handler
+		if err := next(ctx); err != nil {
+			echoCtx.Error(err)
+		}
+		return nil
 	}
 }
 
@@ -212,6 +271,24 @@ func BuildHttpHandler(handler interface{}, m ...MiddlewareFunc) echo.HandlerFunc
 
 //noinspection ALL
 func (this *WebX) BuildHttpHandler(handler interface{}, m ...MiddlewareFunc) echo.HandlerFunc {
+	return this.buildHttpHandler(newHandlerMeta(handler), nil, m...)
+}
+
+//handlerMeta is the reflected signature of a bootx handler
+type handlerMeta struct {
+	fv      reflect.Value
+	fName   string
+	inType  reflect.Type
+	outType reflect.Type
+	flags   uint32
+}
+
+func newHandlerMeta(handler interface{}) *handlerMeta {
+	return newHandlerMetaOf(handler, typeOfContext)
+}
+
+//ctxType is the type of optional first in param, Context or MqttContext
+func newHandlerMetaOf(handler interface{}, ctxType reflect.Type) *handlerMeta {
 	fv, ok := handler.(reflect.Value)
 	if !ok {
 		fv = reflect.ValueOf(handler)
@@ -219,26 +296,57 @@ func (this *WebX) BuildHttpHandler(handler interface{}, m ...MiddlewareFunc) ech
 	std.Assert(fv.Kind() == reflect.Func, "handler not func!")
 	ft := fv.Type()
 	fName := getFuncName(fv)
-	inType, inFlags := checkInParam(fName, ft)
-	_, outFlags := checkOutParam(fName, ft)
-	flags := inFlags | outFlags
-	return ConvertFromEchoCtx(func(ctx Context) error {
-		ctx.Request().Header.Set(HeaderFuncName, fName)
-		ctx.setHandlerValue(fv)
-		ctx.setFuncFlags(flags)
-		ctx.setInType(inType)
+	inType, inFlags := checkInParam(fName, ft, ctxType)
+	outType, outFlags := checkOutParam(fName, ft)
+	return &handlerMeta{
+		fv:      fv,
+		fName:   fName,
+		inType:  inType,
+		outType: outType,
+		flags:   inFlags | outFlags,
+	}
+}
+
+func (this *WebX) buildHttpHandler(meta *handlerMeta, route *RouteInfo, m ...MiddlewareFunc) echo.HandlerFunc {
+	h := ConvertFromEchoCtx(func(ctx Context) error {
+		ctx.Request().Header.Set(HeaderFuncName, meta.fName)
+		ctx.Set(ctxKeyMetricsFunc, meta.fName)
+		ctx.setRoute(route)
+		ctx.setHandlerValue(meta.fv)
+		ctx.setFuncFlags(meta.flags)
+		ctx.setInType(meta.inType)
 		h := ____buildChain(m...)
 		//pre use
 		if this.preUseMiddleware.Len() > 0 {
 			h = applyMiddleware(h, this.preUseMiddleware.midwares...)
 		}
 		h(ctx)
-		//if has rsp & no error need write response,otherwise err handler will handle
-		if !ctx.Response().Committed && ctx.Resp() != nil && ctx.Err() == nil {
-			return ctx.JSONPretty(ctx.HttpStatusCode(), ctx.Resp(), jsonIndent)
+		//if no error need write response,otherwise err handler will handle
+		if !ctx.Response().Committed && ctx.Err() == nil {
+			//no rsp, e.g. handler returns error only, status without body
+			if ctx.Resp() == nil {
+				return ctx.NoContent(ctx.HttpStatusCode())
+			}
+			return this.rendererOf(ctx).Render(ctx, ctx.HttpStatusCode(), ctx.Resp())
 		}
 		return ctx.Err()
 	})
+	built := &builtHandler{meta: meta, route: route, h: h}
+	//method value is allocated every time, so it is a unique key of handlers table
+	serve := built.serve
+	this.handlers.add(serve, built)
+	return serve
+}
+
+//builtHandler is the handler built by bootx, its meta is looked up when route registered by echo methods
+type builtHandler struct {
+	meta  *handlerMeta
+	route *RouteInfo
+	h     echo.HandlerFunc
+}
+
+func (this *builtHandler) serve(echoCtx echo.Context) error {
+	return this.h(echoCtx)
 }
 
 func ____buildChain(m ...MiddlewareFunc) HandlerFunc {
@@ -258,7 +366,7 @@ func ____buildChain(m ...MiddlewareFunc) HandlerFunc {
 				err := ctx.Bind(req)
 				if err != nil {
 					ctx.SetHttpStatusCode(http.StatusBadRequest)
-					ctx.SetError(echo.NewHTTPError(http.StatusBadRequest, err.Error()))
+					ctx.SetError(ErrBadRequest.Wrap(err).WithDetails(&ErrorDetail{Message: bindErrorMessage(err)}))
 				}
 			}
 			if !isPtr {
@@ -274,6 +382,10 @@ func ____buildChain(m ...MiddlewareFunc) HandlerFunc {
 
 func ____buildCall() HandlerFunc {
 	return func(ctx Context) {
+		//bind or validate failed, don't call handler with invalid req
+		if ctx.Err() != nil {
+			return
+		}
 		inParams := make([]reflect.Value, 0)
 		//has Ctx
 		if ctx.HasInCtxArg() {
@@ -317,7 +429,7 @@ const (
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 var typeOfContext = reflect.TypeOf((*Context)(nil)).Elem()
 
-func checkInParam(name string, t reflect.Type) (reflect.Type, uint32) {
+func checkInParam(name string, t reflect.Type, ctxType reflect.Type) (reflect.Type, uint32) {
 	var handlerFlags uint32 = 0
 	var inParamType reflect.Type = nil
 	inNum := t.NumIn()
@@ -329,7 +441,7 @@ func checkInParam(name string, t reflect.Type) (reflect.Type, uint32) {
 		//func()
 	case 1:
 		// func foo(Context)
-		if t.In(0) == typeOfContext {
+		if t.In(0) == ctxType {
 			handlerFlags = handlerFlags | handlerHasCtx
 		} else {
 			handlerFlags = handlerFlags | handlerHasReqData
@@ -339,8 +451,8 @@ func checkInParam(name string, t reflect.Type) (reflect.Type, uint32) {
 	case 2:
 		// func foo(Context,param1)
 		in0 := t.In(0)
-		std.Assert(in0 == typeOfContext,
-			fmt.Sprintf("'%s' not valid :first in param must be Context", name))
+		std.Assert(in0 == ctxType,
+			fmt.Sprintf("'%s' not valid :first in param must be %s", name, ctxType.Name()))
 		in1 := t.In(1)
 		inParamType = in1
 		handlerFlags = handlerFlags | handlerHasCtx | handlerHasReqData
@@ -383,3 +495,10 @@ func getFuncName(fv reflect.Value) string {
 	}
 	return fname
 }
+
+func bindErrorMessage(err error) string {
+	if he, ok := err.(*echo.HTTPError); ok {
+		return fmt.Sprintf("%v", he.Message)
+	}
+	return err.Error()
+}
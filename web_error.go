@@ -0,0 +1,332 @@
+package bootx
+
+import (
+	"fmt"
+	"github.com/gen-iot/std"
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/zh"
+	"github.com/go-playground/universal-translator"
+	"github.com/pkg/errors"
+	"gopkg.in/go-playground/validator.v9"
+	enTranslations "gopkg.in/go-playground/validator.v9/translations/en"
+	zhTranslations "gopkg.in/go-playground/validator.v9/translations/zh"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//used when Accept-Language is empty or not supported, same as std.Str2Lang
+var DefaultLanguage = "zh"
+
+//ErrorCode is a registered business error, client should rely on Code instead of message
+type ErrorCode struct {
+	Code       int
+	HttpStatus int
+	MessageKey string
+}
+
+//ErrorDetail describe one failure, e.g. one invalid field
+type ErrorDetail struct {
+	Field   string `json:"field,omitempty" xml:"field,omitempty" msgpack:"field,omitempty"`
+	Rule    string `json:"rule,omitempty" xml:"rule,omitempty" msgpack:"rule,omitempty"`
+	Message string `json:"message" xml:"message" msgpack:"message"`
+}
+
+//Error is the application error, written by error handler as ErrorResponse
+type Error struct {
+	Code       int
+	HttpStatus int
+	MessageKey string
+	//message format args
+	Args    []interface{}
+	Details []*ErrorDetail
+	Cause   error
+}
+
+var (
+	errorCodes    = make(map[int]*ErrorCode)
+	errorCodeLock = &sync.RWMutex{}
+)
+
+//DefineError register error code, panic if code duplicate
+func DefineError(code int, httpStatus int, messageKey string) *ErrorCode {
+	errorCodeLock.Lock()
+	defer errorCodeLock.Unlock()
+	_, dup := errorCodes[code]
+	std.Assert(!dup, fmt.Sprintf("error code %d duplicate define", code))
+	ec := &ErrorCode{Code: code, HttpStatus: httpStatus, MessageKey: messageKey}
+	errorCodes[code] = ec
+	return ec
+}
+
+func LookupErrorCode(code int) (*ErrorCode, bool) {
+	errorCodeLock.RLock()
+	defer errorCodeLock.RUnlock()
+	ec, ok := errorCodes[code]
+	return ec, ok
+}
+
+//ErrorCodes return all registered codes order by code
+func ErrorCodes() []*ErrorCode {
+	errorCodeLock.RLock()
+	out := make([]*ErrorCode, 0, len(errorCodes))
+	for _, ec := range errorCodes {
+		out = append(out, ec)
+	}
+	errorCodeLock.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Code < out[j].Code
+	})
+	return out
+}
+
+//builtin error codes
+var (
+	ErrBadRequest      = DefineError(400, http.StatusBadRequest, "bad_request")
+	ErrValidation      = DefineError(40001, http.StatusBadRequest, "validation_failed")
+	ErrUnauthorized    = DefineError(401, http.StatusUnauthorized, "unauthorized")
+	ErrForbidden       = DefineError(403, http.StatusForbidden, "forbidden")
+	ErrNotFound        = DefineError(404, http.StatusNotFound, "not_found")
+	ErrConflict        = DefineError(409, http.StatusConflict, "conflict")
+	ErrTooManyRequests = DefineError(429, http.StatusTooManyRequests, "too_many_requests")
+	ErrInternal        = DefineError(500, http.StatusInternalServerError, "internal_error")
+	ErrUnavailable     = DefineError(503, http.StatusServiceUnavailable, "service_unavailable")
+)
+
+func (this *ErrorCode) Error() string {
+	return fmt.Sprintf("error %d : %s", this.Code, this.MessageKey)
+}
+
+func (this *ErrorCode) New(args ...interface{}) *Error {
+	return this.Wrap(nil, args...)
+}
+
+func (this *ErrorCode) Wrap(cause error, args ...interface{}) *Error {
+	return &Error{
+		Code:       this.Code,
+		HttpStatus: this.HttpStatus,
+		MessageKey: this.MessageKey,
+		Args:       args,
+		Cause:      cause,
+	}
+}
+
+func (this *Error) Error() string {
+	if this.Cause != nil {
+		return fmt.Sprintf("error %d : %s : %v", this.Code, this.MessageKey, this.Cause)
+	}
+	return fmt.Sprintf("error %d : %s", this.Code, this.MessageKey)
+}
+
+func (this *Error) Unwrap() error {
+	return this.Cause
+}
+
+//Is report err is *Error or *ErrorCode with same code, e.g. errors.Is(err, bootx.ErrNotFound)
+func (this *Error) Is(target error) bool {
+	switch t := target.(type) {
+	case *ErrorCode:
+		return t.Code == this.Code
+	case *Error:
+		return t.Code == this.Code
+	}
+	return false
+}
+
+func (this *Error) WithDetails(details ...*ErrorDetail) *Error {
+	this.Details = append(this.Details, details...)
+	return this
+}
+
+//Message translate MessageKey with Args
+func (this *Error) Message(lang string) string {
+	return TranslateMessage(lang, this.MessageKey, this.Args...)
+}
+
+var (
+	errorMessages    = make(map[string]map[string]string)
+	errorMessageLock = &sync.RWMutex{}
+)
+
+//RegisterErrorMessages add messages of lang, message is format string of fmt
+func RegisterErrorMessages(lang string, messages map[string]string) {
+	lang = strings.ToLower(lang)
+	errorMessageLock.Lock()
+	defer errorMessageLock.Unlock()
+	m, ok := errorMessages[lang]
+	if !ok {
+		m = make(map[string]string)
+		errorMessages[lang] = m
+	}
+	for k, v := range messages {
+		m[k] = v
+	}
+}
+
+//TranslateMessage lookup lang,DefaultLanguage,en in order, return key if not found
+func TranslateMessage(lang string, key string, args ...interface{}) string {
+	errorMessageLock.RLock()
+	format, found := "", false
+	for _, l := range []string{lang, DefaultLanguage, "en"} {
+		if format, found = errorMessages[l][key]; found {
+			break
+		}
+	}
+	errorMessageLock.RUnlock()
+	if !found {
+		format = key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(format, args...)
+	}
+	return format
+}
+
+func init() {
+	RegisterErrorMessages("en", map[string]string{
+		"bad_request":         "bad request",
+		"validation_failed":   "validation failed",
+		"unauthorized":        "unauthorized",
+		"forbidden":           "forbidden",
+		"not_found":           "not found",
+		"conflict":            "conflict",
+		"too_many_requests":   "too many requests",
+		"internal_error":      "internal error",
+		"service_unavailable": "service unavailable",
+	})
+	RegisterErrorMessages("zh", map[string]string{
+		"bad_request":         "请求错误",
+		"validation_failed":   "参数校验失败",
+		"unauthorized":        "未授权",
+		"forbidden":           "禁止访问",
+		"not_found":           "资源不存在",
+		"conflict":            "资源冲突",
+		"too_many_requests":   "请求过于频繁",
+		"internal_error":      "服务器内部错误",
+		"service_unavailable": "服务不可用",
+	})
+}
+
+//ParseLanguage return primary tag of the first language in Accept-Language, e.g. zh-CN,zh;q=0.9 -> zh
+func ParseLanguage(acceptLanguage string) string {
+	first := strings.Split(acceptLanguage, ",")[0]
+	first = strings.TrimSpace(strings.Split(first, ";")[0])
+	first = strings.ToLower(strings.Split(first, "-")[0])
+	if len(first) == 0 || first == "*" {
+		return DefaultLanguage
+	}
+	return first
+}
+
+//translators of validator, registered on std.GlobalValidator
+var validateTranslators = make(map[string]ut.Translator)
+
+func init() {
+	v := std.GlobalValidator()
+	zhLocale := zh.New()
+	enLocale := en.New()
+	uni := ut.New(enLocale, enLocale, zhLocale)
+	if trans, ok := uni.GetTranslator("en"); ok {
+		std.AssertError(enTranslations.RegisterDefaultTranslations(v, trans), "register validator en translations")
+		validateTranslators["en"] = trans
+	}
+	if trans, ok := uni.GetTranslator("zh"); ok {
+		std.AssertError(zhTranslations.RegisterDefaultTranslations(v, trans), "register validator zh translations")
+		validateTranslators["zh"] = trans
+	}
+}
+
+//ValidateWithLang validate struct by `validate` tag, return *Error(ErrValidation) with per-field details
+func ValidateWithLang(lang string, i interface{}) error {
+	err := std.GlobalValidator().Struct(i)
+	if err == nil {
+		return nil
+	}
+	fieldErrs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return ErrValidation.Wrap(err)
+	}
+	return newValidationError(lang, reflect.TypeOf(i), fieldErrs)
+}
+
+func newValidationError(lang string, root reflect.Type, fieldErrs validator.ValidationErrors) *Error {
+	trans, ok := validateTranslators[lang]
+	if !ok {
+		trans = validateTranslators[DefaultLanguage]
+	}
+	out := ErrValidation.Wrap(fieldErrs)
+	for _, fe := range fieldErrs {
+		msg := fmt.Sprintf("%v", fe)
+		if trans != nil {
+			msg = fe.Translate(trans)
+		}
+		out.Details = append(out.Details, &ErrorDetail{
+			Field:   jsonFieldPath(root, fe.StructNamespace()),
+			Rule:    fe.Tag(),
+			Message: msg,
+		})
+	}
+	return out
+}
+
+//struct namespace Req.Items[0].Name -> items[0].name, use json tag name if present
+func jsonFieldPath(root reflect.Type, ns string) string {
+	segs := strings.Split(ns, ".")
+	if len(segs) > 1 {
+		//first is root struct name
+		segs = segs[1:]
+	}
+	t := root
+	out := make([]string, 0, len(segs))
+	for _, seg := range segs {
+		name, index := seg, ""
+		if i := strings.IndexByte(seg, '['); i >= 0 {
+			name, index = seg[:i], seg[i:]
+		}
+		for t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t == nil || t.Kind() != reflect.Struct {
+			out = append(out, seg)
+			t = nil
+			continue
+		}
+		f, ok := t.FieldByName(name)
+		if !ok {
+			out = append(out, seg)
+			t = nil
+			continue
+		}
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; len(tag) > 0 && tag != "-" {
+			name = tag
+		}
+		out = append(out, name+index)
+		t = f.Type
+		for len(index) > 0 && t != nil {
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if t.Kind() != reflect.Slice && t.Kind() != reflect.Array && t.Kind() != reflect.Map {
+				break
+			}
+			t = t.Elem()
+			index = index[strings.IndexByte(index, ']')+1:]
+		}
+	}
+	return strings.Join(out, ".")
+}
+
+//toError convert any error to *Error, *echo.HTTPError is handled by error handler
+func toError(err error, root reflect.Type, lang string) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var fieldErrs validator.ValidationErrors
+	if errors.As(err, &fieldErrs) {
+		return newValidationError(lang, root, fieldErrs)
+	}
+	return ErrInternal.Wrap(err)
+}
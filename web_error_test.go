@@ -0,0 +1,119 @@
+package bootx
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var errTestQuota = DefineError(99001, http.StatusForbidden, "test_quota")
+
+func init() {
+	RegisterErrorMessages("en", map[string]string{"test_quota": "quota of %s exceeded"})
+	RegisterErrorMessages("zh", map[string]string{"test_quota": "%s配额已用完"})
+}
+
+type errorTestItem struct {
+	Qty int `json:"qty" validate:"min=1"`
+}
+
+type errorTestReq struct {
+	Name  string           `json:"name" validate:"required"`
+	Items []*errorTestItem `json:"items" validate:"dive"`
+}
+
+func serveError(t *testing.T, web *WebX, method, target, lang, body string) (int, *ErrorResponse) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", lang)
+	rec := httptest.NewRecorder()
+	web.ServeHTTP(rec, req)
+	rsp := new(ErrorResponse)
+	if err := json.Unmarshal(rec.Body.Bytes(), rsp); err != nil {
+		t.Fatalf("decode error response failed : %v, body %s", err, rec.Body.String())
+	}
+	return rec.Code, rsp
+}
+
+func TestErrorResponse(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	web.Post("/orders", func(ctx Context, req *errorTestReq) error {
+		return ctx.Validate(req)
+	})
+	web.Get("/quota", func() error {
+		return errors.Wrap(errTestQuota.New("sms"), "send code")
+	})
+	web.Get("/panic", func() error {
+		return fmt.Errorf("db down")
+	})
+
+	code, rsp := serveError(t, web, http.MethodGet, "/quota", "zh-CN,zh;q=0.9", "")
+	if code != http.StatusForbidden || rsp.Code != 99001 || rsp.Message != "sms配额已用完" {
+		t.Errorf("unexpected zh response %d %+v", code, rsp)
+	}
+	if _, rsp = serveError(t, web, http.MethodGet, "/quota", "en-US", ""); rsp.Message != "quota of sms exceeded" {
+		t.Errorf("unexpected en message %s", rsp.Message)
+	}
+	//unknown language falls back to DefaultLanguage
+	if _, rsp = serveError(t, web, http.MethodGet, "/quota", "fr", ""); rsp.Message != "sms配额已用完" {
+		t.Errorf("unexpected fallback message %s", rsp.Message)
+	}
+
+	code, rsp = serveError(t, web, http.MethodPost, "/orders", "en", `{"items":[{"qty":1},{"qty":0}]}`)
+	if code != http.StatusBadRequest || rsp.Code != ErrValidation.Code {
+		t.Fatalf("unexpected validation response %d %+v", code, rsp)
+	}
+	fields := make([]string, 0)
+	for _, d := range rsp.Details {
+		fields = append(fields, d.Field+":"+d.Rule)
+		if len(d.Message) == 0 {
+			t.Errorf("detail of %s has no message", d.Field)
+		}
+	}
+	if got := strings.Join(fields, ","); got != "name:required,items[1].qty:min" {
+		t.Errorf("unexpected details %s", got)
+	}
+
+	code, rsp = serveError(t, web, http.MethodPost, "/orders", "en", `{"name":`)
+	if code != http.StatusBadRequest || rsp.Code != ErrBadRequest.Code {
+		t.Errorf("unexpected bind error response %d %+v", code, rsp)
+	}
+
+	code, rsp = serveError(t, web, http.MethodGet, "/panic", "en", "")
+	if code != http.StatusInternalServerError || rsp.Message != "internal error" {
+		t.Errorf("expect internal error without cause, got %d %+v", code, rsp)
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	err := errors.Wrap(ErrNotFound.Wrap(fmt.Errorf("no row")), "query device")
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) {
+		t.Error("errors.Is not match by code")
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Cause.Error() != "no row" {
+		t.Errorf("cause not kept: %v", e)
+	}
+	if ec, ok := LookupErrorCode(99001); !ok || ec != errTestQuota {
+		t.Error("defined code not registered")
+	}
+}
+
+func TestParseLanguage(t *testing.T) {
+	for in, expect := range map[string]string{
+		"":                "zh",
+		"*":               "zh",
+		"en-US,en;q=0.9":  "en",
+		"ZH-Hans-CN":      "zh",
+		" ja ; q=0.8, en": "ja",
+	} {
+		if got := ParseLanguage(in); got != expect {
+			t.Errorf("ParseLanguage(%q) expect %s, got %s", in, expect, got)
+		}
+	}
+}
@@ -4,42 +4,35 @@ import (
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
-	"net/http"
 )
 
 //统一异常处理
 func (this *WebX) defaultErrorHandler(err error, ctx Context) {
 	code := 500
-	rsp := make(map[string]interface{})
-	switch cause := errors.Cause(err).(type) {
-	case *echo.HTTPError:
-		{
-			msg := fmt.Sprintf("%v", cause.Message)
-			code = cause.Code
-			rsp["code"] = cause.Code
-			rsp["message"] = msg
-		}
-	default:
-		{
-			logger.Printf("unexpect error :%v", err)
-			msg := "unexpect error "
-			if this.conf.Debug {
-				msg = fmt.Sprintf("%v", err)
+	rsp := &ErrorResponse{}
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		code = httpErr.Code
+		rsp.Code = httpErr.Code
+		rsp.Message = fmt.Sprintf("%v", httpErr.Message)
+	} else {
+		lang := ctx.Language()
+		e := toError(err, ctx.InType(), lang)
+		code = e.HttpStatus
+		rsp.Code = e.Code
+		rsp.Message = e.Message(lang)
+		rsp.Details = e.Details
+		if code >= 500 {
+			ctx.Log().Error("unexpect error", "err", err)
+			if this.conf.Debug && e.Cause != nil {
+				rsp.Message = fmt.Sprintf("%s : %v", rsp.Message, e.Cause)
 			}
-			code = http.StatusInternalServerError
-			rsp["code"] = code
-			rsp["message"] = msg
 		}
 	}
 	// Send response
 	if !ctx.Response().Committed {
-		if ctx.Request().Method == http.MethodHead {
-			err = ctx.NoContent(code)
-		} else {
-			err = ctx.JSONPretty(code, rsp, jsonIndent)
-		}
-		if err != nil {
-			logger.Println(err)
+		if err = this.renderError(ctx, code, rsp); err != nil {
+			ctx.Log().Error("write error response failed", "err", err)
 		}
 	}
 }
@@ -0,0 +1,62 @@
+package bootx
+
+import (
+	"bufio"
+	"github.com/labstack/echo/v4"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebServerLimits(t *testing.T) {
+	conf := WebDefaultConfig
+	conf.ReadHeaderTimeout = 1
+	conf.IdleTimeout = -1
+	conf.MaxHeaderBytes = 1024
+	conf.MaxConns = 1
+	web := NewWebWithConf(conf)
+	web.GET("/ping", func(ctx echo.Context) error {
+		return ctx.String(http.StatusOK, "pong")
+	})
+	base := startTestWeb(t, web)
+	defer web.stop()
+	s := web.Server
+	if s.ReadHeaderTimeout != time.Second || s.IdleTimeout != 0 || s.ReadTimeout != DefaultWebReadTimeout*time.Second {
+		t.Errorf("unexpected server timeouts %v %v %v", s.ReadHeaderTimeout, s.IdleTimeout, s.ReadTimeout)
+	}
+	addr := strings.TrimPrefix(base, "http://")
+
+	//the only connection send header slowly, closed by ReadHeaderTimeout
+	slow, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	_, _ = slow.Write([]byte("GET /ping HTTP/1.1\r\nHost: x\r\n"))
+
+	//connection is accepted after the slow one is closed
+	cli := &http.Client{Timeout: 300 * time.Millisecond}
+	if _, err = cli.Get(base + "/ping"); err == nil {
+		t.Error("expect request blocked while MaxConns reached")
+	}
+	begin := time.Now()
+	_ = slow.SetReadDeadline(time.Now().Add(3 * time.Second))
+	line, _ := bufio.NewReader(slow).ReadString('\n')
+	if cost := time.Since(begin); cost > 2*time.Second {
+		t.Errorf("slow header not timed out, cost %v, got %s", cost, line)
+	}
+
+	cli.Timeout = 3 * time.Second
+	req, _ := http.NewRequest(http.MethodGet, base+"/ping", nil)
+	req.Header.Set("X-Large", strings.Repeat("a", 8*1024))
+	rsp, err := cli.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rsp.Body.Close()
+	if rsp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("expect 431, got %d", rsp.StatusCode)
+	}
+}
@@ -0,0 +1,298 @@
+package bootx
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/gen-iot/std"
+	"github.com/golang/protobuf/proto"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	MIMEApplicationMsgpack  = "application/msgpack"
+	MIMEApplicationXMsgpack = "application/x-msgpack"
+	MIMEApplicationProtobuf = "application/x-protobuf"
+	//compact json, e.g. Accept: application/json; pretty=false
+	acceptParamPretty = "pretty"
+)
+
+//ResponseRenderer write handler result & error response, set by WebX.SetRenderer or WithRenderer per route
+type ResponseRenderer interface {
+	//resp is nil if handler has no rsp arg or return nil
+	Render(ctx Context, code int, resp interface{}) error
+	RenderError(ctx Context, code int, body *ErrorResponse) error
+}
+
+type (
+	//ResponseEnvelope wrap success response, e.g. {"code":0,"data":{},"message":""}
+	ResponseEnvelope struct {
+		XMLName xml.Name    `json:"-" xml:"response" msgpack:"-"`
+		Code    int         `json:"code" xml:"code" msgpack:"code"`
+		Data    interface{} `json:"data" xml:"data,omitempty" msgpack:"data"`
+		Message string      `json:"message" xml:"message" msgpack:"message"`
+	}
+	//ErrorResponse is the body written by error handler
+	ErrorResponse struct {
+		XMLName xml.Name       `json:"-" xml:"error" msgpack:"-"`
+		Code    int            `json:"code" xml:"code" msgpack:"code"`
+		Message string         `json:"message" xml:"message" msgpack:"message"`
+		Details []*ErrorDetail `json:"details,omitempty" xml:"details>detail,omitempty" msgpack:"details,omitempty"`
+	}
+)
+
+//ResponseEncoder encode v to response body, pretty is a hint for text format
+type ResponseEncoder func(v interface{}, pretty bool) ([]byte, error)
+
+type responseEncoderEntry struct {
+	contentType string
+	encode      ResponseEncoder
+}
+
+var responseEncoders = make(map[string]*responseEncoderEntry)
+var responseEncoderLock = &sync.RWMutex{}
+
+func init() {
+	RegisterResponseEncoder(echo.MIMEApplicationJSON, echo.MIMEApplicationJSONCharsetUTF8, encodeJson)
+	RegisterResponseEncoder(echo.MIMEApplicationXML, echo.MIMEApplicationXMLCharsetUTF8, encodeXml)
+	RegisterResponseEncoder(echo.MIMETextXML, echo.MIMETextXMLCharsetUTF8, encodeXml)
+	RegisterResponseEncoder(MIMEApplicationMsgpack, MIMEApplicationMsgpack, encodeMsgpack)
+	RegisterResponseEncoder(MIMEApplicationXMsgpack, MIMEApplicationXMsgpack, encodeMsgpack)
+	RegisterResponseEncoder(MIMEApplicationProtobuf, MIMEApplicationProtobuf, encodeProtobuf)
+}
+
+//RegisterResponseEncoder add or replace encoder of mime, e.g. application/cbor
+func RegisterResponseEncoder(mime string, contentType string, enc ResponseEncoder) {
+	std.Assert(enc != nil, "response encoder is nil")
+	responseEncoderLock.Lock()
+	defer responseEncoderLock.Unlock()
+	responseEncoders[strings.ToLower(mime)] = &responseEncoderEntry{contentType: contentType, encode: enc}
+}
+
+func getResponseEncoder(mime string) *responseEncoderEntry {
+	responseEncoderLock.RLock()
+	defer responseEncoderLock.RUnlock()
+	return responseEncoders[mime]
+}
+
+func encodeJson(v interface{}, pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(v, jsonIndentPrefix, jsonIndent)
+	}
+	return json.Marshal(v)
+}
+
+func encodeXml(v interface{}, pretty bool) ([]byte, error) {
+	var data []byte
+	var err error
+	if pretty {
+		data, err = xml.MarshalIndent(v, jsonIndentPrefix, jsonIndent)
+	} else {
+		data, err = xml.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+func encodeMsgpack(v interface{}, _ bool) ([]byte, error) {
+	return std.MsgpackMarshal(v)
+}
+
+//protobuf can't be wrapped, envelope is ignored
+func encodeProtobuf(v interface{}, _ bool) ([]byte, error) {
+	if e, ok := v.(*ResponseEnvelope); ok {
+		v = e.Data
+	}
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, errNotProtoMessage
+	}
+	return proto.Marshal(msg)
+}
+
+var errNotProtoMessage = fmt.Errorf("response is not proto.Message")
+
+type RendererConfig struct {
+	//wrap success response in ResponseEnvelope
+	Envelope bool
+	//indent json/xml, overridden by Accept param, e.g. application/json; pretty=false
+	Pretty bool
+	//content types could be negotiated from Accept in preference order,
+	//the first is used when nothing acceptable, default application/json only
+	Offers []string
+}
+
+var DefaultRendererConfig = RendererConfig{
+	Envelope: false,
+	Pretty:   true,
+	Offers:   []string{echo.MIMEApplicationJSON},
+}
+
+//RendererAllOffers are all builtin content types
+var RendererAllOffers = []string{
+	echo.MIMEApplicationJSON,
+	echo.MIMEApplicationXML,
+	echo.MIMETextXML,
+	MIMEApplicationMsgpack,
+	MIMEApplicationXMsgpack,
+	MIMEApplicationProtobuf,
+}
+
+//NegotiateRenderer choose encoder by Accept header
+type NegotiateRenderer struct {
+	conf RendererConfig
+}
+
+func NewRenderer(conf RendererConfig) *NegotiateRenderer {
+	if len(conf.Offers) == 0 {
+		conf.Offers = DefaultRendererConfig.Offers
+	}
+	offers := make([]string, len(conf.Offers))
+	for i, o := range conf.Offers {
+		offers[i] = strings.ToLower(o)
+	}
+	conf.Offers = offers
+	return &NegotiateRenderer{conf: conf}
+}
+
+func (this *NegotiateRenderer) Render(ctx Context, code int, resp interface{}) error {
+	if this.conf.Envelope {
+		resp = &ResponseEnvelope{Code: 0, Data: resp}
+	} else if resp == nil {
+		return nil
+	}
+	return this.write(ctx, code, resp)
+}
+
+func (this *NegotiateRenderer) RenderError(ctx Context, code int, body *ErrorResponse) error {
+	return this.write(ctx, code, body)
+}
+
+func (this *NegotiateRenderer) write(ctx Context, code int, v interface{}) error {
+	mime, pretty := this.negotiate(ctx.Request().Header.Get(echo.HeaderAccept))
+	enc := getResponseEncoder(mime)
+	if enc == nil {
+		return fmt.Errorf("no response encoder for '%s'", mime)
+	}
+	data, err := enc.encode(v, pretty)
+	if err == errNotProtoMessage && mime != this.conf.Offers[0] {
+		//e.g. error response, fallback to default offer
+		mime = this.conf.Offers[0]
+		if enc = getResponseEncoder(mime); enc == nil {
+			return fmt.Errorf("no response encoder for '%s'", mime)
+		}
+		data, err = enc.encode(v, pretty)
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.Blob(code, enc.contentType, data)
+}
+
+type acceptRange struct {
+	mime   string
+	q      float64
+	params map[string]string
+}
+
+//return negotiated mime & pretty
+func (this *NegotiateRenderer) negotiate(accept string) (string, bool) {
+	for _, r := range parseAccept(accept) {
+		mime := this.match(r.mime)
+		if len(mime) == 0 {
+			continue
+		}
+		pretty := this.conf.Pretty
+		if p, ok := r.params[acceptParamPretty]; ok {
+			pretty, _ = strconv.ParseBool(p)
+		}
+		return mime, pretty
+	}
+	return this.conf.Offers[0], this.conf.Pretty
+}
+
+func (this *NegotiateRenderer) match(mime string) string {
+	for _, offer := range this.conf.Offers {
+		switch {
+		case mime == offer, mime == "*/*":
+			return offer
+		case strings.HasSuffix(mime, "/*") && strings.HasPrefix(offer, mime[:len(mime)-1]):
+			return offer
+		}
+	}
+	return ""
+}
+
+//parse Accept header, sorted by q desc, q=0 ranges are dropped
+func parseAccept(accept string) []*acceptRange {
+	out := make([]*acceptRange, 0)
+	for _, part := range strings.Split(accept, ",") {
+		segs := strings.Split(part, ";")
+		mime := strings.ToLower(strings.TrimSpace(segs[0]))
+		if len(mime) == 0 {
+			continue
+		}
+		r := &acceptRange{mime: mime, q: 1, params: make(map[string]string)}
+		for _, seg := range segs[1:] {
+			kv := strings.SplitN(strings.TrimSpace(seg), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			k := strings.ToLower(strings.TrimSpace(kv[0]))
+			v := strings.Trim(strings.TrimSpace(kv[1]), "\"")
+			if k == "q" {
+				if q, err := strconv.ParseFloat(v, 64); err == nil {
+					r.q = q
+				}
+				continue
+			}
+			r.params[k] = v
+		}
+		if r.q > 0 {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].q > out[j].q
+	})
+	return out
+}
+
+//SetRenderer replace renderer of all routes, routes with WithRenderer are not affected
+func (this *WebX) SetRenderer(r ResponseRenderer) {
+	std.Assert(r != nil, "renderer is nil")
+	this.renderer = r
+}
+
+func (this *WebX) Renderer() ResponseRenderer {
+	return this.renderer
+}
+
+func (this *WebX) rendererOf(ctx Context) ResponseRenderer {
+	if r := ctx.Route(); r != nil && r.renderer != nil {
+		return r.renderer
+	}
+	return this.renderer
+}
+
+//WithRenderer override renderer of route
+func WithRenderer(r ResponseRenderer) RouteOption {
+	return func(info *RouteInfo) {
+		info.renderer = r
+	}
+}
+
+//for HEAD request only status code is written
+func (this *WebX) renderError(ctx Context, code int, body *ErrorResponse) error {
+	if ctx.Request().Method == http.MethodHead {
+		return ctx.NoContent(code)
+	}
+	return this.rendererOf(ctx).RenderError(ctx, code, body)
+}
@@ -0,0 +1,131 @@
+package bootx
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gen-iot/std"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type renderTestRsp struct {
+	Name string `json:"name" xml:"name" msgpack:"name"`
+}
+
+func serveAccept(web *WebX, method, target, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if len(accept) > 0 {
+		req.Header.Set(echo.HeaderAccept, accept)
+	}
+	rec := httptest.NewRecorder()
+	web.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNegotiateRenderer(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	web.SetRenderer(NewRenderer(RendererConfig{Pretty: true, Offers: RendererAllOffers}))
+	web.Get("/item", func() (*renderTestRsp, error) {
+		return &renderTestRsp{Name: "bulb"}, nil
+	})
+	fail := func() error {
+		return echo.NewHTTPError(http.StatusConflict, "busy")
+	}
+	web.Get("/fail", fail)
+	web.Handle(http.MethodHead, "/fail", fail)
+
+	cases := []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{accept: "", contentType: echo.MIMEApplicationJSONCharsetUTF8, body: "{\n    \"name\": \"bulb\"\n}"},
+		{accept: "application/json; pretty=false", contentType: echo.MIMEApplicationJSONCharsetUTF8, body: `{"name":"bulb"}`},
+		{accept: "text/html, application/xml;q=0.9, */*;q=0.1", contentType: echo.MIMEApplicationXMLCharsetUTF8,
+			body: "<renderTestRsp>\n    <name>bulb</name>\n</renderTestRsp>"},
+		{accept: "application/json;q=0.5, text/*", contentType: echo.MIMETextXMLCharsetUTF8},
+		{accept: "image/png", contentType: echo.MIMEApplicationJSONCharsetUTF8},
+	}
+	for _, c := range cases {
+		rec := serveAccept(web, http.MethodGet, "/item", c.accept)
+		if ct := rec.Header().Get(echo.HeaderContentType); ct != c.contentType {
+			t.Errorf("accept '%s' expect %s, got %s", c.accept, c.contentType, ct)
+		}
+		if len(c.body) > 0 && !strings.Contains(rec.Body.String(), c.body) {
+			t.Errorf("accept '%s' expect body %s, got %s", c.accept, c.body, rec.Body.String())
+		}
+	}
+
+	rec := serveAccept(web, http.MethodGet, "/item", MIMEApplicationMsgpack)
+	rsp := new(renderTestRsp)
+	if err := std.MsgpackUnmarshal(rec.Body.Bytes(), rsp); err != nil || rsp.Name != "bulb" {
+		t.Errorf("msgpack not decoded: %v %+v", err, rsp)
+	}
+
+	//proto is not possible for error, fallback to first offer
+	rec = serveAccept(web, http.MethodGet, "/fail", MIMEApplicationProtobuf)
+	if rec.Code != http.StatusConflict || rec.Header().Get(echo.HeaderContentType) != echo.MIMEApplicationJSONCharsetUTF8 {
+		t.Errorf("unexpected error response %d %s", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+	rec = serveAccept(web, http.MethodHead, "/fail", "")
+	if rec.Code != http.StatusConflict || rec.Body.Len() != 0 {
+		t.Errorf("expect head error without body, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRendererEnvelope(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	envelope := NewRenderer(RendererConfig{Envelope: true})
+	web.Get("/wrapped", func() (*renderTestRsp, error) {
+		return &renderTestRsp{Name: "bulb"}, nil
+	}, WithRenderer(envelope))
+	web.Get("/plain", func() (*renderTestRsp, error) {
+		return &renderTestRsp{Name: "bulb"}, nil
+	})
+
+	rec := serveAccept(web, http.MethodGet, "/wrapped", "")
+	body := &struct {
+		Code int            `json:"code"`
+		Data *renderTestRsp `json:"data"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), body); err != nil || body.Data == nil || body.Data.Name != "bulb" {
+		t.Errorf("expect enveloped response, got %s", rec.Body.String())
+	}
+	rec = serveAccept(web, http.MethodGet, "/plain", "")
+	if strings.Contains(rec.Body.String(), "data") {
+		t.Errorf("envelope of route leaked: %s", rec.Body.String())
+	}
+}
+
+func TestParseAccept(t *testing.T) {
+	ranges := parseAccept("text/html;q=0.2, application/json; pretty=\"false\", image/*;q=0, */*;q=0.5")
+	got := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		got = append(got, fmt.Sprintf("%s %v %s", r.mime, r.q, r.params[acceptParamPretty]))
+	}
+	expect := "application/json 1 false,*/* 0.5 ,text/html 0.2 "
+	if strings.Join(got, ",") != expect {
+		t.Errorf("expect %s, got %s", expect, strings.Join(got, ","))
+	}
+}
+
+func TestRenderNilResp(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	web.SetRenderer(NewRenderer(RendererConfig{Envelope: true}))
+	web.Post("/devices", func(ctx Context) error {
+		ctx.SetHttpStatusCode(http.StatusAccepted)
+		return nil
+	})
+	web.Get("/devices", func() error {
+		return nil
+	})
+	for method, code := range map[string]int{http.MethodPost: http.StatusAccepted, http.MethodGet: http.StatusOK} {
+		rec := serveAccept(web, method, "/devices", "")
+		if rec.Code != code || rec.Body.Len() != 0 || len(rec.Header().Get(echo.HeaderContentType)) != 0 {
+			t.Errorf("%s expect %d without body, got %d %s", method, code, rec.Code, rec.Body.String())
+		}
+	}
+}
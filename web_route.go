@@ -0,0 +1,358 @@
+package bootx
+
+import (
+	"context"
+	"fmt"
+	"github.com/gen-iot/std"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+//RouteInfo is the metadata of route registered by WebX.Handle, or echo methods with BuildHttpHandler
+type RouteInfo struct {
+	Method   string
+	Path     string
+	FuncName string
+	//request type, nil if handler has no req arg
+	InType reflect.Type
+	//response type, nil if handler only return error
+	OutType reflect.Type
+
+	Name    string
+	Summary string
+	Tags    []string
+	//route require authorization,see middleware.NoAuthRouteSkipper
+	Auth bool
+	//handler context deadline, 0 means no timeout
+	Timeout time.Duration
+
+	middlewares []MiddlewareFunc
+	renderer    ResponseRenderer
+}
+
+type RouteOption func(r *RouteInfo)
+
+func WithName(name string) RouteOption {
+	return func(r *RouteInfo) {
+		r.Name = name
+	}
+}
+
+func WithSummary(summary string) RouteOption {
+	return func(r *RouteInfo) {
+		r.Summary = summary
+	}
+}
+
+func WithTags(tags ...string) RouteOption {
+	return func(r *RouteInfo) {
+		r.Tags = append(r.Tags, tags...)
+	}
+}
+
+func WithAuth(auth bool) RouteOption {
+	return func(r *RouteInfo) {
+		r.Auth = auth
+	}
+}
+
+func WithTimeout(timeout time.Duration) RouteOption {
+	return func(r *RouteInfo) {
+		r.Timeout = timeout
+	}
+}
+
+//WithMiddleware add bootx middleware to route, or to all routes when used on group
+func WithMiddleware(m ...MiddlewareFunc) RouteOption {
+	return func(r *RouteInfo) {
+		r.middlewares = append(r.middlewares, m...)
+	}
+}
+
+type routeTable struct {
+	lock   *sync.RWMutex
+	routes []*RouteInfo
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		lock:   &sync.RWMutex{},
+		routes: make([]*RouteInfo, 0),
+	}
+}
+
+func (this *routeTable) add(r *RouteInfo) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.routes = append(this.routes, r)
+}
+
+func (this *routeTable) list() []*RouteInfo {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	out := make([]*RouteInfo, len(this.routes))
+	copy(out, this.routes)
+	return out
+}
+
+//handlerTable handlers built by WebX, keyed by identity of the func value
+type handlerTable struct {
+	lock     *sync.RWMutex
+	handlers map[uintptr]*builtHandler
+}
+
+func newHandlerTable() *handlerTable {
+	return &handlerTable{
+		lock:     &sync.RWMutex{},
+		handlers: make(map[uintptr]*builtHandler),
+	}
+}
+
+//func value is a pointer to its closure, copies of it share the key.
+//builtHandler holds the func, so the closure is never freed & reused by others
+func handlerKey(h echo.HandlerFunc) uintptr {
+	return uintptr(*(*unsafe.Pointer)(unsafe.Pointer(&h)))
+}
+
+func (this *handlerTable) add(h echo.HandlerFunc, built *builtHandler) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.handlers[handlerKey(h)] = built
+}
+
+//nil if h is not built by this web
+func (this *handlerTable) get(h echo.HandlerFunc) *builtHandler {
+	if h == nil {
+		return nil
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.handlers[handlerKey(h)]
+}
+
+var routeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodConnect: true,
+	http.MethodTrace:   true,
+}
+
+//Handle check handler signature, build & register it, the route is recorded for api document
+func (this *WebX) Handle(method, path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.handle(this.Echo.Add, method, path, handler, opts...)
+}
+
+func (this *WebX) Get(path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.Handle(http.MethodGet, path, handler, opts...)
+}
+
+func (this *WebX) Post(path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.Handle(http.MethodPost, path, handler, opts...)
+}
+
+func (this *WebX) Put(path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.Handle(http.MethodPut, path, handler, opts...)
+}
+
+func (this *WebX) Patch(path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.Handle(http.MethodPatch, path, handler, opts...)
+}
+
+func (this *WebX) Delete(path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.Handle(http.MethodDelete, path, handler, opts...)
+}
+
+type echoAddFunc = func(method, path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+
+func (this *WebX) handle(add echoAddFunc, method, path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	method = strings.ToUpper(method)
+	std.Assert(routeMethods[method], fmt.Sprintf("route '%s' : unknown http method '%s'", path, method))
+	meta := newHandlerMeta(handler)
+	r := &RouteInfo{
+		Method:   method,
+		FuncName: meta.fName,
+		InType:   meta.inType,
+		OutType:  meta.outType,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	m := r.middlewares
+	if r.Timeout > 0 {
+		m = append([]MiddlewareFunc{timeoutMiddleware(r.Timeout)}, m...)
+	}
+	route := add(method, path, this.buildHttpHandler(meta, r, m...))
+	r.Path = route.Path
+	this.routes.add(r)
+	return route
+}
+
+//Add same as echo, route of handler built by BuildHttpHandler is recorded for api document
+func (this *WebX) Add(method, path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	route := this.Echo.Add(method, path, h, m...)
+	this.recordRoute(route, h)
+	return route
+}
+
+func (this *WebX) GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return this.Add(http.MethodGet, path, h, m...)
+}
+
+func (this *WebX) HEAD(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return this.Add(http.MethodHead, path, h, m...)
+}
+
+func (this *WebX) POST(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return this.Add(http.MethodPost, path, h, m...)
+}
+
+func (this *WebX) PUT(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return this.Add(http.MethodPut, path, h, m...)
+}
+
+func (this *WebX) PATCH(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return this.Add(http.MethodPatch, path, h, m...)
+}
+
+func (this *WebX) DELETE(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return this.Add(http.MethodDelete, path, h, m...)
+}
+
+func (this *WebX) OPTIONS(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return this.Add(http.MethodOptions, path, h, m...)
+}
+
+func (this *WebX) CONNECT(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return this.Add(http.MethodConnect, path, h, m...)
+}
+
+func (this *WebX) TRACE(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return this.Add(http.MethodTrace, path, h, m...)
+}
+
+func (this *WebX) Any(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) []*echo.Route {
+	routes := this.Echo.Any(path, h, m...)
+	for _, route := range routes {
+		this.recordRoute(route, h)
+	}
+	return routes
+}
+
+func (this *WebX) Match(methods []string, path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) []*echo.Route {
+	routes := this.Echo.Match(methods, path, h, m...)
+	for _, route := range routes {
+		this.recordRoute(route, h)
+	}
+	return routes
+}
+
+//routes of Handle are recorded by itself
+func (this *WebX) recordRoute(route *echo.Route, h echo.HandlerFunc) {
+	built := this.handlers.get(h)
+	if built == nil || built.route != nil {
+		return
+	}
+	this.routes.add(&RouteInfo{
+		Method:   route.Method,
+		Path:     route.Path,
+		FuncName: built.meta.fName,
+		InType:   built.meta.inType,
+		OutType:  built.meta.outType,
+	})
+}
+
+func timeoutMiddleware(timeout time.Duration) MiddlewareFunc {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx Context) {
+			req := ctx.Request()
+			tCtx, cancel := context.WithTimeout(req.Context(), timeout)
+			defer cancel()
+			ctx.SetRequest(req.WithContext(tCtx))
+			next(ctx)
+			if ctx.Err() != nil && errors.Cause(ctx.Err()) == context.DeadlineExceeded {
+				ctx.SetError(echo.NewHTTPError(http.StatusServiceUnavailable, "handler timeout"))
+			}
+		}
+	}
+}
+
+//RouteInfos return all routes registered by Handle, or echo methods with BuildHttpHandler
+func (this *WebX) RouteInfos() []*RouteInfo {
+	return this.routes.list()
+}
+
+//RouteGroup register routes with common prefix, bootx middlewares & route options
+type RouteGroup struct {
+	web   *WebX
+	group *echo.Group
+	opts  []RouteOption
+}
+
+//NewGroup create route group, opts are applied to every route of the group before route's own opts
+func (this *WebX) NewGroup(prefix string, opts ...RouteOption) *RouteGroup {
+	return &RouteGroup{
+		web:   this,
+		group: this.Group(prefix),
+		opts:  opts,
+	}
+}
+
+//Echo return the underlying echo group, e.g. for echo middlewares
+func (this *RouteGroup) Echo() *echo.Group {
+	return this.group
+}
+
+//Use add bootx middlewares to routes registered after
+func (this *RouteGroup) Use(m ...MiddlewareFunc) {
+	this.opts = append(this.opts, WithMiddleware(m...))
+}
+
+//Group create sub group inherit options of this group
+func (this *RouteGroup) Group(prefix string, opts ...RouteOption) *RouteGroup {
+	inherit := make([]RouteOption, 0, len(this.opts)+len(opts))
+	inherit = append(inherit, this.opts...)
+	inherit = append(inherit, opts...)
+	return &RouteGroup{
+		web:   this.web,
+		group: this.group.Group(prefix),
+		opts:  inherit,
+	}
+}
+
+func (this *RouteGroup) Handle(method, path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	all := make([]RouteOption, 0, len(this.opts)+len(opts))
+	all = append(all, this.opts...)
+	all = append(all, opts...)
+	return this.web.handle(this.group.Add, method, path, handler, all...)
+}
+
+func (this *RouteGroup) Get(path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.Handle(http.MethodGet, path, handler, opts...)
+}
+
+func (this *RouteGroup) Post(path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.Handle(http.MethodPost, path, handler, opts...)
+}
+
+func (this *RouteGroup) Put(path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.Handle(http.MethodPut, path, handler, opts...)
+}
+
+func (this *RouteGroup) Patch(path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.Handle(http.MethodPatch, path, handler, opts...)
+}
+
+func (this *RouteGroup) Delete(path string, handler interface{}, opts ...RouteOption) *echo.Route {
+	return this.Handle(http.MethodDelete, path, handler, opts...)
+}
@@ -0,0 +1,108 @@
+package bootx
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type routeTestReq struct {
+	Id string `param:"id"`
+}
+
+type routeTestRsp struct {
+	Id    string `json:"id"`
+	Trace string `json:"trace"`
+}
+
+//traceMiddleware append name to X-Trace, so execution order can be checked
+func traceMiddleware(name string) MiddlewareFunc {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx Context) {
+			h := ctx.Request().Header
+			h.Set("X-Trace", h.Get("X-Trace")+name+"/")
+			next(ctx)
+		}
+	}
+}
+
+func serveRoute(web *WebX, method, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	web.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+func TestRouteGroup(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	var route *RouteInfo
+	api := web.NewGroup("/api", WithTags("api"), WithMiddleware(traceMiddleware("api")))
+	v1 := api.Group("/v1", WithAuth(true))
+	v1.Use(traceMiddleware("v1"))
+	v1.Get("/devices/:id", func(ctx Context, req *routeTestReq) (*routeTestRsp, error) {
+		route = ctx.Route()
+		return &routeTestRsp{Id: req.Id, Trace: ctx.Request().Header.Get("X-Trace")}, nil
+	}, WithName("getDevice"), WithTags("device"), WithMiddleware(traceMiddleware("route")))
+	api.Post("/login", func(ctx Context) error {
+		route = ctx.Route()
+		return nil
+	})
+
+	rec := serveRoute(web, http.MethodGet, "/api/v1/devices/d1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expect 200, got %d %s", rec.Code, rec.Body.String())
+	}
+	rsp := new(routeTestRsp)
+	if err := json.Unmarshal(rec.Body.Bytes(), rsp); err != nil || rsp.Id != "d1" || rsp.Trace != "api/v1/route/" {
+		t.Errorf("unexpected body %s", rec.Body.String())
+	}
+	if route == nil || route.Name != "getDevice" || !route.Auth || strings.Join(route.Tags, ",") != "api,device" ||
+		route.Path != "/api/v1/devices/:id" {
+		t.Errorf("unexpected route %+v", route)
+	}
+
+	serveRoute(web, http.MethodPost, "/api/login")
+	if route == nil || route.Auth || route.Path != "/api/login" {
+		t.Errorf("sibling group options leaked: %+v", route)
+	}
+
+	paths := make([]string, 0)
+	for _, r := range web.RouteInfos() {
+		paths = append(paths, r.Method+" "+r.Path)
+	}
+	if got := strings.Join(paths, ","); got != "GET /api/v1/devices/:id,POST /api/login" {
+		t.Errorf("unexpected route infos %s", got)
+	}
+}
+
+func TestRouteTimeout(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	web.Get("/slow", func(ctx Context) error {
+		select {
+		case <-ctx.Request().Context().Done():
+			return ctx.Request().Context().Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	}, WithTimeout(20*time.Millisecond))
+	begin := time.Now()
+	rec := serveRoute(web, http.MethodGet, "/slow")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expect 503, got %d", rec.Code)
+	}
+	if cost := time.Since(begin); cost > 500*time.Millisecond {
+		t.Errorf("handler not cancelled, cost %v", cost)
+	}
+}
+
+func TestRouteUnknownMethod(t *testing.T) {
+	web := NewWebWithConf(WebDefaultConfig)
+	defer func() {
+		if recover() == nil {
+			t.Error("expect panic of unknown method")
+		}
+	}()
+	web.Handle("FETCH", "/x", func() error { return nil })
+}
@@ -0,0 +1,106 @@
+package bootx
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+//startTestWeb serve web on a free port, return its base url
+func startTestWeb(t *testing.T, web *WebX) string {
+	t.Helper()
+	web.conf.Port = freePort(t)
+	web.HideBanner = true
+	web.HidePort = true
+	if err := web.start(); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("http://127.0.0.1:%d", web.conf.Port)
+}
+
+func TestWebStopDrain(t *testing.T) {
+	conf := WebDefaultConfig
+	conf.ShutdownTimeout = 5
+	web := NewWebWithConf(conf)
+	web.GET("/slow", func(ctx echo.Context) error {
+		time.Sleep(200 * time.Millisecond)
+		return ctx.String(http.StatusOK, "done")
+	})
+	base := startTestWeb(t, web)
+	type result struct {
+		body string
+		err  error
+	}
+	resChan := make(chan result, 1)
+	go func() {
+		rsp, err := http.Get(base + "/slow")
+		if err != nil {
+			resChan <- result{err: err}
+			return
+		}
+		defer rsp.Body.Close()
+		body, err := ioutil.ReadAll(rsp.Body)
+		resChan <- result{body: string(body), err: err}
+	}()
+	for atomic.LoadInt64(&web.inFlight) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	web.stop()
+	res := <-resChan
+	if res.err != nil || res.body != "done" {
+		t.Fatalf("expect in-flight request drained, got '%s', err %v", res.body, res.err)
+	}
+	if n := atomic.LoadInt64(&web.drained); n != 1 {
+		t.Errorf("expect 1 drained, got %d", n)
+	}
+	if _, err := http.Get(base + "/slow"); err == nil {
+		t.Error("expect new request refused after stop")
+	}
+}
+
+func TestWebStopTimeout(t *testing.T) {
+	conf := WebDefaultConfig
+	conf.ShutdownTimeout = 1
+	web := NewWebWithConf(conf)
+	release := make(chan struct{})
+	defer close(release)
+	web.GET("/stuck", func(ctx echo.Context) error {
+		<-release
+		return ctx.NoContent(http.StatusOK)
+	})
+	base := startTestWeb(t, web)
+	errChan := make(chan error, 1)
+	go func() {
+		rsp, err := http.Get(base + "/stuck")
+		if err == nil {
+			_ = rsp.Body.Close()
+		}
+		errChan <- err
+	}()
+	for atomic.LoadInt64(&web.inFlight) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	begin := time.Now()
+	web.stop()
+	if cost := time.Since(begin); cost < time.Second || cost > 3*time.Second {
+		t.Errorf("expect stop forced after 1s, cost %v", cost)
+	}
+	if err := <-errChan; err == nil {
+		t.Error("expect stuck request aborted")
+	}
+}
@@ -0,0 +1,153 @@
+package bootx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/http2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type webTLSFiles struct {
+	cert     string
+	key      string
+	clientCA string
+}
+
+func writeWebTLSFiles(t *testing.T, ca *testCA, clientCA *testCA) webTLSFiles {
+	t.Helper()
+	dir := t.TempDir()
+	files := webTLSFiles{cert: filepath.Join(dir, "server.pem"), key: filepath.Join(dir, "server.key")}
+	certPem, keyPem := ca.issue(t, "web")
+	writeTLSFile(t, files.cert, certPem)
+	writeTLSFile(t, files.key, keyPem)
+	if clientCA != nil {
+		files.clientCA = filepath.Join(dir, "client-ca.pem")
+		writeTLSFile(t, files.clientCA, clientCA.certPem)
+	}
+	return files
+}
+
+func newProtoTestWeb(t *testing.T, conf WebConfig) (*WebX, string) {
+	t.Helper()
+	web := NewWebWithConf(conf)
+	web.GET("/proto", func(ctx echo.Context) error {
+		return ctx.String(http.StatusOK, ctx.Request().Proto)
+	})
+	base := startTestWeb(t, web)
+	t.Cleanup(web.stop)
+	return web, base
+}
+
+func getProto(cli *http.Client, url string) (string, error) {
+	rsp, err := cli.Get(url + "/proto")
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	return string(body), err
+}
+
+func tlsTestClient(ca *testCA, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certs},
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+func TestWebTLS(t *testing.T) {
+	ca := newTestCA(t, "server-ca")
+	files := writeWebTLSFiles(t, ca, nil)
+	for _, c := range []struct {
+		disableHTTP2 bool
+		proto        string
+	}{
+		{disableHTTP2: false, proto: "HTTP/2.0"},
+		{disableHTTP2: true, proto: "HTTP/1.1"},
+	} {
+		conf := WebDefaultConfig
+		conf.TLS = WebTLSConfig{CertFile: files.cert, KeyFile: files.key, ReloadIntervalSec: -1}
+		conf.DisableHTTP2 = c.disableHTTP2
+		_, base := newProtoTestWeb(t, conf)
+		base = strings.Replace(base, "http://", "https://", 1)
+		proto, err := getProto(tlsTestClient(ca), base)
+		if err != nil || proto != c.proto {
+			t.Errorf("disableHTTP2=%v expect %s, got %s %v", c.disableHTTP2, c.proto, proto, err)
+		}
+	}
+}
+
+func TestWebMTLSReload(t *testing.T) {
+	serverCA := newTestCA(t, "server-ca")
+	clientCA := newTestCA(t, "client-ca")
+	files := writeWebTLSFiles(t, serverCA, clientCA)
+	conf := WebDefaultConfig
+	conf.TLS = WebTLSConfig{CertFile: files.cert, KeyFile: files.key, ClientCAFile: files.clientCA, ReloadIntervalSec: -1}
+	_, base := newProtoTestWeb(t, conf)
+	base = strings.Replace(base, "http://", "https://", 1)
+
+	if _, err := getProto(tlsTestClient(serverCA), base); err == nil {
+		t.Error("expect request without client certificate rejected")
+	}
+	if _, err := getProto(tlsTestClient(serverCA, clientCA.tlsCert(t, "device")), base); err != nil {
+		t.Errorf("request with client certificate failed: %v", err)
+	}
+
+	//certificates replaced on disk, applied by SIGHUP without restart
+	newServerCA := newTestCA(t, "server-ca-2")
+	certPem, keyPem := newServerCA.issue(t, "web")
+	writeTLSFile(t, files.cert, certPem)
+	writeTLSFile(t, files.key, keyPem)
+	getKernel().reload()
+	if _, err := getProto(tlsTestClient(newServerCA, clientCA.tlsCert(t, "device")), base); err != nil {
+		t.Errorf("expect reloaded certificate served, got %v", err)
+	}
+}
+
+func TestWebH2C(t *testing.T) {
+	conf := WebDefaultConfig
+	conf.H2C = true
+	_, base := newProtoTestWeb(t, conf)
+	cli := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	if proto, err := getProto(cli, base); err != nil || proto != "HTTP/2.0" {
+		t.Errorf("expect h2c, got %s %v", proto, err)
+	}
+	if proto, err := getProto(http.DefaultClient, base); err != nil || proto != "HTTP/1.1" {
+		t.Errorf("expect http/1.1 still served, got %s %v", proto, err)
+	}
+}
+
+func TestWebRedirectHttps(t *testing.T) {
+	ca := newTestCA(t, "server-ca")
+	files := writeWebTLSFiles(t, ca, nil)
+	conf := WebDefaultConfig
+	conf.TLS = WebTLSConfig{CertFile: files.cert, KeyFile: files.key, ReloadIntervalSec: -1}
+	conf.RedirectHttpPort = freePort(t)
+	web, _ := newProtoTestWeb(t, conf)
+	cli := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	rsp, err := cli.Get(fmt.Sprintf("http://127.0.0.1:%d/proto?a=1", conf.RedirectHttpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rsp.Body.Close()
+	expect := fmt.Sprintf("https://127.0.0.1:%d/proto?a=1", web.conf.Port)
+	if rsp.StatusCode != http.StatusMovedPermanently || rsp.Header.Get("Location") != expect {
+		t.Errorf("expect redirect to %s, got %d %s", expect, rsp.StatusCode, rsp.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,629 @@
+package bootx
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/gen-iot/std"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//tus resumable upload protocol 1.0.0, see https://tus.io/protocols/resumable-upload.html
+const (
+	TusVersion             = "1.0.0"
+	TusExtensions          = "creation,creation-with-upload,termination,checksum,expiration"
+	TusChecksumAlgorithms  = "md5,sha1,sha256"
+	HeaderTusResumable     = "Tus-Resumable"
+	HeaderTusVersion       = "Tus-Version"
+	HeaderTusExtension     = "Tus-Extension"
+	HeaderTusMaxSize       = "Tus-Max-Size"
+	HeaderTusChecksumAlgo  = "Tus-Checksum-Algorithm"
+	HeaderUploadOffset     = "Upload-Offset"
+	HeaderUploadLength     = "Upload-Length"
+	HeaderUploadMetadata   = "Upload-Metadata"
+	HeaderUploadExpires    = "Upload-Expires"
+	HeaderUploadChecksum   = "Upload-Checksum"
+	MIMEOffsetOctetStream  = "application/offset+octet-stream"
+	DefaultTusMaxSize      = 4 * KSizeGb
+	DefaultTusExpiration   = 24 * time.Hour
+	DefaultTusCleanupEvery = 10 * time.Minute
+	//tus checksum extension status code
+	StatusChecksumMismatch = 460
+	tusCleanupBatch        = 100
+	tusChunkKeyPrefix      = "tus"
+	tusExposeHeaders       = "Location,Tus-Resumable,Tus-Version,Tus-Extension,Tus-Max-Size,Tus-Checksum-Algorithm," +
+		"Upload-Offset,Upload-Length,Upload-Metadata,Upload-Expires"
+	//completion claimed longer than it is taken over, e.g. the instance crashed
+	tusCompletingTimeout = 30 * time.Minute
+)
+
+var (
+	ErrTusVersion           = DefineError(41201, http.StatusPreconditionFailed, "tus_version")
+	ErrTusOffset            = DefineError(40901, http.StatusConflict, "tus_offset")
+	ErrTusGone              = DefineError(41001, http.StatusGone, "tus_gone")
+	ErrTusChecksum          = DefineError(46001, StatusChecksumMismatch, "tus_checksum")
+	ErrTusContentType       = DefineError(41502, http.StatusUnsupportedMediaType, "tus_content_type")
+	ErrTusChecksumAlgorithm = DefineError(40004, http.StatusBadRequest, "tus_checksum_algorithm")
+)
+
+func init() {
+	RegisterErrorMessages("en", map[string]string{
+		"tus_version":            "unsupported tus version",
+		"tus_offset":             "upload offset mismatch, current %d",
+		"tus_gone":               "upload expired",
+		"tus_checksum":           "checksum mismatch",
+		"tus_content_type":       "content type must be " + MIMEOffsetOctetStream,
+		"tus_checksum_algorithm": "unsupported checksum algorithm",
+	})
+	RegisterErrorMessages("zh", map[string]string{
+		"tus_version":            "不支持的tus版本",
+		"tus_offset":             "上传偏移不一致,当前%d",
+		"tus_gone":               "上传已过期",
+		"tus_checksum":           "校验失败",
+		"tus_content_type":       "Content-Type必须是" + MIMEOffsetOctetStream,
+		"tus_checksum_algorithm": "不支持的校验算法",
+	})
+}
+
+type TusConfig struct {
+	//nil means DefaultStorage(), chunks & final file are stored in it
+	Storage Storage
+	//required, NewRedisUploadStore / NewDBUploadStore / NewMemoryUploadStore
+	Store UploadSessionStore
+	//max Upload-Length, default 4GB
+	MaxSize int64
+	//max body of one PATCH, 0 means no limit, WebConfig.BodyLimit still applies
+	MaxChunkSize int64
+	//unfinished sessions are removed after it, default 24h
+	Expiration time.Duration
+	//default 10m
+	CleanupInterval time.Duration
+	//object key of final file, default yyyy/mm/dd/{id}{ext of metadata filename}
+	KeyFunc func(s *UploadSession) string
+	//called after final file stored & verified, by the request uploading last chunk, before session completed.
+	//if it failed the session is not completed & it is retried by an empty PATCH, so it must be idempotent
+	OnComplete func(ctx Context, s *UploadSession) error
+}
+
+var DefaultTusConfig = TusConfig{
+	MaxSize:         DefaultTusMaxSize,
+	Expiration:      DefaultTusExpiration,
+	CleanupInterval: DefaultTusCleanupEvery,
+}
+
+//TusServer serve resumable upload, it is a Module which clean expired sessions
+type TusServer struct {
+	conf     TusConfig
+	basePath string
+	started  int32
+	stopOnce *sync.Once
+	stopChan chan struct{}
+	done     chan struct{}
+}
+
+//EnableTus mount tus endpoints at path & register cleanup module,
+//POST path create upload, HEAD/PATCH/DELETE path/:id query/upload chunk/terminate
+func (this *WebX) EnableTus(path string, conf TusConfig) (*TusServer, error) {
+	if conf.Store == nil {
+		return nil, &ConfigError{Module: "tus", Err: fmt.Errorf("session store required")}
+	}
+	if conf.Storage == nil {
+		conf.Storage = DefaultStorage()
+	}
+	if conf.MaxSize <= 0 {
+		conf.MaxSize = DefaultTusConfig.MaxSize
+	}
+	if conf.Expiration <= 0 {
+		conf.Expiration = DefaultTusConfig.Expiration
+	}
+	if conf.CleanupInterval <= 0 {
+		conf.CleanupInterval = DefaultTusConfig.CleanupInterval
+	}
+	if conf.KeyFunc == nil {
+		conf.KeyFunc = defaultTusKey
+	}
+	path = "/" + strings.Trim(path, "/")
+	srv := &TusServer{
+		conf:     conf,
+		basePath: path,
+		stopOnce: &sync.Once{},
+		stopChan: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := AddModule(srv); err != nil {
+		return nil, err
+	}
+	//CORS middleware answer OPTIONS before routing, so discovery headers are set in Pre
+	this.Pre(srv.discoveryMiddleware)
+	g := this.Group(path, srv.tusHeaderMiddleware)
+	g.OPTIONS("", srv.options)
+	g.POST("", ConvertFromEchoCtx(srv.create))
+	g.HEAD("/:id", ConvertFromEchoCtx(srv.head))
+	g.PATCH("/:id", ConvertFromEchoCtx(srv.patch))
+	g.DELETE("/:id", ConvertFromEchoCtx(srv.terminate))
+	return srv, nil
+}
+
+func defaultTusKey(s *UploadSession) string {
+	return s.CreatedAt.Format("2006/01/02/") + s.Id + strings.ToLower(path.Ext(s.Metadata["filename"]))
+}
+
+func (this *TusServer) Name() string {
+	return "tus:" + this.basePath
+}
+
+func (this *TusServer) Dependencies() []string {
+	return nil
+}
+
+func (this *TusServer) Init() error {
+	return nil
+}
+
+func (this *TusServer) Start() error {
+	if atomic.CompareAndSwapInt32(&this.started, 0, 1) {
+		go this.cleanupLoop()
+	}
+	return nil
+}
+
+func (this *TusServer) Stop() error {
+	this.stopOnce.Do(func() {
+		close(this.stopChan)
+		if atomic.LoadInt32(&this.started) == 1 {
+			<-this.done
+		}
+	})
+	return nil
+}
+
+//Tus-Resumable is required except OPTIONS, and always responded
+func (this *TusServer) tusHeaderMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		ctx.Response().Header().Set(HeaderTusResumable, TusVersion)
+		if ctx.Request().Method != http.MethodOptions && ctx.Request().Header.Get(HeaderTusResumable) != TusVersion {
+			ctx.Response().Header().Set(HeaderTusVersion, TusVersion)
+			return ErrTusVersion.New()
+		}
+		return next(ctx)
+	}
+}
+
+func (this *TusServer) discoveryMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		req := ctx.Request()
+		if req.URL.Path != this.basePath && !strings.HasPrefix(req.URL.Path, this.basePath+"/") {
+			return next(ctx)
+		}
+		h := ctx.Response().Header()
+		//browser can only read exposed headers
+		h.Set(echo.HeaderAccessControlExposeHeaders, tusExposeHeaders)
+		if req.Method == http.MethodOptions {
+			h.Set(HeaderTusResumable, TusVersion)
+			h.Set(HeaderTusVersion, TusVersion)
+			h.Set(HeaderTusExtension, TusExtensions)
+			h.Set(HeaderTusMaxSize, strconv.FormatInt(this.conf.MaxSize, 10))
+			h.Set(HeaderTusChecksumAlgo, TusChecksumAlgorithms)
+		}
+		return next(ctx)
+	}
+}
+
+func (this *TusServer) options(ctx echo.Context) error {
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+func (this *TusServer) create(ctx Context) error {
+	length, err := strconv.ParseInt(ctx.Request().Header.Get(HeaderUploadLength), 10, 64)
+	if err != nil || length < 0 {
+		return ErrBadRequest.New().WithDetails(&ErrorDetail{Field: HeaderUploadLength, Message: "invalid " + HeaderUploadLength})
+	}
+	if length > this.conf.MaxSize {
+		return ErrUploadTooLarge.New(HeaderUploadLength)
+	}
+	meta, err := parseTusMetadata(ctx.Request().Header.Get(HeaderUploadMetadata))
+	if err != nil {
+		return ErrBadRequest.Wrap(err).WithDetails(&ErrorDetail{Field: HeaderUploadMetadata, Message: err.Error()})
+	}
+	now := time.Now()
+	s := &UploadSession{
+		Id:        std.GenRandomUUID(),
+		Length:    length,
+		Metadata:  meta,
+		CreatedAt: now,
+		ExpiresAt: now.Add(this.conf.Expiration),
+	}
+	reqCtx := ctx.Request().Context()
+	if err = this.conf.Store.Create(reqCtx, s); err != nil {
+		return ErrInternal.Wrap(err)
+	}
+	h := ctx.Response().Header()
+	h.Set(echo.HeaderLocation, this.location(ctx, s.Id))
+	h.Set(HeaderUploadExpires, s.ExpiresAt.UTC().Format(http.TimeFormat))
+	if length == 0 {
+		//nothing to upload
+		if s, err = this.tryComplete(ctx, s); err != nil {
+			return err
+		}
+	} else if ctx.Request().ContentLength != 0 && ctx.Request().Header.Get(echo.HeaderContentType) == MIMEOffsetOctetStream {
+		//creation-with-upload
+		if s, err = this.writeChunk(ctx, s); err != nil {
+			return err
+		}
+	}
+	h.Set(HeaderUploadOffset, strconv.FormatInt(s.Offset, 10))
+	return ctx.NoContent(http.StatusCreated)
+}
+
+func (this *TusServer) location(ctx Context, id string) string {
+	scheme := ctx.Scheme()
+	return fmt.Sprintf("%s://%s%s/%s", scheme, ctx.Request().Host, this.basePath, id)
+}
+
+func (this *TusServer) session(ctx Context) (*UploadSession, error) {
+	s, err := this.conf.Store.Get(ctx.Request().Context(), ctx.Param("id"))
+	if err == ErrUploadSessionNotFound {
+		return nil, ErrNotFound.New()
+	}
+	if err != nil {
+		return nil, ErrInternal.Wrap(err)
+	}
+	if !s.Completed && s.ExpiresAt.Before(time.Now()) {
+		return nil, ErrTusGone.New()
+	}
+	return s, nil
+}
+
+func (this *TusServer) head(ctx Context) error {
+	s, err := this.session(ctx)
+	if err != nil {
+		return err
+	}
+	h := ctx.Response().Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set(HeaderUploadOffset, strconv.FormatInt(s.Offset, 10))
+	h.Set(HeaderUploadLength, strconv.FormatInt(s.Length, 10))
+	if !s.Completed {
+		h.Set(HeaderUploadExpires, s.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	if len(s.Metadata) > 0 {
+		h.Set(HeaderUploadMetadata, formatTusMetadata(s.Metadata))
+	}
+	return ctx.NoContent(http.StatusOK)
+}
+
+func (this *TusServer) patch(ctx Context) error {
+	if ctx.Request().Header.Get(echo.HeaderContentType) != MIMEOffsetOctetStream {
+		return ErrTusContentType.New()
+	}
+	s, err := this.session(ctx)
+	if err != nil {
+		return err
+	}
+	offset, err := strconv.ParseInt(ctx.Request().Header.Get(HeaderUploadOffset), 10, 64)
+	if err != nil {
+		return ErrBadRequest.New().WithDetails(&ErrorDetail{Field: HeaderUploadOffset, Message: "invalid " + HeaderUploadOffset})
+	}
+	if offset != s.Offset || s.Completed {
+		return ErrTusOffset.New(s.Offset)
+	}
+	if s, err = this.writeChunk(ctx, s); err != nil {
+		return err
+	}
+	h := ctx.Response().Header()
+	h.Set(HeaderUploadOffset, strconv.FormatInt(s.Offset, 10))
+	if !s.Completed {
+		h.Set(HeaderUploadExpires, s.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+//store request body as one chunk, advance offset & assemble final file when all received
+func (this *TusServer) writeChunk(ctx Context, s *UploadSession) (*UploadSession, error) {
+	reqCtx := ctx.Request().Context()
+	checksum, err := parseTusChecksum(ctx.Request().Header.Get(HeaderUploadChecksum))
+	if err != nil {
+		return nil, err
+	}
+	limit := s.Length - s.Offset
+	if this.conf.MaxChunkSize > 0 && this.conf.MaxChunkSize < limit {
+		limit = this.conf.MaxChunkSize
+	}
+	key := fmt.Sprintf("%s/%s/%020d-%s", tusChunkKeyPrefix, s.Id, s.Offset, std.GenRandomUUID())
+	counter := &limitedCounter{r: ctx.Request().Body, limit: limit}
+	var body io.Reader = counter
+	if checksum != nil {
+		body = io.TeeReader(counter, checksum.hash)
+	}
+	err = this.conf.Storage.Put(reqCtx, key, body, -1, MIMEOffsetOctetStream)
+	if counter.exceeded {
+		if err == nil {
+			this.deleteChunks(key)
+		}
+		return nil, ErrUploadTooLarge.New(s.Id)
+	}
+	if err != nil {
+		return nil, ErrInternal.Wrap(err)
+	}
+	if checksum != nil && !checksum.match() {
+		this.deleteChunks(key)
+		return nil, ErrTusChecksum.New()
+	}
+	if counter.n == 0 {
+		this.deleteChunks(key)
+		return this.tryComplete(ctx, s)
+	}
+	expect := s.Offset
+	s.Offset += counter.n
+	s.Chunks = append(s.Chunks, key)
+	s.ExpiresAt = time.Now().Add(this.conf.Expiration)
+	ok, err := this.conf.Store.Update(reqCtx, s, expect, "")
+	if err != nil || !ok {
+		//concurrent patch won
+		this.deleteChunks(key)
+		if err != nil {
+			return nil, ErrInternal.Wrap(err)
+		}
+		return nil, ErrTusOffset.New(expect)
+	}
+	return this.tryComplete(ctx, s)
+}
+
+//all received but not completed, including a complete failed before, retried by an empty patch.
+//completion is claimed by compare-and-set, only the winner assembles final file & calls OnComplete
+func (this *TusServer) tryComplete(ctx Context, s *UploadSession) (*UploadSession, error) {
+	if s.Offset != s.Length || s.Completed {
+		return s, nil
+	}
+	if len(s.Completing) > 0 && time.Since(s.CompletingAt) < tusCompletingTimeout {
+		//completing by other request
+		return s, nil
+	}
+	expect, expectAt := s.Completing, s.CompletingAt
+	s.Completing, s.CompletingAt = std.GenRandomUUID(), time.Now()
+	ok, err := this.conf.Store.Update(ctx.Request().Context(), s, s.Offset, expect)
+	if err != nil || !ok {
+		s.Completing, s.CompletingAt = expect, expectAt
+		if err != nil {
+			return nil, ErrInternal.Wrap(err)
+		}
+		return s, nil
+	}
+	if err = this.complete(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//concat chunks to final file, verify metadata md5/sha256 if present, s is claimed by tryComplete.
+//final file is kept in s if OnComplete failed, only OnComplete is called when retried
+func (this *TusServer) complete(ctx Context, s *UploadSession) error {
+	reqCtx := ctx.Request().Context()
+	token := s.Completing
+	if s.File == nil {
+		f, err := StoreStream(reqCtx, this.conf.Storage, StoreRequest{
+			Key:          this.conf.KeyFunc(s),
+			FileName:     s.Metadata["filename"],
+			Reader:       &chunksReader{ctx: reqCtx, storage: this.conf.Storage, keys: s.Chunks},
+			Size:         s.Length,
+			ExpectMd5:    strings.ToLower(s.Metadata["md5"]),
+			ExpectSha256: strings.ToLower(s.Metadata["sha256"]),
+		})
+		if err != nil {
+			if errors.Is(err, ErrUploadChecksum) {
+				//final file broken, upload again from start
+				this.remove(s)
+				return ErrTusChecksum.Wrap(err)
+			}
+			this.releaseCompleting(s)
+			return err
+		}
+		s.File = f
+	}
+	if this.conf.OnComplete != nil {
+		if err := this.conf.OnComplete(ctx, s); err != nil {
+			this.releaseCompleting(s)
+			return err
+		}
+	}
+	chunks := s.Chunks
+	s.Chunks = nil
+	s.Completed = true
+	s.Completing = ""
+	ok, err := this.conf.Store.Update(reqCtx, s, s.Offset, token)
+	if err != nil {
+		return ErrInternal.Wrap(err)
+	}
+	if !ok {
+		//claim taken over as timeout, the new owner completes it
+		return ErrInternal.Wrap(errors.New("upload completion taken over"))
+	}
+	this.deleteChunks(chunks...)
+	return nil
+}
+
+//give up claim after complete failed, so it can be retried by an empty patch, stored final file is kept
+func (this *TusServer) releaseCompleting(s *UploadSession) {
+	token := s.Completing
+	s.Completing, s.CompletingAt = "", time.Time{}
+	_, err := this.conf.Store.Update(context.Background(), s, s.Offset, token)
+	if err != nil {
+		moduleLog("tus").Warn("release upload completing failed", "id", s.Id, "err", err)
+	}
+}
+
+func (this *TusServer) terminate(ctx Context) error {
+	s, err := this.session(ctx)
+	if err != nil {
+		return err
+	}
+	if err = this.conf.Store.Delete(ctx.Request().Context(), s.Id); err != nil {
+		return ErrInternal.Wrap(err)
+	}
+	this.deleteChunks(s.Chunks...)
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+func (this *TusServer) deleteChunks(keys ...string) {
+	for _, key := range keys {
+		if err := this.conf.Storage.Delete(context.Background(), key); err != nil {
+			moduleLog("tus").Warn("delete chunk failed", "key", key, "err", err)
+		}
+	}
+}
+
+func (this *TusServer) remove(s *UploadSession) {
+	if err := this.conf.Store.Delete(context.Background(), s.Id); err != nil {
+		moduleLog("tus").Warn("delete upload session failed", "id", s.Id, "err", err)
+		return
+	}
+	this.deleteChunks(s.Chunks...)
+}
+
+func (this *TusServer) cleanupLoop() {
+	defer close(this.done)
+	ticker := time.NewTicker(this.conf.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stopChan:
+			return
+		case <-ticker.C:
+			this.Cleanup()
+		}
+	}
+}
+
+//Cleanup remove expired sessions & their chunks, final files are kept
+func (this *TusServer) Cleanup() {
+	for {
+		list, err := this.conf.Store.Expired(context.Background(), time.Now(), tusCleanupBatch)
+		if err != nil {
+			moduleLog("tus").Error("list expired upload sessions failed", "err", err)
+			return
+		}
+		for _, s := range list {
+			this.remove(s)
+		}
+		if len(list) > 0 {
+			moduleLog("tus").Info("expired upload sessions removed", "count", len(list))
+		}
+		if len(list) < tusCleanupBatch {
+			return
+		}
+	}
+}
+
+//read chunks in order, open one at a time
+type chunksReader struct {
+	ctx     context.Context
+	storage Storage
+	keys    []string
+	cur     io.ReadCloser
+}
+
+func (this *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if this.cur == nil {
+			if len(this.keys) == 0 {
+				return 0, io.EOF
+			}
+			r, err := this.storage.Open(this.ctx, this.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			this.cur = r
+			this.keys = this.keys[1:]
+		}
+		n, err := this.cur.Read(p)
+		if err == io.EOF {
+			std.CloseIgnoreErr(this.cur)
+			this.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+//Upload-Metadata: key base64(value),key2
+func parseTusMetadata(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		value := ""
+		if len(kv) == 2 {
+			bs, err := base64.StdEncoding.DecodeString(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return nil, fmt.Errorf("metadata '%s' not base64", kv[0])
+			}
+			value = string(bs)
+		}
+		out[kv[0]] = value
+	}
+	return out, nil
+}
+
+func formatTusMetadata(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+type tusChecksum struct {
+	hash   hash.Hash
+	expect []byte
+}
+
+func (this *tusChecksum) match() bool {
+	return bytes.Equal(this.hash.Sum(nil), this.expect)
+}
+
+//Upload-Checksum: sha1 base64(digest)
+func parseTusChecksum(s string) (*tusChecksum, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	kv := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	if len(kv) != 2 {
+		return nil, ErrBadRequest.New().WithDetails(&ErrorDetail{Field: HeaderUploadChecksum, Message: "invalid " + HeaderUploadChecksum})
+	}
+	var h hash.Hash
+	switch strings.ToLower(kv[0]) {
+	case "md5":
+		h = md5.New()
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return nil, ErrTusChecksumAlgorithm.New()
+	}
+	expect, err := base64.StdEncoding.DecodeString(kv[1])
+	if err != nil {
+		return nil, ErrBadRequest.New().WithDetails(&ErrorDetail{Field: HeaderUploadChecksum, Message: "invalid " + HeaderUploadChecksum})
+	}
+	return &tusChecksum{hash: h, expect: expect}, nil
+}
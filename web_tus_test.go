@@ -0,0 +1,239 @@
+package bootx
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//tusTestClient send tus requests to web, Tus-Resumable is set unless overwritten
+type tusTestClient struct {
+	t   *testing.T
+	web *WebX
+}
+
+func (this *tusTestClient) do(method, target string, body string, headers ...string) *httptest.ResponseRecorder {
+	this.t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(HeaderTusResumable, TusVersion)
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", MIMEOffsetOctetStream)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	this.web.ServeHTTP(rec, req)
+	return rec
+}
+
+func newTusTestServer(t *testing.T, conf TusConfig) (*tusTestClient, *TusServer) {
+	web := NewWebWithConf(WebDefaultConfig)
+	srv, err := web.EnableTus("/files", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//EnableTus register a global module
+	t.Cleanup(func() {
+		gModules.lock.Lock()
+		defer gModules.lock.Unlock()
+		delete(gModules.index, srv.Name())
+		entries := gModules.entries[:0]
+		for _, e := range gModules.entries {
+			if e.Module != Module(srv) {
+				entries = append(entries, e)
+			}
+		}
+		gModules.entries = entries
+	})
+	return &tusTestClient{t: t, web: web}, srv
+}
+
+func tusSha1(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestTusUpload(t *testing.T) {
+	storage := NewMemoryStorage()
+	store := NewMemoryUploadStore()
+	var completed *UploadSession
+	cli, _ := newTusTestServer(t, TusConfig{
+		Storage: storage,
+		Store:   store,
+		MaxSize: 100,
+		KeyFunc: func(s *UploadSession) string {
+			return "final/" + s.Metadata["filename"]
+		},
+		OnComplete: func(ctx Context, s *UploadSession) error {
+			completed = s
+			return nil
+		},
+	})
+
+	rec := cli.do(http.MethodOptions, "/files", "")
+	if rec.Header().Get(HeaderTusVersion) != TusVersion || rec.Header().Get(HeaderTusMaxSize) != "100" {
+		t.Errorf("unexpected discovery headers %v", rec.Header())
+	}
+	if rec = cli.do(http.MethodPost, "/files", "", HeaderTusResumable, "0.2.2", HeaderUploadLength, "11"); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("expect 412 of unsupported version, got %d", rec.Code)
+	}
+	if rec = cli.do(http.MethodPost, "/files", "", HeaderUploadLength, "101"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expect 413 of too large upload, got %d", rec.Code)
+	}
+
+	sum := md5.Sum([]byte("hello world"))
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt")) +
+		",md5 " + base64.StdEncoding.EncodeToString([]byte(hex.EncodeToString(sum[:])))
+	rec = cli.do(http.MethodPost, "/files", "", HeaderUploadLength, "11", HeaderUploadMetadata, meta)
+	if rec.Code != http.StatusCreated || rec.Header().Get(HeaderUploadOffset) != "0" {
+		t.Fatalf("create failed %d %s", rec.Code, rec.Body.String())
+	}
+	loc := rec.Header().Get("Location")
+	if !strings.HasPrefix(loc, "http://example.com/files/") {
+		t.Fatalf("unexpected location %s", loc)
+	}
+	target := strings.TrimPrefix(loc, "http://example.com")
+
+	steps := []struct {
+		offset   string
+		body     string
+		checksum string
+		code     int
+		expect   string
+	}{
+		{offset: "0", body: "hello", checksum: tusSha1("hello"), code: http.StatusNoContent, expect: "5"},
+		{offset: "0", body: "hello", code: http.StatusConflict, expect: "5"},
+		{offset: "5", body: " world", checksum: tusSha1("broken"), code: StatusChecksumMismatch, expect: "5"},
+		{offset: "5", body: " world and more", code: http.StatusRequestEntityTooLarge, expect: "5"},
+		{offset: "5", body: " world", code: http.StatusNoContent, expect: "11"},
+	}
+	for i, step := range steps {
+		headers := []string{HeaderUploadOffset, step.offset}
+		if len(step.checksum) > 0 {
+			headers = append(headers, HeaderUploadChecksum, step.checksum)
+		}
+		if rec = cli.do(http.MethodPatch, target, step.body, headers...); rec.Code != step.code {
+			t.Fatalf("step %d expect %d, got %d %s", i, step.code, rec.Code, rec.Body.String())
+		}
+		rec = cli.do(http.MethodHead, target, "")
+		if got := rec.Header().Get(HeaderUploadOffset); got != step.expect {
+			t.Fatalf("step %d expect offset %s, got %s", i, step.expect, got)
+		}
+	}
+
+	if completed == nil || completed.File == nil || completed.File.Key != "final/a.txt" || completed.File.Size != 11 {
+		t.Fatalf("OnComplete not called with file: %+v", completed)
+	}
+	//chunks are removed, only final file left
+	if keys := storage.Keys(); len(keys) != 1 || keys[0] != "final/a.txt" {
+		t.Errorf("unexpected objects %v", keys)
+	}
+	r, _ := storage.Open(context.Background(), "final/a.txt")
+	if data, _ := ioutil.ReadAll(r); string(data) != "hello world" {
+		t.Errorf("unexpected final file %s", data)
+	}
+	if rec = cli.do(http.MethodPatch, target, "x", HeaderUploadOffset, "11"); rec.Code != http.StatusConflict {
+		t.Errorf("expect 409 of completed upload, got %d", rec.Code)
+	}
+}
+
+func TestTusFinalChecksum(t *testing.T) {
+	storage := NewMemoryStorage()
+	cli, _ := newTusTestServer(t, TusConfig{Storage: storage, Store: NewMemoryUploadStore()})
+	meta := "md5 " + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("0", 32)))
+	//creation-with-upload of all bytes
+	rec := cli.do(http.MethodPost, "/files", "data", HeaderUploadLength, "4", HeaderUploadMetadata, meta)
+	if rec.Code != StatusChecksumMismatch {
+		t.Fatalf("expect 460, got %d %s", rec.Code, rec.Body.String())
+	}
+	//session is dropped, client must start over
+	if keys := storage.Keys(); len(keys) != 0 {
+		t.Errorf("expect no object left, got %v", keys)
+	}
+}
+
+func TestTusOnCompleteFailed(t *testing.T) {
+	storage := NewMemoryStorage()
+	store := NewMemoryUploadStore()
+	calls := 0
+	var stored *UploadedFile
+	cli, _ := newTusTestServer(t, TusConfig{
+		Storage: storage,
+		Store:   store,
+		OnComplete: func(ctx Context, s *UploadSession) error {
+			calls++
+			if calls == 1 {
+				stored = s.File
+				return ErrInternal.New()
+			}
+			if s.File == nil || s.File.Key != stored.Key {
+				t.Errorf("expect final file reused, got %+v", s.File)
+			}
+			return nil
+		},
+	})
+	rec := cli.do(http.MethodPost, "/files", "data", HeaderUploadLength, "4")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expect 500 of OnComplete failed, got %d %s", rec.Code, rec.Body.String())
+	}
+	target := strings.TrimPrefix(rec.Header().Get("Location"), "http://example.com")
+	id := strings.TrimPrefix(target, "/files/")
+	if s, err := store.Get(context.Background(), id); err != nil || s.Completed || s.File == nil {
+		t.Fatalf("expect not completed with final file, got %+v %v", s, err)
+	}
+	//retried by an empty patch
+	rec = cli.do(http.MethodPatch, target, "", HeaderUploadOffset, "4", "Content-Type", MIMEOffsetOctetStream)
+	if rec.Code != http.StatusNoContent || calls != 2 {
+		t.Fatalf("expect completed by retry, got %d calls %d %s", rec.Code, calls, rec.Body.String())
+	}
+	if s, err := store.Get(context.Background(), id); err != nil || !s.Completed {
+		t.Errorf("expect completed, got %+v %v", s, err)
+	}
+	if keys := storage.Keys(); len(keys) != 1 || keys[0] != stored.Key {
+		t.Errorf("expect only final file left, got %v", keys)
+	}
+}
+
+func TestTusCleanup(t *testing.T) {
+	storage := NewMemoryStorage()
+	store := NewMemoryUploadStore()
+	cli, srv := newTusTestServer(t, TusConfig{Storage: storage, Store: store, Expiration: 30 * time.Millisecond})
+	rec := cli.do(http.MethodPost, "/files", "part", HeaderUploadLength, "10")
+	if rec.Code != http.StatusCreated || len(storage.Keys()) != 1 {
+		t.Fatalf("create with upload failed %d %v", rec.Code, storage.Keys())
+	}
+	target := strings.TrimPrefix(rec.Header().Get("Location"), "http://example.com")
+	time.Sleep(50 * time.Millisecond)
+	if rec = cli.do(http.MethodHead, target, ""); rec.Code != http.StatusGone {
+		t.Errorf("expect 410 of expired upload, got %d", rec.Code)
+	}
+	srv.Cleanup()
+	if rec = cli.do(http.MethodHead, target, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expect 404 after cleanup, got %d", rec.Code)
+	}
+	if keys := storage.Keys(); len(keys) != 0 {
+		t.Errorf("chunks of expired upload left: %v", keys)
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	m, err := parseTusMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==, is_confidential")
+	if err != nil || m["filename"] != "world_domination_plan.pdf" || len(m) != 2 {
+		t.Errorf("unexpected metadata %v %v", m, err)
+	}
+	if _, ok := m["is_confidential"]; !ok {
+		t.Error("key without value lost")
+	}
+	if _, err = parseTusMetadata("filename !!"); err == nil {
+		t.Error("expect error of invalid base64")
+	}
+}
@@ -0,0 +1,320 @@
+package bootx
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/gen-iot/std"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	//expected checksum headers of multipart file part
+	HeaderContentMD5     = "Content-MD5"
+	HeaderContentSha256  = "X-Content-Sha256"
+	DefaultUploadMaxSize = 32 * KSizeMb
+	//max size of one non-file form field
+	uploadMaxFieldSize = KSizeMb
+	sniffLen           = 512
+)
+
+var (
+	ErrUploadMissing  = DefineError(40002, http.StatusBadRequest, "upload_missing")
+	ErrUploadChecksum = DefineError(40003, http.StatusBadRequest, "upload_checksum")
+	ErrUploadTooLarge = DefineError(41301, http.StatusRequestEntityTooLarge, "upload_too_large")
+	ErrUploadTooMany  = DefineError(41302, http.StatusRequestEntityTooLarge, "upload_too_many")
+	ErrUploadType     = DefineError(41501, http.StatusUnsupportedMediaType, "upload_type")
+)
+
+func init() {
+	RegisterErrorMessages("en", map[string]string{
+		"upload_missing":   "no file uploaded",
+		"upload_checksum":  "file '%s' checksum mismatch",
+		"upload_too_large": "file '%s' exceed size limit",
+		"upload_too_many":  "too many files, max %d",
+		"upload_type":      "file '%s' type not allowed",
+	})
+	RegisterErrorMessages("zh", map[string]string{
+		"upload_missing":   "缺少上传文件",
+		"upload_checksum":  "文件'%s'校验失败",
+		"upload_too_large": "文件'%s'大小超过上传限制",
+		"upload_too_many":  "文件数量超过限制,最多%d个",
+		"upload_type":      "文件'%s'类型不支持",
+	})
+}
+
+type UploadConfig struct {
+	//nil means DefaultStorage()
+	Storage Storage
+	//accepted file form keys, empty means any
+	FormKeys []string
+	//max size of each file, default 32MB
+	MaxFileSize int64
+	//max size of all files, 0 means no limit
+	MaxTotalSize int64
+	//max file count, 0 means no limit
+	MaxFiles int
+	//allowed extensions, e.g. .png
+	AllowExtensions []string
+	//allowed sniffed content type, e.g. image/png, image/*
+	AllowContentTypes []string
+	//object key of file, default yyyy/mm/dd/{uuid}{ext}
+	KeyFunc func(formKey string, fileName string) string
+}
+
+var DefaultUploadConfig = UploadConfig{
+	MaxFileSize: DefaultUploadMaxSize,
+}
+
+//UploadedFile is the metadata of stored object
+type UploadedFile struct {
+	FormKey     string `json:"formKey"`
+	FileName    string `json:"fileName"`
+	Key         string `json:"key"`
+	Storage     string `json:"storage"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	Md5         string `json:"md5"`
+	Sha256      string `json:"sha256"`
+}
+
+type UploadResult struct {
+	Files []*UploadedFile `json:"files"`
+	//non-file form fields
+	Fields url.Values `json:"fields"`
+}
+
+func defaultUploadKey(_ string, fileName string) string {
+	return time.Now().Format("2006/01/02/") + std.GenRandomUUID() + strings.ToLower(path.Ext(fileName))
+}
+
+//Upload stream all files of multipart request to storage,
+//stored files are deleted if any file fails, the request body must not be parsed before
+func Upload(ctx Context, conf UploadConfig) (*UploadResult, error) {
+	if conf.Storage == nil {
+		conf.Storage = DefaultStorage()
+	}
+	if conf.MaxFileSize <= 0 {
+		conf.MaxFileSize = DefaultUploadConfig.MaxFileSize
+	}
+	if conf.KeyFunc == nil {
+		conf.KeyFunc = defaultUploadKey
+	}
+	reader, err := ctx.Request().MultipartReader()
+	if err != nil {
+		return nil, ErrUploadMissing.Wrap(err)
+	}
+	reqCtx := ctx.Request().Context()
+	result := &UploadResult{Files: make([]*UploadedFile, 0), Fields: make(url.Values)}
+	ok := false
+	defer func() {
+		if ok {
+			return
+		}
+		for _, f := range result.Files {
+			if err := conf.Storage.Delete(context.Background(), f.Key); err != nil {
+				ctx.Log().Warn("delete uploaded file failed", "key", f.Key, "err", err)
+			}
+		}
+	}()
+	total := int64(0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrBadRequest.Wrap(err)
+		}
+		if len(part.FileName()) == 0 {
+			value, err := ioutil.ReadAll(io.LimitReader(part, uploadMaxFieldSize))
+			if err != nil {
+				return nil, ErrBadRequest.Wrap(err)
+			}
+			result.Fields.Add(part.FormName(), string(value))
+			continue
+		}
+		if len(conf.FormKeys) > 0 && !containsString(conf.FormKeys, part.FormName()) {
+			continue
+		}
+		if conf.MaxFiles > 0 && len(result.Files) >= conf.MaxFiles {
+			return nil, ErrUploadTooMany.New(conf.MaxFiles)
+		}
+		limit := conf.MaxFileSize
+		if conf.MaxTotalSize > 0 && conf.MaxTotalSize-total < limit {
+			limit = conf.MaxTotalSize - total
+			if limit <= 0 {
+				return nil, ErrUploadTooLarge.New(part.FileName())
+			}
+		}
+		f, err := storeUploadPart(reqCtx, conf, part, limit)
+		if err != nil {
+			return nil, err
+		}
+		total += f.Size
+		result.Files = append(result.Files, f)
+	}
+	if len(result.Files) == 0 {
+		return nil, ErrUploadMissing.New()
+	}
+	ok = true
+	return result, nil
+}
+
+func storeUploadPart(ctx context.Context, conf UploadConfig, part *multipart.Part, limit int64) (*UploadedFile, error) {
+	fileName := path.Base(strings.Replace(part.FileName(), "\\", "/", -1))
+	if len(conf.AllowExtensions) > 0 && !containsString(conf.AllowExtensions, path.Ext(fileName)) {
+		return nil, ErrUploadType.New(fileName)
+	}
+	expectMd5, err := decodeChecksum(part.Header.Get(HeaderContentMD5), md5.Size)
+	if err != nil {
+		return nil, err
+	}
+	expectSha256, err := decodeChecksum(part.Header.Get(HeaderContentSha256), sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	return StoreStream(ctx, conf.Storage, StoreRequest{
+		Key:               conf.KeyFunc(part.FormName(), fileName),
+		FormKey:           part.FormName(),
+		FileName:          fileName,
+		Reader:            part,
+		Size:              -1,
+		MaxSize:           limit,
+		AllowContentTypes: conf.AllowContentTypes,
+		ExpectMd5:         expectMd5,
+		ExpectSha256:      expectSha256,
+	})
+}
+
+//StoreRequest is the input of StoreStream
+type StoreRequest struct {
+	Key      string
+	FormKey  string
+	FileName string
+	Reader   io.Reader
+	//-1 if unknown
+	Size int64
+	//0 means no limit
+	MaxSize int64
+	//sniffed content type must match one if not empty
+	AllowContentTypes []string
+	//hex checksum, ignored if empty
+	ExpectMd5    string
+	ExpectSha256 string
+}
+
+//StoreStream sniff content type, compute checksum & enforce size while streaming to storage,
+//the object is deleted if checksum mismatch
+func StoreStream(ctx context.Context, storage Storage, req StoreRequest) (*UploadedFile, error) {
+	key, err := cleanObjectKey(req.Key)
+	if err != nil {
+		return nil, ErrBadRequest.Wrap(err)
+	}
+	req.Key = key
+	br := bufio.NewReaderSize(req.Reader, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, ErrBadRequest.Wrap(err)
+	}
+	contentType := http.DetectContentType(head)
+	if len(req.AllowContentTypes) > 0 && !matchContentType(req.AllowContentTypes, contentType) {
+		return nil, ErrUploadType.New(req.FileName)
+	}
+	md5h := md5.New()
+	sha256h := sha256.New()
+	counter := &limitedCounter{r: br, limit: req.MaxSize}
+	tee := io.TeeReader(counter, io.MultiWriter(md5h, sha256h))
+	err = storage.Put(ctx, req.Key, tee, req.Size, contentType)
+	if counter.exceeded {
+		if err == nil {
+			_ = storage.Delete(context.Background(), req.Key)
+		}
+		return nil, ErrUploadTooLarge.New(req.FileName)
+	}
+	if err != nil {
+		return nil, ErrInternal.Wrap(err)
+	}
+	f := &UploadedFile{
+		FormKey:     req.FormKey,
+		FileName:    req.FileName,
+		Key:         req.Key,
+		Storage:     storage.Name(),
+		Size:        counter.n,
+		ContentType: contentType,
+		Md5:         hex.EncodeToString(md5h.Sum(nil)),
+		Sha256:      hex.EncodeToString(sha256h.Sum(nil)),
+	}
+	if (len(req.ExpectMd5) > 0 && !strings.EqualFold(req.ExpectMd5, f.Md5)) ||
+		(len(req.ExpectSha256) > 0 && !strings.EqualFold(req.ExpectSha256, f.Sha256)) {
+		_ = storage.Delete(context.Background(), req.Key)
+		return nil, ErrUploadChecksum.New(req.FileName)
+	}
+	return f, nil
+}
+
+//return error when more than limit bytes read, limit <= 0 means no limit
+type limitedCounter struct {
+	r        io.Reader
+	limit    int64
+	n        int64
+	exceeded bool
+}
+
+func (this *limitedCounter) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.n += int64(n)
+	if this.limit > 0 && this.n > this.limit {
+		this.exceeded = true
+		return n, ErrUploadTooLarge.New("")
+	}
+	return n, err
+}
+
+//checksum in hex or base64(Content-MD5 of rfc1864), return lower hex
+func decodeChecksum(s string, size int) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return "", nil
+	}
+	if len(s) == size*2 {
+		if _, err := hex.DecodeString(s); err == nil {
+			return strings.ToLower(s), nil
+		}
+	}
+	bs, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(bs) != size {
+		return "", ErrBadRequest.New().WithDetails(&ErrorDetail{Message: "invalid checksum '" + s + "'"})
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+func matchContentType(allows []string, contentType string) bool {
+	mime := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	for _, allow := range allows {
+		allow = strings.ToLower(allow)
+		if allow == mime || (strings.HasSuffix(allow, "/*") && strings.HasPrefix(mime, allow[:len(allow)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, it := range list {
+		if strings.EqualFold(it, s) {
+			return true
+		}
+	}
+	return false
+}
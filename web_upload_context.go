@@ -1,6 +1,8 @@
 package bootx
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
 	"io/ioutil"
@@ -32,6 +34,7 @@ type UploadContext struct {
 var errMissFile = errors.New("缺少file参数")
 var errTooLargeFile = errors.New("文件大小超过上传限制")
 var errNotAllowFileType = errors.New("不支持的文件类型")
+var errFileMd5NotMatch = errors.New("文件md5校验失败")
 
 func (ctx *UploadContext) Validate() error {
 	file, err := ctx.FormFile(ctx.FormKeyName)
@@ -47,12 +50,7 @@ func (ctx *UploadContext) Validate() error {
 	}
 	ctx.FileName = file.Filename
 	ctx.FileExt = strings.ToLower(path.Ext(file.Filename))
-	if len(ctx.AllowExtensions) > 0 {
-		for _, ext := range ctx.AllowExtensions {
-			if strings.ToLower(ext) == ctx.FileExt {
-				break
-			}
-		}
+	if len(ctx.AllowExtensions) > 0 && !containsString(ctx.AllowExtensions, ctx.FileExt) {
 		return errNotAllowFileType
 	}
 	ctx.FileHeader = file
@@ -72,5 +70,36 @@ func (ctx *UploadContext) ReadAll() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(ctx.FileMd5) > 0 {
+		sum := md5.Sum(ctx.DataBytes)
+		if !strings.EqualFold(ctx.FileMd5, hex.EncodeToString(sum[:])) {
+			return nil, errFileMd5NotMatch
+		}
+	}
 	return ctx.DataBytes[:], nil
 }
+
+//SaveTo stream file to storage without ReadAll, FileMd5 is verified
+func (ctx *UploadContext) SaveTo(storage Storage, key string) (*UploadedFile, error) {
+	if !ctx.FormKeyValid {
+		return nil, errMissFile
+	}
+	file, err := ctx.FileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	f, err := StoreStream(ctx.Request().Context(), storage, StoreRequest{
+		Key:       key,
+		FormKey:   ctx.FormKeyName,
+		FileName:  ctx.FileName,
+		Reader:    file,
+		Size:      ctx.FileHeader.Size,
+		MaxSize:   ctx.FileMaxSize,
+		ExpectMd5: strings.ToLower(ctx.FileMd5),
+	})
+	if errors.Is(err, ErrUploadChecksum) {
+		return nil, errFileMd5NotMatch
+	}
+	return f, err
+}
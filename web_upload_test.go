@@ -0,0 +1,193 @@
+package bootx
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type uploadTestPart struct {
+	formKey  string
+	fileName string
+	content  string
+	md5      string
+}
+
+//buildMultipart empty fileName means a plain form field
+func buildMultipart(t *testing.T, parts ...uploadTestPart) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for _, p := range parts {
+		h := textproto.MIMEHeader{}
+		if len(p.fileName) == 0 {
+			h.Set("Content-Disposition", `form-data; name="`+p.formKey+`"`)
+		} else {
+			h.Set("Content-Disposition", `form-data; name="`+p.formKey+`"; filename="`+p.fileName+`"`)
+		}
+		if len(p.md5) > 0 {
+			h.Set(HeaderContentMD5, p.md5)
+		}
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = pw.Write([]byte(p.content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body, w.FormDataContentType()
+}
+
+func newUploadTestWeb(conf UploadConfig) *WebX {
+	web := NewWebWithConf(WebDefaultConfig)
+	web.Post("/upload", func(ctx Context) (*UploadResult, error) {
+		return Upload(ctx, conf)
+	})
+	return web
+}
+
+func postUpload(t *testing.T, web *WebX, parts ...uploadTestPart) *httptest.ResponseRecorder {
+	t.Helper()
+	body, contentType := buildMultipart(t, parts...)
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	web.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUpload(t *testing.T) {
+	storage := NewMemoryStorage()
+	web := newUploadTestWeb(UploadConfig{
+		Storage:  storage,
+		FormKeys: []string{"file"},
+		KeyFunc: func(formKey string, fileName string) string {
+			return "dev/" + fileName
+		},
+	})
+	sum := md5.Sum([]byte("hello"))
+	rec := postUpload(t, web,
+		uploadTestPart{formKey: "deviceId", content: "d1"},
+		uploadTestPart{formKey: "file", fileName: `C:\tmp\a.txt`, content: "hello", md5: base64.StdEncoding.EncodeToString(sum[:])},
+		uploadTestPart{formKey: "ignored", fileName: "x.txt", content: "skip"},
+		uploadTestPart{formKey: "file", fileName: "b.json", content: `{"on":true}`},
+	)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expect 200, got %d %s", rec.Code, rec.Body.String())
+	}
+	result := new(UploadResult)
+	if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Fields.Get("deviceId") != "d1" || len(result.Files) != 2 {
+		t.Fatalf("unexpected result %s", rec.Body.String())
+	}
+	a := result.Files[0]
+	if a.Key != "dev/a.txt" || a.Size != 5 || a.Storage != "memory" || !strings.HasPrefix(a.ContentType, "text/plain") ||
+		a.Sha256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("unexpected file %+v", a)
+	}
+	r, err := storage.Open(context.Background(), "dev/b.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(r); string(data) != `{"on":true}` {
+		t.Errorf("unexpected stored content %s", data)
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	cases := []struct {
+		name  string
+		conf  UploadConfig
+		parts []uploadTestPart
+		code  int
+	}{
+		{
+			name: "too large",
+			conf: UploadConfig{MaxFileSize: 8},
+			parts: []uploadTestPart{
+				{formKey: "f", fileName: "a.txt", content: "small"},
+				{formKey: "f", fileName: "b.txt", content: "larger than limit"},
+			},
+			code: ErrUploadTooLarge.Code,
+		},
+		{
+			name: "total too large",
+			conf: UploadConfig{MaxTotalSize: 8},
+			parts: []uploadTestPart{
+				{formKey: "f", fileName: "a.txt", content: "small"},
+				{formKey: "f", fileName: "b.txt", content: "small"},
+			},
+			code: ErrUploadTooLarge.Code,
+		},
+		{
+			name: "too many",
+			conf: UploadConfig{MaxFiles: 1},
+			parts: []uploadTestPart{
+				{formKey: "f", fileName: "a.txt", content: "a"},
+				{formKey: "f", fileName: "b.txt", content: "b"},
+			},
+			code: ErrUploadTooMany.Code,
+		},
+		{
+			name: "checksum",
+			conf: UploadConfig{},
+			parts: []uploadTestPart{
+				{formKey: "f", fileName: "a.txt", content: "a"},
+				{formKey: "f", fileName: "b.txt", content: "b", md5: strings.Repeat("0", 32)},
+			},
+			code: ErrUploadChecksum.Code,
+		},
+		{
+			name: "extension",
+			conf: UploadConfig{AllowExtensions: []string{".png"}},
+			parts: []uploadTestPart{
+				{formKey: "f", fileName: "a.txt", content: "a"},
+			},
+			code: ErrUploadType.Code,
+		},
+		{
+			name: "sniffed type",
+			conf: UploadConfig{AllowContentTypes: []string{"image/*"}},
+			parts: []uploadTestPart{
+				{formKey: "f", fileName: "a.png", content: "not a png"},
+			},
+			code: ErrUploadType.Code,
+		},
+		{
+			name:  "missing",
+			conf:  UploadConfig{},
+			parts: []uploadTestPart{{formKey: "name", content: "x"}},
+			code:  ErrUploadMissing.Code,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			storage := NewMemoryStorage()
+			c.conf.Storage = storage
+			rec := postUpload(t, newUploadTestWeb(c.conf), c.parts...)
+			rsp := new(ErrorResponse)
+			if err := json.Unmarshal(rec.Body.Bytes(), rsp); err != nil || rsp.Code != c.code {
+				t.Errorf("expect code %d, got %d %s", c.code, rec.Code, rec.Body.String())
+			}
+			//files stored before the failure are rolled back
+			if keys := storage.Keys(); len(keys) != 0 {
+				sort.Strings(keys)
+				t.Errorf("expect no object left, got %v", keys)
+			}
+		})
+	}
+}